@@ -0,0 +1,119 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+var (
+	// Parsed ALLOWED_HOSTS: exact hostnames and IP networks.
+	allowedHostNames []string
+	allowedNets      []*net.IPNet
+)
+
+// parseAllowedHosts splits comma-separated ALLOWED_HOSTS value into
+// hostnames and networks. Bare IP addresses are treated as single-host
+// networks.
+func parseAllowedHosts(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			_, ipnet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return fmt.Errorf("invalid CIDR %q: %w", entry, err)
+			}
+			allowedNets = append(allowedNets, ipnet)
+			continue
+		}
+
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			allowedNets = append(allowedNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		allowedHostNames = append(allowedHostNames, strings.ToLower(entry))
+	}
+
+	return nil
+}
+
+// DialAllowed connects to the address like the dialer, refusing hosts not
+// permitted by ALLOWED_HOSTS. Hostnames are allowed when listed explicitly,
+// otherwise each address the dialer connects to must belong to an allowed
+// network. Addresses are checked by the dialer itself once resolved, so a
+// hostname can't resolve to an allowed address for the check and to
+// another one for the connection.
+func DialAllowed(ctx context.Context, d *net.Dialer, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if allowedByName(host) {
+		return d.DialContext(ctx, network, address)
+	}
+
+	guarded := *d
+	control := d.Control
+	guarded.Control = func(network, address string, c syscall.RawConn) error {
+		if err := checkAllowedAddress(host, address); err != nil {
+			return err
+		}
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}
+
+	return guarded.DialContext(ctx, network, address)
+}
+
+// allowedByName reports whether connections to the host need no address
+// check, as ALLOWED_HOSTS is empty or lists the hostname.
+func allowedByName(host string) bool {
+	if len(allowedHostNames) == 0 && len(allowedNets) == 0 {
+		return true
+	}
+	for _, name := range allowedHostNames {
+		if strings.EqualFold(host, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkAllowedAddress verifies the resolved "ip:port" address dialed for
+// the host belongs to an allowed network.
+func checkAllowedAddress(host, address string) error {
+	ip, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if parsed := net.ParseIP(ip); parsed == nil || !inAllowedNets(parsed) {
+		return fmt.Errorf("destination host %q (%s) is not allowed", host, ip)
+	}
+
+	return nil
+}
+
+// inAllowedNets reports whether ip belongs to one of the allowed networks.
+func inAllowedNets(ip net.IP) bool {
+	for _, ipnet := range allowedNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,103 @@
+package exporter
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// useAllowedHosts configures ALLOWED_HOSTS until the test ends.
+func useAllowedHosts(t *testing.T, value string) {
+	t.Helper()
+
+	names, nets := allowedHostNames, allowedNets
+	t.Cleanup(func() { allowedHostNames, allowedNets = names, nets })
+	allowedHostNames, allowedNets = nil, nil
+	if err := parseAllowedHosts(value); err != nil {
+		t.Fatalf("parseAllowedHosts(%q): %v", value, err)
+	}
+}
+
+func TestParseAllowedHosts(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantNames int
+		wantNets  int
+		wantErr   bool
+	}{
+		{"", 0, 0, false},
+		{"sftp.partner.com, SFTP.other.com", 2, 0, false},
+		{"10.0.0.0/8,192.168.1.10", 0, 2, false},
+		{"2001:db8::/32,::1", 0, 2, false},
+		{"sftp.partner.com,,10.0.0.0/8,", 1, 1, false},
+		{"10.0.0.0/33", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		func() {
+			defer func(names []string, nets []*net.IPNet) { allowedHostNames, allowedNets = names, nets }(allowedHostNames, allowedNets)
+			allowedHostNames, allowedNets = nil, nil
+
+			err := parseAllowedHosts(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseAllowedHosts(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && (len(allowedHostNames) != tt.wantNames || len(allowedNets) != tt.wantNets) {
+				t.Errorf("parseAllowedHosts(%q) = %d names and %d networks, want %d and %d", tt.value, len(allowedHostNames), len(allowedNets), tt.wantNames, tt.wantNets)
+			}
+		}()
+	}
+}
+
+func TestDialAllowed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	tests := []struct {
+		name    string
+		allowed string
+		host    string
+		wantErr bool
+	}{
+		{"no allowlist", "", "127.0.0.1", false},
+		{"allowed network", "127.0.0.0/8", "127.0.0.1", false},
+		{"allowed address", "127.0.0.1", "127.0.0.1", false},
+		{"allowed hostname", "LOCALHOST", "localhost", false},
+		{"hostname resolving into allowed network", "127.0.0.0/8", "localhost", false},
+		{"disallowed network", "10.0.0.0/8", "127.0.0.1", true},
+		{"disallowed hostname", "sftp.partner.com,10.0.0.0/8", "localhost", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useAllowedHosts(t, tt.allowed)
+
+			conn, err := DialAllowed(context.Background(), &net.Dialer{}, "tcp4", net.JoinHostPort(tt.host, port))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DialAllowed(%s) error = %v, want error %t", tt.host, err, tt.wantErr)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), "is not allowed") {
+					t.Errorf("DialAllowed(%s) error = %v, want allowlist error", tt.host, err)
+				}
+				return
+			}
+			conn.Close()
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// auditInserter is the subset of the BigQuery inserter used by the exporter.
+type auditInserter interface {
+	Put(ctx context.Context, src interface{}) error
+}
+
+var (
+	// BigQuery table receiving export audit records, disabled when empty.
+	AUDIT_DATASET = ""
+	AUDIT_TABLE   = ""
+	// Time limit of inserting an audit record before the invocation returns.
+	AUDIT_INSERT_TIMEOUT = 10 * time.Second
+	auditRecords         auditInserter
+)
+
+// auditRecord is a row of the export audit table.
+type auditRecord struct {
+	Bucket      string    `bigquery:"bucket"`
+	Object      string    `bigquery:"object"`
+	Destination string    `bigquery:"destination"`
+	Bytes       int64     `bigquery:"bytes"`
+	Checksum    string    `bigquery:"checksum"`
+	Algorithm   string    `bigquery:"algorithm"`
+	StartTime   time.Time `bigquery:"start_time"`
+	EndTime     time.Time `bigquery:"end_time"`
+	Outcome     string    `bigquery:"outcome"`
+	Error       string    `bigquery:"error"`
+}
+
+// initAudit reads audit table from environment variables and initializes
+// BigQuery client when auditing is configured.
+func initAudit(ctx context.Context) error {
+	AUDIT_DATASET = os.Getenv("AUDIT_DATASET")
+	AUDIT_TABLE = os.Getenv("AUDIT_TABLE")
+	if AUDIT_DATASET == "" && AUDIT_TABLE == "" {
+		return nil
+	}
+	if AUDIT_DATASET == "" || AUDIT_TABLE == "" {
+		return fmt.Errorf("both AUDIT_DATASET and AUDIT_TABLE must be set")
+	}
+	if os.Getenv("AUDIT_INSERT_TIMEOUT") != "" {
+		timeout, err := time.ParseDuration(os.Getenv("AUDIT_INSERT_TIMEOUT"))
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid AUDIT_INSERT_TIMEOUT: %q", os.Getenv("AUDIT_INSERT_TIMEOUT"))
+		}
+		AUDIT_INSERT_TIMEOUT = timeout
+	}
+
+	client, err := bigquery.NewClient(ctx, bigquery.DetectProjectID)
+	if err != nil {
+		return fmt.Errorf("bigquery.NewClient: %w", err)
+	}
+	auditRecords = client.Dataset(AUDIT_DATASET).Table(AUDIT_TABLE).Inserter()
+
+	return nil
+}
+
+// newAuditRecord starts audit record of an object export.
+func newAuditRecord(bucket, object string) *auditRecord {
+	return &auditRecord{
+		Bucket:    bucket,
+		Object:    object,
+		Algorithm: CHECKSUM_ALGORITHM,
+		StartTime: time.Now().UTC(),
+	}
+}
+
+// delivered completes audit record with the uploaded file details.
+func (r *auditRecord) delivered(destination string, size int64, checksum string) {
+	r.Destination = destination
+	r.Bytes = size
+	r.Checksum = checksum
+}
+
+// recordAudit inserts audit record of a finished export before the
+// invocation returns, as CPU is throttled afterwards. The insert is bounded
+// by AUDIT_INSERT_TIMEOUT, records failing to insert are logged in full.
+func recordAudit(r *auditRecord, err error) {
+	if auditRecords == nil || r == nil {
+		return
+	}
+
+	r.EndTime = time.Now().UTC()
+	switch {
+	case err != nil:
+		r.Outcome = "failure"
+		r.Error = err.Error()
+	case r.Destination == "":
+		r.Outcome = "skipped"
+	default:
+		r.Outcome = "success"
+	}
+
+	// Use a fresh context, the export context may already be cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), AUDIT_INSERT_TIMEOUT)
+	defer cancel()
+	if err := auditRecords.Put(ctx, r); err != nil {
+		log.Printf("unable to insert audit record of %s: %v: %+v", r.Object, err, *r)
+	}
+}
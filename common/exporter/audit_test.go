@@ -0,0 +1,93 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeInserter keeps inserted audit records, failing inserts with err.
+type fakeInserter struct {
+	records []auditRecord
+	err     error
+	// Wait for the context to be done before returning, when set.
+	block bool
+}
+
+func (f *fakeInserter) Put(ctx context.Context, src interface{}) error {
+	if f.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	f.records = append(f.records, *src.(*auditRecord))
+	return f.err
+}
+
+func TestRecordAudit(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination string
+		err         error
+		wantOutcome string
+		wantError   string
+	}{
+		{"success", "sftp://partner/in/report.csv", nil, "success", ""},
+		{"skipped", "", nil, "skipped", ""},
+		{"failure", "", errors.New("connection reset"), "failure", "connection reset"},
+		{"failure after delivery", "sftp://partner/in/report.csv", errors.New("marker write failed"), "failure", "marker write failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(inserter auditInserter) { auditRecords = inserter }(auditRecords)
+			inserter := &fakeInserter{}
+			auditRecords = inserter
+
+			r := newAuditRecord("bucket", "report.csv")
+			if tt.destination != "" {
+				r.delivered(tt.destination, 8, "abc123")
+			}
+			recordAudit(r, tt.err)
+
+			if len(inserter.records) != 1 {
+				t.Fatalf("inserted %d records, want 1", len(inserter.records))
+			}
+			got := inserter.records[0]
+			if got.Bucket != "bucket" || got.Object != "report.csv" || got.Destination != tt.destination {
+				t.Errorf("record = %+v, want bucket, object and destination of the export", got)
+			}
+			if got.Outcome != tt.wantOutcome || got.Error != tt.wantError {
+				t.Errorf("record outcome = %q, error = %q, want %q, %q", got.Outcome, got.Error, tt.wantOutcome, tt.wantError)
+			}
+			if got.Algorithm != CHECKSUM_ALGORITHM || got.StartTime.IsZero() || got.EndTime.Before(got.StartTime) {
+				t.Errorf("record = %+v, want checksum algorithm and start time before end time", got)
+			}
+			if tt.destination != "" && (got.Bytes != 8 || got.Checksum != "abc123") {
+				t.Errorf("record size = %d, checksum = %q, want 8, %q", got.Bytes, got.Checksum, "abc123")
+			}
+		})
+	}
+}
+
+func TestRecordAuditBestEffort(t *testing.T) {
+	defer func(inserter auditInserter, timeout time.Duration) {
+		auditRecords, AUDIT_INSERT_TIMEOUT = inserter, timeout
+	}(auditRecords, AUDIT_INSERT_TIMEOUT)
+	AUDIT_INSERT_TIMEOUT = 20 * time.Millisecond
+
+	// Failed and slow inserts never fail or hold the export.
+	auditRecords = &fakeInserter{err: errors.New("quota exceeded")}
+	recordAudit(newAuditRecord("bucket", "report.csv"), nil)
+
+	auditRecords = &fakeInserter{block: true}
+	start := time.Now()
+	recordAudit(newAuditRecord("bucket", "report.csv"), nil)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("recordAudit() took %s, want at most AUDIT_INSERT_TIMEOUT", elapsed)
+	}
+
+	// Nothing is inserted without an audit table.
+	auditRecords = nil
+	recordAudit(newAuditRecord("bucket", "report.csv"), nil)
+}
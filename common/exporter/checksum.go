@@ -0,0 +1,34 @@
+package exporter
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+)
+
+// Algorithm used for checksums of processed objects.
+var CHECKSUM_ALGORITHM = "sha256"
+
+// ChecksumAlgorithms maps supported CHECKSUM_ALGORITHM values to hash constructors.
+var ChecksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// NewChecksumHash returns a new hash implementing CHECKSUM_ALGORITHM.
+func NewChecksumHash() hash.Hash {
+	return ChecksumAlgorithms[CHECKSUM_ALGORITHM]()
+}
+
+// DataChecksum returns hex encoded CHECKSUM_ALGORITHM checksum of data.
+func DataChecksum(data []byte) string {
+	h := NewChecksumHash()
+	h.Write(data)
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
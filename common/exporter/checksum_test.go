@@ -0,0 +1,48 @@
+package exporter
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDataChecksum(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		want      string
+	}{
+		{"md5", "900150983cd24fb0d6963f7d28e17f72"},
+		{"sha1", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{"sha256", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"sha512", "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			defer func(algorithm string) { CHECKSUM_ALGORITHM = algorithm }(CHECKSUM_ALGORITHM)
+			CHECKSUM_ALGORITHM = tt.algorithm
+
+			if got := DataChecksum([]byte("abc")); got != tt.want {
+				t.Errorf("DataChecksum() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamDigest(t *testing.T) {
+	tests := []string{"", "abc", strings.Repeat("line of content\n", 10000)}
+
+	for _, content := range tests {
+		digest := newStreamDigest()
+		if _, err := io.Copy(digest, strings.NewReader(content)); err != nil {
+			t.Fatalf("io.Copy: %v", err)
+		}
+
+		if digest.size != int64(len(content)) {
+			t.Errorf("size = %d, want %d", digest.size, len(content))
+		}
+		if got, want := digest.checksum(), DataChecksum([]byte(content)); got != want {
+			t.Errorf("checksum() = %s, want %s as of buffered content", got, want)
+		}
+	}
+}
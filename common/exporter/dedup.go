@@ -0,0 +1,52 @@
+package exporter
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// Skip exports of content already exported within the window, 0 disables deduplication.
+	DEDUP_WINDOW time.Duration = 0
+	// Maximal number of recently exported content hashes kept by an instance.
+	DEDUP_CACHE_SIZE = 1000
+	recentHashes     = newHashCache()
+)
+
+// hashCache remembers when content hashes were exported. It is per function
+// instance, so duplicates handled by different instances are still exported.
+type hashCache struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []string
+}
+
+func newHashCache() *hashCache {
+	return &hashCache{seen: map[string]time.Time{}}
+}
+
+// seenRecently reports whether the hash was exported within DEDUP_WINDOW.
+func (c *hashCache) seenRecently(sum string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	at, ok := c.seen[sum]
+	return ok && now.Sub(at) < DEDUP_WINDOW
+}
+
+// add records export of the hash, evicting the oldest hashes beyond
+// DEDUP_CACHE_SIZE.
+func (c *hashCache) add(sum string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.seen[sum]; !ok {
+		c.order = append(c.order, sum)
+	}
+	c.seen[sum] = now
+
+	for len(c.order) > DEDUP_CACHE_SIZE {
+		delete(c.seen, c.order[0])
+		c.order = c.order[1:]
+	}
+}
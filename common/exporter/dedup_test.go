@@ -0,0 +1,100 @@
+package exporter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+)
+
+// exportContent transfers the stored object, returning whether it was uploaded.
+func exportContent(t *testing.T, store *exportertest.Store, objectName, content string) bool {
+	t.Helper()
+
+	generation := store.Put("bucket", objectName, []byte(content), nil)
+	x := exporter.NewExport(&storagedata.StorageObjectData{Bucket: "bucket", Name: objectName, Generation: generation, Size: int64(len(content))})
+	x.Match()
+
+	uploaded := false
+	err := x.Transfer(context.Background(), exporter.Transfer{
+		Name: objectName,
+		Open: func(ctx context.Context) (exporter.Uploader, error) {
+			uploaded = true
+			return &captureUploader{}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Transfer(%q) error = %v", objectName, err)
+	}
+
+	return uploaded
+}
+
+func TestTransferDeduplicates(t *testing.T) {
+	type step struct {
+		object       string
+		content      string
+		wantUploaded bool
+	}
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		size   int
+		steps  []step
+	}{
+		{"disabled", 0, 10, []step{
+			{"a.csv", "1,alice\n", true},
+			{"b.csv", "1,alice\n", true},
+		}},
+		{"duplicate under another name", time.Hour, 10, []step{
+			{"a.csv", "1,alice\n", true},
+			{"b.csv", "1,alice\n", false},
+			{"in/c.csv", "1,alice\n", false},
+			{"d.csv", "2,bob\n", true},
+		}},
+		{"same name and content", time.Hour, 10, []step{
+			{"a.csv", "1,alice\n", true},
+			{"a.csv", "1,alice\n", false},
+		}},
+		{"evicted hash", time.Hour, 2, []step{
+			{"a.csv", "1,alice\n", true},
+			{"b.csv", "2,bob\n", true},
+			{"c.csv", "3,carol\n", true},
+			{"d.csv", "1,alice\n", true},
+			{"e.csv", "3,carol\n", false},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter.UseDedup(t, tt.window, tt.size)
+			store := exportertest.NewStore().Use(t)
+
+			for _, s := range tt.steps {
+				if got := exportContent(t, store, s.object, s.content); got != s.wantUploaded {
+					t.Errorf("export of %s with %q uploaded %t, want %t", s.object, s.content, got, s.wantUploaded)
+				}
+			}
+		})
+	}
+}
+
+func TestTransferDeduplicatesWithinWindow(t *testing.T) {
+	exporter.UseDedup(t, 50*time.Millisecond, 10)
+	store := exportertest.NewStore().Use(t)
+
+	if !exportContent(t, store, "a.csv", "1,alice\n") {
+		t.Fatal("first export of the content not uploaded")
+	}
+	if exportContent(t, store, "b.csv", "1,alice\n") {
+		t.Error("duplicate content uploaded within DEDUP_WINDOW")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !exportContent(t, store, "c.csv", "1,alice\n") {
+		t.Error("content exported before DEDUP_WINDOW not uploaded")
+	}
+}
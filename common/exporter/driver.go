@@ -0,0 +1,201 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Backend delivers objects which passed the shared filters to its destination.
+type Backend interface {
+	// Accept applies filters of the backend to the object, returning its
+	// delivery, or nil when the object is skipped.
+	Accept(ctx context.Context, x *Export) (Delivery, error)
+}
+
+// Delivery delivers an accepted object, typically with Export.Transfer. It
+// runs within the export time budget, once the object generation is known
+// not to be exported yet.
+type Delivery func(ctx context.Context) error
+
+// Export is the export of an object changed by a storage event.
+type Export struct {
+	Bucket   string
+	Object   string
+	Metadata *storagedata.StorageObjectData
+	summary  *Summary
+	audit    *auditRecord
+}
+
+// NewExport starts the export of the object changed by a storage event.
+func NewExport(metadata *storagedata.StorageObjectData) *Export {
+	return &Export{
+		Bucket:   metadata.GetBucket(),
+		Object:   metadata.GetName(),
+		Metadata: metadata,
+		summary:  newExportSummary(metadata.GetBucket(), metadata.GetName()),
+	}
+}
+
+// Match records that the object matched the export rules of the backend,
+// starting an audit record of the export attempt.
+func (x *Export) Match() {
+	x.audit = newAuditRecord(x.Bucket, x.Object)
+	x.summary.Match()
+}
+
+// Matched reports whether Match was called.
+func (x *Export) Matched() bool {
+	return x.summary.Matched()
+}
+
+// Skip records why the object is not exported.
+func (x *Export) Skip(reason string) {
+	x.summary.Skip(reason)
+}
+
+// Reject records the object is not exported as its content is invalid.
+func (x *Export) Reject(cause error) {
+	x.summary.Reject(cause)
+}
+
+// Delivered records the file delivered to the destination in the audit
+// record, export event, receipt, tag and marker of the object.
+func (x *Export) Delivered(ctx context.Context, destination string, size int64, checksum string) {
+	x.audit.delivered(destination, size, checksum)
+	publishExportEvent(ctx, x.Bucket, x.Object, destination, size, checksum)
+	writeReceipt(ctx, x.Bucket, x.Object, destination, size, checksum)
+	tagExported(ctx, x.Bucket, x.Object, x.Metadata.GetGeneration())
+	writeMarker(ctx, x.Bucket, x.Object, x.Metadata.GetGeneration(), destination)
+}
+
+// run consumes a CloudEvent message with changed object, delivering it
+// to the backend when it passes the filters.
+func run(ctx context.Context, e event.Event, b Backend) (err error) {
+	var metadata storagedata.StorageObjectData
+	if err := protojson.Unmarshal(e.Data(), &metadata); err != nil {
+		return fmt.Errorf("protojson.Unmarshal: %w", err)
+	}
+
+	log.Printf("Bucket: %s", metadata.GetBucket())
+	log.Printf("File: %s", metadata.GetName())
+
+	objectName := metadata.GetName()
+	bucketName := metadata.GetBucket()
+
+	// Summarize decisions made for the object once the invocation ends.
+	x := NewExport(&metadata)
+	defer func() {
+		x.summary.Log(err)
+		x.summary.report(ctx)
+	}()
+
+	// Ignore events of buckets outside of ALLOWED_BUCKETS, e.g. from a misconfigured trigger.
+	if !IsAllowedBucket(bucketName) {
+		log.Printf("Ignoring object %s of bucket %s, which is not in ALLOWED_BUCKETS", objectName, bucketName)
+		x.Skip("bucket")
+		return nil
+	}
+
+	// Skip objects under ignored prefixes before any other processing.
+	if IsIgnored(objectName) {
+		log.Printf("Skipping object %s under ignored prefix", objectName)
+		x.Skip("ignored prefix")
+		return nil
+	}
+
+	// Blocked extensions take precedence over any rule exporting the object.
+	if IsBlocked(objectName) {
+		log.Printf("Skipping object %s with blocked extension", objectName)
+		x.Skip("blocked extension")
+		return nil
+	}
+
+	// Never export receipts written after earlier exports.
+	if isReceipt(objectName) {
+		log.Printf("Skipping receipt object %s", objectName)
+		x.Skip("receipt")
+		return nil
+	}
+
+	// Skip objects tagged by an earlier export.
+	if isTagged(metadata.GetMetadata()) {
+		log.Printf("Skipping object %s, already tagged with %s", objectName, POST_EXPORT_TAG)
+		x.Skip("already exported")
+		return nil
+	}
+
+	// Skip editor and temporary artifacts, e.g. ".~lock.report.csv#" or "report.csv~".
+	if SKIP_HIDDEN_OBJECTS && IsHidden(objectName) {
+		log.Printf("Skipping hidden or temporary object %s", objectName)
+		x.Skip("hidden")
+		return nil
+	}
+
+	// Export only objects flagged as ready to ship.
+	if !hasMetadataFlag(metadata.GetMetadata()) {
+		log.Printf("Skipping object %s without %s metadata", objectName, REQUIRE_METADATA_FLAG)
+		x.Skip("metadata flag")
+		return nil
+	}
+
+	// Skip stale events for objects updated outside of the export window.
+	if !IsForcedExport(ctx) && isStale(metadata.GetUpdated(), time.Now()) {
+		log.Printf("Skipping object %s updated at %s, older than %s", objectName, metadata.GetUpdated().AsTime().Format(time.RFC3339), MODIFIED_SINCE)
+		x.Skip("stale")
+		return nil
+	}
+
+	// Apply filters of the backend, e.g. content types or extensions.
+	deliver, err := b.Accept(ctx, x)
+	if err != nil || deliver == nil {
+		return rejected(x, err)
+	}
+
+	// Give upstream time to finish writing, the export budget starts afterwards.
+	if err := delayExport(ctx); err != nil {
+		return err
+	}
+
+	// Abort all operations when the export runs out of its time budget, so
+	// the platform retries the event instead of hitting the function timeout.
+	if EXPORT_DEADLINE > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, EXPORT_DEADLINE)
+		defer cancel()
+	}
+
+	// Skip replayed events of a generation which was already exported.
+	exported, err := isExportedGeneration(ctx, bucketName, objectName, metadata.GetGeneration())
+	if err != nil {
+		return err
+	}
+	if exported {
+		log.Printf("Skipping object %s, generation %d was already exported", objectName, metadata.GetGeneration())
+		x.Skip("exported generation")
+		return nil
+	}
+
+	// Audit every export attempt which matched the backend rules.
+	defer func() { recordAudit(x.audit, err) }()
+
+	return rejected(x, deliver(ctx))
+}
+
+// rejected reports content rejected by the backend and not handled by it
+// as an error of the object.
+func rejected(x *Export, err error) error {
+	var rejection *RejectError
+	if errors.As(err, &rejection) {
+		x.Reject(rejection.Cause)
+		return fmt.Errorf("object %s rejected: %w", x.Object, rejection.Cause)
+	}
+
+	return err
+}
@@ -0,0 +1,154 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// deliveryBackend accepts every object with the delivery.
+type deliveryBackend Delivery
+
+func (b deliveryBackend) Accept(ctx context.Context, x *Export) (Delivery, error) {
+	return Delivery(b), nil
+}
+
+func TestRunExportDeadline(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		delay    time.Duration
+		upload   time.Duration
+		wantErr  error
+	}{
+		{"no deadline", 0, 0, 50 * time.Millisecond, nil},
+		{"within deadline", time.Second, 0, 50 * time.Millisecond, nil},
+		{"slow upload aborted", 50 * time.Millisecond, 0, 5 * time.Second, context.DeadlineExceeded},
+		{"delay outside of the budget", 200 * time.Millisecond, 200 * time.Millisecond, 50 * time.Millisecond, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(deadline, delay time.Duration) {
+				EXPORT_DEADLINE, EXPORT_DELAY = deadline, delay
+			}(EXPORT_DEADLINE, EXPORT_DELAY)
+			EXPORT_DEADLINE, EXPORT_DELAY = tt.deadline, tt.delay
+
+			var hasDeadline bool
+			slowUpload := deliveryBackend(func(ctx context.Context) error {
+				_, hasDeadline = ctx.Deadline()
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(tt.upload):
+					return nil
+				}
+			})
+
+			start := time.Now()
+			err := run(context.Background(), ObjectEvent(t, "bucket", "report.csv"), slowUpload)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("run() error = %v, want %v", err, tt.wantErr)
+			}
+			if hasDeadline != (tt.deadline > 0) {
+				t.Errorf("delivery context has deadline %t, want %t", hasDeadline, tt.deadline > 0)
+			}
+			if tt.wantErr != nil {
+				if elapsed := time.Since(start); elapsed > tt.deadline+time.Second {
+					t.Errorf("export aborted after %s, want about %s", elapsed, tt.deadline)
+				}
+			}
+		})
+	}
+}
+
+func TestRunMetadataFlag(t *testing.T) {
+	defer func(flag string) { REQUIRE_METADATA_FLAG = flag }(REQUIRE_METADATA_FLAG)
+	REQUIRE_METADATA_FLAG = "export=true"
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     bool
+	}{
+		{"matching", map[string]string{"export": "true"}, true},
+		{"not matching", map[string]string{"export": "false"}, false},
+		{"absent", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := protojson.Marshal(&storagedata.StorageObjectData{Bucket: "bucket", Name: "report.csv", Generation: 1, Metadata: tt.metadata})
+			if err != nil {
+				t.Fatalf("protojson.Marshal: %v", err)
+			}
+			e := event.New()
+			if err := e.SetData(event.ApplicationJSON, data); err != nil {
+				t.Fatalf("unable to set event data: %v", err)
+			}
+
+			delivered := false
+			deliver := func(ctx context.Context) error {
+				delivered = true
+				return nil
+			}
+			if err := run(context.Background(), e, deliveryBackend(deliver)); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			if delivered != tt.want {
+				t.Errorf("object with metadata %v delivered %t, want %t", tt.metadata, delivered, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunAllowedBuckets(t *testing.T) {
+	defer func(buckets []string) { ALLOWED_BUCKETS = buckets }(ALLOWED_BUCKETS)
+	ALLOWED_BUCKETS = []string{"bucket"}
+
+	tests := []struct {
+		bucket   string
+		want     bool
+		wantSkip string
+	}{
+		{"bucket", true, ""},
+		{"other", false, "bucket"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.bucket, func(t *testing.T) {
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			defer log.SetOutput(os.Stderr)
+			var summary Summary
+			ctx := context.WithValue(context.Background(), summaryKey{}, &summary)
+
+			delivered := false
+			deliver := func(ctx context.Context) error {
+				delivered = true
+				return nil
+			}
+			if err := run(ctx, ObjectEvent(t, tt.bucket, "report.csv"), deliveryBackend(deliver)); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			if delivered != tt.want {
+				t.Errorf("object of bucket %s delivered %t, want %t", tt.bucket, delivered, tt.want)
+			}
+			if summary.skipReason != tt.wantSkip {
+				t.Errorf("skip reason = %q, want %q", summary.skipReason, tt.wantSkip)
+			}
+			if ignored := strings.Contains(logged.String(), "not in ALLOWED_BUCKETS"); ignored == tt.want {
+				t.Errorf("ignored bucket logged %t, want %t", ignored, !tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+var (
+	// Pub/Sub topic notified after each successful export, disabled when empty.
+	EXPORT_EVENT_TOPIC = ""
+	pubsubClient       *pubsub.Client
+	// Topic handle shared by all exports, as each handle runs its own
+	// publishing goroutines until it is stopped.
+	exportTopic *pubsub.Topic
+)
+
+// exportEvent is the payload published to EXPORT_EVENT_TOPIC.
+type exportEvent struct {
+	Bucket      string    `json:"bucket"`
+	Object      string    `json:"object"`
+	Destination string    `json:"destination"`
+	Bytes       int64     `json:"bytes"`
+	Checksum    string    `json:"checksum"`
+	Algorithm   string    `json:"algorithm"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// initExportEvents reads EXPORT_EVENT_TOPIC and initializes Pub/Sub client
+// when completion messages are enabled.
+func initExportEvents(ctx context.Context) error {
+	EXPORT_EVENT_TOPIC = os.Getenv("EXPORT_EVENT_TOPIC")
+	if EXPORT_EVENT_TOPIC == "" {
+		return nil
+	}
+
+	var err error
+	pubsubClient, err = pubsub.NewClient(ctx, pubsub.DetectProjectID)
+	if err != nil {
+		return fmt.Errorf("pubsub.NewClient: %w", err)
+	}
+	exportTopic = pubsubClient.Topic(EXPORT_EVENT_TOPIC)
+
+	return nil
+}
+
+// stopExportEvents sends export events still pending and stops the topic.
+func stopExportEvents() {
+	if exportTopic != nil {
+		exportTopic.Stop()
+	}
+}
+
+// publishExportEvent notifies EXPORT_EVENT_TOPIC that data of the object
+// left our environment. Failures are logged but never fail the function,
+// as the file was already delivered.
+func publishExportEvent(ctx context.Context, bucket, object, destination string, size int64, checksum string) {
+	if EXPORT_EVENT_TOPIC == "" {
+		return
+	}
+
+	msg, err := json.Marshal(exportEvent{
+		Bucket:      bucket,
+		Object:      object,
+		Destination: destination,
+		Bytes:       size,
+		Checksum:    checksum,
+		Algorithm:   CHECKSUM_ALGORITHM,
+		Timestamp:   time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("unable to encode export event for %s: %v", object, err)
+		return
+	}
+
+	result := exportTopic.Publish(ctx, &pubsub.Message{Data: msg})
+	id, err := result.Get(ctx)
+	if err != nil {
+		log.Printf("unable to publish export event for %s to topic %s: %v", object, EXPORT_EVENT_TOPIC, err)
+		return
+	}
+
+	log.Printf("Published export event for %s to topic %s (message %s)", object, EXPORT_EVENT_TOPIC, id)
+}
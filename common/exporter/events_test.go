@@ -0,0 +1,124 @@
+package exporter_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// startExportTopic publishes export events to a topic of an in-process
+// Pub/Sub server until the test ends.
+func startExportTopic(t *testing.T) *pstest.Server {
+	t.Helper()
+	ctx := context.Background()
+
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.Dial: %v", err)
+	}
+	client, err := pubsub.NewClient(ctx, "project", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("pubsub.NewClient: %v", err)
+	}
+	topic, err := client.CreateTopic(ctx, "exported")
+	if err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	t.Cleanup(func() {
+		topic.Stop()
+		client.Close()
+	})
+	exporter.UseExportTopic(t, "exported", topic)
+
+	return srv
+}
+
+// failingUploader fails every upload.
+type failingUploader struct{}
+
+func (failingUploader) Upload(ctx context.Context, name string, r io.Reader) error {
+	return errors.New("connection reset")
+}
+
+func (failingUploader) Close() error {
+	return nil
+}
+
+func TestTransferPublishesExportEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		uploader exporter.Uploader
+		wantErr  bool
+	}{
+		{"delivered", &captureUploader{}, false},
+		{"upload failure", failingUploader{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := startExportTopic(t)
+			store := exportertest.NewStore().Use(t)
+			generation := store.Put("bucket", "report.csv", []byte("id,name\n"), nil)
+			x := exporter.NewExport(&storagedata.StorageObjectData{Bucket: "bucket", Name: "report.csv", Generation: generation, Size: 8})
+			x.Match()
+
+			start := time.Now().UTC()
+			err := x.Transfer(context.Background(), exporter.Transfer{
+				Name:        "report.csv",
+				Destination: "sftp://partner/in/report.csv",
+				Open: func(ctx context.Context) (exporter.Uploader, error) {
+					return tt.uploader, nil
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Transfer() error = %v, want error %t", err, tt.wantErr)
+			}
+
+			messages := srv.Messages()
+			if tt.wantErr {
+				if len(messages) != 0 {
+					t.Errorf("published %d messages after a failed upload, want none", len(messages))
+				}
+				return
+			}
+			if len(messages) != 1 {
+				t.Fatalf("published %d messages, want 1", len(messages))
+			}
+			var got struct {
+				Bucket      string    `json:"bucket"`
+				Object      string    `json:"object"`
+				Destination string    `json:"destination"`
+				Bytes       int64     `json:"bytes"`
+				Checksum    string    `json:"checksum"`
+				Algorithm   string    `json:"algorithm"`
+				Timestamp   time.Time `json:"timestamp"`
+			}
+			if err := json.Unmarshal(messages[0].Data, &got); err != nil {
+				t.Fatalf("unable to decode message: %v", err)
+			}
+			if got.Bucket != "bucket" || got.Object != "report.csv" || got.Destination != "sftp://partner/in/report.csv" || got.Bytes != 8 {
+				t.Errorf("message = %+v, want bucket, object, destination and size of the export", got)
+			}
+			if got.Checksum != exporter.DataChecksum([]byte("id,name\n")) || got.Algorithm != exporter.CHECKSUM_ALGORITHM {
+				t.Errorf("message checksum = %s %q, want %s of the content", got.Algorithm, got.Checksum, exporter.CHECKSUM_ALGORITHM)
+			}
+			if got.Timestamp.Before(start.Truncate(time.Second)) {
+				t.Errorf("message timestamp = %s, want the time of the export", got.Timestamp)
+			}
+		})
+	}
+}
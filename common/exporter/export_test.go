@@ -0,0 +1,69 @@
+package exporter
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Run consumes the event with changed object like the registered export
+// function, delivering it to the backend.
+func Run(ctx context.Context, e event.Event, b Backend) error {
+	return run(ctx, e, b)
+}
+
+// ObjectEvent returns the event of the creation of the first generation of
+// the object.
+func ObjectEvent(t *testing.T, bucket, object string) event.Event {
+	t.Helper()
+
+	return MetadataEvent(t, bucket, object, 1, nil)
+}
+
+// MetadataEvent returns the event of the change of the object generation
+// carrying the custom metadata.
+func MetadataEvent(t *testing.T, bucket, object string, generation int64, metadata map[string]string) event.Event {
+	t.Helper()
+
+	data, err := protojson.Marshal(&storagedata.StorageObjectData{Bucket: bucket, Name: object, Generation: generation, Metadata: metadata})
+	if err != nil {
+		t.Fatalf("protojson.Marshal: %v", err)
+	}
+	e := event.New()
+	if err := e.SetData(event.ApplicationJSON, data); err != nil {
+		t.Fatalf("unable to set event data: %v", err)
+	}
+
+	return e
+}
+
+// UseExportTopic publishes export events to the topic until the test ends.
+func UseExportTopic(t *testing.T, name string, topic *pubsub.Topic) {
+	prevName, prevTopic := EXPORT_EVENT_TOPIC, exportTopic
+	t.Cleanup(func() { EXPORT_EVENT_TOPIC, exportTopic = prevName, prevTopic })
+	EXPORT_EVENT_TOPIC, exportTopic = name, topic
+}
+
+// UseDedup deduplicates exports within the window with a fresh cache of
+// the size until the test ends.
+func UseDedup(t *testing.T, window time.Duration, size int) {
+	prevWindow, prevSize, prevHashes := DEDUP_WINDOW, DEDUP_CACHE_SIZE, recentHashes
+	t.Cleanup(func() { DEDUP_WINDOW, DEDUP_CACHE_SIZE, recentHashes = prevWindow, prevSize, prevHashes })
+	DEDUP_WINDOW, DEDUP_CACHE_SIZE, recentHashes = window, size, newHashCache()
+}
+
+// UseReprocess returns the reprocess endpoint, which replays exports to the
+// backend for requests authorized by the token, until the test ends.
+func UseReprocess(t *testing.T, b Backend, token string) http.HandlerFunc {
+	prevBackend, prevToken := backend, reprocessToken
+	t.Cleanup(func() { backend, reprocessToken = prevBackend, prevToken })
+	backend, reprocessToken = b, token
+
+	return reprocess
+}
@@ -0,0 +1,328 @@
+// Package exporter provides the export driver shared by Cloud Functions
+// exporting files from Google Storage Bucket to partner destinations. It
+// handles the storage event, filters, download, deduplication and the
+// records of delivered files, while backends implement the destination.
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"github.com/cloudevents/sdk-go/v2/event"
+)
+
+// backend receives objects of the function registered with Register.
+var backend Backend
+
+// InTest reports whether the process is a test binary built by go test.
+// Backends skip their init then, as tests configure the package without
+// access to GCP services. It stands in for testing.Testing of Go 1.21.
+func InTest() bool {
+	return strings.HasSuffix(os.Args[0], ".test")
+}
+
+// Init resolves the project and reads configuration shared by all backends
+// from environment variables. Backends call it first in their init, so
+// secrets of the project can be accessed during the rest of it.
+func Init() {
+	// Declare a separate err variable to avoid shadowing the package variables.
+	var err error
+
+	PROJECT_ID, err = resolveProjectID()
+	if err != nil {
+		log.Fatalf("unable to resolve project ID: %v", err)
+	}
+	SECRET_PREFIX = os.Getenv("SECRET_PREFIX")
+
+	// Get configuration of object handling shared with the rename function.
+	InitObjects()
+
+	// Get verification of checksums stored in object metadata from environment variables.
+	if os.Getenv("CHECKSUM_METADATA_KEY") != "" {
+		CHECKSUM_METADATA_KEY = os.Getenv("CHECKSUM_METADATA_KEY")
+	}
+	if os.Getenv("CHECKSUM_METADATA_ALGORITHM") != "" {
+		CHECKSUM_METADATA_ALGORITHM = os.Getenv("CHECKSUM_METADATA_ALGORITHM")
+		if _, ok := ChecksumAlgorithms[CHECKSUM_METADATA_ALGORITHM]; !ok {
+			log.Fatalf("unsupported CHECKSUM_METADATA_ALGORITHM: %q", CHECKSUM_METADATA_ALGORITHM)
+		}
+	}
+
+	// Get allowlist of destination hosts from environment variable.
+	if os.Getenv("ALLOWED_HOSTS") != "" {
+		if err := parseAllowedHosts(os.Getenv("ALLOWED_HOSTS")); err != nil {
+			log.Fatalf("invalid ALLOWED_HOSTS: %v", err)
+		}
+	}
+
+	// Get export window for object updates from environment variable.
+	if os.Getenv("MODIFIED_SINCE") != "" {
+		MODIFIED_SINCE, err = time.ParseDuration(os.Getenv("MODIFIED_SINCE"))
+		if err != nil {
+			log.Fatalf("invalid MODIFIED_SINCE: %v", err)
+		}
+	}
+
+	// Get metadata flag required on exported objects from environment variable.
+	if os.Getenv("REQUIRE_METADATA_FLAG") != "" {
+		REQUIRE_METADATA_FLAG = os.Getenv("REQUIRE_METADATA_FLAG")
+		if strings.HasPrefix(REQUIRE_METADATA_FLAG, "=") {
+			log.Fatalf("invalid REQUIRE_METADATA_FLAG: %q", REQUIRE_METADATA_FLAG)
+		}
+	}
+
+	// Get content types of exported objects from environment variable.
+	if os.Getenv("ALLOWED_CONTENT_TYPES") != "" {
+		for _, contentType := range strings.Split(os.Getenv("ALLOWED_CONTENT_TYPES"), ",") {
+			if contentType = strings.TrimSpace(contentType); contentType != "" {
+				ALLOWED_CONTENT_TYPES = append(ALLOWED_CONTENT_TYPES, strings.ToLower(contentType))
+			}
+		}
+	}
+
+	// Get tag set on exported objects from environment variable.
+	if os.Getenv("POST_EXPORT_TAG") != "" {
+		POST_EXPORT_TAG = os.Getenv("POST_EXPORT_TAG")
+		if key, _ := exportTag(); key == "" {
+			log.Fatalf("invalid POST_EXPORT_TAG: %q has no key", POST_EXPORT_TAG)
+		}
+	}
+
+	// Get bucket of export markers from environment variable.
+	if os.Getenv("MARKER_BUCKET") != "" {
+		MARKER_BUCKET = os.Getenv("MARKER_BUCKET")
+	}
+
+	// Get prefix of export receipts from environment variable.
+	if os.Getenv("RECEIPTS_PREFIX") != "" {
+		RECEIPTS_PREFIX = os.Getenv("RECEIPTS_PREFIX")
+	}
+
+	// Get extensions which are never exported from environment variable.
+	if os.Getenv("BLOCKED_EXTENSIONS") != "" {
+		for _, ext := range strings.Split(os.Getenv("BLOCKED_EXTENSIONS"), ",") {
+			if ext = strings.ToLower(strings.TrimSpace(ext)); ext != "" {
+				if !strings.HasPrefix(ext, ".") {
+					ext = "." + ext
+				}
+				BLOCKED_EXTENSIONS = append(BLOCKED_EXTENSIONS, ext)
+			}
+		}
+		log.Printf("Blocked extensions: %s", strings.Join(BLOCKED_EXTENSIONS, ","))
+	}
+
+	// Get content deduplication settings from environment variables.
+	if os.Getenv("DEDUP_WINDOW") != "" {
+		DEDUP_WINDOW, err = time.ParseDuration(os.Getenv("DEDUP_WINDOW"))
+		if err != nil {
+			log.Fatalf("invalid DEDUP_WINDOW: %v", err)
+		}
+	}
+	if os.Getenv("DEDUP_CACHE_SIZE") != "" {
+		DEDUP_CACHE_SIZE, err = strconv.Atoi(os.Getenv("DEDUP_CACHE_SIZE"))
+		if err != nil || DEDUP_CACHE_SIZE < 1 {
+			log.Fatalf("invalid DEDUP_CACHE_SIZE: %q", os.Getenv("DEDUP_CACHE_SIZE"))
+		}
+	}
+
+	// Enable trailing newline normalization from environment variable.
+	if os.Getenv("NORMALIZE_TRAILING_NEWLINE") != "" {
+		NORMALIZE_TRAILING_NEWLINE, err = strconv.ParseBool(os.Getenv("NORMALIZE_TRAILING_NEWLINE"))
+		if err != nil {
+			log.Fatalf("invalid NORMALIZE_TRAILING_NEWLINE: %v", err)
+		}
+	}
+
+	// Get number of chunks read ahead while streaming from environment variable.
+	if os.Getenv("PIPELINE_CHUNKS") != "" {
+		PIPELINE_CHUNKS, err = strconv.Atoi(os.Getenv("PIPELINE_CHUNKS"))
+		if err != nil || PIPELINE_CHUNKS < 0 {
+			log.Fatalf("invalid PIPELINE_CHUNKS: %q", os.Getenv("PIPELINE_CHUNKS"))
+		}
+	}
+
+	// Get export delay from environment variable.
+	if os.Getenv("EXPORT_DELAY") != "" {
+		EXPORT_DELAY, err = time.ParseDuration(os.Getenv("EXPORT_DELAY"))
+		if err != nil {
+			log.Fatalf("invalid EXPORT_DELAY: %v", err)
+		}
+	}
+
+	// Get export time budget from environment variable.
+	if os.Getenv("EXPORT_DEADLINE") != "" {
+		EXPORT_DEADLINE, err = time.ParseDuration(os.Getenv("EXPORT_DEADLINE"))
+		if err != nil {
+			log.Fatalf("invalid EXPORT_DEADLINE: %v", err)
+		}
+	}
+
+	// Get export sampling limits from environment variables.
+	initSampling()
+
+	// Get upload progress logging thresholds from environment variables.
+	if os.Getenv("PROGRESS_BYTES") != "" {
+		PROGRESS_BYTES, err = strconv.ParseInt(os.Getenv("PROGRESS_BYTES"), 10, 64)
+		if err != nil {
+			log.Fatalf("invalid PROGRESS_BYTES: %v", err)
+		}
+	}
+	if os.Getenv("PROGRESS_INTERVAL") != "" {
+		PROGRESS_INTERVAL, err = time.ParseDuration(os.Getenv("PROGRESS_INTERVAL"))
+		if err != nil {
+			log.Fatalf("invalid PROGRESS_INTERVAL: %v", err)
+		}
+	}
+
+	// Get health check timeout from environment variable.
+	if os.Getenv("HEALTHZ_TIMEOUT") != "" {
+		HEALTHZ_TIMEOUT, err = time.ParseDuration(os.Getenv("HEALTHZ_TIMEOUT"))
+		if err != nil {
+			log.Fatalf("invalid HEALTHZ_TIMEOUT: %v", err)
+		}
+	}
+
+	// Get list of health checks to perform from environment variable.
+	if os.Getenv("HEALTHZ_CHECKS") != "" {
+		HEALTHZ_CHECKS = strings.Split(os.Getenv("HEALTHZ_CHECKS"), ",")
+	}
+
+	// Get bucket used by the storage health check from environment variable.
+	if os.Getenv("HEALTHZ_BUCKET") != "" {
+		HEALTHZ_BUCKET = os.Getenv("HEALTHZ_BUCKET")
+	}
+
+	// Get secret holding token guarding the reprocess endpoint from environment variable.
+	if os.Getenv("REPROCESS_TOKEN_SECRET") != "" {
+		REPROCESS_TOKEN_SECRET = SecretVersionName(os.Getenv("REPROCESS_TOKEN_SECRET"))
+	}
+}
+
+// InitObjects reads configuration of object filters, checksums, GCS retries
+// and streaming from environment variables, failing on invalid values. Init
+// calls it, the rename function calls it on its own.
+func InitObjects() {
+	// Declare a separate err variable to avoid shadowing the package variables.
+	var err error
+
+	// Get checksum algorithm from environment variable.
+	if os.Getenv("CHECKSUM_ALGORITHM") != "" {
+		CHECKSUM_ALGORITHM = os.Getenv("CHECKSUM_ALGORITHM")
+		if _, ok := ChecksumAlgorithms[CHECKSUM_ALGORITHM]; !ok {
+			log.Fatalf("unsupported CHECKSUM_ALGORITHM: %q", CHECKSUM_ALGORITHM)
+		}
+	}
+
+	// Get buckets whose objects are processed from environment variable.
+	if os.Getenv("ALLOWED_BUCKETS") != "" {
+		for _, bucket := range strings.Split(os.Getenv("ALLOWED_BUCKETS"), ",") {
+			if bucket = strings.TrimSpace(bucket); bucket != "" {
+				ALLOWED_BUCKETS = append(ALLOWED_BUCKETS, bucket)
+			}
+		}
+	}
+
+	// Get object prefixes which are never processed from environment variable.
+	if os.Getenv("IGNORE_PREFIXES") != "" {
+		for _, prefix := range strings.Split(os.Getenv("IGNORE_PREFIXES"), ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				IGNORE_PREFIXES = append(IGNORE_PREFIXES, prefix)
+			}
+		}
+	}
+
+	// Get skipping of hidden and temporary objects from environment variable.
+	if os.Getenv("SKIP_HIDDEN_OBJECTS") != "" {
+		SKIP_HIDDEN_OBJECTS, err = strconv.ParseBool(os.Getenv("SKIP_HIDDEN_OBJECTS"))
+		if err != nil {
+			log.Fatalf("invalid SKIP_HIDDEN_OBJECTS: %v", err)
+		}
+	}
+
+	// Get retry policy of GCS reads and writes from environment variables.
+	if os.Getenv("GCS_READ_ATTEMPTS") != "" {
+		GCS_READ_ATTEMPTS, err = strconv.Atoi(os.Getenv("GCS_READ_ATTEMPTS"))
+		if err != nil || GCS_READ_ATTEMPTS < 1 {
+			log.Fatalf("invalid GCS_READ_ATTEMPTS: %q", os.Getenv("GCS_READ_ATTEMPTS"))
+		}
+	}
+	if os.Getenv("GCS_WRITE_ATTEMPTS") != "" {
+		GCS_WRITE_ATTEMPTS, err = strconv.Atoi(os.Getenv("GCS_WRITE_ATTEMPTS"))
+		if err != nil || GCS_WRITE_ATTEMPTS < 1 {
+			log.Fatalf("invalid GCS_WRITE_ATTEMPTS: %q", os.Getenv("GCS_WRITE_ATTEMPTS"))
+		}
+	}
+	if os.Getenv("GCS_RETRY_DELAY") != "" {
+		GCS_READ_RETRY_DELAY, err = time.ParseDuration(os.Getenv("GCS_RETRY_DELAY"))
+		if err != nil {
+			log.Fatalf("invalid GCS_RETRY_DELAY: %v", err)
+		}
+	}
+
+	// Get size above which objects are streamed from environment variable.
+	if os.Getenv("STREAM_THRESHOLD_BYTES") != "" {
+		STREAM_THRESHOLD_BYTES, err = strconv.ParseInt(os.Getenv("STREAM_THRESHOLD_BYTES"), 10, 64)
+		if err != nil {
+			log.Fatalf("invalid STREAM_THRESHOLD_BYTES: %v", err)
+		}
+	}
+}
+
+// InitStorage initializes the storage client and Objects. Register calls
+// it, the rename function calls it on its own.
+func InitStorage(ctx context.Context) error {
+	var err error
+	storageClient, err = storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient: %w", err)
+	}
+	Objects = &gcsStore{client: storageClient}
+
+	return nil
+}
+
+// Register initializes the clients used by the driver and registers the
+// export, health check and reprocess functions, delivering objects to the
+// backend. Backends call it last in their init.
+func Register(ctx context.Context, b Backend) {
+	backend = b
+
+	// Get token guarding the reprocess endpoint from GCP Secret Manager.
+	if err := initReprocess(ctx); err != nil {
+		log.Fatalf("failed to initialize reprocess endpoint: %v", err)
+	}
+
+	// Initialize Storage client.
+	if err := InitStorage(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	// Initialize completion messages publishing.
+	if err := initExportEvents(ctx); err != nil {
+		log.Fatalf("unable to initialize export events: %v", err)
+	}
+
+	// Initialize export audit records.
+	if err := initAudit(ctx); err != nil {
+		log.Fatalf("unable to initialize export audit: %v", err)
+	}
+
+	functions.CloudEvent("ExportFiles", func(ctx context.Context, e event.Event) error {
+		return run(ctx, e, backend)
+	})
+	functions.HTTP("Healthz", healthz)
+	functions.HTTP("Reprocess", reprocess)
+}
+
+// Shutdown flushes and stops the clients initialized by Register. Backends
+// call it once the instance is stopped, after in-flight exports completed.
+func Shutdown() {
+	stopExportEvents()
+}
@@ -0,0 +1,351 @@
+// Package exportertest provides an in-memory exporter.ObjectStore, so the
+// exporters and the rename function can be tested without Cloud Storage.
+package exportertest
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// Store keeps objects in memory. Like a bucket with object versioning,
+// overwritten and deleted generations stay readable when they are requested
+// explicitly, while generation 0 denotes the live generation.
+type Store struct {
+	mu         sync.Mutex
+	objects    map[string]*object
+	generation int64
+	// Fail, when set, is called before each operation, e.g. "NewReader",
+	// and its error is returned instead of performing the operation.
+	Fail func(op, bucket, object string) error
+}
+
+var _ exporter.ObjectStore = (*Store)(nil)
+
+// object holds generations of an object, oldest first.
+type object struct {
+	versions []*version
+	live     bool
+}
+
+type version struct {
+	attrs storage.ObjectAttrs
+	data  []byte
+}
+
+// NewStore returns an empty store.
+func NewStore() *Store {
+	return &Store{objects: map[string]*object{}}
+}
+
+// Use makes the store exporter.Objects until the test ends.
+func (s *Store) Use(t interface{ Cleanup(func()) }) *Store {
+	objects := exporter.Objects
+	t.Cleanup(func() { exporter.Objects = objects })
+	exporter.Objects = s
+
+	return s
+}
+
+// Put stores content as a new live generation of the object, returning
+// the generation.
+func (s *Store) Put(bucket, name string, data []byte, metadata map[string]string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.put(bucket, name, data, exporter.WriteOptions{Metadata: metadata})
+}
+
+// Content returns content of the live generation of the object.
+func (s *Store) Content(bucket, name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, err := s.version(bucket, name, 0)
+	if err != nil {
+		return nil, false
+	}
+
+	return v.data, true
+}
+
+// Names returns names of live objects of the bucket in lexical order.
+func (s *Store) Names(bucket string) []string {
+	attrs, _ := s.List(context.Background(), bucket, "")
+	names := make([]string, 0, len(attrs))
+	for _, a := range attrs {
+		names = append(names, a.Name)
+	}
+
+	return names
+}
+
+func (s *Store) put(bucket, name string, data []byte, opts exporter.WriteOptions) int64 {
+	key := bucket + "/" + name
+	o := s.objects[key]
+	if o == nil {
+		o = &object{}
+		s.objects[key] = o
+	}
+
+	s.generation++
+	sum := md5.Sum(data)
+	now := time.Now()
+	o.versions = append(o.versions, &version{
+		attrs: storage.ObjectAttrs{
+			Bucket:          bucket,
+			Name:            name,
+			Generation:      s.generation,
+			Size:            int64(len(data)),
+			ContentType:     opts.ContentType,
+			ContentEncoding: opts.ContentEncoding,
+			Metadata:        copyMetadata(opts.Metadata),
+			MD5:             sum[:],
+			CRC32C:          crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)),
+			Created:         now,
+			Updated:         now,
+		},
+		data: append([]byte(nil), data...),
+	})
+	o.live = true
+
+	return s.generation
+}
+
+// version returns the generation of the object, the live one for 0.
+func (s *Store) version(bucket, name string, generation int64) (*version, error) {
+	o := s.objects[bucket+"/"+name]
+	if o == nil || len(o.versions) == 0 {
+		return nil, storage.ErrObjectNotExist
+	}
+	if generation == 0 {
+		if !o.live {
+			return nil, storage.ErrObjectNotExist
+		}
+		return o.versions[len(o.versions)-1], nil
+	}
+	for _, v := range o.versions {
+		if v.attrs.Generation == generation {
+			return v, nil
+		}
+	}
+
+	return nil, storage.ErrObjectNotExist
+}
+
+func (s *Store) fail(op, bucket, name string) error {
+	if s.Fail == nil {
+		return nil
+	}
+
+	return s.Fail(op, bucket, name)
+}
+
+// NewReader returns content as stored, compressed content is never decompressed.
+func (s *Store) NewReader(ctx context.Context, bucket, name string, generation int64, compressed bool) (io.ReadCloser, error) {
+	return s.NewRangeReader(ctx, bucket, name, generation, 0)
+}
+
+func (s *Store) NewRangeReader(ctx context.Context, bucket, name string, generation, offset int64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("NewReader", bucket, name); err != nil {
+		return nil, err
+	}
+	v, err := s.version(bucket, name, generation)
+	if err != nil {
+		return nil, err
+	}
+	if offset > int64(len(v.data)) {
+		offset = int64(len(v.data))
+	}
+
+	return io.NopCloser(bytes.NewReader(v.data[offset:])), nil
+}
+
+func (s *Store) Delete(ctx context.Context, bucket, name string, generation int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("Delete", bucket, name); err != nil {
+		return err
+	}
+	v, err := s.version(bucket, name, generation)
+	if err != nil {
+		return err
+	}
+
+	// Deleting the live object keeps its generation, deleting a generation
+	// removes it for good.
+	o := s.objects[bucket+"/"+name]
+	if generation == 0 {
+		o.live = false
+		return nil
+	}
+	for i := range o.versions {
+		if o.versions[i] == v {
+			if i == len(o.versions)-1 {
+				o.live = false
+			}
+			o.versions = append(o.versions[:i], o.versions[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) Attrs(ctx context.Context, bucket, name string, generation int64) (*storage.ObjectAttrs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("Attrs", bucket, name); err != nil {
+		return nil, err
+	}
+	v, err := s.version(bucket, name, generation)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := v.attrs
+	attrs.Metadata = copyMetadata(v.attrs.Metadata)
+
+	return &attrs, nil
+}
+
+// UpdateMetadata merges metadata like Cloud Storage does, keys with empty
+// values are removed.
+func (s *Store) UpdateMetadata(ctx context.Context, bucket, name string, generation int64, metadata map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("UpdateMetadata", bucket, name); err != nil {
+		return err
+	}
+	v, err := s.version(bucket, name, generation)
+	if err != nil {
+		return err
+	}
+
+	if v.attrs.Metadata == nil {
+		v.attrs.Metadata = map[string]string{}
+	}
+	for key, value := range metadata {
+		if value == "" {
+			delete(v.attrs.Metadata, key)
+			continue
+		}
+		v.attrs.Metadata[key] = value
+	}
+	v.attrs.Updated = time.Now()
+
+	return nil
+}
+
+// NewWriter buffers content, which is stored as a new generation on Close.
+func (s *Store) NewWriter(ctx context.Context, bucket, name string, opts exporter.WriteOptions) io.WriteCloser {
+	return &writer{ctx: ctx, store: s, bucket: bucket, name: name, opts: opts}
+}
+
+// Copy copies the object, keeping its metadata when metadata is nil.
+func (s *Store) Copy(ctx context.Context, bucket, dstObject, srcObject string, generation int64, metadata map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("Copy", bucket, dstObject); err != nil {
+		return err
+	}
+	v, err := s.version(bucket, srcObject, generation)
+	if err != nil {
+		return err
+	}
+
+	opts := exporter.WriteOptions{ContentType: v.attrs.ContentType, ContentEncoding: v.attrs.ContentEncoding, Metadata: v.attrs.Metadata}
+	if metadata != nil {
+		opts.Metadata = metadata
+	}
+	s.put(bucket, dstObject, v.data, opts)
+
+	return nil
+}
+
+// List returns live objects under the prefix in lexical order.
+func (s *Store) List(ctx context.Context, bucket, prefix string) ([]*storage.ObjectAttrs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.fail("List", bucket, prefix); err != nil {
+		return nil, err
+	}
+
+	var attrs []*storage.ObjectAttrs
+	for key, o := range s.objects {
+		name := strings.TrimPrefix(key, bucket+"/")
+		if name == key || !o.live || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		a := o.versions[len(o.versions)-1].attrs
+		a.Metadata = copyMetadata(a.Metadata)
+		attrs = append(attrs, &a)
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Name < attrs[j].Name })
+
+	return attrs, nil
+}
+
+// writer stores buffered content in the store once it is closed.
+type writer struct {
+	ctx    context.Context
+	store  *Store
+	bucket string
+	name   string
+	opts   exporter.WriteOptions
+	buf    bytes.Buffer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return w.buf.Write(p)
+}
+
+func (w *writer) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+
+	if err := w.store.fail("NewWriter", w.bucket, w.name); err != nil {
+		return err
+	}
+	w.store.put(w.bucket, w.name, w.buf.Bytes(), w.opts)
+
+	return nil
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+
+	copied := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+
+	return copied
+}
@@ -0,0 +1,148 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// Buckets whose objects are processed, all when empty.
+	ALLOWED_BUCKETS []string
+	// Object prefixes which are never processed.
+	IGNORE_PREFIXES []string
+	// Extensions of objects which are never exported, regardless of other rules.
+	BLOCKED_EXTENSIONS []string
+	// Content types of objects which are exported, all when empty.
+	ALLOWED_CONTENT_TYPES []string
+	// Skip hidden and temporary objects, whose base name starts with "." or ends with "~" or "#".
+	SKIP_HIDDEN_OBJECTS = true
+	// Custom metadata "key=value" objects must carry to be exported, any
+	// value of the key is accepted when given without "=value".
+	REQUIRE_METADATA_FLAG = ""
+	// Only objects updated within this window are exported, 0 disables the check.
+	MODIFIED_SINCE time.Duration = 0
+	// Time to wait before exporting new objects, letting upstream finish writing
+	// related files. The delay adds latency, is billed and counts towards the
+	// function timeout, so keep it well below it. 0 disables the delay.
+	EXPORT_DELAY time.Duration = 0
+	// Total time budget of an export covering download, transform and upload, 0 disables it.
+	EXPORT_DEADLINE time.Duration = 0
+)
+
+// IsAllowedBucket reports whether objects of the bucket are processed, which is
+// true for all buckets when ALLOWED_BUCKETS is empty.
+func IsAllowedBucket(bucket string) bool {
+	if len(ALLOWED_BUCKETS) == 0 {
+		return true
+	}
+	for _, allowed := range ALLOWED_BUCKETS {
+		if bucket == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsIgnored reports whether the object is stored under any of IGNORE_PREFIXES.
+func IsIgnored(object string) bool {
+	for _, prefix := range IGNORE_PREFIXES {
+		if strings.HasPrefix(object, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsBlocked reports whether the object name ends with any of BLOCKED_EXTENSIONS,
+// ignoring case.
+func IsBlocked(object string) bool {
+	name := strings.ToLower(path.Base(object))
+	for _, ext := range BLOCKED_EXTENSIONS {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckContentType verifies the object content type is one of
+// ALLOWED_CONTENT_TYPES, ignoring parameters like charset.
+func CheckContentType(contentType string) error {
+	if len(ALLOWED_CONTENT_TYPES) == 0 {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("content type %q is not allowed", contentType)
+	}
+	for _, allowed := range ALLOWED_CONTENT_TYPES {
+		if mediaType == allowed {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("content type %q is not allowed", contentType)
+}
+
+// IsHidden reports whether the base name of the object starts with "." or
+// ends with "~" or "#", as hidden files and editor artifacts do.
+func IsHidden(object string) bool {
+	base := path.Base(object)
+	return strings.HasPrefix(base, ".") || strings.HasSuffix(base, "~") || strings.HasSuffix(base, "#")
+}
+
+// hasMetadataFlag reports whether custom metadata carries REQUIRE_METADATA_FLAG,
+// which is always true when no flag is required.
+func hasMetadataFlag(metadata map[string]string) bool {
+	if REQUIRE_METADATA_FLAG == "" {
+		return true
+	}
+
+	key, value, hasValue := strings.Cut(REQUIRE_METADATA_FLAG, "=")
+	actual, ok := metadata[key]
+	if !ok {
+		return false
+	}
+
+	return !hasValue || actual == value
+}
+
+// delayExport waits for EXPORT_DELAY, returning early with an error when
+// the context is done before the delay elapses.
+func delayExport(ctx context.Context) error {
+	if EXPORT_DELAY <= 0 {
+		return nil
+	}
+
+	log.Printf("Waiting %s before export", EXPORT_DELAY)
+	timer := time.NewTimer(EXPORT_DELAY)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("export delay interrupted: %w", ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isStale reports whether an object was last updated before the
+// MODIFIED_SINCE window.
+func isStale(updated *timestamppb.Timestamp, now time.Time) bool {
+	if MODIFIED_SINCE <= 0 || updated == nil {
+		return false
+	}
+
+	return updated.AsTime().Before(now.Add(-MODIFIED_SINCE))
+}
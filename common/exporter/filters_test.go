@@ -0,0 +1,248 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestIsStale(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		window  time.Duration
+		updated *timestamppb.Timestamp
+		want    bool
+	}{
+		{"inside window", 24 * time.Hour, timestamppb.New(now.Add(-time.Hour)), false},
+		{"window boundary", 24 * time.Hour, timestamppb.New(now.Add(-24 * time.Hour)), false},
+		{"outside window", 24 * time.Hour, timestamppb.New(now.Add(-25 * time.Hour)), true},
+		{"updated in the future", time.Hour, timestamppb.New(now.Add(time.Minute)), false},
+		{"window disabled", 0, timestamppb.New(now.Add(-365 * 24 * time.Hour)), false},
+		{"no update time", time.Hour, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(window time.Duration) { MODIFIED_SINCE = window }(MODIFIED_SINCE)
+			MODIFIED_SINCE = tt.window
+
+			if got := isStale(tt.updated, now); got != tt.want {
+				t.Errorf("isStale() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAllowedBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		bucket  string
+		want    bool
+	}{
+		{"all buckets allowed", nil, "bucket", true},
+		{"allowed", []string{"bucket", "other"}, "other", true},
+		{"not allowed", []string{"bucket"}, "other", false},
+		{"prefix of allowed bucket", []string{"bucket"}, "buck", false},
+		{"case differs", []string{"bucket"}, "Bucket", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(buckets []string) { ALLOWED_BUCKETS = buckets }(ALLOWED_BUCKETS)
+			ALLOWED_BUCKETS = tt.allowed
+
+			if got := IsAllowedBucket(tt.bucket); got != tt.want {
+				t.Errorf("IsAllowedBucket(%q) with ALLOWED_BUCKETS=%q = %t, want %t", tt.bucket, tt.allowed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsIgnored(t *testing.T) {
+	defer func(prefixes []string) { IGNORE_PREFIXES = prefixes }(IGNORE_PREFIXES)
+	IGNORE_PREFIXES = []string{"_incoming/", "tmp"}
+
+	tests := []struct {
+		object string
+		want   bool
+	}{
+		{"_incoming/report.csv", true},
+		{"_incoming/2024/report.csv", true},
+		{"tmp/report.csv", true},
+		{"tmp-report.csv", true},
+		{"in/_incoming/report.csv", false},
+		{"_Incoming/report.csv", false},
+		{"report.csv", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsIgnored(tt.object); got != tt.want {
+			t.Errorf("IsIgnored(%q) = %t, want %t", tt.object, got, tt.want)
+		}
+	}
+
+	IGNORE_PREFIXES = nil
+	if IsIgnored("_incoming/report.csv") {
+		t.Error("IsIgnored() = true without IGNORE_PREFIXES, want false")
+	}
+}
+
+func TestIsBlocked(t *testing.T) {
+	defer func(extensions []string) { BLOCKED_EXTENSIONS = extensions }(BLOCKED_EXTENSIONS)
+	BLOCKED_EXTENSIONS = []string{".exe", ".sh", ".tar.gz"}
+
+	tests := []struct {
+		object string
+		want   bool
+	}{
+		{"in/setup.exe", true},
+		{"in/SETUP.EXE", true},
+		{"deploy.sh", true},
+		{"in/backup.tar.gz", true},
+		{"in/report.csv", false},
+		{"in/report.gz", false},
+		{"in/exe/report.csv", false},
+		{"in/reportsh", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsBlocked(tt.object); got != tt.want {
+			t.Errorf("IsBlocked(%q) = %t, want %t", tt.object, got, tt.want)
+		}
+	}
+
+	BLOCKED_EXTENSIONS = nil
+	if IsBlocked("in/setup.exe") {
+		t.Error("IsBlocked() = true without BLOCKED_EXTENSIONS, want false")
+	}
+}
+
+func TestIsHidden(t *testing.T) {
+	tests := []struct {
+		object string
+		want   bool
+	}{
+		{".~lock.report.csv#", true},
+		{"in/.~lock.report.csv#", true},
+		{"in/.report.csv", true},
+		{"in/report.csv~", true},
+		{"in/#report.csv#", true},
+		{"in/report.csv", false},
+		{"in/report.v1.csv", false},
+		{".in/report.csv", false},
+		{"in/report~1.csv", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsHidden(tt.object); got != tt.want {
+			t.Errorf("IsHidden(%q) = %t, want %t", tt.object, got, tt.want)
+		}
+	}
+}
+
+func TestCheckContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowed     []string
+		contentType string
+		wantErr     bool
+	}{
+		{"allowlist disabled", nil, "application/octet-stream", false},
+		{"allowlist disabled without content type", nil, "", false},
+		{"allowed", []string{"text/csv", "text/plain"}, "text/plain", false},
+		{"allowed with parameters", []string{"text/csv"}, "text/csv; charset=utf-8", false},
+		{"allowed in other case", []string{"text/csv"}, "Text/CSV", false},
+		{"disallowed", []string{"text/csv", "text/plain"}, "application/octet-stream", true},
+		{"missing content type", []string{"text/csv"}, "", true},
+		{"malformed content type", []string{"text/csv"}, "text/csv;;", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(allowed []string) { ALLOWED_CONTENT_TYPES = allowed }(ALLOWED_CONTENT_TYPES)
+			ALLOWED_CONTENT_TYPES = tt.allowed
+
+			if err := CheckContentType(tt.contentType); (err != nil) != tt.wantErr {
+				t.Errorf("CheckContentType(%q) error = %v, want error %t", tt.contentType, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHasMetadataFlag(t *testing.T) {
+	tests := []struct {
+		name     string
+		flag     string
+		metadata map[string]string
+		want     bool
+	}{
+		{"no flag required", "", nil, true},
+		{"matching value", "export=true", map[string]string{"export": "true"}, true},
+		{"other value", "export=true", map[string]string{"export": "false"}, false},
+		{"value case differs", "export=true", map[string]string{"export": "True"}, false},
+		{"absent key", "export=true", map[string]string{"owner": "sales"}, false},
+		{"absent metadata", "export=true", nil, false},
+		{"key only", "export", map[string]string{"export": ""}, true},
+		{"key only absent", "export", map[string]string{"owner": "sales"}, false},
+		{"empty value required", "export=", map[string]string{"export": ""}, true},
+		{"empty value required but set", "export=", map[string]string{"export": "true"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(flag string) { REQUIRE_METADATA_FLAG = flag }(REQUIRE_METADATA_FLAG)
+			REQUIRE_METADATA_FLAG = tt.flag
+
+			if got := hasMetadataFlag(tt.metadata); got != tt.want {
+				t.Errorf("hasMetadataFlag(%v) with %q = %t, want %t", tt.metadata, tt.flag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDelayExport(t *testing.T) {
+	defer func(delay time.Duration) { EXPORT_DELAY = delay }(EXPORT_DELAY)
+
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		timeout time.Duration
+		wantErr error
+	}{
+		{"disabled", 0, 0, nil},
+		{"honored", 50 * time.Millisecond, 0, nil},
+		{"canceled", 5 * time.Second, 20 * time.Millisecond, context.DeadlineExceeded},
+		{"disabled with expired context", 0, time.Nanosecond, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			EXPORT_DELAY = tt.delay
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			start := time.Now()
+			err := delayExport(ctx)
+			elapsed := time.Since(start)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("delayExport() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && elapsed < tt.delay {
+				t.Errorf("delayExport() returned after %s, want at least %s", elapsed, tt.delay)
+			}
+			if tt.wantErr != nil && elapsed > time.Second {
+				t.Errorf("delayExport() returned after %s, want about %s", elapsed, tt.timeout)
+			}
+		})
+	}
+}
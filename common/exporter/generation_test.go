@@ -0,0 +1,67 @@
+package exporter_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+)
+
+// captureUploader keeps the content of the uploaded file.
+type captureUploader struct {
+	content bytes.Buffer
+}
+
+func (u *captureUploader) Upload(ctx context.Context, name string, r io.Reader) error {
+	_, err := io.Copy(&u.content, r)
+	return err
+}
+
+func (u *captureUploader) Close() error {
+	return nil
+}
+
+func TestTransferPinsGeneration(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int64
+	}{
+		{"buffered", 0},
+		{"streamed", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(threshold int64) { exporter.STREAM_THRESHOLD_BYTES = threshold }(exporter.STREAM_THRESHOLD_BYTES)
+			exporter.STREAM_THRESHOLD_BYTES = tt.threshold
+
+			store := exportertest.NewStore().Use(t)
+			generation := store.Put("bucket", "report.csv", []byte("first version\n"), nil)
+			x := exporter.NewExport(&storagedata.StorageObjectData{Bucket: "bucket", Name: "report.csv", Generation: generation, Size: 14})
+			x.Match()
+
+			// Overwrite the object after the event, and again once the
+			// upload starts while the object is being read.
+			store.Put("bucket", "report.csv", []byte("second version\n"), nil)
+			up := &captureUploader{}
+			err := x.Transfer(context.Background(), exporter.Transfer{
+				Name: "report.csv",
+				Open: func(ctx context.Context) (exporter.Uploader, error) {
+					store.Put("bucket", "report.csv", []byte("third version\n"), nil)
+					return up, nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("Transfer() error = %v", err)
+			}
+
+			if got := up.content.String(); got != "first version\n" {
+				t.Errorf("exported %q, want content of generation %d", got, generation)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// Health check related variables. Backends extend HEALTHZ_CHECKS with
+	// their destination check before Init.
+	HEALTHZ_TIMEOUT = 5 * time.Second
+	HEALTHZ_CHECKS  = []string{"secretmanager", "storage"}
+	HEALTHZ_BUCKET  = ""
+)
+
+// healthStatus is the JSON body returned by the health check endpoint.
+type healthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// HealthChecks maps check names to lightweight dependency probes. Backends
+// add probes of their secrets and destinations.
+var HealthChecks = map[string]func(ctx context.Context) error{
+	"storage": checkStorage,
+}
+
+// healthz verifies that the function can reach its dependencies without
+// transferring any files. It returns 200 when all configured checks pass
+// and 503 otherwise.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), HEALTHZ_TIMEOUT)
+	defer cancel()
+
+	status := healthStatus{Status: "ok", Checks: map[string]string{}}
+	for _, name := range HEALTHZ_CHECKS {
+		name = strings.TrimSpace(name)
+		check, ok := HealthChecks[name]
+		if !ok {
+			status.Status = "error"
+			status.Checks[name] = "unknown check"
+			continue
+		}
+
+		if err := check(ctx); err != nil {
+			log.Printf("health check %s failed: %v", name, err)
+			status.Status = "error"
+			status.Checks[name] = err.Error()
+			continue
+		}
+		status.Checks[name] = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("unable to encode health status: %v", err)
+	}
+}
+
+// checkStorage verifies the storage client is initialized and, when
+// HEALTHZ_BUCKET is set, that the bucket attributes can be read.
+func checkStorage(ctx context.Context) error {
+	if storageClient == nil {
+		return fmt.Errorf("storage client is not initialized")
+	}
+	if HEALTHZ_BUCKET == "" {
+		return nil
+	}
+
+	if _, err := storageClient.Bucket(HEALTHZ_BUCKET).Attrs(ctx); err != nil {
+		return fmt.Errorf("Bucket(%q).Attrs: %w", HEALTHZ_BUCKET, err)
+	}
+
+	return nil
+}
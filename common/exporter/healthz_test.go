@@ -0,0 +1,102 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestHealthz(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	failing := func(ctx context.Context) error { return errors.New("unreachable") }
+
+	tests := []struct {
+		name       string
+		checks     []string
+		probes     map[string]func(ctx context.Context) error
+		wantCode   int
+		wantStatus string
+		wantChecks map[string]string
+	}{
+		{
+			name:       "all checks pass",
+			checks:     []string{"secretmanager", "sftp"},
+			probes:     map[string]func(ctx context.Context) error{"secretmanager": ok, "sftp": ok},
+			wantCode:   http.StatusOK,
+			wantStatus: "ok",
+			wantChecks: map[string]string{"secretmanager": "ok", "sftp": "ok"},
+		},
+		{
+			name:       "failing check",
+			checks:     []string{"secretmanager", "sftp"},
+			probes:     map[string]func(ctx context.Context) error{"secretmanager": ok, "sftp": failing},
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: "error",
+			wantChecks: map[string]string{"secretmanager": "ok", "sftp": "unreachable"},
+		},
+		{
+			name:       "unknown check",
+			checks:     []string{" nas "},
+			probes:     map[string]func(ctx context.Context) error{},
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: "error",
+			wantChecks: map[string]string{"nas": "unknown check"},
+		},
+		{
+			name:       "no checks",
+			checks:     nil,
+			probes:     map[string]func(ctx context.Context) error{"sftp": failing},
+			wantCode:   http.StatusOK,
+			wantStatus: "ok",
+			wantChecks: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(checks []string, probes map[string]func(ctx context.Context) error) {
+				HEALTHZ_CHECKS, HealthChecks = checks, probes
+			}(HEALTHZ_CHECKS, HealthChecks)
+			HEALTHZ_CHECKS, HealthChecks = tt.checks, tt.probes
+
+			rec := httptest.NewRecorder()
+			healthz(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("status code = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			var status healthStatus
+			if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+				t.Fatalf("unable to decode response: %v", err)
+			}
+			if status.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", status.Status, tt.wantStatus)
+			}
+			if len(status.Checks) != len(tt.wantChecks) {
+				t.Errorf("checks = %v, want %v", status.Checks, tt.wantChecks)
+			}
+			for name, want := range tt.wantChecks {
+				if got := status.Checks[name]; got != want {
+					t.Errorf("check %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckStorageUninitialized(t *testing.T) {
+	defer func(client *storage.Client) { storageClient = client }(storageClient)
+	storageClient = nil
+
+	if err := checkStorage(context.Background()); err == nil {
+		t.Error("checkStorage() succeeded without a storage client")
+	}
+}
@@ -0,0 +1,75 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Bucket storing a marker object for each exported object generation, so
+// replayed events of an already exported generation are skipped, disabled
+// when empty.
+var MARKER_BUCKET = ""
+
+// forceExportKey marks contexts of explicit exports, e.g. reprocessing,
+// which bypass markers, MODIFIED_SINCE and deduplication.
+type forceExportKey struct{}
+
+// IsForcedExport reports whether the context belongs to an explicit export.
+func IsForcedExport(ctx context.Context) bool {
+	return ctx.Value(forceExportKey{}) != nil
+}
+
+// markerName returns name of the marker object of an object generation.
+func markerName(bucket, object string, generation int64) string {
+	return fmt.Sprintf("%s/%s#%d", bucket, object, generation)
+}
+
+// isExportedGeneration reports whether a marker of the object generation
+// exists. Exports forced by the context, e.g. reprocessing, always proceed.
+func isExportedGeneration(ctx context.Context, bucket, object string, generation int64) (bool, error) {
+	if MARKER_BUCKET == "" || IsForcedExport(ctx) {
+		return false, nil
+	}
+
+	_, err := Objects.Attrs(ctx, MARKER_BUCKET, markerName(bucket, object, generation), 0)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to check export marker of %s: %w", object, err)
+	}
+
+	return true, nil
+}
+
+// writeMarker records the exported object generation in MARKER_BUCKET.
+// Failures are logged but never fail the function, as the file was already
+// delivered.
+func writeMarker(ctx context.Context, bucket, object string, generation int64, destination string) {
+	if MARKER_BUCKET == "" {
+		return
+	}
+
+	marker, err := json.Marshal(struct {
+		Destination string    `json:"destination"`
+		Timestamp   time.Time `json:"timestamp"`
+	}{destination, time.Now().UTC()})
+	if err != nil {
+		log.Printf("unable to encode export marker for %s: %v", object, err)
+		return
+	}
+
+	name := markerName(bucket, object, generation)
+	if err := writeObject(ctx, MARKER_BUCKET, name, marker); err != nil {
+		log.Printf("unable to write export marker %s for %s: %v", name, object, err)
+		return
+	}
+
+	log.Printf("Export marker of %s written to gs://%s/%s", object, MARKER_BUCKET, name)
+}
@@ -0,0 +1,121 @@
+package exporter_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+)
+
+// useMarkerBucket records exported generations in the markers bucket until
+// the test ends.
+func useMarkerBucket(t *testing.T) {
+	t.Helper()
+
+	prev := exporter.MARKER_BUCKET
+	t.Cleanup(func() { exporter.MARKER_BUCKET = prev })
+	exporter.MARKER_BUCKET = "markers"
+}
+
+func TestRunExportedGeneration(t *testing.T) {
+	useMarkerBucket(t)
+	store := exportertest.NewStore().Use(t)
+	first := store.Put("bucket", "in/report.csv", []byte("id,name\n"), nil)
+	second := store.Put("bucket", "in/report.csv", []byte("id,name\n1,alice\n"), nil)
+
+	// The replayed event of the first generation is skipped, while the
+	// next generation is exported again.
+	tests := []struct {
+		name       string
+		generation int64
+		want       bool
+	}{
+		{"first export", first, true},
+		{"replayed generation", first, false},
+		{"new generation", second, true},
+	}
+
+	for _, tt := range tests {
+		up := &fakeUploader{files: map[string]string{}}
+		if err := exporter.Run(context.Background(), exporter.MetadataEvent(t, "bucket", "in/report.csv", tt.generation, nil), transferBackend{up: up}); err != nil {
+			t.Fatalf("%s: Run() error = %v", tt.name, err)
+		}
+		if _, ok := up.files["report.csv"]; ok != tt.want {
+			t.Errorf("%s: generation %d exported %t, want %t", tt.name, tt.generation, ok, tt.want)
+		}
+	}
+
+	want := []string{fmt.Sprintf("bucket/in/report.csv#%d", first), fmt.Sprintf("bucket/in/report.csv#%d", second)}
+	if got := store.Names("markers"); !reflect.DeepEqual(got, want) {
+		t.Errorf("markers bucket holds %q, want %q", got, want)
+	}
+	data, _ := store.Content("markers", want[0])
+	var marker struct {
+		Destination string `json:"destination"`
+	}
+	if err := json.Unmarshal(data, &marker); err != nil || marker.Destination != "fake://in/report.csv" {
+		t.Errorf("marker %s = %q, want destination %q", want[0], data, "fake://in/report.csv")
+	}
+}
+
+func TestRunMarkerFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		failOp     string
+		wantExport bool
+		wantErr    bool
+	}{
+		{"marker check failure", "Attrs", false, true},
+		{"marker write failure", "NewWriter", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMarkerBucket(t)
+			store := exportertest.NewStore().Use(t)
+			store.Fail = func(op, bucket, name string) error {
+				if op == tt.failOp && bucket == "markers" {
+					return errors.New("permission denied")
+				}
+				return nil
+			}
+			generation := store.Put("bucket", "in/report.csv", []byte("id,name\n"), nil)
+			up := &fakeUploader{files: map[string]string{}}
+
+			err := exporter.Run(context.Background(), exporter.MetadataEvent(t, "bucket", "in/report.csv", generation, nil), transferBackend{up: up})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run() error = %v, want error %t", err, tt.wantErr)
+			}
+			if _, ok := up.files["report.csv"]; ok != tt.wantExport {
+				t.Errorf("exported %t, want %t", ok, tt.wantExport)
+			}
+		})
+	}
+}
+
+func TestReprocessExportedGeneration(t *testing.T) {
+	useMarkerBucket(t)
+	store := exportertest.NewStore().Use(t)
+	if !exportContent(t, store, "in/report.csv", "id,name\n") {
+		t.Fatal("first export of in/report.csv skipped")
+	}
+
+	// Reprocessing is explicit, so the exported generation is exported again.
+	up := &fakeUploader{files: map[string]string{}}
+	w := httptest.NewRecorder()
+	exporter.UseReprocess(t, transferBackend{up: up}, "secret")(w, reprocessRequest(http.MethodPost, "secret", "bucket", "in/report.csv"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("reprocess responded %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if want := map[string]string{"report.csv": "id,name\n"}; !reflect.DeepEqual(up.files, want) {
+		t.Errorf("uploaded %v, want %v", up.files, want)
+	}
+}
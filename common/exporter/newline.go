@@ -0,0 +1,31 @@
+package exporter
+
+import "bytes"
+
+// Make exported files end with exactly one line ending, adding a missing
+// one and dropping extra empty lines at the end.
+var NORMALIZE_TRAILING_NEWLINE = false
+
+// NormalizeTrailingNewline replaces all line endings at the end of data with
+// a single one, leaving interior content untouched. The line ending is
+// "\r\n" when the content uses it and "\n" otherwise. Empty data is kept.
+func NormalizeTrailingNewline(data []byte) []byte {
+	if !NORMALIZE_TRAILING_NEWLINE || len(data) == 0 {
+		return data
+	}
+
+	eol := []byte("\n")
+	if bytes.Contains(data, []byte("\r\n")) {
+		eol = []byte("\r\n")
+	}
+
+	trimmed := bytes.TrimRight(data, "\r\n")
+	if len(trimmed) == len(data)-len(eol) && bytes.HasSuffix(data, eol) {
+		return data
+	}
+
+	out := make([]byte, 0, len(trimmed)+len(eol))
+	out = append(out, trimmed...)
+
+	return append(out, eol...)
+}
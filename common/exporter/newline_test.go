@@ -0,0 +1,34 @@
+package exporter
+
+import "testing"
+
+func TestNormalizeTrailingNewline(t *testing.T) {
+	tests := []struct {
+		name     string
+		disabled bool
+		data     string
+		want     string
+	}{
+		{"no trailing newline", false, "id,name\n1,alice", "id,name\n1,alice\n"},
+		{"one trailing newline", false, "id,name\n1,alice\n", "id,name\n1,alice\n"},
+		{"multiple trailing newlines", false, "id,name\n1,alice\n\n\n", "id,name\n1,alice\n"},
+		{"interior empty lines kept", false, "id,name\n\n1,alice\n\n", "id,name\n\n1,alice\n"},
+		{"CRLF without trailing newline", false, "id,name\r\n1,alice", "id,name\r\n1,alice\r\n"},
+		{"CRLF with multiple trailing newlines", false, "id,name\r\n1,alice\r\n\r\n", "id,name\r\n1,alice\r\n"},
+		{"CRLF with LF at the end", false, "id,name\r\n1,alice\n", "id,name\r\n1,alice\r\n"},
+		{"only newlines", false, "\n\n", "\n"},
+		{"empty", false, "", ""},
+		{"disabled", true, "id,name\n1,alice\n\n", "id,name\n1,alice\n\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(normalize bool) { NORMALIZE_TRAILING_NEWLINE = normalize }(NORMALIZE_TRAILING_NEWLINE)
+			NORMALIZE_TRAILING_NEWLINE = !tt.disabled
+
+			if got := string(NormalizeTrailingNewline([]byte(tt.data))); got != tt.want {
+				t.Errorf("NormalizeTrailingNewline(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
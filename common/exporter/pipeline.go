@@ -0,0 +1,83 @@
+package exporter
+
+import (
+	"io"
+	"log"
+)
+
+// Number of chunks of streamed objects read ahead from GCS while earlier
+// chunks are uploaded, overlapping download and upload, 0 disables it.
+var PIPELINE_CHUNKS = 0
+
+// Size of chunks read ahead from GCS.
+const pipelineChunkSize = 256 << 10
+
+// pipelinedReader reads content of a source through io.Pipe, with
+// up to PIPELINE_CHUNKS chunks downloaded ahead. Read errors are returned
+// by the pipe and closing it stops the download.
+type pipelinedReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// NewPipelinedReader starts reading ahead from the reader, or returns it
+// as is when pipelining is disabled.
+func NewPipelinedReader(object string, r io.Reader) io.ReadCloser {
+	if PIPELINE_CHUNKS <= 0 {
+		return io.NopCloser(r)
+	}
+	log.Printf("Pipelining object %s with %d chunks of %d bytes read ahead", object, PIPELINE_CHUNKS, pipelineChunkSize)
+
+	pr, pw := io.Pipe()
+	chunks := make(chan []byte, PIPELINE_CHUNKS)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var readErr error
+
+	// Download chunks ahead of the upload.
+	go func() {
+		defer close(done)
+		defer close(chunks)
+		for {
+			buf := make([]byte, pipelineChunkSize)
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				select {
+				case chunks <- buf[:n]:
+				case <-stop:
+					return
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+		}
+	}()
+
+	// Feed downloaded chunks into the pipe, the error read above is stored
+	// before chunks is closed.
+	go func() {
+		defer close(stop)
+		for chunk := range chunks {
+			if _, err := pw.Write(chunk); err != nil {
+				return
+			}
+		}
+		pw.CloseWithError(readErr)
+	}()
+
+	return &pipelinedReader{PipeReader: pr, done: done}
+}
+
+// Close stops the download and waits until it no longer reads the source,
+// so the source can be closed.
+func (p *pipelinedReader) Close() error {
+	err := p.PipeReader.Close()
+	<-p.done
+
+	return err
+}
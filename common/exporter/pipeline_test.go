@@ -0,0 +1,163 @@
+package exporter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedReader returns the first chunk of content at once and the rest
+// only after the gate is opened.
+type gatedReader struct {
+	first []byte
+	rest  io.Reader
+	gate  chan struct{}
+	mu    sync.Mutex
+	reads int
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	g.mu.Lock()
+	g.reads++
+	g.mu.Unlock()
+
+	if len(g.first) > 0 {
+		n := copy(p, g.first)
+		g.first = g.first[n:]
+		return n, nil
+	}
+	<-g.gate
+	return g.rest.Read(p)
+}
+
+func (g *gatedReader) readCount() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.reads
+}
+
+// erroringReader returns the content followed by the error.
+type erroringReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e erroringReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		return n, e.err
+	}
+	return n, err
+}
+
+func TestNewPipelinedReader(t *testing.T) {
+	defer func(chunks int) { PIPELINE_CHUNKS = chunks }(PIPELINE_CHUNKS)
+
+	content := strings.Repeat("1,alice\n", pipelineChunkSize*7/16)
+	tests := []struct {
+		name    string
+		chunks  int
+		source  io.Reader
+		want    string
+		wantErr error
+	}{
+		{"disabled", 0, strings.NewReader(content), content, nil},
+		{"pipelined", 2, strings.NewReader(content), content, nil},
+		{"single chunk read ahead", 1, strings.NewReader(content), content, nil},
+		{"empty", 2, strings.NewReader(""), "", nil},
+		{"download error", 2, erroringReader{strings.NewReader(content), errors.New("connection reset")}, content, errors.New("connection reset")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			PIPELINE_CHUNKS = tt.chunks
+
+			r := NewPipelinedReader("report.csv", tt.source)
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if (err != nil) != (tt.wantErr != nil) || (err != nil && err.Error() != tt.wantErr.Error()) {
+				t.Fatalf("ReadAll() error = %v, want %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("pipelined %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestNewPipelinedReaderOverlaps(t *testing.T) {
+	defer func(chunks int) { PIPELINE_CHUNKS = chunks }(PIPELINE_CHUNKS)
+	PIPELINE_CHUNKS = 2
+
+	first := bytes.Repeat([]byte("a"), pipelineChunkSize)
+	source := &gatedReader{first: first, rest: strings.NewReader("tail"), gate: make(chan struct{})}
+	r := NewPipelinedReader("report.csv", source)
+	defer r.Close()
+
+	// The first chunk reaches the upload while the download still waits
+	got := make([]byte, len(first))
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(r, got)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatalf("ReadFull() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("first chunk not delivered before the download completed")
+	}
+
+	close(source.gate)
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, first) || string(rest) != "tail" {
+		t.Errorf("pipelined %d bytes and %q, want %d bytes and %q", len(got), rest, len(first), "tail")
+	}
+}
+
+func TestNewPipelinedReaderCloseStopsDownload(t *testing.T) {
+	defer func(chunks int) { PIPELINE_CHUNKS = chunks }(PIPELINE_CHUNKS)
+	PIPELINE_CHUNKS = 1
+
+	// The upload fails after the first chunk, leaving an endless download
+	source := &gatedReader{rest: zeroReader{}, gate: make(chan struct{})}
+	close(source.gate)
+	r := NewPipelinedReader("report.csv", source)
+	if _, err := io.ReadFull(r, make([]byte, pipelineChunkSize)); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- r.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close() still waiting for the download")
+	}
+
+	reads := source.readCount()
+	time.Sleep(20 * time.Millisecond)
+	if got := source.readCount(); got != reads {
+		t.Errorf("source read %d more times after Close()", got-reads)
+	}
+}
+
+// zeroReader returns zero bytes forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
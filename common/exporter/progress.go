@@ -0,0 +1,54 @@
+package exporter
+
+import (
+	"io"
+	"log"
+	"time"
+)
+
+// Upload progress is logged every PROGRESS_BYTES or PROGRESS_INTERVAL.
+var (
+	PROGRESS_BYTES    int64 = 64 << 20
+	PROGRESS_INTERVAL       = 30 * time.Second
+)
+
+// progressReader counts bytes passing through it and periodically logs
+// the transfer progress.
+type progressReader struct {
+	r         io.Reader
+	name      string
+	total     int64
+	read      int64
+	lastBytes int64
+	lastTime  time.Time
+}
+
+// NewProgressReader wraps r to log progress of transferring name of the
+// given total size every PROGRESS_BYTES bytes or PROGRESS_INTERVAL.
+func NewProgressReader(r io.Reader, name string, total int64) io.Reader {
+	return &progressReader{r: r, name: name, total: total, lastTime: time.Now()}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+
+	if (PROGRESS_BYTES > 0 && p.read-p.lastBytes >= PROGRESS_BYTES) ||
+		(PROGRESS_INTERVAL > 0 && time.Since(p.lastTime) >= PROGRESS_INTERVAL) {
+		p.logProgress()
+	}
+
+	return n, err
+}
+
+// logProgress emits a structured progress line and resets the counters.
+func (p *progressReader) logProgress() {
+	percent := 100.0
+	if p.total > 0 {
+		percent = float64(p.read) * 100 / float64(p.total)
+	}
+	log.Printf("Upload progress. file=%q bytes=%d total=%d percent=%.1f\n", p.name, p.read, p.total, percent)
+
+	p.lastBytes = p.read
+	p.lastTime = time.Now()
+}
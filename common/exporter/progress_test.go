@@ -0,0 +1,53 @@
+package exporter
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		bytes    int64
+		interval time.Duration
+		want     int
+	}{
+		{"large stream", 10 << 20, 1 << 20, 0, 10},
+		{"small file", 100 << 10, 1 << 20, 0, 0},
+		{"disabled", 10 << 20, 0, 0, 0},
+		{"interval", 1 << 20, 0, time.Nanosecond, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(size int64, interval time.Duration) { PROGRESS_BYTES, PROGRESS_INTERVAL = size, interval }(PROGRESS_BYTES, PROGRESS_INTERVAL)
+			PROGRESS_BYTES, PROGRESS_INTERVAL = tt.bytes, tt.interval
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			defer log.SetOutput(os.Stderr)
+
+			r := NewProgressReader(bytes.NewReader(make([]byte, tt.size)), "report.csv", int64(tt.size))
+			n, err := io.Copy(io.Discard, r)
+			if err != nil || n != int64(tt.size) {
+				t.Fatalf("io.Copy() = %d, %v, want %d bytes", n, err, tt.size)
+			}
+
+			got := strings.Count(logged.String(), "Upload progress.")
+			if tt.interval > 0 {
+				if got < tt.want {
+					t.Errorf("logged progress %d times, want at least %d", got, tt.want)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("logged progress %d times, want %d", got, tt.want)
+			}
+		})
+	}
+}
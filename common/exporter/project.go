@@ -0,0 +1,25 @@
+package exporter
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+// resolveProjectID returns ID of the GCP project from _PROJECT_ID, falling
+// back to the metadata server when the variable is not set.
+func resolveProjectID() (string, error) {
+	if id := os.Getenv("_PROJECT_ID"); id != "" {
+		return id, nil
+	}
+
+	id, err := metadata.ProjectID()
+	if err != nil {
+		return "", fmt.Errorf("_PROJECT_ID is not set and metadata.ProjectID failed: %w", err)
+	}
+	log.Printf("Resolved project ID %s from the metadata server", id)
+
+	return id, nil
+}
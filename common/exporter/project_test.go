@@ -0,0 +1,57 @@
+package exporter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveProjectID(t *testing.T) {
+	projectID := ""
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/computeMetadata/v1/project/project-id" || r.Header.Get("Metadata-Flavor") != "Google" || projectID == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Metadata-Flavor", "Google")
+		w.Write([]byte(projectID))
+	}))
+	defer srv.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+
+	// The metadata client caches the project ID once resolved, so cases
+	// reaching the metadata server successfully come last
+	tests := []struct {
+		name         string
+		env          string
+		metadata     string
+		want         string
+		wantRequests int
+		wantErr      bool
+	}{
+		{"from environment", "env-project", "metadata-project", "env-project", 0, false},
+		{"metadata server fails", "", "", "", 1, true},
+		{"from metadata server", "", "metadata-project", "metadata-project", 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("_PROJECT_ID", tt.env)
+			projectID, requests = tt.metadata, 0
+
+			got, err := resolveProjectID()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveProjectID() error = %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveProjectID() = %q, want %q", got, tt.want)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("resolveProjectID() made %d metadata requests, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
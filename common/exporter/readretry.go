@@ -0,0 +1,93 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+var (
+	// Number of attempts to read an object when GCS read fails midway.
+	GCS_READ_ATTEMPTS = 3
+	// Delay before retrying GCS operations, e.g. reopening the object, doubled with each attempt.
+	GCS_READ_RETRY_DELAY = time.Second
+)
+
+// retryReader reads an object from GCS, reopening it with a range read at
+// the last successful offset when the read fails with a transient error.
+type retryReader struct {
+	ctx        context.Context
+	bucket     string
+	object     string
+	generation int64
+	rc         io.ReadCloser
+	offset     int64
+	attempt    int
+}
+
+// NewRetryReader opens the given generation of an object for reading,
+// retrying transient errors.
+func NewRetryReader(ctx context.Context, bucket, object string, generation int64) (*retryReader, error) {
+	var rc io.ReadCloser
+	err := RetryGCS(ctx, "Open of object "+object, GCS_READ_ATTEMPTS, func() (err error) {
+		rc, err = Objects.NewRangeReader(ctx, bucket, object, generation, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &retryReader{
+		ctx:        ctx,
+		bucket:     bucket,
+		object:     object,
+		generation: generation,
+		rc:         rc,
+		attempt:    1,
+	}, nil
+}
+
+func (r *retryReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.offset += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	if r.attempt >= GCS_READ_ATTEMPTS || !IsTransientGCSError(err) {
+		return n, err
+	}
+
+	log.Printf("Read of object %s failed at offset %d (attempt %d of %d): %v", r.object, r.offset, r.attempt, GCS_READ_ATTEMPTS, err)
+	r.rc.Close()
+	r.rc = io.NopCloser(errReader{err})
+
+	select {
+	case <-r.ctx.Done():
+		return n, r.ctx.Err()
+	case <-time.After(retryDelay(r.attempt)):
+	}
+	r.attempt++
+
+	rc, oerr := Objects.NewRangeReader(r.ctx, r.bucket, r.object, r.generation, r.offset)
+	if oerr != nil {
+		return n, fmt.Errorf("unable to reopen object at offset %d: %w (read error: %v)", r.offset, oerr, err)
+	}
+	r.rc = rc
+
+	return n, nil
+}
+
+func (r *retryReader) Close() error {
+	return r.rc.Close()
+}
+
+// errReader is a reader which always fails with the error.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
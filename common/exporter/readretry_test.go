@@ -0,0 +1,102 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyObjects serves a single object whose reads fail with the errors,
+// one per opened reader, after the given number of bytes.
+type flakyObjects struct {
+	ObjectStore
+	data    string
+	failAt  int
+	errs    []error
+	offsets []int64
+}
+
+func (f *flakyObjects) NewRangeReader(ctx context.Context, bucket, object string, generation, offset int64) (io.ReadCloser, error) {
+	f.offsets = append(f.offsets, offset)
+	r := io.Reader(strings.NewReader(f.data[offset:]))
+	if len(f.errs) > 0 {
+		r = io.MultiReader(io.LimitReader(r, int64(f.failAt)), errReader{f.errs[0]})
+		f.errs = f.errs[1:]
+	}
+
+	return io.NopCloser(r), nil
+}
+
+func TestRetryReader(t *testing.T) {
+	defer func(attempts int, delay time.Duration) {
+		GCS_READ_ATTEMPTS, GCS_READ_RETRY_DELAY = attempts, delay
+	}(GCS_READ_ATTEMPTS, GCS_READ_RETRY_DELAY)
+	GCS_READ_ATTEMPTS, GCS_READ_RETRY_DELAY = 3, time.Millisecond
+	data := strings.Repeat("0123456789", 10)
+
+	tests := []struct {
+		name        string
+		errs        []error
+		wantErr     bool
+		wantOffsets []int64
+	}{
+		{"no errors", nil, false, []int64{0}},
+		{"transient error", []error{io.ErrUnexpectedEOF}, false, []int64{0, 30}},
+		{"transient errors within attempts", []error{io.ErrUnexpectedEOF, io.ErrUnexpectedEOF}, false, []int64{0, 30, 60}},
+		{"transient errors exceeding attempts", []error{io.ErrUnexpectedEOF, io.ErrUnexpectedEOF, io.ErrUnexpectedEOF}, true, []int64{0, 30, 60}},
+		{"permanent error", []error{errors.New("permission denied")}, true, []int64{0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(objects ObjectStore) { Objects = objects }(Objects)
+			store := &flakyObjects{data: data, failAt: 30, errs: tt.errs}
+			Objects = store
+
+			r, err := NewRetryReader(context.Background(), "bucket", "report.csv", 1)
+			if err != nil {
+				t.Fatalf("NewRetryReader() error = %v", err)
+			}
+			defer r.Close()
+
+			got, err := io.ReadAll(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("read error = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != data {
+				t.Errorf("read %q, want %q", got, data)
+			}
+			if len(store.offsets) != len(tt.wantOffsets) {
+				t.Fatalf("object opened at offsets %v, want %v", store.offsets, tt.wantOffsets)
+			}
+			for i, offset := range store.offsets {
+				if offset != tt.wantOffsets[i] {
+					t.Errorf("object opened at offsets %v, want %v", store.offsets, tt.wantOffsets)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestRetryReaderCanceled(t *testing.T) {
+	defer func(delay time.Duration) { GCS_READ_RETRY_DELAY = delay }(GCS_READ_RETRY_DELAY)
+	GCS_READ_RETRY_DELAY = time.Hour
+	defer func(objects ObjectStore) { Objects = objects }(Objects)
+	Objects = &flakyObjects{data: "id,name\n", failAt: 3, errs: []error{io.ErrUnexpectedEOF}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	r, err := NewRetryReader(ctx, "bucket", "report.csv", 1)
+	if err != nil {
+		t.Fatalf("NewRetryReader() error = %v", err)
+	}
+	defer r.Close()
+
+	if _, err := io.ReadAll(r); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("read error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
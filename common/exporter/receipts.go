@@ -0,0 +1,84 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// Prefix in the source bucket where a JSON receipt is written for each
+// exported object, e.g. "receipts/" for "receipts/<object>.json", disabled when empty.
+var RECEIPTS_PREFIX = ""
+
+// receiptName returns name of the receipt object of an exported object.
+func receiptName(object string) string {
+	return path.Join(RECEIPTS_PREFIX, object) + ".json"
+}
+
+// isReceipt reports whether the object is a receipt written by the exporter.
+func isReceipt(object string) bool {
+	if RECEIPTS_PREFIX == "" {
+		return false
+	}
+
+	return strings.HasPrefix(object, strings.TrimSuffix(RECEIPTS_PREFIX, "/")+"/")
+}
+
+// writeReceipt records the delivered file in a receipt next to the source
+// object. Failures are logged but never fail the function, as the file was
+// already delivered.
+func writeReceipt(ctx context.Context, bucket, object, destination string, size int64, checksum string) {
+	if RECEIPTS_PREFIX == "" {
+		return
+	}
+
+	receipt, err := json.Marshal(exportEvent{
+		Bucket:      bucket,
+		Object:      object,
+		Destination: destination,
+		Bytes:       size,
+		Checksum:    checksum,
+		Algorithm:   CHECKSUM_ALGORITHM,
+		Timestamp:   time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("unable to encode receipt for %s: %v", object, err)
+		return
+	}
+
+	name := receiptName(object)
+	if err := writeObject(ctx, bucket, name, receipt); err != nil {
+		log.Printf("unable to write receipt %s for %s: %v", name, object, err)
+		return
+	}
+
+	log.Printf("Receipt of %s written to %s", object, name)
+}
+
+// writeObject stores data as a JSON object in the bucket.
+func writeObject(ctx context.Context, bucket, object string, data []byte) error {
+	return WriteContent(ctx, bucket, object, "application/json", data)
+}
+
+// WriteContent stores data as an object of the content type in the bucket.
+func WriteContent(ctx context.Context, bucket, object, contentType string, data []byte) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wc := Objects.NewWriter(ctx, bucket, object, WriteOptions{ContentType: contentType})
+	if _, err := wc.Write(data); err != nil {
+		// Abort the upload, so no partial object is created.
+		cancel()
+		wc.Close()
+		return fmt.Errorf("Writer.Write: %w", err)
+	}
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("Writer.Close: %w", err)
+	}
+
+	return nil
+}
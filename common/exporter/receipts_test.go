@@ -0,0 +1,120 @@
+package exporter_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+)
+
+func TestTransferWritesReceipt(t *testing.T) {
+	defer func(prefix string) { exporter.RECEIPTS_PREFIX = prefix }(exporter.RECEIPTS_PREFIX)
+
+	tests := []struct {
+		name        string
+		prefix      string
+		uploader    exporter.Uploader
+		wantReceipt bool
+		wantErr     bool
+	}{
+		{"delivered", "receipts/", &captureUploader{}, true, false},
+		{"prefix without slash", "receipts", &captureUploader{}, true, false},
+		{"upload failure", "receipts/", failingUploader{}, false, true},
+		{"disabled", "", &captureUploader{}, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter.RECEIPTS_PREFIX = tt.prefix
+			store := exportertest.NewStore().Use(t)
+			generation := store.Put("bucket", "in/report.csv", []byte("id,name\n"), nil)
+			x := exporter.NewExport(&storagedata.StorageObjectData{Bucket: "bucket", Name: "in/report.csv", Generation: generation, Size: 8})
+			x.Match()
+
+			start := time.Now().UTC()
+			err := x.Transfer(context.Background(), exporter.Transfer{
+				Name:        "report.csv",
+				Destination: "sftp://partner/in/report.csv",
+				Open: func(ctx context.Context) (exporter.Uploader, error) {
+					return tt.uploader, nil
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Transfer() error = %v, want error %t", err, tt.wantErr)
+			}
+
+			data, ok := store.Content("bucket", "receipts/in/report.csv.json")
+			if ok != tt.wantReceipt {
+				t.Fatalf("bucket holds %q, want receipt written %t", store.Names("bucket"), tt.wantReceipt)
+			}
+			if !ok {
+				if names := store.Names("bucket"); !reflect.DeepEqual(names, []string{"in/report.csv"}) {
+					t.Errorf("bucket holds %q, want no receipt", names)
+				}
+				return
+			}
+			attrs, err := store.Attrs(context.Background(), "bucket", "receipts/in/report.csv.json", 0)
+			if err != nil {
+				t.Fatalf("Attrs() error = %v", err)
+			}
+			if attrs.ContentType != "application/json" {
+				t.Errorf("receipt content type = %q, want %q", attrs.ContentType, "application/json")
+			}
+			var got struct {
+				Bucket      string    `json:"bucket"`
+				Object      string    `json:"object"`
+				Destination string    `json:"destination"`
+				Bytes       int64     `json:"bytes"`
+				Checksum    string    `json:"checksum"`
+				Algorithm   string    `json:"algorithm"`
+				Timestamp   time.Time `json:"timestamp"`
+			}
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("unable to decode receipt %q: %v", data, err)
+			}
+			if got.Bucket != "bucket" || got.Object != "in/report.csv" || got.Destination != "sftp://partner/in/report.csv" || got.Bytes != 8 {
+				t.Errorf("receipt = %+v, want bucket, object, destination and size of the export", got)
+			}
+			if got.Checksum != exporter.DataChecksum([]byte("id,name\n")) || got.Algorithm != exporter.CHECKSUM_ALGORITHM {
+				t.Errorf("receipt checksum = %s %q, want %s of the content", got.Algorithm, got.Checksum, exporter.CHECKSUM_ALGORITHM)
+			}
+			if got.Timestamp.Before(start.Truncate(time.Second)) {
+				t.Errorf("receipt timestamp = %s, want the time of the export", got.Timestamp)
+			}
+		})
+	}
+}
+
+func TestRunSkipsReceipts(t *testing.T) {
+	defer func(prefix string) { exporter.RECEIPTS_PREFIX = prefix }(exporter.RECEIPTS_PREFIX)
+	exporter.RECEIPTS_PREFIX = "receipts"
+
+	tests := []struct {
+		object string
+		want   map[string]string
+	}{
+		{"receipts/in/report.csv.json", map[string]string{}},
+		{"receipts-2024.csv", map[string]string{"receipts-2024.csv": "id,name\n"}},
+		{"in/receipts/report.csv", map[string]string{"report.csv": "id,name\n"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.object, func(t *testing.T) {
+			store := exportertest.NewStore().Use(t)
+			store.Put("bucket", tt.object, []byte("id,name\n"), nil)
+			up := &fakeUploader{files: map[string]string{}}
+
+			if err := exporter.Run(context.Background(), exporter.ObjectEvent(t, "bucket", tt.object), transferBackend{up: up}); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if !reflect.DeepEqual(up.files, tt.want) {
+				t.Errorf("uploaded %q, want %q", up.files, tt.want)
+			}
+		})
+	}
+}
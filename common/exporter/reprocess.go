@@ -0,0 +1,151 @@
+package exporter
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// Secret version holding bearer token required by the reprocess
+	// endpoint, which is disabled when empty. REPROCESS_TOKEN_SECRET names
+	// the secret, prefixed with SECRET_PREFIX like all other secrets.
+	REPROCESS_TOKEN_SECRET = ""
+	reprocessToken         string
+)
+
+// reprocessResult is the JSON body returned by the reprocess endpoint.
+type reprocessResult struct {
+	Bucket string `json:"bucket"`
+	Object string `json:"object"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// initReprocess reads the token guarding the reprocess endpoint.
+func initReprocess(ctx context.Context) error {
+	if REPROCESS_TOKEN_SECRET == "" {
+		return nil
+	}
+
+	var err error
+	reprocessToken, err = AccessSecretVersion(ctx, REPROCESS_TOKEN_SECRET)
+	if err != nil {
+		return fmt.Errorf("failed to get secret: %w", err)
+	}
+
+	return nil
+}
+
+// reprocess replays the export of a single object given by "bucket" and
+// "object" parameters, running the same path as storage events do.
+func reprocess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizedReprocess(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	result := reprocessResult{Bucket: r.FormValue("bucket"), Object: r.FormValue("object")}
+	if result.Bucket == "" || result.Object == "" {
+		http.Error(w, "bucket and object are required", http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	var summary Summary
+	if err := reprocessObject(context.WithValue(r.Context(), summaryKey{}, &summary), result.Bucket, result.Object); err != nil {
+		log.Printf("reprocess of %s/%s failed: %v", result.Bucket, result.Object, err)
+		result.Status, result.Error = "failed", err.Error()
+		status = http.StatusInternalServerError
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			result.Status = "not found"
+			status = http.StatusNotFound
+		}
+	} else {
+		// Report why nothing was exported instead of claiming success.
+		switch {
+		case summary.rejection != nil:
+			result.Status, result.Error = "rejected", summary.rejection.Error()
+			status = http.StatusUnprocessableEntity
+		case summary.skipReason != "":
+			result.Status = "skipped: " + summary.skipReason
+		default:
+			result.Status = "ok"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("unable to encode reprocess result: %v", err)
+	}
+}
+
+// authorizedReprocess reports whether the request carries the configured
+// bearer token. Requests are refused when no token is configured.
+func authorizedReprocess(r *http.Request) bool {
+	if reprocessToken == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(reprocessToken)) == 1
+}
+
+// reprocessObject builds a storage event of the latest object generation
+// and passes it to the export driver of the registered backend.
+func reprocessObject(ctx context.Context, bucket, object string) error {
+	attrs, err := Objects.Attrs(ctx, bucket, object, 0)
+	if err != nil {
+		return fmt.Errorf("Object(%q).Attrs: %w", object, err)
+	}
+
+	// Reprocessing is explicit, so the object is exported even when tagged.
+	metadata := map[string]string{}
+	for k, v := range attrs.Metadata {
+		metadata[k] = v
+	}
+	if POST_EXPORT_TAG != "" {
+		key, _ := exportTag()
+		delete(metadata, key)
+	}
+
+	data, err := protojson.Marshal(&storagedata.StorageObjectData{
+		Bucket:      attrs.Bucket,
+		Name:        attrs.Name,
+		Generation:  attrs.Generation,
+		Size:        attrs.Size,
+		ContentType: attrs.ContentType,
+		Metadata:    metadata,
+		Updated:     timestamppb.New(attrs.Updated),
+	})
+	if err != nil {
+		return fmt.Errorf("protojson.Marshal: %w", err)
+	}
+
+	e := event.New()
+	e.SetID(fmt.Sprintf("reprocess-%s-%d", object, attrs.Generation))
+	e.SetSource("//storage.googleapis.com/projects/_/buckets/" + bucket)
+	e.SetType("google.cloud.storage.object.v1.finalized")
+	if err := e.SetData(event.ApplicationJSON, data); err != nil {
+		return fmt.Errorf("event.SetData: %w", err)
+	}
+	log.Printf("Reprocessing object %s of bucket %s (generation %d)", object, bucket, attrs.Generation)
+
+	return run(context.WithValue(ctx, forceExportKey{}, true), e, backend)
+}
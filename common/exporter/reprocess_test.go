@@ -0,0 +1,126 @@
+package exporter_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+)
+
+// reprocessRequest returns the reprocess request of the object in bucket,
+// authorized by the bearer token unless it is empty.
+func reprocessRequest(method, token, bucket, object string) *http.Request {
+	form := url.Values{"bucket": {bucket}, "object": {object}}
+	r := httptest.NewRequest(method, "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return r
+}
+
+// quarantiningBackend rejects all objects, quarantining them like exporters
+// do when QUARANTINE_PREFIX is set.
+type quarantiningBackend struct{}
+
+func (quarantiningBackend) Accept(ctx context.Context, x *exporter.Export) (exporter.Delivery, error) {
+	x.Match()
+	x.Reject(errors.New("invalid header"))
+
+	return nil, nil
+}
+
+func TestReprocess(t *testing.T) {
+	up := &fakeUploader{}
+	reject := func(ctx context.Context, data []byte) ([]byte, error) {
+		return nil, exporter.RejectContent(errors.New("invalid header"))
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		method     string
+		auth       string
+		object     string
+		backend    exporter.Backend
+		wantCode   int
+		wantStatus string
+		want       map[string]string
+	}{
+		{"existing object", "secret", http.MethodPost, "secret", "in/report.csv", transferBackend{up: up}, http.StatusOK, "ok", map[string]string{"report.csv": "id,name\n"}},
+		{"missing object", "secret", http.MethodPost, "secret", "in/missing.csv", transferBackend{up: up}, http.StatusNotFound, "not found", map[string]string{}},
+		{"skipped by backend", "secret", http.MethodPost, "secret", "in/report.csv", transferBackend{skip: true, up: up}, http.StatusOK, "skipped: backend", map[string]string{}},
+		{"quarantined", "secret", http.MethodPost, "secret", "in/report.csv", quarantiningBackend{}, http.StatusUnprocessableEntity, "rejected", map[string]string{}},
+		{"rejected without quarantine", "secret", http.MethodPost, "secret", "in/report.csv", transferBackend{transform: reject, up: up}, http.StatusInternalServerError, "failed", map[string]string{}},
+		{"failed upload", "secret", http.MethodPost, "secret", "in/report.csv", transferBackend{openErr: errors.New("connection refused"), up: up}, http.StatusInternalServerError, "failed", map[string]string{}},
+		{"wrong token", "secret", http.MethodPost, "guess", "in/report.csv", transferBackend{up: up}, http.StatusForbidden, "", map[string]string{}},
+		{"missing token", "secret", http.MethodPost, "", "in/report.csv", transferBackend{up: up}, http.StatusForbidden, "", map[string]string{}},
+		{"endpoint disabled", "", http.MethodPost, "", "in/report.csv", transferBackend{up: up}, http.StatusForbidden, "", map[string]string{}},
+		{"other method", "secret", http.MethodGet, "secret", "in/report.csv", transferBackend{up: up}, http.StatusMethodNotAllowed, "", map[string]string{}},
+		{"missing object name", "secret", http.MethodPost, "secret", "", transferBackend{up: up}, http.StatusBadRequest, "", map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := exportertest.NewStore().Use(t)
+			store.Put("bucket", "in/report.csv", []byte("id,name\n"), nil)
+			up.files = map[string]string{}
+
+			w := httptest.NewRecorder()
+			exporter.UseReprocess(t, tt.backend, tt.token)(w, reprocessRequest(tt.method, tt.auth, "bucket", tt.object))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("reprocess responded %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantStatus != "" {
+				var result struct {
+					Bucket, Object, Status string
+				}
+				if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+					t.Fatalf("unable to decode reprocess result: %v", err)
+				}
+				if result.Bucket != "bucket" || result.Object != tt.object || result.Status != tt.wantStatus {
+					t.Errorf("reprocess result = %+v, want status %q of bucket/%s", result, tt.wantStatus, tt.object)
+				}
+			}
+			if !reflect.DeepEqual(up.files, tt.want) {
+				t.Errorf("uploaded %v, want %v", up.files, tt.want)
+			}
+		})
+	}
+}
+
+func TestReprocessBypassesFilters(t *testing.T) {
+	defer func(window time.Duration) { exporter.MODIFIED_SINCE = window }(exporter.MODIFIED_SINCE)
+	exporter.UseDedup(t, time.Hour, 10)
+	store := exportertest.NewStore().Use(t)
+
+	// The content was exported once already and is duplicated within the
+	// dedup window, the object also turned stale meanwhile.
+	if !exportContent(t, store, "in/report.csv", "id,name\n") {
+		t.Fatal("first export of in/report.csv skipped")
+	}
+	exporter.MODIFIED_SINCE = time.Nanosecond
+	time.Sleep(time.Millisecond)
+
+	up := &fakeUploader{files: map[string]string{}}
+	w := httptest.NewRecorder()
+	exporter.UseReprocess(t, transferBackend{up: up}, "secret")(w, reprocessRequest(http.MethodPost, "secret", "bucket", "in/report.csv"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("reprocess responded %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if want := map[string]string{"report.csv": "id,name\n"}; !reflect.DeepEqual(up.files, want) {
+		t.Errorf("uploaded %v, want %v", up.files, want)
+	}
+}
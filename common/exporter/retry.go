@@ -0,0 +1,55 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Number of attempts to write an object, e.g. a quarantine copy, on transient GCS errors.
+var GCS_WRITE_ATTEMPTS = 3
+
+// IsTransientGCSError reports whether a GCS operation failing with err may
+// succeed when retried. Missing objects or buckets and permission errors
+// are permanent, rate limits, 5xx and network errors are transient.
+func IsTransientGCSError(err error) bool {
+	if errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, storage.ErrBucketNotExist) {
+		return false
+	}
+
+	return storage.ShouldRetry(err)
+}
+
+// retryDelay returns delay before the retry following the attempt,
+// doubling GCS_READ_RETRY_DELAY with each attempt.
+func retryDelay(attempt int) time.Duration {
+	return GCS_READ_RETRY_DELAY << (attempt - 1)
+}
+
+// RetryGCS runs a GCS operation up to attempts times, retrying transient
+// errors with backoff and failing fast on permanent ones.
+func RetryGCS(ctx context.Context, operation string, attempts int, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !IsTransientGCSError(err) {
+			return err
+		}
+		if attempt >= attempts {
+			log.Printf("%s failed with transient error, giving up after %d attempts: %v", operation, attempts, err)
+			return err
+		}
+
+		log.Printf("%s failed with transient error (attempt %d of %d): %v", operation, attempt, attempts, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryDelay(attempt)):
+		}
+	}
+}
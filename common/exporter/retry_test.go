@@ -0,0 +1,120 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIsTransientGCSError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"missing object", storage.ErrObjectNotExist, false},
+		{"wrapped missing object", fmt.Errorf("Object(%q).NewReader: %w", "report.csv", storage.ErrObjectNotExist), false},
+		{"missing bucket", storage.ErrBucketNotExist, false},
+		{"not found", &googleapi.Error{Code: 404}, false},
+		{"permission denied", &googleapi.Error{Code: 403}, false},
+		{"unauthenticated", &googleapi.Error{Code: 401}, false},
+		{"precondition failed", &googleapi.Error{Code: 412}, false},
+		{"request timeout", &googleapi.Error{Code: 408}, true},
+		{"rate limited", &googleapi.Error{Code: 429}, true},
+		{"server error", &googleapi.Error{Code: 500}, true},
+		{"service unavailable", fmt.Errorf("write: %w", &googleapi.Error{Code: 503}), true},
+		{"truncated response", io.ErrUnexpectedEOF, true},
+		{"connection reset", &url.Error{Op: "Get", URL: "https://storage.googleapis.com", Err: syscall.ECONNRESET}, true},
+		{"grpc unavailable", status.Error(codes.Unavailable, "unavailable"), true},
+		{"grpc permission denied", status.Error(codes.PermissionDenied, "denied"), false},
+		{"other error", errors.New("invalid argument"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransientGCSError(tt.err); got != tt.want {
+				t.Errorf("IsTransientGCSError(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryGCS(t *testing.T) {
+	defer func(delay time.Duration) { GCS_READ_RETRY_DELAY = delay }(GCS_READ_RETRY_DELAY)
+	GCS_READ_RETRY_DELAY = time.Millisecond
+
+	transient, permanent := &googleapi.Error{Code: 503}, &googleapi.Error{Code: 403}
+
+	tests := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"success", nil, 1, nil},
+		{"transient errors retried", []error{transient, transient}, 3, nil},
+		{"transient errors exhausted", []error{transient, transient, transient}, 3, transient},
+		{"permanent error not retried", []error{permanent}, 1, permanent},
+		{"permanent after transient", []error{transient, permanent}, 2, permanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := RetryGCS(context.Background(), "Write of object report.csv", 3, func() error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("RetryGCS() error = %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("RetryGCS() made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryGCSCanceled(t *testing.T) {
+	defer func(delay time.Duration) { GCS_READ_RETRY_DELAY = delay }(GCS_READ_RETRY_DELAY)
+	GCS_READ_RETRY_DELAY = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	err := RetryGCS(ctx, "Delete of object report.csv", 3, func() error {
+		attempts++
+		return &googleapi.Error{Code: 503}
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("RetryGCS() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if attempts != 1 {
+		t.Errorf("RetryGCS() made %d attempts, want 1", attempts)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	defer func(delay time.Duration) { GCS_READ_RETRY_DELAY = delay }(GCS_READ_RETRY_DELAY)
+	GCS_READ_RETRY_DELAY = 100 * time.Millisecond
+
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond} {
+		if got := retryDelay(attempt); got != want {
+			t.Errorf("retryDelay(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+}
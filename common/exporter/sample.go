@@ -0,0 +1,110 @@
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+var (
+	// Export only first SAMPLE_BYTES bytes or SAMPLE_LINES lines of objects,
+	// meant for testing and sampling only. Disabled when zero.
+	SAMPLE_BYTES int64 = 0
+	SAMPLE_LINES       = 0
+)
+
+// initSampling reads sampling limits from environment variables.
+func initSampling() {
+	var err error
+	if os.Getenv("SAMPLE_BYTES") != "" {
+		SAMPLE_BYTES, err = strconv.ParseInt(os.Getenv("SAMPLE_BYTES"), 10, 64)
+		if err != nil || SAMPLE_BYTES < 0 {
+			log.Fatalf("invalid SAMPLE_BYTES: %q", os.Getenv("SAMPLE_BYTES"))
+		}
+	}
+	if os.Getenv("SAMPLE_LINES") != "" {
+		SAMPLE_LINES, err = strconv.Atoi(os.Getenv("SAMPLE_LINES"))
+		if err != nil || SAMPLE_LINES < 0 {
+			log.Fatalf("invalid SAMPLE_LINES: %q", os.Getenv("SAMPLE_LINES"))
+		}
+	}
+
+	if SAMPLE_BYTES > 0 || SAMPLE_LINES > 0 {
+		log.Printf("WARNING: sampling enabled, only partial content is exported. bytes=%d lines=%d", SAMPLE_BYTES, SAMPLE_LINES)
+	}
+}
+
+// SampleContent truncates data to SAMPLE_LINES lines and then to SAMPLE_BYTES
+// bytes. Data shorter than the limits is returned unchanged.
+func SampleContent(data []byte) []byte {
+	if SAMPLE_LINES > 0 {
+		data = firstLines(data, SAMPLE_LINES)
+	}
+	if SAMPLE_BYTES > 0 && int64(len(data)) > SAMPLE_BYTES {
+		data = data[:SAMPLE_BYTES]
+	}
+
+	return data
+}
+
+// firstLines returns first n lines of data including their line endings.
+func firstLines(data []byte, n int) []byte {
+	r := bufio.NewReader(bytes.NewReader(data))
+	size := 0
+	for i := 0; i < n; i++ {
+		line, err := r.ReadSlice('\n')
+		size += len(line)
+		if err == bufio.ErrBufferFull {
+			// Lines longer than the buffer are consumed in several reads.
+			i--
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return data[:size]
+}
+
+// SampleReader limits streamed content to SAMPLE_LINES lines and then to
+// SAMPLE_BYTES bytes, like SampleContent does for buffered content.
+func SampleReader(r io.Reader) io.Reader {
+	if SAMPLE_LINES > 0 {
+		r = &lineLimitReader{r: r, n: SAMPLE_LINES}
+	}
+	if SAMPLE_BYTES > 0 {
+		r = io.LimitReader(r, SAMPLE_BYTES)
+	}
+
+	return r
+}
+
+// lineLimitReader reads from r until n lines including their line endings
+// were read.
+type lineLimitReader struct {
+	r io.Reader
+	n int
+}
+
+func (l *lineLimitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, io.EOF
+	}
+
+	n, err := l.r.Read(p)
+	for i := 0; i < n; i++ {
+		if p[i] != '\n' {
+			continue
+		}
+		l.n--
+		if l.n == 0 {
+			return i + 1, nil
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,57 @@
+package exporter
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSampleContent(t *testing.T) {
+	long := strings.Repeat("x", 10000) + "\n"
+
+	tests := []struct {
+		name  string
+		bytes int64
+		lines int
+		data  string
+		want  string
+	}{
+		{"disabled", 0, 0, "a\nb\nc\n", "a\nb\nc\n"},
+		{"first lines", 0, 2, "a\nb\nc\n", "a\nb\n"},
+		{"first lines with CRLF", 0, 1, "a\r\nb\r\n", "a\r\n"},
+		{"fewer lines than limit", 0, 5, "a\nb\n", "a\nb\n"},
+		{"last line without newline", 0, 5, "a\nb", "a\nb"},
+		{"lines longer than buffer", 0, 2, long + long + long, long + long},
+		{"first bytes", 4, 0, "a\nb\nc\n", "a\nb\n"},
+		{"fewer bytes than limit", 100, 0, "a\nb\n", "a\nb\n"},
+		{"lines then bytes", 3, 2, "aa\nbb\ncc\n", "aa\n"},
+		{"bytes within lines", 100, 1, "aa\nbb\n", "aa\n"},
+		{"empty", 4, 2, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(b int64, l int) { SAMPLE_BYTES, SAMPLE_LINES = b, l }(SAMPLE_BYTES, SAMPLE_LINES)
+			SAMPLE_BYTES, SAMPLE_LINES = tt.bytes, tt.lines
+
+			if got := SampleContent([]byte(tt.data)); string(got) != tt.want {
+				t.Errorf("SampleContent() = %q, want %q", got, tt.want)
+			}
+
+			for name, r := range map[string]io.Reader{
+				"reader":          bytes.NewReader([]byte(tt.data)),
+				"one byte reader": iotest.OneByteReader(bytes.NewReader([]byte(tt.data))),
+			} {
+				got, err := io.ReadAll(SampleReader(r))
+				if err != nil {
+					t.Fatalf("SampleReader() with %s error = %v", name, err)
+				}
+				if string(got) != tt.want {
+					t.Errorf("SampleReader() with %s = %q, want %q", name, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package exporter
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"time"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// GCP project which owns the secrets, from _PROJECT_ID or the metadata server.
+	PROJECT_ID = ""
+	// Prefix of secret names selecting the environment, e.g. "dev" for "dev-sftp-host".
+	SECRET_PREFIX = ""
+	// Number of failed Secret Manager accesses by error class.
+	secretAccessFailures = expvar.NewMap("secret_access_failures")
+)
+
+// SecretVersionName returns resource name of the latest version of the
+// secret in PROJECT_ID, prefixed with SECRET_PREFIX when set.
+func SecretVersionName(secret string) string {
+	if SECRET_PREFIX != "" {
+		secret = SECRET_PREFIX + "-" + secret
+	}
+
+	return "projects/" + PROJECT_ID + "/secrets/" + secret + "/versions/latest"
+}
+
+// AccessSecretVersion accesses the payload for the given secret version if one
+// exists. The version can be a version number as a string (e.g. "5") or an
+// alias (e.g. "latest"). Latency and failures of every access are logged
+// and failures are counted by class.
+func AccessSecretVersion(ctx context.Context, name string) (string, error) {
+	start := time.Now()
+	secret, err := FetchSecretVersion(ctx, name)
+	latency := time.Since(start)
+
+	if err != nil {
+		class := classifySecretError(err)
+		secretAccessFailures.Add(class, 1)
+		log.Printf("Secret access failed. secret=%q latency=%s class=%s failures=%s: %v", name, latency, class, secretAccessFailures.Get(class), err)
+		return "", err
+	}
+	log.Printf("Secret accessed. secret=%q latency=%s", name, latency)
+
+	return secret, nil
+}
+
+// classifySecretError distinguishes permission errors and missing secrets or
+// versions, which need operator action, from transient ones worth retrying.
+func classifySecretError(err error) string {
+	switch status.Code(err) {
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return "permission"
+	case codes.NotFound:
+		return "not_found"
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal:
+		return "transient"
+	default:
+		return "other"
+	}
+}
+
+// FetchSecretVersion accesses the secret version, replaced by tests serving
+// secrets without Secret Manager.
+var FetchSecretVersion = fetchSecretVersion
+
+// fetchSecretVersion calls Secret Manager to access the secret version.
+func fetchSecretVersion(ctx context.Context, name string) (string, error) {
+	// name := "projects/my-project/secrets/my-secret/versions/5"
+	// name := "projects/my-project/secrets/my-secret/versions/latest"
+
+	// Create the client.
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to create secretmanager client: %w", err)
+	}
+	defer client.Close()
+
+	// Build the request.
+	req := &secretmanagerpb.AccessSecretVersionRequest{
+		Name: name,
+	}
+
+	// Call the API.
+	result, err := client.AccessSecretVersion(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to access secret version: %w", err)
+	}
+
+	// Verify the data checksum.
+	crc32c := crc32.MakeTable(crc32.Castagnoli)
+	checksum := int64(crc32.Checksum(result.Payload.Data, crc32c))
+	if checksum != *result.Payload.DataCrc32C {
+		return "", fmt.Errorf("data corruption detected")
+	}
+
+	secret := string(result.Payload.Data)
+
+	return secret, nil
+}
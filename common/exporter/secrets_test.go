@@ -0,0 +1,109 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifySecretError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{status.Error(codes.PermissionDenied, "denied"), "permission"},
+		{status.Error(codes.Unauthenticated, "no credentials"), "permission"},
+		{status.Error(codes.NotFound, "no such secret"), "not_found"},
+		{status.Error(codes.Unavailable, "unavailable"), "transient"},
+		{status.Error(codes.DeadlineExceeded, "deadline"), "transient"},
+		{status.Error(codes.ResourceExhausted, "quota"), "transient"},
+		{status.Error(codes.InvalidArgument, "bad name"), "other"},
+		{errors.New("data corruption detected"), "other"},
+	}
+
+	for _, tt := range tests {
+		if got := classifySecretError(tt.err); got != tt.want {
+			t.Errorf("classifySecretError(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// failureCount returns the number of secret access failures of the class.
+func failureCount(class string) int64 {
+	if v, ok := secretAccessFailures.Get(class).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestAccessSecretVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantClass string
+	}{
+		{"success", nil, ""},
+		{"permission denied", status.Error(codes.PermissionDenied, "denied"), "permission"},
+		{"throttled", status.Error(codes.ResourceExhausted, "quota"), "transient"},
+		{"missing secret", status.Error(codes.NotFound, "no such secret"), "not_found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(fetch func(context.Context, string) (string, error)) { FetchSecretVersion = fetch }(FetchSecretVersion)
+			FetchSecretVersion = func(ctx context.Context, name string) (string, error) {
+				if tt.err != nil {
+					return "", tt.err
+				}
+				return "s3cret", nil
+			}
+			before := map[string]int64{}
+			for _, class := range []string{"permission", "not_found", "transient", "other"} {
+				before[class] = failureCount(class)
+			}
+
+			got, err := AccessSecretVersion(context.Background(), SecretVersionName("sftp-password"))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("AccessSecretVersion() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && got != "s3cret" {
+				t.Errorf("AccessSecretVersion() = %q, want %q", got, "s3cret")
+			}
+			for class, count := range before {
+				want := count
+				if class == tt.wantClass {
+					want++
+				}
+				if got := failureCount(class); got != want {
+					t.Errorf("%s failures = %d, want %d", class, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSecretVersionName(t *testing.T) {
+	defer func(project, prefix string) { PROJECT_ID, SECRET_PREFIX = project, prefix }(PROJECT_ID, SECRET_PREFIX)
+	PROJECT_ID = "acme"
+
+	tests := []struct {
+		prefix string
+		secret string
+		want   string
+	}{
+		{"", "sftp-host", "projects/acme/secrets/sftp-host/versions/latest"},
+		{"dev", "sftp-host", "projects/acme/secrets/dev-sftp-host/versions/latest"},
+		{"prod", "nas-pass", "projects/acme/secrets/prod-nas-pass/versions/latest"},
+	}
+
+	for _, tt := range tests {
+		SECRET_PREFIX = tt.prefix
+		if got := SecretVersionName(tt.secret); got != tt.want {
+			t.Errorf("SecretVersionName(%q) with SECRET_PREFIX %q = %q, want %q", tt.secret, tt.prefix, got, tt.want)
+		}
+	}
+}
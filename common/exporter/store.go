@@ -0,0 +1,118 @@
+package exporter
+
+import (
+	"context"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ObjectStore abstracts the storage operations used by the exporters, so
+// they can be backed by a fake implementation in tests. Generation 0
+// means the latest object generation.
+type ObjectStore interface {
+	// NewReader opens object content. With compressed set, content stored
+	// with Content-Encoding gzip is returned without decompressing it.
+	NewReader(ctx context.Context, bucket, object string, generation int64, compressed bool) (io.ReadCloser, error)
+	// NewRangeReader reads an object starting at the offset.
+	NewRangeReader(ctx context.Context, bucket, object string, generation, offset int64) (io.ReadCloser, error)
+	Delete(ctx context.Context, bucket, object string, generation int64) error
+	Attrs(ctx context.Context, bucket, object string, generation int64) (*storage.ObjectAttrs, error)
+	// UpdateMetadata merges custom metadata into existing metadata of the object.
+	UpdateMetadata(ctx context.Context, bucket, object string, generation int64, metadata map[string]string) error
+	// NewWriter creates or replaces an object, the write completes on Close.
+	NewWriter(ctx context.Context, bucket, object string, opts WriteOptions) io.WriteCloser
+	// Copy copies an object within the bucket, replacing custom metadata.
+	Copy(ctx context.Context, bucket, dstObject, srcObject string, generation int64, metadata map[string]string) error
+	// List returns attributes of objects under the prefix.
+	List(ctx context.Context, bucket, prefix string) ([]*storage.ObjectAttrs, error)
+}
+
+// WriteOptions holds attributes of newly written objects.
+type WriteOptions struct {
+	ContentType     string
+	ContentEncoding string
+	Metadata        map[string]string
+	// Send content in a single request instead of buffering it in chunks,
+	// such writes are not retried by the client.
+	SingleRequest bool
+}
+
+var (
+	storageClient *storage.Client
+	// Objects is the store used for all storage operations of the exporters.
+	Objects ObjectStore
+)
+
+// gcsStore implements ObjectStore with Google Cloud Storage client.
+type gcsStore struct {
+	client *storage.Client
+}
+
+// object returns handle of an object, pinned to the generation when known.
+func (s *gcsStore) object(bucket, object string, generation int64) *storage.ObjectHandle {
+	o := s.client.Bucket(bucket).Object(object)
+	if generation > 0 {
+		o = o.Generation(generation)
+	}
+
+	return o
+}
+
+func (s *gcsStore) NewReader(ctx context.Context, bucket, object string, generation int64, compressed bool) (io.ReadCloser, error) {
+	return s.object(bucket, object, generation).ReadCompressed(compressed).NewReader(ctx)
+}
+
+func (s *gcsStore) NewRangeReader(ctx context.Context, bucket, object string, generation, offset int64) (io.ReadCloser, error) {
+	return s.object(bucket, object, generation).NewRangeReader(ctx, offset, -1)
+}
+
+func (s *gcsStore) UpdateMetadata(ctx context.Context, bucket, object string, generation int64, metadata map[string]string) error {
+	_, err := s.object(bucket, object, generation).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata})
+
+	return err
+}
+
+func (s *gcsStore) NewWriter(ctx context.Context, bucket, object string, opts WriteOptions) io.WriteCloser {
+	wc := s.client.Bucket(bucket).Object(object).NewWriter(ctx)
+	wc.ContentType = opts.ContentType
+	wc.ContentEncoding = opts.ContentEncoding
+	wc.Metadata = opts.Metadata
+	if opts.SingleRequest {
+		wc.ChunkSize = 0
+	}
+
+	return wc
+}
+
+func (s *gcsStore) Delete(ctx context.Context, bucket, object string, generation int64) error {
+	return s.object(bucket, object, generation).Delete(ctx)
+}
+
+func (s *gcsStore) Attrs(ctx context.Context, bucket, object string, generation int64) (*storage.ObjectAttrs, error) {
+	return s.object(bucket, object, generation).Attrs(ctx)
+}
+
+func (s *gcsStore) Copy(ctx context.Context, bucket, dstObject, srcObject string, generation int64, metadata map[string]string) error {
+	copier := s.client.Bucket(bucket).Object(dstObject).CopierFrom(s.object(bucket, srcObject, generation))
+	copier.Metadata = metadata
+	_, err := copier.Run(ctx)
+
+	return err
+}
+
+func (s *gcsStore) List(ctx context.Context, bucket, prefix string) ([]*storage.ObjectAttrs, error) {
+	var attrs []*storage.ObjectAttrs
+	it := s.client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		a, err := it.Next()
+		if err == iterator.Done {
+			return attrs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, a)
+	}
+}
@@ -0,0 +1,54 @@
+package exporter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+)
+
+func TestDownloadFileIntoMemory(t *testing.T) {
+	store := exportertest.NewStore().Use(t)
+	first := store.Put("bucket", "report.csv", []byte("first version\n"), nil)
+	second := store.Put("bucket", "report.csv", []byte("second version\n"), nil)
+
+	tests := []struct {
+		name       string
+		object     string
+		generation int64
+		want       string
+		wantErr    bool
+	}{
+		{"live generation", "report.csv", 0, "second version\n", false},
+		{"latest generation", "report.csv", second, "second version\n", false},
+		{"overwritten generation", "report.csv", first, "first version\n", false},
+		{"missing object", "missing.csv", 0, "", true},
+		{"missing generation", "report.csv", second + 1, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := exporter.DownloadFileIntoMemory(context.Background(), "bucket", tt.object, tt.generation, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DownloadFileIntoMemory() error = %v, want error %t", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("DownloadFileIntoMemory() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadFileIntoMemoryFailure(t *testing.T) {
+	store := exportertest.NewStore().Use(t)
+	store.Put("bucket", "report.csv", []byte("id,name\n"), nil)
+	store.Fail = func(op, bucket, object string) error {
+		return errors.New("access denied")
+	}
+
+	if _, err := exporter.DownloadFileIntoMemory(context.Background(), "bucket", "report.csv", 0, ""); err == nil {
+		t.Error("DownloadFileIntoMemory() error = nil, want error")
+	}
+}
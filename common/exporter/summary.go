@@ -0,0 +1,107 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// summaryKey carries a Summary receiving the summary of an explicit
+// export, so its caller can report why nothing was exported.
+type summaryKey struct{}
+
+// Summary collects decisions made for an object during an invocation,
+// logged as a single structured line when it ends. The exporters and the
+// rename function share it, so their summaries can be queried alike.
+type Summary struct {
+	kind       string
+	done       string
+	bucket     string
+	object     string
+	matched    bool
+	skipReason string
+	rejection  error
+	start      time.Time
+}
+
+// NewSummary starts the summary of the object. Kind names the summary in
+// the log line, e.g. "Export", and done is the outcome of objects which were
+// neither skipped nor rejected, e.g. "exported".
+func NewSummary(kind, done, bucket, object string) *Summary {
+	return &Summary{kind: kind, done: done, bucket: bucket, object: object, start: time.Now()}
+}
+
+// newExportSummary starts the summary of an exported object.
+func newExportSummary(bucket, object string) *Summary {
+	return NewSummary("Export", "exported", bucket, object)
+}
+
+// Match records the object matched the processed extensions.
+func (s *Summary) Match() {
+	s.matched = true
+}
+
+// Matched reports whether the object matched the processed extensions.
+func (s *Summary) Matched() bool {
+	return s.matched
+}
+
+// Skip records why the object was not processed.
+func (s *Summary) Skip(reason string) {
+	s.skipReason = reason
+}
+
+// Reject records the object was rejected for the cause.
+func (s *Summary) Reject(cause error) {
+	s.rejection = cause
+}
+
+// outcome returns final result of the invocation.
+func (s *Summary) outcome(err error) string {
+	switch {
+	case err != nil:
+		return "failed"
+	case s.rejection != nil:
+		return "rejected"
+	case s.skipReason != "":
+		return "skipped"
+	default:
+		return s.done
+	}
+}
+
+// report copies the summary to the one carried by the context, if any.
+func (s *Summary) report(ctx context.Context) {
+	if out, ok := ctx.Value(summaryKey{}).(*Summary); ok {
+		*out = *s
+	}
+}
+
+// Log emits the summary given the error returned by the invocation.
+func (s *Summary) Log(err error) {
+	cause := ""
+	if err != nil {
+		cause = err.Error()
+	} else if s.rejection != nil {
+		cause = s.rejection.Error()
+	}
+
+	log.Printf("%s summary. bucket=%q object=%q matched=%t skip_reason=%q outcome=%s error=%q error_class=%q duration=%s\n", s.kind, s.bucket, s.object, s.matched, s.skipReason, s.outcome(err), cause, errorClass(err), time.Since(s.start))
+}
+
+// classifiedError is implemented by backend errors which alerting tells
+// apart from other failures, e.g. a destination out of disk space.
+type classifiedError interface {
+	ErrorClass() string
+}
+
+// errorClass returns class of the error reported in export summaries.
+func errorClass(err error) string {
+	var classified classifiedError
+	if errors.As(err, &classified) {
+		return classified.ErrorClass()
+	}
+
+	return ""
+}
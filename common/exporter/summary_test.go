@@ -0,0 +1,97 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// backendFunc is a Backend implemented by a function.
+type backendFunc func(ctx context.Context, x *Export) (Delivery, error)
+
+func (f backendFunc) Accept(ctx context.Context, x *Export) (Delivery, error) {
+	return f(ctx, x)
+}
+
+func TestSummaryLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		decide func(s *Summary)
+		err    error
+		want   []string
+	}{
+		{"exported", func(s *Summary) { s.Match() }, nil, []string{`matched=true`, `skip_reason=""`, `outcome=exported`, `error=""`}},
+		{"skipped", func(s *Summary) { s.Skip("extension") }, nil, []string{`matched=false`, `skip_reason="extension"`, `outcome=skipped`}},
+		{"rejected", func(s *Summary) { s.Match(); s.Reject(errors.New("invalid header")) }, nil, []string{`matched=true`, `outcome=rejected`, `error="invalid header"`}},
+		{"failed", func(s *Summary) { s.Match() }, errors.New("connection refused"), []string{`matched=true`, `outcome=failed`, `error="connection refused"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			defer log.SetOutput(os.Stderr)
+
+			s := NewSummary("Export", "exported", "bucket", "in/report.csv")
+			tt.decide(s)
+			s.Log(tt.err)
+
+			got := logged.String()
+			for _, want := range append(tt.want, `Export summary. bucket="bucket" object="in/report.csv"`) {
+				if !strings.Contains(got, want) {
+					t.Errorf("summary %q doesn't contain %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	defer func(prefixes []string) { IGNORE_PREFIXES = prefixes }(IGNORE_PREFIXES)
+	IGNORE_PREFIXES = []string{"tmp/"}
+
+	exported := backendFunc(func(ctx context.Context, x *Export) (Delivery, error) {
+		x.Match()
+		return func(ctx context.Context) error { return nil }, nil
+	})
+	unmatched := backendFunc(func(ctx context.Context, x *Export) (Delivery, error) {
+		x.Skip("extension")
+		return nil, nil
+	})
+
+	tests := []struct {
+		name        string
+		object      string
+		backend     Backend
+		wantMatched bool
+		wantSkip    string
+		wantOutcome string
+	}{
+		{"matched", "in/report.csv", exported, true, "", "exported"},
+		{"skipped by backend", "in/report.xml", unmatched, false, "extension", "skipped"},
+		{"ignored prefix", "tmp/report.csv", exported, false, "ignored prefix", "skipped"},
+		{"hidden object", "in/report.csv~", exported, false, "hidden", "skipped"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var summary Summary
+			ctx := context.WithValue(context.Background(), summaryKey{}, &summary)
+
+			err := run(ctx, ObjectEvent(t, "bucket", tt.object), tt.backend)
+			if err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			if summary.object != tt.object || summary.matched != tt.wantMatched || summary.skipReason != tt.wantSkip {
+				t.Errorf("summary of %s = matched %t, skip reason %q, want %t, %q", summary.object, summary.matched, summary.skipReason, tt.wantMatched, tt.wantSkip)
+			}
+			if got := summary.outcome(err); got != tt.wantOutcome {
+				t.Errorf("outcome = %q, want %q", got, tt.wantOutcome)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package exporter
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+// Custom metadata "key=value" set on source objects after a successful
+// export, along with "<key>_at" holding the export time, disabled when empty.
+// Tagged objects are skipped when triggered again. The value defaults to
+// "true" when given without "=value".
+var POST_EXPORT_TAG = ""
+
+// exportTag returns key and value of POST_EXPORT_TAG.
+func exportTag() (string, string) {
+	key, value, ok := strings.Cut(POST_EXPORT_TAG, "=")
+	if !ok {
+		value = "true"
+	}
+
+	return key, value
+}
+
+// isTagged reports whether custom metadata carries POST_EXPORT_TAG.
+func isTagged(metadata map[string]string) bool {
+	if POST_EXPORT_TAG == "" {
+		return false
+	}
+
+	key, value := exportTag()
+	return metadata[key] == value
+}
+
+// tagExported marks the given generation of the source object as exported.
+// Failures are logged but never fail the function, as the file was already
+// delivered.
+func tagExported(ctx context.Context, bucket, object string, generation int64) {
+	if POST_EXPORT_TAG == "" {
+		return
+	}
+
+	key, value := exportTag()
+	tag := map[string]string{
+		key:         value,
+		key + "_at": time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := Objects.UpdateMetadata(ctx, bucket, object, generation, tag); err != nil {
+		log.Printf("unable to tag object %s with %s: %v", object, POST_EXPORT_TAG, err)
+		return
+	}
+
+	log.Printf("Object %s tagged with %s", object, POST_EXPORT_TAG)
+}
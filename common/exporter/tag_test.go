@@ -0,0 +1,154 @@
+package exporter_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+)
+
+func TestTransferTagsSource(t *testing.T) {
+	defer func(tag string) { exporter.POST_EXPORT_TAG = tag }(exporter.POST_EXPORT_TAG)
+
+	tests := []struct {
+		name      string
+		tag       string
+		uploader  exporter.Uploader
+		updateErr error
+		want      map[string]string
+		wantErr   bool
+	}{
+		{"key and value", "exported=yes", &captureUploader{}, nil, map[string]string{"owner": "etl", "exported": "yes"}, false},
+		{"key only", "exported", &captureUploader{}, nil, map[string]string{"owner": "etl", "exported": "true"}, false},
+		{"upload failure", "exported", failingUploader{}, nil, map[string]string{"owner": "etl"}, true},
+		{"tag failure", "exported", &captureUploader{}, errors.New("permission denied"), map[string]string{"owner": "etl"}, false},
+		{"disabled", "", &captureUploader{}, nil, map[string]string{"owner": "etl"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter.POST_EXPORT_TAG = tt.tag
+			store := exportertest.NewStore().Use(t)
+			store.Fail = func(op, bucket, name string) error {
+				if op == "UpdateMetadata" {
+					return tt.updateErr
+				}
+				return nil
+			}
+			generation := store.Put("bucket", "report.csv", []byte("id,name\n"), map[string]string{"owner": "etl"})
+			x := exporter.NewExport(&storagedata.StorageObjectData{Bucket: "bucket", Name: "report.csv", Generation: generation, Size: 8})
+			x.Match()
+
+			start := time.Now().UTC().Truncate(time.Second)
+			err := x.Transfer(context.Background(), exporter.Transfer{
+				Name: "report.csv",
+				Open: func(ctx context.Context) (exporter.Uploader, error) {
+					return tt.uploader, nil
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Transfer() error = %v, want error %t", err, tt.wantErr)
+			}
+
+			attrs, err := store.Attrs(context.Background(), "bucket", "report.csv", 0)
+			if err != nil {
+				t.Fatalf("Attrs() error = %v", err)
+			}
+			got := map[string]string{}
+			for key, value := range attrs.Metadata {
+				got[key] = value
+			}
+			if at, ok := got["exported_at"]; ok {
+				exportedAt, err := time.Parse(time.RFC3339, at)
+				if err != nil || exportedAt.Before(start) {
+					t.Errorf("exported_at = %q, want the RFC 3339 time of the export", at)
+				}
+				delete(got, "exported_at")
+			} else if _, tagged := tt.want["exported"]; tagged {
+				t.Errorf("metadata %v has no exported_at", attrs.Metadata)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("metadata = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunSkipsTaggedObjects(t *testing.T) {
+	defer func(tag string) { exporter.POST_EXPORT_TAG = tag }(exporter.POST_EXPORT_TAG)
+	exporter.POST_EXPORT_TAG = "exported=yes"
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     bool
+	}{
+		{"untagged", nil, true},
+		{"tagged", map[string]string{"exported": "yes"}, false},
+		{"other value", map[string]string{"exported": "no"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := exportertest.NewStore().Use(t)
+			generation := store.Put("bucket", "report.csv", []byte("id,name\n"), tt.metadata)
+			up := &fakeUploader{files: map[string]string{}}
+
+			err := exporter.Run(context.Background(), exporter.MetadataEvent(t, "bucket", "report.csv", generation, tt.metadata), transferBackend{up: up})
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if _, ok := up.files["report.csv"]; ok != tt.want {
+				t.Errorf("object with metadata %v exported %t, want %t", tt.metadata, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunSkipsRetriggeredExport(t *testing.T) {
+	defer func(tag string) { exporter.POST_EXPORT_TAG = tag }(exporter.POST_EXPORT_TAG)
+	exporter.POST_EXPORT_TAG = "exported"
+	store := exportertest.NewStore().Use(t)
+	generation := store.Put("bucket", "report.csv", []byte("id,name\n"), nil)
+
+	// The metadata update of the tag triggers the function again.
+	for i, want := range []bool{true, false} {
+		attrs, err := store.Attrs(context.Background(), "bucket", "report.csv", 0)
+		if err != nil {
+			t.Fatalf("Attrs() error = %v", err)
+		}
+		up := &fakeUploader{files: map[string]string{}}
+		if err := exporter.Run(context.Background(), exporter.MetadataEvent(t, "bucket", "report.csv", generation, attrs.Metadata), transferBackend{up: up}); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		if _, ok := up.files["report.csv"]; ok != want {
+			t.Errorf("trigger %d exported %t, want %t", i+1, ok, want)
+		}
+	}
+}
+
+func TestReprocessTaggedObject(t *testing.T) {
+	defer func(tag string) { exporter.POST_EXPORT_TAG = tag }(exporter.POST_EXPORT_TAG)
+	exporter.POST_EXPORT_TAG = "exported"
+	store := exportertest.NewStore().Use(t)
+	store.Put("bucket", "in/report.csv", []byte("id,name\n"), map[string]string{"exported": "true"})
+
+	// Reprocessing is explicit, so tagged objects are exported again.
+	up := &fakeUploader{files: map[string]string{}}
+	w := httptest.NewRecorder()
+	exporter.UseReprocess(t, transferBackend{up: up}, "secret")(w, reprocessRequest(http.MethodPost, "secret", "bucket", "in/report.csv"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("reprocess responded %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if want := map[string]string{"report.csv": "id,name\n"}; !reflect.DeepEqual(up.files, want) {
+		t.Errorf("uploaded %v, want %v", up.files, want)
+	}
+}
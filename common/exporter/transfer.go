@@ -0,0 +1,269 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// Objects larger than STREAM_THRESHOLD_BYTES are streamed to the destination
+// instead of being buffered in memory, 0 buffers all objects. Steps needing
+// the whole content before the upload starts can't be streamed, objects
+// using any of them are rejected, e.g. deduplication.
+var STREAM_THRESHOLD_BYTES int64 = 0
+
+// Uploader delivers exported files to a destination backend.
+type Uploader interface {
+	// Upload stores content read from r under the name.
+	Upload(ctx context.Context, name string, r io.Reader) error
+	// Close releases resources held for the export.
+	Close() error
+}
+
+// Transfer describes delivery of content of the object as a single file.
+type Transfer struct {
+	// Name of the file passed to the uploader.
+	Name string
+	// Location of the delivered file reported in audit records, events,
+	// receipts and markers.
+	Destination string
+	// Open returns the uploader receiving the file.
+	Open func(ctx context.Context) (Uploader, error)
+	// Transform changes buffered content before the upload, nil keeps it.
+	Transform func(ctx context.Context, data []byte) ([]byte, error)
+	// TransformStream changes streamed content before the upload, nil keeps it.
+	// Returned readers implementing io.Closer are closed once the upload ends.
+	TransformStream func(ctx context.Context, r io.Reader) (io.Reader, error)
+	// Content steps of the backend needing the whole content, so objects
+	// using them are rejected instead of being streamed.
+	Unstreamable []string
+	// Delivered is called once the file was delivered and recorded, nil when unused.
+	Delivered func(ctx context.Context)
+}
+
+// SkipError ends a transform of content which is not exported for the reason.
+type SkipError struct {
+	Reason string
+}
+
+func (e *SkipError) Error() string {
+	return "skipped: " + e.Reason
+}
+
+// SkipContent returns error of a transform skipping the export for the reason.
+func SkipContent(reason string) error {
+	return &SkipError{Reason: reason}
+}
+
+// RejectError marks content which must not be exported, before any of it
+// was uploaded.
+type RejectError struct {
+	Cause error
+}
+
+func (e *RejectError) Error() string {
+	return e.Cause.Error()
+}
+
+func (e *RejectError) Unwrap() error {
+	return e.Cause
+}
+
+// RejectContent returns error of a transform rejecting invalid content.
+func RejectContent(cause error) error {
+	return &RejectError{Cause: cause}
+}
+
+// Transfer downloads the object, transforms its content and uploads it as
+// the file of the transfer. Large objects are streamed, the others buffered
+// and deduplicated. Content skipped by a transform ends the transfer without
+// error, rejected content is reported as *RejectError.
+func (x *Export) Transfer(ctx context.Context, t Transfer) error {
+	if ShouldStream(x.Object, x.Metadata.GetSize()) {
+		return x.stream(ctx, t)
+	}
+
+	data, err := DownloadFileIntoMemory(ctx, x.Bucket, x.Object, x.Metadata.GetGeneration(), StoredChecksum(x.Object, x.Metadata.GetMetadata()))
+	if err != nil {
+		return fmt.Errorf("unable download object %s from bucket %s: %v", x.Object, x.Bucket, err)
+	}
+	if t.Transform != nil {
+		data, err = t.Transform(ctx, data)
+		var skipped *SkipError
+		if errors.As(err, &skipped) {
+			x.Skip(skipped.Reason)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Skip content which was recently exported under another name.
+	sum := DataChecksum(data)
+	if DEDUP_WINDOW > 0 && !IsForcedExport(ctx) && recentHashes.seenRecently(sum, time.Now()) {
+		log.Printf("Skipping object %s, identical content %s=%s was exported within %s", x.Object, CHECKSUM_ALGORITHM, sum, DEDUP_WINDOW)
+		x.Skip("duplicate content")
+		return nil
+	}
+
+	if err := upload(ctx, t, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("unable to upload object %s: %w", x.Object, err)
+	}
+	recentHashes.add(sum, time.Now())
+	x.delivered(ctx, t, int64(len(data)), sum)
+
+	return nil
+}
+
+// stream uploads content of the object while it is downloaded.
+func (x *Export) stream(ctx context.Context, t Transfer) error {
+	steps := append([]string(nil), t.Unstreamable...)
+	if DEDUP_WINDOW > 0 && !IsForcedExport(ctx) {
+		steps = append(steps, "deduplication")
+	}
+	if len(steps) > 0 {
+		return RejectContent(fmt.Errorf("object is above STREAM_THRESHOLD_BYTES=%d, where %s can't be applied", STREAM_THRESHOLD_BYTES, strings.Join(steps, ", ")))
+	}
+
+	rc, err := NewRetryReader(ctx, x.Bucket, x.Object, x.Metadata.GetGeneration())
+	if err != nil {
+		return fmt.Errorf("unable to open object %s from bucket %s: %w", x.Object, x.Bucket, err)
+	}
+	defer rc.Close()
+	pipelined := NewPipelinedReader(x.Object, NewVerifiedReader(rc, x.Object, StoredChecksum(x.Object, x.Metadata.GetMetadata())))
+	defer pipelined.Close()
+
+	var content io.Reader = pipelined
+	if t.TransformStream != nil {
+		content, err = t.TransformStream(ctx, content)
+		if err != nil {
+			return err
+		}
+		// Stop transforms still running when the upload ends early.
+		if c, ok := content.(io.Closer); ok {
+			defer c.Close()
+		}
+	}
+
+	// Compute checksum within the same pass over the data.
+	digest := newStreamDigest()
+	if err := upload(ctx, t, io.TeeReader(content, digest)); err != nil {
+		return fmt.Errorf("unable to upload object %s: %w", x.Object, err)
+	}
+	sum := digest.checksum()
+	log.Printf("Blob %v streamed. object=%q %s=%s\n", x.Object, x.Object, CHECKSUM_ALGORITHM, sum)
+	x.delivered(ctx, t, digest.size, sum)
+
+	return nil
+}
+
+// upload opens uploader of the transfer and uploads the content.
+func upload(ctx context.Context, t Transfer, r io.Reader) error {
+	up, err := t.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer up.Close()
+
+	return up.Upload(ctx, t.Name, r)
+}
+
+// delivered records the file delivered by the transfer.
+func (x *Export) delivered(ctx context.Context, t Transfer, size int64, sum string) {
+	x.Delivered(ctx, t.Destination, size, sum)
+	if t.Delivered != nil {
+		t.Delivered(ctx)
+	}
+}
+
+// ShouldStream reports whether an object of the size is streamed, logging
+// which path is taken.
+func ShouldStream(object string, size int64) bool {
+	if STREAM_THRESHOLD_BYTES > 0 && size > STREAM_THRESHOLD_BYTES {
+		log.Printf("Streaming object %s of %d bytes, above STREAM_THRESHOLD_BYTES=%d", object, size, STREAM_THRESHOLD_BYTES)
+		return true
+	}
+
+	log.Printf("Buffering object %s of %d bytes in memory", object, size)
+	return false
+}
+
+// streamDigest computes size and checksum of streamed content.
+type streamDigest struct {
+	size int64
+	hash hash.Hash
+}
+
+func newStreamDigest() *streamDigest {
+	return &streamDigest{hash: NewChecksumHash()}
+}
+
+func (d *streamDigest) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	return d.hash.Write(p)
+}
+
+// checksum returns hex encoded checksum of the content written so far.
+func (d *streamDigest) checksum() string {
+	return fmt.Sprintf("%x", d.hash.Sum(nil))
+}
+
+// DownloadFileIntoMemory downloads the given generation of an object,
+// verifying its content against the expected checksum when given.
+func DownloadFileIntoMemory(ctx context.Context, bucket, object string, generation int64, expected string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*50)
+	defer cancel()
+
+	// Reopen the object at the last offset on transient read errors.
+	rc, err := NewRetryReader(ctx, bucket, object, generation)
+	if err != nil {
+		return nil, fmt.Errorf("Object(%q).NewRangeReader: %w", object, err)
+	}
+	defer rc.Close()
+
+	// Compute checksum within the same pass over the data.
+	h := NewChecksumHash()
+	data, err := io.ReadAll(io.TeeReader(NewVerifiedReader(rc, object, expected), h))
+	if err != nil {
+		return nil, fmt.Errorf("ioutil.ReadAll: %w", err)
+	}
+	log.Printf("Blob %v downloaded. object=%q %s=%x\n", object, object, CHECKSUM_ALGORITHM, h.Sum(nil))
+
+	return data, nil
+}
+
+// ReaderSize returns size of the content when known from the reader, or -1.
+func ReaderSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case *bytes.Reader:
+		return int64(r.Len())
+	case *bytes.Buffer:
+		return int64(r.Len())
+	}
+
+	return -1
+}
+
+// CleanRelativePath cleans a destination file path relative to the
+// destination root, rejecting absolute paths and paths which resolve
+// outside of the root (e.g. "../secret" or "a/../../secret").
+func CleanRelativePath(name string) (string, error) {
+	if path.IsAbs(name) {
+		return "", fmt.Errorf("absolute path %q is not allowed", name)
+	}
+
+	cleaned := path.Clean(name)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("path %q escapes destination folder", name)
+	}
+
+	return cleaned, nil
+}
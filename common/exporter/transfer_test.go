@@ -0,0 +1,57 @@
+package exporter
+
+import "testing"
+
+func TestCleanRelativePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"report.csv", "report.csv", false},
+		{"out/daily/report.csv", "out/daily/report.csv", false},
+		{"out//./daily/report.csv", "out/daily/report.csv", false},
+		{"out/../report.csv", "report.csv", false},
+		{"..report.csv", "..report.csv", false},
+		{"../secret", "", true},
+		{"out/../../secret", "", true},
+		{"/etc/passwd", "", true},
+		{"..", "", true},
+		{".", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := CleanRelativePath(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CleanRelativePath(%q) error = %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("CleanRelativePath(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShouldStream(t *testing.T) {
+	defer func(threshold int64) { STREAM_THRESHOLD_BYTES = threshold }(STREAM_THRESHOLD_BYTES)
+
+	tests := []struct {
+		threshold int64
+		size      int64
+		want      bool
+	}{
+		{0, 1 << 30, false},
+		{100, 0, false},
+		{100, 99, false},
+		{100, 100, false},
+		{100, 101, true},
+	}
+
+	for _, tt := range tests {
+		STREAM_THRESHOLD_BYTES = tt.threshold
+		if got := ShouldStream("report.csv", tt.size); got != tt.want {
+			t.Errorf("ShouldStream() of %d bytes with threshold %d = %t, want %t", tt.size, tt.threshold, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package exporter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+)
+
+// fakeUploader keeps the uploaded files by name.
+type fakeUploader struct {
+	files  map[string]string
+	closed int
+}
+
+func (u *fakeUploader) Upload(ctx context.Context, name string, r io.Reader) error {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return err
+	}
+	u.files[name] = buf.String()
+
+	return nil
+}
+
+func (u *fakeUploader) Close() error {
+	u.closed++
+	return nil
+}
+
+// transferBackend delivers accepted objects with the transfer to the
+// uploader, under the base name of the object.
+type transferBackend struct {
+	skip      bool
+	transform func(ctx context.Context, data []byte) ([]byte, error)
+	openErr   error
+	up        *fakeUploader
+}
+
+func (b transferBackend) Accept(ctx context.Context, x *exporter.Export) (exporter.Delivery, error) {
+	if b.skip {
+		x.Skip("backend")
+		return nil, nil
+	}
+	x.Match()
+
+	return func(ctx context.Context) error {
+		return x.Transfer(ctx, exporter.Transfer{
+			Name:        x.Object[strings.LastIndex(x.Object, "/")+1:],
+			Destination: "fake://" + x.Object,
+			Open: func(ctx context.Context) (exporter.Uploader, error) {
+				if b.openErr != nil {
+					return nil, b.openErr
+				}
+				return b.up, nil
+			},
+			Transform: b.transform,
+		})
+	}, nil
+}
+
+func TestRunUploadsThroughBackend(t *testing.T) {
+	defer func(buckets, prefixes, extensions []string) {
+		exporter.ALLOWED_BUCKETS, exporter.IGNORE_PREFIXES, exporter.BLOCKED_EXTENSIONS = buckets, prefixes, extensions
+	}(exporter.ALLOWED_BUCKETS, exporter.IGNORE_PREFIXES, exporter.BLOCKED_EXTENSIONS)
+	exporter.ALLOWED_BUCKETS, exporter.IGNORE_PREFIXES, exporter.BLOCKED_EXTENSIONS = []string{"bucket"}, []string{"tmp/"}, []string{".exe"}
+
+	upper := func(ctx context.Context, data []byte) ([]byte, error) { return bytes.ToUpper(data), nil }
+	skip := func(ctx context.Context, data []byte) ([]byte, error) { return nil, exporter.SkipContent("unchanged") }
+	reject := func(ctx context.Context, data []byte) ([]byte, error) {
+		return nil, exporter.RejectContent(errors.New("invalid header"))
+	}
+
+	tests := []struct {
+		name       string
+		bucket     string
+		object     string
+		backend    transferBackend
+		want       map[string]string
+		wantClosed int
+		wantErr    bool
+	}{
+		{"exported", "bucket", "in/report.csv", transferBackend{}, map[string]string{"report.csv": "id,name\n"}, 1, false},
+		{"transformed", "bucket", "in/report.csv", transferBackend{transform: upper}, map[string]string{"report.csv": "ID,NAME\n"}, 1, false},
+		{"other bucket", "other", "in/report.csv", transferBackend{}, map[string]string{}, 0, false},
+		{"ignored prefix", "bucket", "tmp/report.csv", transferBackend{}, map[string]string{}, 0, false},
+		{"blocked extension", "bucket", "in/setup.exe", transferBackend{}, map[string]string{}, 0, false},
+		{"hidden object", "bucket", "in/.report.csv", transferBackend{}, map[string]string{}, 0, false},
+		{"skipped by backend", "bucket", "in/report.csv", transferBackend{skip: true}, map[string]string{}, 0, false},
+		{"skipped by transform", "bucket", "in/report.csv", transferBackend{transform: skip}, map[string]string{}, 0, false},
+		{"rejected by transform", "bucket", "in/report.csv", transferBackend{transform: reject}, map[string]string{}, 0, true},
+		{"uploader unavailable", "bucket", "in/report.csv", transferBackend{openErr: errors.New("connection refused")}, map[string]string{}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := exportertest.NewStore().Use(t)
+			store.Put(tt.bucket, tt.object, []byte("id,name\n"), nil)
+			up := &fakeUploader{files: map[string]string{}}
+			tt.backend.up = up
+
+			err := exporter.Run(context.Background(), exporter.ObjectEvent(t, tt.bucket, tt.object), tt.backend)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(up.files, tt.want) {
+				t.Errorf("uploaded %q, want %q", up.files, tt.want)
+			}
+			if up.closed != tt.wantClosed {
+				t.Errorf("uploader closed %d times, want %d", up.closed, tt.wantClosed)
+			}
+		})
+	}
+}
+
+func TestTransferUnstreamable(t *testing.T) {
+	defer func(threshold int64) { exporter.STREAM_THRESHOLD_BYTES = threshold }(exporter.STREAM_THRESHOLD_BYTES)
+	exporter.STREAM_THRESHOLD_BYTES = 8
+
+	tests := []struct {
+		name         string
+		content      string
+		unstreamable []string
+		dedup        time.Duration
+		wantReject   bool
+	}{
+		{"buffered", "id,name\n", []string{"trailer"}, time.Hour, false},
+		{"streamed", "id,name\n1\n", nil, 0, false},
+		{"streamed with unstreamable step", "id,name\n1\n", []string{"trailer"}, 0, true},
+		{"streamed with deduplication", "id,name\n1\n", nil, time.Hour, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter.UseDedup(t, tt.dedup, 10)
+			store := exportertest.NewStore().Use(t)
+			generation := store.Put("bucket", "report.csv", []byte(tt.content), nil)
+			x := exporter.NewExport(&storagedata.StorageObjectData{Bucket: "bucket", Name: "report.csv", Generation: generation, Size: int64(len(tt.content))})
+			x.Match()
+
+			up := &fakeUploader{files: map[string]string{}}
+			err := x.Transfer(context.Background(), exporter.Transfer{
+				Name:         "report.csv",
+				Open:         func(ctx context.Context) (exporter.Uploader, error) { return up, nil },
+				Unstreamable: tt.unstreamable,
+			})
+			var rejection *exporter.RejectError
+			if errors.As(err, &rejection) != tt.wantReject {
+				t.Fatalf("Transfer() error = %v, want rejection %t", err, tt.wantReject)
+			}
+			want := map[string]string{"report.csv": tt.content}
+			if tt.wantReject {
+				want = map[string]string{}
+			}
+			if !reflect.DeepEqual(up.files, want) {
+				t.Errorf("uploaded %q, want %q", up.files, want)
+			}
+		})
+	}
+}
+
+func TestRunSkipsHiddenObjects(t *testing.T) {
+	defer func(skip bool) { exporter.SKIP_HIDDEN_OBJECTS = skip }(exporter.SKIP_HIDDEN_OBJECTS)
+
+	tests := []struct {
+		skip   bool
+		object string
+		want   bool
+	}{
+		{true, "in/report.csv", true},
+		{true, "in/.~lock.report.csv#", false},
+		{true, "in/report.csv~", false},
+		{false, "in/.~lock.report.csv#", true},
+		{false, "in/report.csv~", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.FormatBool(tt.skip)+" "+tt.object, func(t *testing.T) {
+			exporter.SKIP_HIDDEN_OBJECTS = tt.skip
+			store := exportertest.NewStore().Use(t)
+			store.Put("bucket", tt.object, []byte("id,name\n"), nil)
+			up := &fakeUploader{files: map[string]string{}}
+
+			if err := exporter.Run(context.Background(), exporter.ObjectEvent(t, "bucket", tt.object), transferBackend{up: up}); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if exported := len(up.files) == 1; exported != tt.want {
+				t.Errorf("%s exported = %t with SKIP_HIDDEN_OBJECTS=%t, want %t", tt.object, exported, tt.skip, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransferPipelined(t *testing.T) {
+	defer func(threshold int64, chunks int) {
+		exporter.STREAM_THRESHOLD_BYTES, exporter.PIPELINE_CHUNKS = threshold, chunks
+	}(exporter.STREAM_THRESHOLD_BYTES, exporter.PIPELINE_CHUNKS)
+	exporter.STREAM_THRESHOLD_BYTES, exporter.PIPELINE_CHUNKS = 8, 2
+
+	content := strings.Repeat("1,alice\n", 100000)
+	tests := []struct {
+		name     string
+		uploader exporter.Uploader
+		wantErr  bool
+	}{
+		{"transferred", &fakeUploader{files: map[string]string{}}, false},
+		{"upload error", failingUploader{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := exportertest.NewStore().Use(t)
+			generation := store.Put("bucket", "report.csv", []byte(content), nil)
+			x := exporter.NewExport(&storagedata.StorageObjectData{Bucket: "bucket", Name: "report.csv", Generation: generation, Size: int64(len(content))})
+			x.Match()
+
+			err := x.Transfer(context.Background(), exporter.Transfer{
+				Name: "report.csv",
+				Open: func(ctx context.Context) (exporter.Uploader, error) { return tt.uploader, nil },
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Transfer() error = %v, want error %t", err, tt.wantErr)
+			}
+			if up, ok := tt.uploader.(*fakeUploader); ok && up.files["report.csv"] != content {
+				t.Errorf("uploaded %d bytes, want %d", len(up.files["report.csv"]), len(content))
+			}
+		})
+	}
+}
+
+func TestRunBlockedExtensions(t *testing.T) {
+	defer func(blocked []string) { exporter.BLOCKED_EXTENSIONS = blocked }(exporter.BLOCKED_EXTENSIONS)
+	exporter.BLOCKED_EXTENSIONS = []string{".sh", ".exe"}
+
+	tests := []struct {
+		object string
+		want   bool
+	}{
+		{"in/report.csv", true},
+		{"in/deploy.sh", false},
+		{"in/DEPLOY.SH", false},
+		{"in/setup.exe", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.object, func(t *testing.T) {
+			store := exportertest.NewStore().Use(t)
+			store.Put("bucket", tt.object, []byte("id,name\n"), nil)
+			up := &fakeUploader{files: map[string]string{}}
+
+			// The backend accepts every object, blocked ones never reach it
+			if err := exporter.Run(context.Background(), exporter.ObjectEvent(t, "bucket", tt.object), transferBackend{up: up}); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if exported := len(up.files) == 1; exported != tt.want {
+				t.Errorf("%s exported = %t, want %t", tt.object, exported, tt.want)
+			}
+		})
+	}
+}
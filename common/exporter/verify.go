@@ -0,0 +1,69 @@
+package exporter
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"strings"
+)
+
+var (
+	// Custom metadata key holding hex encoded checksum of the object computed
+	// by the uploader, content is verified against it when set.
+	CHECKSUM_METADATA_KEY = ""
+	// Algorithm of the checksum stored under CHECKSUM_METADATA_KEY.
+	CHECKSUM_METADATA_ALGORITHM = "sha256"
+)
+
+// StoredChecksum returns checksum stored in custom metadata of the object,
+// or an empty string when verification is disabled or no checksum is stored.
+func StoredChecksum(object string, metadata map[string]string) string {
+	if CHECKSUM_METADATA_KEY == "" {
+		return ""
+	}
+
+	sum := strings.ToLower(strings.TrimSpace(metadata[CHECKSUM_METADATA_KEY]))
+	if sum == "" {
+		log.Printf("Object %s has no %s metadata, content is not verified", object, CHECKSUM_METADATA_KEY)
+	}
+
+	return sum
+}
+
+// verifiedReader computes checksum of the content while it is read and
+// fails the read at the end of content when it doesn't match the expected
+// one, so corrupted content is never completed at the destination.
+type verifiedReader struct {
+	r        io.Reader
+	object   string
+	expected string
+	hash     hash.Hash
+}
+
+// NewVerifiedReader returns reader verifying content against the expected
+// checksum, or the reader as is when no checksum is expected.
+func NewVerifiedReader(r io.Reader, object, expected string) io.Reader {
+	if expected == "" {
+		return r
+	}
+
+	return &verifiedReader{r: r, object: object, expected: expected, hash: ChecksumAlgorithms[CHECKSUM_METADATA_ALGORITHM]()}
+}
+
+func (v *verifiedReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+
+	actual := hex.EncodeToString(v.hash.Sum(nil))
+	if actual != v.expected {
+		return n, fmt.Errorf("checksum mismatch for object %s: %s metadata is %s, downloaded content has %s", v.object, CHECKSUM_METADATA_ALGORITHM, v.expected, actual)
+	}
+	log.Printf("Object %s verified against %s metadata. %s=%s", v.object, CHECKSUM_METADATA_KEY, CHECKSUM_METADATA_ALGORITHM, actual)
+
+	return n, io.EOF
+}
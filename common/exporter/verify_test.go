@@ -0,0 +1,130 @@
+package exporter_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+)
+
+// Checksums of "id,name\n".
+const (
+	contentSHA256 = "40d6bfdc74eae2ed68a97137ce414fa4ca6de1b3831cfd9a73c4622d8a8942c1"
+	contentMD5    = "fc1cb85445a6b6c5383b9f16af5ac890"
+)
+
+func TestStoredChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		metadata map[string]string
+		want     string
+	}{
+		{"disabled", "", map[string]string{"sha256": contentSHA256}, ""},
+		{"stored", "sha256", map[string]string{"sha256": contentSHA256}, contentSHA256},
+		{"upper case with spaces", "sha256", map[string]string{"sha256": " " + strings.ToUpper(contentSHA256) + "\n"}, contentSHA256},
+		{"missing", "sha256", map[string]string{"md5": contentMD5}, ""},
+		{"no metadata", "sha256", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(key string) { exporter.CHECKSUM_METADATA_KEY = key }(exporter.CHECKSUM_METADATA_KEY)
+			exporter.CHECKSUM_METADATA_KEY = tt.key
+
+			if got := exporter.StoredChecksum("report.csv", tt.metadata); got != tt.want {
+				t.Errorf("StoredChecksum(%v) = %q, want %q", tt.metadata, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewVerifiedReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		expected  string
+		wantErr   bool
+	}{
+		{"matching sha256", "sha256", contentSHA256, false},
+		{"matching md5", "md5", contentMD5, false},
+		{"mismatching", "sha256", strings.Repeat("0", 64), true},
+		{"other algorithm", "md5", contentSHA256, true},
+		{"not verified", "sha256", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(algorithm string) { exporter.CHECKSUM_METADATA_ALGORITHM = algorithm }(exporter.CHECKSUM_METADATA_ALGORITHM)
+			exporter.CHECKSUM_METADATA_ALGORITHM = tt.algorithm
+
+			got, err := io.ReadAll(exporter.NewVerifiedReader(strings.NewReader("id,name\n"), "report.csv", tt.expected))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("read error = %v, want error %t", err, tt.wantErr)
+			}
+			if string(got) != "id,name\n" {
+				t.Errorf("read %q, want the content as is", got)
+			}
+		})
+	}
+}
+
+func TestTransferVerifiesChecksum(t *testing.T) {
+	defer func(key string) { exporter.CHECKSUM_METADATA_KEY = key }(exporter.CHECKSUM_METADATA_KEY)
+	exporter.CHECKSUM_METADATA_KEY = "sha256"
+
+	tests := []struct {
+		name      string
+		threshold int64
+		checksum  string
+		wantErr   bool
+	}{
+		{"buffered matching", 0, contentSHA256, false},
+		{"buffered mismatching", 0, strings.Repeat("0", 64), true},
+		{"buffered without checksum", 0, "", false},
+		{"streamed matching", 1, contentSHA256, false},
+		{"streamed mismatching", 1, strings.Repeat("0", 64), true},
+		{"streamed without checksum", 1, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(threshold int64) { exporter.STREAM_THRESHOLD_BYTES = threshold }(exporter.STREAM_THRESHOLD_BYTES)
+			exporter.STREAM_THRESHOLD_BYTES = tt.threshold
+			metadata := map[string]string{}
+			if tt.checksum != "" {
+				metadata["sha256"] = tt.checksum
+			}
+
+			store := exportertest.NewStore().Use(t)
+			generation := store.Put("bucket", "report.csv", []byte("id,name\n"), metadata)
+			x := exporter.NewExport(&storagedata.StorageObjectData{Bucket: "bucket", Name: "report.csv", Generation: generation, Size: 8, Metadata: metadata})
+			x.Match()
+
+			up := &captureUploader{}
+			err := x.Transfer(context.Background(), exporter.Transfer{
+				Name: "report.csv",
+				Open: func(ctx context.Context) (exporter.Uploader, error) {
+					return up, nil
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Transfer() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "checksum mismatch") {
+				t.Errorf("Transfer() error = %v, want the checksum mismatch reported", err)
+			}
+			// Buffered content is verified before any of it is uploaded.
+			if tt.wantErr && tt.threshold == 0 && up.content.Len() != 0 {
+				t.Errorf("uploaded %q of corrupted content, want none", up.content.String())
+			}
+			if !tt.wantErr && up.content.String() != "id,name\n" {
+				t.Errorf("uploaded %q, want %q", up.content.String(), "id,name\n")
+			}
+		})
+	}
+}
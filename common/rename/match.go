@@ -0,0 +1,44 @@
+package rename
+
+import "strings"
+
+// HasSuffixFold reports whether s ends with suffix, ignoring case when
+// CASE_INSENSITIVE_MATCH is set.
+func HasSuffixFold(s, suffix string) bool {
+	if !CASE_INSENSITIVE_MATCH {
+		return strings.HasSuffix(s, suffix)
+	}
+
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+// TrimSuffixFold returns s without the suffix matched by HasSuffixFold.
+func TrimSuffixFold(s, suffix string) string {
+	if HasSuffixFold(s, suffix) {
+		return s[:len(s)-len(suffix)]
+	}
+
+	return s
+}
+
+// IsSeparator reports whether the character is one of RENAME_SEPARATORS,
+// ignoring case when CASE_INSENSITIVE_MATCH is set.
+func IsSeparator(c rune) bool {
+	for _, sep := range RENAME_SEPARATORS {
+		if c == sep || CASE_INSENSITIVE_MATCH && strings.EqualFold(string(c), string(sep)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IndexSeparator returns index of the first separator in s, or -1.
+func IndexSeparator(s string) int {
+	return strings.IndexFunc(s, IsSeparator)
+}
+
+// ContainsSeparator reports whether s contains any separator.
+func ContainsSeparator(s string) bool {
+	return IndexSeparator(s) >= 0
+}
@@ -0,0 +1,97 @@
+package rename
+
+import "testing"
+
+func TestHasSuffixFold(t *testing.T) {
+	tests := []struct {
+		insensitive bool
+		s           string
+		suffix      string
+		want        bool
+		wantTrimmed string
+	}{
+		{false, "report.csv", ".csv", true, "report"},
+		{false, "report.CSV", ".csv", false, "report.CSV"},
+		{true, "report.CSV", ".csv", true, "report"},
+		{true, "report.Csv.GZ", ".gz", true, "report.Csv"},
+		{true, "report.txt", ".csv", false, "report.txt"},
+		{true, "csv", ".csv", false, "csv"},
+	}
+
+	defer func(insensitive bool) { CASE_INSENSITIVE_MATCH = insensitive }(CASE_INSENSITIVE_MATCH)
+	for _, tt := range tests {
+		CASE_INSENSITIVE_MATCH = tt.insensitive
+
+		if got := HasSuffixFold(tt.s, tt.suffix); got != tt.want {
+			t.Errorf("HasSuffixFold(%q, %q) with CASE_INSENSITIVE_MATCH %t = %t, want %t", tt.s, tt.suffix, tt.insensitive, got, tt.want)
+		}
+		if got := TrimSuffixFold(tt.s, tt.suffix); got != tt.wantTrimmed {
+			t.Errorf("TrimSuffixFold(%q, %q) with CASE_INSENSITIVE_MATCH %t = %q, want %q", tt.s, tt.suffix, tt.insensitive, got, tt.wantTrimmed)
+		}
+	}
+}
+
+func TestIndexSeparator(t *testing.T) {
+	defer func(separators string, insensitive bool) {
+		RENAME_SEPARATORS, CASE_INSENSITIVE_MATCH = separators, insensitive
+	}(RENAME_SEPARATORS, CASE_INSENSITIVE_MATCH)
+	RENAME_SEPARATORS = "|x"
+
+	tests := []struct {
+		insensitive bool
+		name        string
+		want        int
+	}{
+		{false, "report|20230801.csv", 6},
+		{false, "reportx20230801.csv", 6},
+		{false, "reportX20230801.csv", -1},
+		{true, "reportX20230801.csv", 6},
+		{true, "report.csv", -1},
+	}
+
+	for _, tt := range tests {
+		CASE_INSENSITIVE_MATCH = tt.insensitive
+		if got := IndexSeparator(tt.name); got != tt.want {
+			t.Errorf("IndexSeparator(%q) with CASE_INSENSITIVE_MATCH %t = %d, want %d", tt.name, tt.insensitive, got, tt.want)
+		}
+		if got := ContainsSeparator(tt.name); got != (tt.want >= 0) {
+			t.Errorf("ContainsSeparator(%q) with CASE_INSENSITIVE_MATCH %t = %t, want %t", tt.name, tt.insensitive, got, tt.want >= 0)
+		}
+	}
+}
+
+func TestCaseInsensitiveMatch(t *testing.T) {
+	tests := []struct {
+		insensitive bool
+		src         string
+		wantMatch   bool
+		want        string
+	}{
+		{false, "in/report|20230801.CSV", false, ""},
+		{true, "in/report|20230801.CSV", true, "in/report.csv"},
+		{true, "in/report.CSV|20230801", false, ""},
+		{true, "in/report|20230801.CSV.GZ", true, "in/report.csv"},
+		{true, "in/report.Csv.Gz|20230801", true, "in/report.Csv"},
+		{true, "in/report|20230801.txt", false, ""},
+	}
+
+	defer func(insensitive bool) { CASE_INSENSITIVE_MATCH = insensitive }(CASE_INSENSITIVE_MATCH)
+	for _, tt := range tests {
+		CASE_INSENSITIVE_MATCH = tt.insensitive
+
+		if got := MatchesExtension(tt.src, ".csv"); got != tt.wantMatch {
+			t.Errorf("MatchesExtension(%q, .csv) with CASE_INSENSITIVE_MATCH %t = %t, want %t", tt.src, tt.insensitive, got, tt.wantMatch)
+		}
+		if !tt.wantMatch {
+			continue
+		}
+		got, err := SetDestFileName(tt.src, ".csv")
+		if err != nil {
+			t.Errorf("SetDestFileName(%q) error = %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("SetDestFileName(%q) with CASE_INSENSITIVE_MATCH %t = %q, want %q", tt.src, tt.insensitive, got, tt.want)
+		}
+	}
+}
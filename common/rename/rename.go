@@ -0,0 +1,211 @@
+// Package rename provides the renaming and content transforms of objects
+// with separated metadata in their names, e.g. "report|20230801.csv". It is
+// shared by the rename function and exporters renaming objects inline.
+package rename
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Extension of gzip compressed objects, which are decompressed while processing.
+	GzipExtension = ".gz"
+	// Ordered list of content transforms applied to processed objects.
+	TRANSFORMS = []string{"tilde-to-comma", "collapse-quotes"}
+	// Pipelines replacing TRANSFORMS for objects with the extension.
+	TRANSFORM_PROFILES = map[string][]string{}
+	// Characters separating meaningful part of object name from metadata.
+	RENAME_SEPARATORS = "|"
+	// Delimiters used by the csv-delimiter transform.
+	SRC_DELIMITER = ','
+	DST_DELIMITER = ','
+	// Quoting of fields written by the csv-requote transform: minimal or always.
+	CSV_QUOTING = "minimal"
+	// Template of destination names referencing separated fields of source
+	// names by 1-based index, e.g. "{2}/{3}" for "custid|region|report.csv".
+	RENAME_TEMPLATE = ""
+	// Extension replacing the source extension on destination names, kept when empty.
+	OUTPUT_EXTENSION = ""
+	// Match extensions and separators ignoring case.
+	CASE_INSENSITIVE_MATCH = false
+	// Translate maps the meaningful part of a name to the destination name,
+	// e.g. an internal code to the partner's filename. Unused when nil.
+	Translate func(name string) (string, error)
+)
+
+// Init reads the rename and transform configuration from environment
+// variables, failing on invalid values.
+func Init() {
+	// Declare a separate err variable to avoid shadowing the package variables.
+	var err error
+
+	// Get transform pipeline from environment variable.
+	if os.Getenv("TRANSFORMS") != "" {
+		TRANSFORMS = strings.Split(os.Getenv("TRANSFORMS"), ",")
+		for i, name := range TRANSFORMS {
+			TRANSFORMS[i] = strings.TrimSpace(name)
+			if _, ok := transforms[TRANSFORMS[i]]; !ok {
+				log.Fatalf("unknown transform in TRANSFORMS: %q", name)
+			}
+		}
+	}
+
+	// Get per-extension transform pipelines from environment variable.
+	if os.Getenv("TRANSFORM_PROFILES") != "" {
+		TRANSFORM_PROFILES, err = parseTransformProfiles(os.Getenv("TRANSFORM_PROFILES"))
+		if err != nil {
+			log.Fatalf("invalid TRANSFORM_PROFILES: %v", err)
+		}
+	}
+
+	// Get object name separators from environment variable.
+	if os.Getenv("RENAME_SEPARATORS") != "" {
+		RENAME_SEPARATORS = os.Getenv("RENAME_SEPARATORS")
+	}
+
+	// Get CSV delimiters for the csv-delimiter transform from environment variables.
+	if os.Getenv("SRC_DELIMITER") != "" {
+		SRC_DELIMITER, err = parseDelimiter(os.Getenv("SRC_DELIMITER"))
+		if err != nil {
+			log.Fatalf("invalid SRC_DELIMITER: %v", err)
+		}
+	}
+	if os.Getenv("DST_DELIMITER") != "" {
+		DST_DELIMITER, err = parseDelimiter(os.Getenv("DST_DELIMITER"))
+		if err != nil {
+			log.Fatalf("invalid DST_DELIMITER: %v", err)
+		}
+	}
+
+	// Get quoting of re-encoded CSV fields from environment variable.
+	if os.Getenv("CSV_QUOTING") != "" {
+		CSV_QUOTING = os.Getenv("CSV_QUOTING")
+		if !validCSVQuoting(CSV_QUOTING) {
+			log.Fatalf("invalid CSV_QUOTING: %q", CSV_QUOTING)
+		}
+	}
+
+	// Get destination name template from environment variable.
+	if os.Getenv("RENAME_TEMPLATE") != "" {
+		RENAME_TEMPLATE = os.Getenv("RENAME_TEMPLATE")
+		if !templateField.MatchString(RENAME_TEMPLATE) {
+			log.Fatalf("invalid RENAME_TEMPLATE: %q references no fields", RENAME_TEMPLATE)
+		}
+	}
+
+	// Get destination extension override from environment variable.
+	if os.Getenv("OUTPUT_EXTENSION") != "" {
+		OUTPUT_EXTENSION = os.Getenv("OUTPUT_EXTENSION")
+		if !strings.HasPrefix(OUTPUT_EXTENSION, ".") {
+			log.Fatalf("invalid OUTPUT_EXTENSION: %q must start with a dot", OUTPUT_EXTENSION)
+		}
+	}
+
+	// Get case-insensitive matching of extensions and separators from environment variable.
+	if os.Getenv("CASE_INSENSITIVE_MATCH") != "" {
+		CASE_INSENSITIVE_MATCH, err = strconv.ParseBool(os.Getenv("CASE_INSENSITIVE_MATCH"))
+		if err != nil {
+			log.Fatalf("invalid CASE_INSENSITIVE_MATCH: %v", err)
+		}
+	}
+}
+
+// MatchesExtension reports whether an object name carries the extension,
+// optionally followed by the gzip extension. Compressed objects may carry
+// it before the separator as well, e.g. "name.csv.gz|meta".
+func MatchesExtension(objectName, extension string) bool {
+	if HasSuffixFold(objectName, extension) || HasSuffixFold(objectName, extension+GzipExtension) {
+		return true
+	}
+
+	dstName := CutSeparator(path.Base(objectName))
+	return HasSuffixFold(dstName, extension+GzipExtension)
+}
+
+// CutSeparator returns part of the name before the earliest occurrence
+// of any of RENAME_SEPARATORS, or the whole name when none is present.
+func CutSeparator(name string) string {
+	if i := IndexSeparator(name); i >= 0 {
+		return name[:i]
+	}
+
+	return name
+}
+
+// IsGzipped reports whether an object name denotes gzip compressed content.
+func IsGzipped(objectName string) bool {
+	dstName := CutSeparator(path.Base(objectName))
+	return HasSuffixFold(objectName, GzipExtension) || HasSuffixFold(dstName, GzipExtension)
+}
+
+// OutputExtension returns extension of destination objects for sources
+// with the extension, which is OUTPUT_EXTENSION when configured.
+func OutputExtension(extension string) string {
+	if OUTPUT_EXTENSION != "" {
+		return OUTPUT_EXTENSION
+	}
+
+	return extension
+}
+
+// SetDestFileName performs operations under existing GCS Object name to
+// define new, destination Object name
+func SetDestFileName(srcObjectName, extension string) (string, error) {
+	fileName := regexp.MustCompile(`.*\/`).ReplaceAllString(srcObjectName, "")
+	log.Printf("Filename without path is %s \n", fileName)
+
+	// // Define which exactly prefixes should be replaced
+	// var prefixes = [2]string{"66000_", "69000_"}
+
+	// // Removing leading prefixes from file name
+	// for _, prefix := range prefixes {
+	// 	if strings.HasPrefix(fileName, prefix) {
+	// 		dstName = strings.TrimPrefix(fileName, prefix)
+	// 	} else {
+	// 		dstName = fileName
+	// 	}
+	// }
+
+	// Cut meaningful part of object name (before separator), or build it
+	// from the separated fields when a template is configured
+	dstName := CutSeparator(fileName)
+	if RENAME_TEMPLATE != "" {
+		var err error
+		dstName, err = applyRenameTemplate(fileName)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Translate internal code to the partner's filename
+	if Translate != nil {
+		var err error
+		dstName, err = Translate(dstName)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Content is stored decompressed, so drop the gzip extension
+	dstName = TrimSuffixFold(dstName, GzipExtension)
+
+	// Replace source extension when it is overridden
+	if OUTPUT_EXTENSION != "" {
+		dstName = TrimSuffixFold(dstName, extension)
+	}
+
+	// Add extension to new object name if needed
+	if !HasSuffixFold(dstName, OutputExtension(extension)) {
+		dstName = fmt.Sprintf("%s%s", dstName, OutputExtension(extension))
+	}
+
+	dstObjectName := strings.Replace(srcObjectName, fileName, dstName, 1)
+
+	return dstObjectName, nil
+}
@@ -0,0 +1,166 @@
+package rename
+
+import "testing"
+
+func TestSetDestFileName(t *testing.T) {
+	tests := []struct {
+		src       string
+		extension string
+		want      string
+	}{
+		{"report|20230801.csv", ".csv", "report.csv"},
+		{"in/report|20230801.csv", ".csv", "in/report.csv"},
+		{"report.csv|20230801", ".csv", "report.csv"},
+		{"report.csv", ".csv", "report.csv"},
+		{"report.csv.gz|20230801", ".csv", "report.csv"},
+		{"report|20230801.csv.gz", ".csv", "report.csv"},
+		{"in/report.csv.gz", ".csv", "in/report.csv"},
+	}
+
+	for _, tt := range tests {
+		got, err := SetDestFileName(tt.src, tt.extension)
+		if err != nil {
+			t.Errorf("SetDestFileName(%q) error = %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("SetDestFileName(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestIsGzipped(t *testing.T) {
+	tests := []struct {
+		object string
+		want   bool
+	}{
+		{"report.csv.gz", true},
+		{"report.csv.gz|20230801", true},
+		{"in/report|20230801.csv.gz", true},
+		{"report.csv|20230801", false},
+		{"report.gzip", false},
+		{"gz/report.csv", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsGzipped(tt.object); got != tt.want {
+			t.Errorf("IsGzipped(%q) = %t, want %t", tt.object, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesExtension(t *testing.T) {
+	tests := []struct {
+		object string
+		want   bool
+	}{
+		{"report|20230801.csv", true},
+		{"report|20230801.csv.gz", true},
+		{"report.csv.gz|20230801", true},
+		{"report.csv|20230801", false},
+		{"report|20230801.txt", false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchesExtension(tt.object, ".csv"); got != tt.want {
+			t.Errorf("MatchesExtension(%q, .csv) = %t, want %t", tt.object, got, tt.want)
+		}
+	}
+}
+
+func TestCutSeparator(t *testing.T) {
+	tests := []struct {
+		separators string
+		name       string
+		want       string
+	}{
+		{"|", "report|20230801.csv", "report"},
+		{"|", "report#20230801.csv", "report#20230801.csv"},
+		{"|#", "report#20230801|x.csv", "report"},
+		{"|#", "report|20230801#x.csv", "report"},
+		{"|#", "report.csv", "report.csv"},
+		{"|#", "|report.csv", ""},
+	}
+
+	for _, tt := range tests {
+		func() {
+			defer func(separators string) { RENAME_SEPARATORS = separators }(RENAME_SEPARATORS)
+			RENAME_SEPARATORS = tt.separators
+
+			if got := CutSeparator(tt.name); got != tt.want {
+				t.Errorf("CutSeparator(%q) with separators %q = %q, want %q", tt.name, tt.separators, got, tt.want)
+			}
+		}()
+	}
+}
+
+func TestSetDestFileNameSeparators(t *testing.T) {
+	defer func(separators string) { RENAME_SEPARATORS = separators }(RENAME_SEPARATORS)
+	RENAME_SEPARATORS = "|#"
+
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"in/report#20230801|x.csv", "in/report.csv"},
+		{"in/report|20230801#x.csv", "in/report.csv"},
+		{"in/report.csv#20230801", "in/report.csv"},
+		{"in/report.csv", "in/report.csv"},
+	}
+
+	for _, tt := range tests {
+		got, err := SetDestFileName(tt.src, ".csv")
+		if err != nil {
+			t.Errorf("SetDestFileName(%q) error = %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("SetDestFileName(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestSetDestFileNameOutputExtension(t *testing.T) {
+	tests := []struct {
+		outputExtension string
+		src             string
+		extension       string
+		want            string
+	}{
+		{"", "in/report|20230801.txt", ".txt", "in/report.txt"},
+		{".dat", "in/report|20230801.txt", ".txt", "in/report.dat"},
+		{".dat", "in/report.txt|20230801", ".txt", "in/report.dat"},
+		{".dat", "in/report|20230801", ".txt", "in/report.dat"},
+		{".dat", "in/report.dat|20230801", ".txt", "in/report.dat"},
+		{".dat", "in/report|20230801.txt.gz", ".txt", "in/report.dat"},
+		{".dat", "in/report.txt", ".txt", "in/report.dat"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.outputExtension+" "+tt.src, func(t *testing.T) {
+			defer func(ext string) { OUTPUT_EXTENSION = ext }(OUTPUT_EXTENSION)
+			OUTPUT_EXTENSION = tt.outputExtension
+
+			got, err := SetDestFileName(tt.src, tt.extension)
+			if err != nil {
+				t.Fatalf("SetDestFileName(%q) error = %v", tt.src, err)
+			}
+			if got != tt.want {
+				t.Errorf("SetDestFileName(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputExtension(t *testing.T) {
+	defer func(ext string) { OUTPUT_EXTENSION = ext }(OUTPUT_EXTENSION)
+
+	OUTPUT_EXTENSION = ""
+	if got := OutputExtension(".txt"); got != ".txt" {
+		t.Errorf("OutputExtension(%q) = %q, want %q", ".txt", got, ".txt")
+	}
+	OUTPUT_EXTENSION = ".dat"
+	if got := OutputExtension(".txt"); got != ".dat" {
+		t.Errorf("OutputExtension(%q) = %q, want %q", ".txt", got, ".dat")
+	}
+}
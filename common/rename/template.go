@@ -0,0 +1,57 @@
+package rename
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// templateField matches field references like "{2}" in RENAME_TEMPLATE.
+var templateField = regexp.MustCompile(`\{(\d+)\}`)
+
+// splitFields splits name into fields delimited by any of RENAME_SEPARATORS.
+// Empty fields are kept, so field indexes match their position in the name.
+func splitFields(name string) []string {
+	var fields []string
+	start := 0
+	for i, c := range name {
+		if IsSeparator(c) {
+			fields = append(fields, name[start:i])
+			start = i + utf8.RuneLen(c)
+		}
+	}
+
+	return append(fields, name[start:])
+}
+
+// applyRenameTemplate builds destination name from fields of the source
+// file name according to RENAME_TEMPLATE. Missing or empty fields and
+// names resolving outside of the source folder are rejected.
+func applyRenameTemplate(fileName string) (string, error) {
+	fields := splitFields(fileName)
+
+	var missing error
+	name := templateField.ReplaceAllStringFunc(RENAME_TEMPLATE, func(ref string) string {
+		i, _ := strconv.Atoi(ref[1 : len(ref)-1])
+		if i < 1 || i > len(fields) || fields[i-1] == "" {
+			if missing == nil {
+				missing = fmt.Errorf("field %d referenced by RENAME_TEMPLATE is missing in %q", i, fileName)
+			}
+			return ""
+		}
+		return fields[i-1]
+	})
+	if missing != nil {
+		return "", missing
+	}
+
+	cleaned := path.Clean(name)
+	if path.IsAbs(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("destination name %q built from %q escapes source folder", name, fileName)
+	}
+
+	return cleaned, nil
+}
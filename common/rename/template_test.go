@@ -0,0 +1,92 @@
+package rename
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitFields(t *testing.T) {
+	defer func(separators string) { RENAME_SEPARATORS = separators }(RENAME_SEPARATORS)
+	RENAME_SEPARATORS = "|#"
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"custid|region|report.csv", []string{"custid", "region", "report.csv"}},
+		{"custid#region|report.csv", []string{"custid", "region", "report.csv"}},
+		{"custid||report.csv", []string{"custid", "", "report.csv"}},
+		{"|report.csv|", []string{"", "report.csv", ""}},
+		{"report.csv", []string{"report.csv"}},
+	}
+
+	for _, tt := range tests {
+		if got := splitFields(tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitFields(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyRenameTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		fileName string
+		want     string
+		wantErr  bool
+	}{
+		{"{2}/{3}", "custid|region|report.csv", "region/report.csv", false},
+		{"{3}", "custid|region|report.csv", "report.csv", false},
+		{"{1}-{3}", "custid|region|report.csv", "custid-report.csv", false},
+		{"{2}/{2}/{3}", "custid|eu|report.csv", "eu/eu/report.csv", false},
+		{"{2}/{4}", "custid|region|report.csv", "", true},
+		{"{0}/{3}", "custid|region|report.csv", "", true},
+		{"{2}/{3}", "custid||report.csv", "", true},
+		{"{2}/{3}", "report.csv", "", true},
+		{"{1}/{2}", "..|report.csv", "", true},
+		{"{1}", "..", "", true},
+		{"/{1}", "report.csv", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template+" "+tt.fileName, func(t *testing.T) {
+			defer func(template string) { RENAME_TEMPLATE = template }(RENAME_TEMPLATE)
+			RENAME_TEMPLATE = tt.template
+
+			got, err := applyRenameTemplate(tt.fileName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyRenameTemplate(%q) error = %v, want error %t", tt.fileName, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("applyRenameTemplate(%q) = %q, want %q", tt.fileName, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetDestFileNameRenameTemplate(t *testing.T) {
+	defer func(template string) { RENAME_TEMPLATE = template }(RENAME_TEMPLATE)
+	RENAME_TEMPLATE = "{2}/{3}"
+
+	tests := []struct {
+		src     string
+		want    string
+		wantErr bool
+	}{
+		{"custid|region|report.csv", "region/report.csv", false},
+		{"in/custid|region|report.csv", "in/region/report.csv", false},
+		{"in/custid|region|report", "in/region/report.csv", false},
+		{"in/custid|region|report.csv.gz", "in/region/report.csv", false},
+		{"in/custid|region", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := SetDestFileName(tt.src, ".csv")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SetDestFileName(%q) error = %v, want error %t", tt.src, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("SetDestFileName(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
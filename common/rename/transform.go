@@ -0,0 +1,218 @@
+package rename
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jf-tech/go-corelib/ios"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// transform wraps a reader with a single content transformation step.
+// Steps returning an io.ReadCloser are closed with the pipeline.
+type transform func(r io.Reader) io.Reader
+
+// transforms maps step names usable in TRANSFORMS to their implementation.
+// New steps only need to be registered here.
+var transforms = map[string]transform{
+	// Replace "~~" field separators with commas, like: sed "s/~~/,/g"
+	"tilde-to-comma": replacing(`~~`, `,`),
+	// Replace doubled quotes around separators, like: sed "s/\"\",\"\"/\",\"/g"
+	"collapse-quotes": replacing(`"",""`, `","`),
+	// Normalize Windows line endings to Unix ones
+	"crlf-to-lf": replacing("\r\n", "\n"),
+	// Re-encode CSV from SRC_DELIMITER to DST_DELIMITER, keeping quoting valid
+	"csv-delimiter": convertDelimiter,
+	// Re-encode CSV quoting fields as configured by CSV_QUOTING
+	"csv-requote": requoteCSV,
+	// Convert ISO-8859-1 (Latin-1) encoded content to UTF-8
+	"latin1-to-utf8": func(r io.Reader) io.Reader {
+		return charmap.ISO8859_1.NewDecoder().Reader(r)
+	},
+}
+
+// replacing returns a transform replacing every occurrence of search
+// with replace in a streaming fashion.
+func replacing(search, replace string) transform {
+	return func(r io.Reader) io.Reader {
+		return ios.NewBytesReplacingReader(r, []byte(search), []byte(replace))
+	}
+}
+
+// convertDelimiter parses CSV content separated by SRC_DELIMITER and
+// writes it back separated by DST_DELIMITER. Fields containing the new
+// delimiter are quoted by the CSV writer.
+func convertDelimiter(r io.Reader) io.Reader {
+	return reencodeCSV(r, false)
+}
+
+// requoteCSV parses CSV content and writes it back, quoting every field
+// when CSV_QUOTING is "always" and only fields which need it otherwise.
+func requoteCSV(r io.Reader) io.Reader {
+	return reencodeCSV(r, CSV_QUOTING == "always")
+}
+
+// validCSVQuoting reports whether the value is a supported CSV_QUOTING.
+func validCSVQuoting(value string) bool {
+	return value == "minimal" || value == "always"
+}
+
+// reencodeCSV parses CSV content separated by SRC_DELIMITER and writes it
+// back separated by DST_DELIMITER, quoting all fields when quoteAll is set.
+// Content is re-encoded in the background until it is read to the end or
+// the returned reader is closed.
+func reencodeCSV(r io.Reader, quoteAll bool) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		cr := csv.NewReader(r)
+		cr.Comma = SRC_DELIMITER
+		cr.FieldsPerRecord = -1
+
+		cw := csv.NewWriter(pw)
+		cw.Comma = DST_DELIMITER
+
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("unable to parse CSV: %w", err))
+				return
+			}
+			if quoteAll {
+				err = writeQuoted(pw, cw, record)
+			} else {
+				err = cw.Write(record)
+			}
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("unable to write CSV: %w", err))
+				return
+			}
+		}
+
+		cw.Flush()
+		pw.CloseWithError(cw.Error())
+	}()
+
+	return pr
+}
+
+// writeQuoted writes the record with every field quoted. Pending output
+// of the CSV writer is flushed first, so records stay in order.
+func writeQuoted(w io.Writer, cw *csv.Writer, record []string) error {
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+
+	fields := make([]string, len(record))
+	for i, field := range record {
+		fields[i] = `"` + strings.ReplaceAll(field, `"`, `""`) + `"`
+	}
+	_, err := io.WriteString(w, strings.Join(fields, string(DST_DELIMITER))+"\n")
+
+	return err
+}
+
+// parseDelimiter converts a delimiter setting into a single rune. The
+// escaped form "\t" is accepted for tab-delimited files.
+func parseDelimiter(s string) (rune, error) {
+	if s == `\t` {
+		return '\t', nil
+	}
+
+	r, size := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError || size != len(s) {
+		return 0, fmt.Errorf("delimiter %q must be a single character", s)
+	}
+
+	return r, nil
+}
+
+// parseTransformProfiles parses TRANSFORM_PROFILES, mapping extensions to
+// their pipelines, e.g. ".csv=tilde-to-comma,latin1-to-utf8;.txt=". An
+// empty pipeline passes content through untouched.
+func parseTransformProfiles(value string) (map[string][]string, error) {
+	profiles := map[string][]string{}
+	for _, profile := range strings.Split(value, ";") {
+		if strings.TrimSpace(profile) == "" {
+			continue
+		}
+		ext, pipeline, ok := strings.Cut(profile, "=")
+		ext = strings.TrimSpace(ext)
+		if !ok || !strings.HasPrefix(ext, ".") {
+			return nil, fmt.Errorf("profile %q must be \".ext=transform,...\"", profile)
+		}
+
+		names := []string{}
+		for _, name := range strings.Split(pipeline, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if _, ok := transforms[name]; !ok {
+				return nil, fmt.Errorf("unknown transform %q in profile of %s", name, ext)
+			}
+			names = append(names, name)
+		}
+		profiles[ext] = names
+	}
+
+	return profiles, nil
+}
+
+// TransformsFor returns the pipeline of the object's extension from
+// TRANSFORM_PROFILES, preferring the longest matching extension and falling
+// back to TRANSFORMS. The gzip extension is ignored, as content is
+// decompressed first.
+func TransformsFor(objectName string) []string {
+	name := TrimSuffixFold(objectName, GzipExtension)
+	matched, pipeline := "", TRANSFORMS
+	for ext, names := range TRANSFORM_PROFILES {
+		if len(ext) > len(matched) && HasSuffixFold(name, ext) {
+			matched, pipeline = ext, names
+		}
+	}
+
+	return pipeline
+}
+
+// ApplyTransforms chains the named transforms in order, so the output of
+// each step is the input of the next one. Callers close the returned reader
+// once they stop reading, which stops steps running in the background. The
+// given reader is left open.
+func ApplyTransforms(r io.Reader, names []string) io.ReadCloser {
+	p := &pipeline{}
+	for _, name := range names {
+		r = transforms[name](r)
+		if c, ok := r.(io.Closer); ok {
+			p.closers = append(p.closers, c)
+		}
+	}
+	p.Reader = r
+
+	return p
+}
+
+// pipeline reads the output of chained transforms.
+type pipeline struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close closes the steps from the last one, so none of them is left
+// writing into a step which is no longer read.
+func (p *pipeline) Close() error {
+	var err error
+	for i := len(p.closers) - 1; i >= 0; i-- {
+		if cerr := p.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
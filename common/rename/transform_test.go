@@ -0,0 +1,234 @@
+package rename
+
+import (
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyTransforms(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []string
+		data  string
+		want  string
+	}{
+		{"no steps", nil, "a~~b\r\n", "a~~b\r\n"},
+		{"default pipeline", []string{"tilde-to-comma", "collapse-quotes"}, `"a""~~""b"`, `"a","b"`},
+		{"reversed pipeline", []string{"collapse-quotes", "tilde-to-comma"}, `"a""~~""b"`, `"a"",""b"`},
+		{"line endings", []string{"tilde-to-comma", "crlf-to-lf"}, "a~~b\r\nc~~d\r\n", "a,b\nc,d\n"},
+		{"latin1", []string{"latin1-to-utf8", "tilde-to-comma"}, "caf\xe9~~1\n", "café,1\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := ApplyTransforms(strings.NewReader(tt.data), tt.steps)
+			defer r.Close()
+
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unable to read content: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ApplyTransforms(%q) = %q, want %q", tt.steps, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertDelimiter(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     rune
+		dst     rune
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{"tab to comma", '\t', ',', "id\tname\n1\talice\n", "id,name\n1,alice\n", false},
+		{"field with target delimiter", '\t', ',', "id\tname\n1\tsmith, alice\n", "id,name\n1,\"smith, alice\"\n", false},
+		{"quoted field with source delimiter", '\t', ',', "id\tname\n1\t\"smith\talice\"\n", "id,name\n1,smith\talice\n", false},
+		{"field with quotes", '\t', ',', "1\t\"the \"\"best\"\"\"\n", "1,\"the \"\"best\"\"\"\n", false},
+		{"field with newline", ';', ',', "1;\"line\nbreak\"\n", "1,\"line\nbreak\"\n", false},
+		{"ragged rows", '\t', ',', "id\tname\n1\n", "id,name\n1\n", false},
+		{"comma to pipe", ',', '|', "id,name\n1,a|b\n", "id|name\n1|\"a|b\"\n", false},
+		{"malformed quoting", '\t', ',', "1\t\"alice\n", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(src, dst rune) { SRC_DELIMITER, DST_DELIMITER = src, dst }(SRC_DELIMITER, DST_DELIMITER)
+			SRC_DELIMITER, DST_DELIMITER = tt.src, tt.dst
+
+			got, err := io.ReadAll(convertDelimiter(strings.NewReader(tt.data)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("convertDelimiter() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("convertDelimiter(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequoteCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		quoting string
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{"minimal plain fields", "minimal", "\"id\",\"name\"\n\"1\",\"alice\"\n", "id,name\n1,alice\n", false},
+		{"minimal field with comma", "minimal", "1,\"smith, alice\"\n", "1,\"smith, alice\"\n", false},
+		{"minimal field with quotes", "minimal", "1,\"the \"\"best\"\"\"\n", "1,\"the \"\"best\"\"\"\n", false},
+		{"minimal field with newline", "minimal", "1,\"line\nbreak\"\n", "1,\"line\nbreak\"\n", false},
+		{"minimal empty field", "minimal", "1,,alice\n", "1,,alice\n", false},
+		{"always plain fields", "always", "id,name\n1,alice\n", "\"id\",\"name\"\n\"1\",\"alice\"\n", false},
+		{"always field with comma", "always", "1,\"smith, alice\"\n", "\"1\",\"smith, alice\"\n", false},
+		{"always field with quotes", "always", "1,\"the \"\"best\"\"\"\n", "\"1\",\"the \"\"best\"\"\"\n", false},
+		{"always field with newline", "always", "1,\"line\nbreak\"\n", "\"1\",\"line\nbreak\"\n", false},
+		{"always empty field", "always", "1,,alice\n", "\"1\",\"\",\"alice\"\n", false},
+		{"malformed quoting", "always", "1,\"alice\n", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(quoting string) { CSV_QUOTING = quoting }(CSV_QUOTING)
+			CSV_QUOTING = tt.quoting
+
+			got, err := io.ReadAll(requoteCSV(strings.NewReader(tt.data)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("requoteCSV() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("requoteCSV(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidCSVQuoting(t *testing.T) {
+	for value, want := range map[string]bool{"minimal": true, "always": true, "": false, "Always": false, "none": false} {
+		if got := validCSVQuoting(value); got != want {
+			t.Errorf("validCSVQuoting(%q) = %t, want %t", value, got, want)
+		}
+	}
+}
+
+// endlessCSV serves CSV records without an end.
+type endlessCSV struct{}
+
+func (endlessCSV) Read(p []byte) (int, error) {
+	return copy(p, "1\talice\n"), nil
+}
+
+func TestConvertDelimiterClose(t *testing.T) {
+	defer func(src rune) { SRC_DELIMITER = src }(SRC_DELIMITER)
+	SRC_DELIMITER = '\t'
+	goroutines := runtime.NumGoroutine()
+
+	r := convertDelimiter(endlessCSV{}).(io.ReadCloser)
+	if _, err := io.ReadFull(r, make([]byte, 64)); err != nil {
+		t.Fatalf("unable to read content: %v", err)
+	}
+	r.Close()
+
+	// The background re-encoding stops on its next write into the closed pipe.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatal("re-encoding goroutine still running after the reader was closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestParseDelimiter(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    rune
+		wantErr bool
+	}{
+		{",", ',', false},
+		{";", ';', false},
+		{`\t`, '\t', false},
+		{"\t", '\t', false},
+		{"¦", '¦', false},
+		{"", 0, true},
+		{",,", 0, true},
+		{"\xff", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseDelimiter(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDelimiter(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseDelimiter(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestTransformsFor(t *testing.T) {
+	defer func(pipeline []string, profiles map[string][]string) {
+		TRANSFORMS, TRANSFORM_PROFILES = pipeline, profiles
+	}(TRANSFORMS, TRANSFORM_PROFILES)
+	TRANSFORMS = []string{"tilde-to-comma"}
+	TRANSFORM_PROFILES = map[string][]string{
+		".csv":      {"crlf-to-lf"},
+		".data.csv": {"latin1-to-utf8"},
+		".txt":      {},
+	}
+
+	tests := []struct {
+		object string
+		want   []string
+	}{
+		{"report.csv", []string{"crlf-to-lf"}},
+		{"report.csv.gz", []string{"crlf-to-lf"}},
+		{"report.data.csv", []string{"latin1-to-utf8"}},
+		{"notes.txt", []string{}},
+		{"report.json", []string{"tilde-to-comma"}},
+	}
+
+	for _, tt := range tests {
+		if got := TransformsFor(tt.object); strings.Join(got, ",") != strings.Join(tt.want, ",") || (got == nil) != (tt.want == nil) {
+			t.Errorf("TransformsFor(%q) = %q, want %q", tt.object, got, tt.want)
+		}
+	}
+}
+
+func TestParseTransformProfiles(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]int
+		wantErr bool
+	}{
+		{".csv=tilde-to-comma,latin1-to-utf8;.txt=", map[string]int{".csv": 2, ".txt": 0}, false},
+		{" .csv = crlf-to-lf ; ", map[string]int{".csv": 1}, false},
+		{"csv=crlf-to-lf", nil, true},
+		{".csv", nil, true},
+		{".csv=unknown", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTransformProfiles(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTransformProfiles(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseTransformProfiles(%q) = %q, want %d profiles", tt.value, got, len(tt.want))
+		}
+		for ext, steps := range tt.want {
+			if len(got[ext]) != steps {
+				t.Errorf("parseTransformProfiles(%q)[%s] = %q, want %d steps", tt.value, ext, got[ext], steps)
+			}
+		}
+	}
+}
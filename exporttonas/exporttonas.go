@@ -3,25 +3,19 @@
 package exporttonas
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"log"
 	"net"
+	"os"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ealebed/gcp-cf/common/exporter"
 	"github.com/hirochachacha/go-smb2"
-
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
-	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
-	"cloud.google.com/go/storage"
-	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
-	"github.com/cloudevents/sdk-go/v2/event"
-	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
-	"google.golang.org/protobuf/encoding/protojson"
 )
 
 const (
@@ -30,11 +24,29 @@ const (
 	NAS_SHARE = "share"
 )
 
-// Global API clients used across function invocations.
 var (
-	storageClient *storage.Client
-	bgctx         = context.Background()
-	NAS_PASS      = ""
+	bgctx    = context.Background()
+	NAS_PASS = ""
+	// Secret Manager resource holding the NAS password.
+	NAS_PASS_SECRET = ""
+	// Suffix of temporary files used while uploading.
+	NAS_PART_SUFFIX = ".part"
+	// Size of the buffer used to copy data to NAS, 0 uses library default.
+	NAS_COPY_BUFFER_SIZE = 0
+	// Time given to unmount and logoff before the SMB connection is closed.
+	NAS_CLOSE_TIMEOUT = 10 * time.Second
+	// Time allowed to establish the TCP connection to the NAS.
+	NAS_DIAL_TIMEOUT = 10 * time.Second
+	// Time allowed for SMB negotiation, authentication and mounting the share.
+	NAS_OPERATION_TIMEOUT = 30 * time.Second
+	// Time allowed for each write to the SMB connection, 0 disables it.
+	NAS_WRITE_TIMEOUT = 60 * time.Second
+	// Remote names or glob patterns which uploads must never overwrite.
+	PROTECTED_REMOTE_NAMES []string
+	// Match extensions of NAS_EXTENSION_FOLDERS ignoring case.
+	CASE_INSENSITIVE_MATCH = false
+	// Case of destination filenames: preserve, lower, upper or upper-ext.
+	FILENAME_CASE = "preserve"
 )
 
 type SMBClient struct {
@@ -44,114 +56,186 @@ type SMBClient struct {
 	share   *smb2.Share
 }
 
+// nasBackend delivers exported objects to the NAS share.
+type nasBackend struct{}
+
 func init() {
+	// Tests configure the package themselves, without GCP access.
+	if exporter.InTest() {
+		return
+	}
+
 	// Declare a separate err variable to avoid shadowing the client variables.
 	var err error
 
-	NAS_PASS, err = accessSecretVersion("projects/my-project/secrets/nas-pass/versions/latest")
+	// Read configuration shared with other exporters.
+	exporter.HEALTHZ_CHECKS = []string{"secretmanager", "storage", "nas"}
+	exporter.Init()
+	exporter.HealthChecks["secretmanager"] = checkSecretManager
+	exporter.HealthChecks["nas"] = checkNAS
+
+	// Prefix the secret with SECRET_PREFIX, so each environment reads its own password.
+	NAS_PASS_SECRET = exporter.SecretVersionName("nas-pass")
+	NAS_PASS, err = exporter.AccessSecretVersion(bgctx, NAS_PASS_SECRET)
 	if err != nil {
 		log.Fatalf("failed to get secret: %v", err)
 	}
 
-	// Initialize Storage client
-	storageClient, err = storage.NewClient(bgctx)
-	if err != nil {
-		log.Fatalf("storage.NewClient: %v", err)
+	// Get temporary upload file suffix from environment variable.
+	if os.Getenv("NAS_PART_SUFFIX") != "" {
+		NAS_PART_SUFFIX = os.Getenv("NAS_PART_SUFFIX")
 	}
 
-	functions.CloudEvent("ExportFiles", exportFiles)
-}
-
-// exportFiles consumes a CloudEvent message with changed object.
-func exportFiles(ctx context.Context, e event.Event) error {
-	var metadata storagedata.StorageObjectData
-	if err := protojson.Unmarshal(e.Data(), &metadata); err != nil {
-		return fmt.Errorf("protojson.Unmarshal: %w", err)
+	// Get NAS copy buffer size from environment variable.
+	if os.Getenv("NAS_COPY_BUFFER_SIZE") != "" {
+		NAS_COPY_BUFFER_SIZE, err = strconv.Atoi(os.Getenv("NAS_COPY_BUFFER_SIZE"))
+		if err != nil {
+			log.Fatalf("invalid NAS_COPY_BUFFER_SIZE: %v", err)
+		}
 	}
 
-	log.Printf("Bucket: %s", metadata.GetBucket())
-	log.Printf("File: %s", metadata.GetName())
-
-	objectName := metadata.GetName()
-	bucketName := metadata.GetBucket()
-
-	data, err := downloadFileIntoMemory(bgctx, bucketName, objectName)
-	if err != nil {
-		return fmt.Errorf("unable download object %s from bucket %s: %v", objectName, bucketName, err)
+	// Get SMB connection timeouts from environment variables.
+	if os.Getenv("NAS_DIAL_TIMEOUT") != "" {
+		NAS_DIAL_TIMEOUT, err = time.ParseDuration(os.Getenv("NAS_DIAL_TIMEOUT"))
+		if err != nil {
+			log.Fatalf("invalid NAS_DIAL_TIMEOUT: %v", err)
+		}
+	}
+	if os.Getenv("NAS_OPERATION_TIMEOUT") != "" {
+		NAS_OPERATION_TIMEOUT, err = time.ParseDuration(os.Getenv("NAS_OPERATION_TIMEOUT"))
+		if err != nil {
+			log.Fatalf("invalid NAS_OPERATION_TIMEOUT: %v", err)
+		}
+	}
+	if os.Getenv("NAS_WRITE_TIMEOUT") != "" {
+		NAS_WRITE_TIMEOUT, err = time.ParseDuration(os.Getenv("NAS_WRITE_TIMEOUT"))
+		if err != nil {
+			log.Fatalf("invalid NAS_WRITE_TIMEOUT: %v", err)
+		}
 	}
 
-	nasClient, err := newSMBClient(NAS_HOST, NAS_USER, NAS_PASS, NAS_SHARE)
-	if err != nil {
-		panic(err)
+	// Get SMB session close timeout from environment variable.
+	if os.Getenv("NAS_CLOSE_TIMEOUT") != "" {
+		NAS_CLOSE_TIMEOUT, err = time.ParseDuration(os.Getenv("NAS_CLOSE_TIMEOUT"))
+		if err != nil {
+			log.Fatalf("invalid NAS_CLOSE_TIMEOUT: %v", err)
+		}
 	}
-	defer nasClient.close()
 
-	return nasClient.upload(objectName, data)
-}
+	// Get resuming of interrupted uploads from environment variable.
+	if os.Getenv("NAS_RESUME_UPLOADS") != "" {
+		NAS_RESUME_UPLOADS, err = strconv.ParseBool(os.Getenv("NAS_RESUME_UPLOADS"))
+		if err != nil {
+			log.Fatalf("invalid NAS_RESUME_UPLOADS: %v", err)
+		}
+	}
 
-// downloadFileIntoMemory downloads an object.
-func downloadFileIntoMemory(bgctx context.Context, bucket, object string) ([]byte, error) {
-	bgctx, cancel := context.WithTimeout(bgctx, time.Second*50)
-	defer cancel()
+	// Get destination folders within the share from environment variables.
+	if os.Getenv("NAS_FOLDER") != "" {
+		NAS_FOLDER, err = shareFolder(os.Getenv("NAS_FOLDER"))
+		if err != nil {
+			log.Fatalf("invalid NAS_FOLDER: %v", err)
+		}
+	}
+	if os.Getenv("NAS_EXTENSION_FOLDERS") != "" {
+		NAS_EXTENSION_FOLDERS, err = parseExtensionFolders(os.Getenv("NAS_EXTENSION_FOLDERS"))
+		if err != nil {
+			log.Fatalf("invalid NAS_EXTENSION_FOLDERS: %v", err)
+		}
+	}
 
-	rc, err := storageClient.Bucket(bucket).Object(object).NewReader(bgctx)
-	if err != nil {
-		return nil, fmt.Errorf("Object(%q).NewReader: %w", object, err)
+	// Get remote names which must never be overwritten from environment variable.
+	if os.Getenv("PROTECTED_REMOTE_NAMES") != "" {
+		for _, pattern := range strings.Split(os.Getenv("PROTECTED_REMOTE_NAMES"), ",") {
+			pattern = strings.TrimSpace(pattern)
+			if _, err := path.Match(pattern, ""); err != nil {
+				log.Fatalf("invalid PROTECTED_REMOTE_NAMES pattern %q: %v", pattern, err)
+			}
+			PROTECTED_REMOTE_NAMES = append(PROTECTED_REMOTE_NAMES, pattern)
+		}
 	}
-	defer rc.Close()
 
-	data, err := io.ReadAll(rc)
-	if err != nil {
-		return nil, fmt.Errorf("ioutil.ReadAll: %w", err)
+	// Get case-insensitive extension matching from environment variable.
+	if os.Getenv("CASE_INSENSITIVE_MATCH") != "" {
+		CASE_INSENSITIVE_MATCH, err = strconv.ParseBool(os.Getenv("CASE_INSENSITIVE_MATCH"))
+		if err != nil {
+			log.Fatalf("invalid CASE_INSENSITIVE_MATCH: %v", err)
+		}
 	}
-	log.Printf("Blob %v downloaded.\n", object)
 
-	return data, nil
-}
+	// Get destination filename case from environment variable.
+	if os.Getenv("FILENAME_CASE") != "" {
+		FILENAME_CASE = os.Getenv("FILENAME_CASE")
+		if !validFilenameCase(FILENAME_CASE) {
+			log.Fatalf("invalid FILENAME_CASE: %q", FILENAME_CASE)
+		}
+	}
 
-// accessSecretVersion accesses the payload for the given secret version if one
-// exists. The version can be a version number as a string (e.g. "5") or an
-// alias (e.g. "latest").
-func accessSecretVersion(name string) (string, error) {
-	// name := "projects/my-project/secrets/my-secret/versions/5"
-	// name := "projects/my-project/secrets/my-secret/versions/latest"
+	// Send pending export events when the instance is stopped.
+	handleShutdown()
 
-	// Create the client.
-	ctx := context.Background()
-	client, err := secretmanager.NewClient(ctx)
-	if err != nil {
-		return "", fmt.Errorf("failed to create secretmanager client: %w", err)
-	}
-	defer client.Close()
+	exporter.Register(bgctx, nasBackend{})
+}
 
-	// Build the request.
-	req := &secretmanagerpb.AccessSecretVersionRequest{
-		Name: name,
+// Accept skips objects whose content type is not allowed, e.g. binary junk,
+// and exports all others into the share.
+func (nasBackend) Accept(ctx context.Context, x *exporter.Export) (exporter.Delivery, error) {
+	if err := exporter.CheckContentType(x.Metadata.GetContentType()); err != nil {
+		log.Printf("Skipping object %s: %v", x.Object, err)
+		x.Skip("content type")
+		return nil, nil
 	}
 
-	// Call the API.
-	result, err := client.AccessSecretVersion(ctx, req)
-	if err != nil {
-		return "", fmt.Errorf("failed to access secret version: %w", err)
-	}
+	return func(ctx context.Context) error {
+		x.Match()
+		filename := applyFilenameCase(x.Object)
+
+		return x.Transfer(ctx, exporter.Transfer{
+			Name:        filename,
+			Destination: exportDestination(filename),
+			Open: func(ctx context.Context) (exporter.Uploader, error) {
+				nasClient, err := newSMBClient(ctx, NAS_HOST, NAS_USER, NAS_PASS, NAS_SHARE)
+				if err != nil {
+					return nil, err
+				}
+
+				return resumableUploader{SMBClient: nasClient, size: x.Metadata.GetSize(), etag: x.Metadata.GetEtag()}, nil
+			},
+			Transform: func(ctx context.Context, data []byte) ([]byte, error) {
+				return exporter.NormalizeTrailingNewline(exporter.SampleContent(data)), nil
+			},
+			TransformStream: func(ctx context.Context, r io.Reader) (io.Reader, error) {
+				return exporter.SampleReader(r), nil
+			},
+			Unstreamable: unstreamedSteps(),
+		})
+	}, nil
+}
 
-	// Verify the data checksum.
-	crc32c := crc32.MakeTable(crc32.Castagnoli)
-	checksum := int64(crc32.Checksum(result.Payload.Data, crc32c))
-	if checksum != *result.Payload.DataCrc32C {
-		return "", fmt.Errorf("data corruption detected")
+// unstreamedSteps returns enabled content steps which need the whole
+// content, so they can't be applied when the object is streamed.
+func unstreamedSteps() []string {
+	var steps []string
+	if exporter.NORMALIZE_TRAILING_NEWLINE {
+		steps = append(steps, "trailing newline normalization")
 	}
 
-	secret := string(result.Payload.Data)
-
-	return secret, nil
+	return steps
 }
 
-func newSMBClient(server, username, password, sharename string) (*SMBClient, error) {
-	conn, err := net.Dial("tcp", server+":445")
+func newSMBClient(ctx context.Context, server, username, password, sharename string) (*SMBClient, error) {
+	// Refuse to connect to hosts outside of the allowlist.
+	dialer := net.Dialer{Timeout: NAS_DIAL_TIMEOUT}
+	conn, err := exporter.DialAllowed(ctx, &dialer, "tcp", net.JoinHostPort(server, "445"))
 	if err != nil {
 		return nil, err
 	}
+	conn = newDeadlineConn(conn)
+
+	// Bound session setup, so a NAS which accepts connections but never
+	// answers fails fast.
+	setupCtx, cancel := context.WithTimeout(ctx, NAS_OPERATION_TIMEOUT)
+	defer cancel()
 
 	d := &smb2.Dialer{
 		Initiator: &smb2.NTLMInitiator{
@@ -160,53 +244,212 @@ func newSMBClient(server, username, password, sharename string) (*SMBClient, err
 		},
 	}
 
-	s, err := d.Dial(conn)
+	s, err := d.DialContext(setupCtx, conn)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	share, err := s.Mount(sharename)
+	share, err := s.WithContext(setupCtx).Mount(sharename)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
+	// Bind share operations to the context, so uploads abort with it.
 	return &SMBClient{
 		conn:    conn,
 		dialer:  d,
 		session: s,
-		share:   share,
+		share:   share.WithContext(ctx),
 	}, nil
 }
 
-func (c *SMBClient) close() {
-	c.share.Umount()
-	c.session.Logoff()
-	c.conn.Close()
+// Close unmounts the share and logs off before closing the connection.
+func (c *SMBClient) Close() error {
+	return closeSMB(c.conn, func() {
+		c.share.Umount()
+		c.session.Logoff()
+	})
 }
 
-func (c *SMBClient) upload(filename string, data []byte) error {
+// closeSMB runs the graceful logoff before closing the connection. When the
+// logoff stalls for NAS_CLOSE_TIMEOUT, e.g. on a dead connection after the
+// context was canceled, the connection is closed anyway, which also unblocks
+// the pending requests.
+func closeSMB(conn net.Conn, logoff func()) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logoff()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(NAS_CLOSE_TIMEOUT):
+		log.Printf("SMB logoff did not complete within %s, closing connection", NAS_CLOSE_TIMEOUT)
+	}
+
+	return conn.Close()
+}
+
+// Upload stores content read from r as filename within the share, aborting
+// when the context is done.
+func (c *SMBClient) Upload(ctx context.Context, filename string, r io.Reader) error {
+	return uploadToShare(smbShare{c.share.WithContext(ctx)}, filename, r)
+}
+
+// uploadToShare writes content into a temporary file renamed to filename
+// once complete, so consumers never see partial files.
+func uploadToShare(share shareFS, filename string, r io.Reader) error {
+	// Make sure the destination stays within the share.
+	filename, err := exporter.CleanRelativePath(filename)
+	if err != nil {
+		log.Printf("Rejected upload: %v", err)
+		return err
+	}
+	// Place the file into the folder configured for its extension.
+	filename = path.Join(destinationFolder(filename), filename)
+
+	// Never clobber critical files on the NAS.
+	if isProtected(filename) {
+		log.Printf("Rejected upload: destination %s is protected", filename)
+		return fmt.Errorf("destination %s is protected", filename)
+	}
+
 	folder := path.Dir(filename)
 	if folder != "" {
-		in, err := c.share.Stat(folder)
+		in, err := share.Stat(folder)
 		if err != nil || !in.IsDir() {
-			err := c.share.MkdirAll(folder, 0755)
+			err := share.MkdirAll(folder, 0755)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
-	dstFile, err := c.share.Create(filename)
+	// Write into a temporary file first, so consumers never see partial files.
+	partFile := filename + NAS_PART_SUFFIX
+
+	// Continue an interrupted upload of the same source content.
+	source, resumable := r.(*resumableSource)
+	var offset int64
+	if resumable {
+		r = source.Reader
+		offset = resumeOffset(share, partFile, source.id)
+		if offset > 0 {
+			if err := skipSource(r, offset); err != nil {
+				removePartFile(share, partFile)
+				return fmt.Errorf("unable to resume upload: %v", err)
+			}
+			log.Printf("Resuming upload of %s at offset %d", filename, offset)
+		}
+	}
+
+	dstFile, err := openPartFile(share, partFile, offset, source)
 	if err != nil {
 		return err
 	}
-	defer dstFile.Close()
 
-	bytes, err := io.Copy(dstFile, bytes.NewReader(data))
+	bytes, err := copyToSMB(dstFile, exporter.NewProgressReader(r, filename, exporter.ReaderSize(r)))
 	if err != nil {
+		dstFile.Close()
+		if resumable {
+			log.Printf("Keeping %s with %d bytes to resume the upload", partFile, offset+bytes)
+		} else {
+			removePartFile(share, partFile)
+		}
 		return fmt.Errorf("unable to upload file: %v", err)
 	}
-	log.Printf("%d bytes copied\n", bytes)
+	if err := dstFile.Close(); err != nil {
+		removePartFile(share, partFile)
+		return fmt.Errorf("unable to close file: %v", err)
+	}
+	log.Printf("%d bytes copied\n", offset+bytes)
+
+	// SMB rename doesn't replace existing files, so remove the old version first.
+	if _, err := share.Stat(filename); err == nil {
+		if err := share.Remove(filename); err != nil {
+			removePartFile(share, partFile)
+			return fmt.Errorf("unable to replace file: %v", err)
+		}
+	}
+	if err := share.Rename(partFile, filename); err != nil {
+		removePartFile(share, partFile)
+		return fmt.Errorf("unable to rename file: %v", err)
+	}
+	if resumable {
+		share.Remove(partFile + resumeStateSuffix)
+	}
 
 	return nil
 }
+
+// copyToSMB copies src into an SMB file. By default the smb2 library
+// copies in chunks of the max write size negotiated with the server
+// (usually 1 MiB, up to 8 MiB with SMB 3). NAS_COPY_BUFFER_SIZE overrides
+// the buffer size, which helps over high-latency WAN links; writes
+// exceeding the negotiated size are still split by the library.
+func copyToSMB(dst shareFile, src io.Reader) (int64, error) {
+	if NAS_COPY_BUFFER_SIZE <= 0 {
+		return io.Copy(dst, src)
+	}
+
+	// Hide File.ReadFrom, which would ignore the custom buffer.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, make([]byte, NAS_COPY_BUFFER_SIZE))
+}
+
+// isProtected reports whether the destination path or its base name matches
+// any of PROTECTED_REMOTE_NAMES glob patterns.
+func isProtected(dstFile string) bool {
+	for _, pattern := range PROTECTED_REMOTE_NAMES {
+		for _, name := range []string{dstFile, strings.TrimPrefix(dstFile, "/"), path.Base(dstFile)} {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// removePartFile deletes a temporary upload file left after a failure,
+// along with its resume state.
+func removePartFile(share shareFS, partFile string) {
+	if err := share.Remove(partFile); err != nil {
+		log.Printf("unable to remove temporary file [%s]: %v", partFile, err)
+	}
+	if NAS_RESUME_UPLOADS {
+		share.Remove(partFile + resumeStateSuffix)
+	}
+}
+
+// validFilenameCase reports whether the value is a supported FILENAME_CASE.
+func validFilenameCase(value string) bool {
+	switch value {
+	case "preserve", "lower", "upper", "upper-ext":
+		return true
+	}
+	return false
+}
+
+// applyFilenameCase changes case of the base filename according to
+// FILENAME_CASE, leaving the folder part untouched. With "upper-ext" only
+// the extension is uppercased, e.g. "report.csv" becomes "report.CSV".
+func applyFilenameCase(filename string) string {
+	dir, base := path.Split(filename)
+	switch FILENAME_CASE {
+	case "lower":
+		base = strings.ToLower(base)
+	case "upper":
+		base = strings.ToUpper(base)
+	case "upper-ext":
+		ext := path.Ext(base)
+		// Dot files like ".env" have no extension to uppercase.
+		if ext != base {
+			base = strings.TrimSuffix(base, ext) + strings.ToUpper(ext)
+		}
+	}
+
+	return dir + base
+}
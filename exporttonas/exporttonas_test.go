@@ -0,0 +1,350 @@
+package exporttonas
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+)
+
+// observingReader records content of the destination file seen in the
+// share while the upload is still reading.
+type observingReader struct {
+	r     io.Reader
+	share *memShare
+	name  string
+	seen  map[string]bool
+}
+
+func (o *observingReader) Read(p []byte) (int, error) {
+	if content, ok := o.share.content(o.name); ok {
+		o.seen[content] = true
+	}
+	return o.r.Read(p)
+}
+
+// failingReader fails once its content is read.
+type failingReader struct {
+	r io.Reader
+}
+
+func (f failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestUploadToShare(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		filename string
+		fail     bool
+		want     []string
+	}{
+		{"new file", "", "report.csv", false, []string{"report.csv"}},
+		{"nested file", "", "out/daily/report.csv", false, []string{"out/daily/report.csv"}},
+		{"replaced file", "old content", "report.csv", false, []string{"report.csv"}},
+		{"failed upload", "", "report.csv", true, []string{}},
+		{"failed replacement", "old content", "report.csv", true, []string{"report.csv"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			share := newMemShare()
+			if tt.existing != "" {
+				share.WriteFile(tt.filename, []byte(tt.existing), 0644)
+			}
+
+			var r io.Reader = strings.NewReader(strings.Repeat("1,alice\n", 10000))
+			if tt.fail {
+				r = failingReader{r}
+			}
+			observed := &observingReader{r: r, share: share, name: tt.filename, seen: map[string]bool{}}
+			err := uploadToShare(share, tt.filename, observed)
+			if (err != nil) != tt.fail {
+				t.Fatalf("uploadToShare() error = %v, want error %t", err, tt.fail)
+			}
+
+			for content := range observed.seen {
+				if content != tt.existing {
+					t.Fatalf("%s held %d bytes before the upload completed", tt.filename, len(content))
+				}
+			}
+			if got := share.names(); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("share holds %q, want %q", got, tt.want)
+			}
+
+			content, _ := share.content(tt.filename)
+			switch {
+			case !tt.fail && content != strings.Repeat("1,alice\n", 10000):
+				t.Errorf("%s holds %d bytes, want the uploaded content", tt.filename, len(content))
+			case tt.fail && content != tt.existing:
+				t.Errorf("%s holds %q, want %q", tt.filename, content, tt.existing)
+			}
+		})
+	}
+}
+
+// recordingFile records sizes of the writes into the file.
+type recordingFile struct {
+	shareFile
+	writes []int
+}
+
+func (f *recordingFile) Write(p []byte) (int, error) {
+	f.writes = append(f.writes, len(p))
+	return f.shareFile.Write(p)
+}
+
+func TestCopyToSMB(t *testing.T) {
+	content := make([]byte, 4<<20+123)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	tests := []struct {
+		name       string
+		bufferSize int
+		wantWrite  int
+	}{
+		{"default buffer", 0, 32 << 10},
+		{"custom buffer", 1 << 20, 1 << 20},
+		{"small buffer", 4 << 10, 4 << 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(size int) { NAS_COPY_BUFFER_SIZE = size }(NAS_COPY_BUFFER_SIZE)
+			NAS_COPY_BUFFER_SIZE = tt.bufferSize
+			share := newMemShare()
+			f, err := share.Create("report.csv")
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			dst := &recordingFile{shareFile: f}
+
+			// Hide WriterTo of the reader, like of the GCS object reader.
+			n, err := copyToSMB(dst, struct{ io.Reader }{bytes.NewReader(content)})
+			if err != nil {
+				t.Fatalf("copyToSMB() error = %v", err)
+			}
+			if n != int64(len(content)) {
+				t.Errorf("copyToSMB() = %d, want %d", n, len(content))
+			}
+			if got, _ := share.content("report.csv"); got != string(content) {
+				t.Errorf("copied content differs from the source")
+			}
+			for _, size := range dst.writes {
+				if size > tt.wantWrite {
+					t.Fatalf("write of %d bytes, want at most %d", size, tt.wantWrite)
+				}
+			}
+			if dst.writes[0] != tt.wantWrite {
+				t.Errorf("first write of %d bytes, want %d", dst.writes[0], tt.wantWrite)
+			}
+		})
+	}
+}
+
+func BenchmarkCopyToSMB(b *testing.B) {
+	content := make([]byte, 16<<20)
+
+	for _, size := range []int{0, 1 << 20, 8 << 20} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			defer func(size int) { NAS_COPY_BUFFER_SIZE = size }(NAS_COPY_BUFFER_SIZE)
+			NAS_COPY_BUFFER_SIZE = size
+			b.SetBytes(int64(len(content)))
+
+			for i := 0; i < b.N; i++ {
+				share := newMemShare()
+				f, _ := share.Create("report.csv")
+				if _, err := copyToSMB(f, struct{ io.Reader }{bytes.NewReader(content)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyFilenameCase(t *testing.T) {
+	tests := []struct {
+		filenameCase string
+		filename     string
+		want         string
+	}{
+		{"preserve", "Daily/Report.Csv", "Daily/Report.Csv"},
+		{"lower", "Daily/Report.CSV", "Daily/report.csv"},
+		{"upper", "Daily/Report.csv", "Daily/REPORT.CSV"},
+		{"upper-ext", "Daily/report.csv", "Daily/report.CSV"},
+		{"upper-ext", "README", "README"},
+		{"upper-ext", ".env", ".env"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filenameCase, func(t *testing.T) {
+			defer func(filenameCase string) { FILENAME_CASE = filenameCase }(FILENAME_CASE)
+			FILENAME_CASE = tt.filenameCase
+
+			if got := applyFilenameCase(tt.filename); got != tt.want {
+				t.Errorf("applyFilenameCase(%q) = %q, want %q", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsProtected(t *testing.T) {
+	defer func(names []string) { PROTECTED_REMOTE_NAMES = names }(PROTECTED_REMOTE_NAMES)
+	PROTECTED_REMOTE_NAMES = []string{"control.txt", "in/*.lock"}
+
+	tests := []struct {
+		filename string
+		want     bool
+	}{
+		{"control.txt", true},
+		{"in/control.txt", true},
+		{"in/upload.lock", true},
+		{"in/2024/upload.lock", false},
+		{"in/control.txt.1", false},
+		{"in/report.csv", false},
+	}
+
+	for _, tt := range tests {
+		if got := isProtected(tt.filename); got != tt.want {
+			t.Errorf("isProtected(%q) = %t, want %t", tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestUploadToShareProtected(t *testing.T) {
+	defer func(names []string) { PROTECTED_REMOTE_NAMES = names }(PROTECTED_REMOTE_NAMES)
+	PROTECTED_REMOTE_NAMES = []string{"control.txt"}
+
+	tests := []struct {
+		filename string
+		wantErr  bool
+	}{
+		{"control.txt", true},
+		{"in/control.txt", true},
+		{"report.csv", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			share := newMemShare()
+			share.MkdirAll("in", 0755)
+			share.WriteFile(tt.filename, []byte("old content"), 0644)
+
+			err := uploadToShare(share, tt.filename, strings.NewReader("new content"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("uploadToShare() error = %v, want error %t", err, tt.wantErr)
+			}
+			want := "new content"
+			if tt.wantErr {
+				want = "old content"
+			}
+			if got, _ := share.content(tt.filename); got != want {
+				t.Errorf("%s holds %q, want %q", tt.filename, got, want)
+			}
+		})
+	}
+}
+
+func TestCloseSMB(t *testing.T) {
+	defer func(timeout time.Duration) { NAS_CLOSE_TIMEOUT = timeout }(NAS_CLOSE_TIMEOUT)
+	NAS_CLOSE_TIMEOUT = 50 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		stalled bool
+	}{
+		{"graceful logoff", false},
+		{"stalled logoff", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, nas := net.Pipe()
+			defer nas.Close()
+
+			// The upload canceled mid-way leaves a write the dead NAS never reads.
+			uploadDone := make(chan error, 1)
+			go func() {
+				_, err := conn.Write([]byte("write request"))
+				uploadDone <- err
+			}()
+
+			logoffDone := make(chan struct{})
+			logoff := func() {
+				defer close(logoffDone)
+				if tt.stalled {
+					// Wait for a logoff reply which never comes.
+					conn.Read(make([]byte, 1))
+				}
+			}
+
+			start := time.Now()
+			if err := closeSMB(conn, logoff); err != nil {
+				t.Fatalf("closeSMB() error = %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > NAS_CLOSE_TIMEOUT+time.Second {
+				t.Errorf("closeSMB() returned after %s, want within %s", elapsed, NAS_CLOSE_TIMEOUT)
+			}
+			if !tt.stalled && time.Since(start) >= NAS_CLOSE_TIMEOUT {
+				t.Errorf("closeSMB() waited for the timeout after a graceful logoff")
+			}
+
+			select {
+			case <-logoffDone:
+			case <-time.After(time.Second):
+				t.Error("logoff still pending after the connection was closed")
+			}
+			select {
+			case err := <-uploadDone:
+				if err == nil {
+					t.Error("pending upload write succeeded, want error")
+				}
+			case <-time.After(time.Second):
+				t.Error("upload still pending after the connection was closed")
+			}
+		})
+	}
+}
+
+func TestAcceptContentType(t *testing.T) {
+	defer func(allowed []string) { exporter.ALLOWED_CONTENT_TYPES = allowed }(exporter.ALLOWED_CONTENT_TYPES)
+	exporter.ALLOWED_CONTENT_TYPES = []string{"text/csv"}
+
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/csv", true},
+		{"text/csv; charset=utf-8", true},
+		{"application/octet-stream", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			x := exporter.NewExport(&storagedata.StorageObjectData{Bucket: "bucket", Name: "report.csv", ContentType: tt.contentType})
+			deliver, err := nasBackend{}.Accept(context.Background(), x)
+			if err != nil {
+				t.Fatalf("Accept() error = %v", err)
+			}
+			if got := deliver != nil; got != tt.want {
+				t.Errorf("object with content type %q accepted %t, want %t", tt.contentType, got, tt.want)
+			}
+		})
+	}
+}
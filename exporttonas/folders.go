@@ -0,0 +1,75 @@
+package exporttonas
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+var (
+	// Folder within the share where files are uploaded, share root when empty.
+	NAS_FOLDER = ""
+	// Subfolders within the share by file extension, e.g. {".csv": "csv"},
+	// overriding NAS_FOLDER for matching files.
+	NAS_EXTENSION_FOLDERS = map[string]string{}
+)
+
+// parseExtensionFolders parses JSON object mapping file extensions to
+// share folders, validating each folder.
+func parseExtensionFolders(value string) (map[string]string, error) {
+	folders := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &folders); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+
+	for ext, folder := range folders {
+		if !strings.HasPrefix(ext, ".") {
+			return nil, fmt.Errorf("extension %q must start with a dot", ext)
+		}
+
+		cleaned, err := shareFolder(folder)
+		if err != nil {
+			return nil, err
+		}
+		folders[ext] = cleaned
+	}
+
+	return folders, nil
+}
+
+// shareFolder returns folder relative to the share root. Leading slashes
+// are dropped, so "/csv" and "csv" both refer to the same folder.
+func shareFolder(folder string) (string, error) {
+	folder = strings.TrimLeft(folder, "/")
+	if folder == "" {
+		return "", nil
+	}
+
+	return exporter.CleanRelativePath(folder)
+}
+
+// destinationFolder returns folder within the share for the file, based on
+// its extension, falling back to NAS_FOLDER for unmapped extensions.
+func destinationFolder(filename string) string {
+	ext := path.Ext(filename)
+	if folder, ok := NAS_EXTENSION_FOLDERS[ext]; ok {
+		return folder
+	}
+	if CASE_INSENSITIVE_MATCH {
+		for mapped, folder := range NAS_EXTENSION_FOLDERS {
+			if strings.EqualFold(mapped, ext) {
+				return folder
+			}
+		}
+	}
+
+	return NAS_FOLDER
+}
+
+// exportDestination returns location of the uploaded file reported in export events.
+func exportDestination(filename string) string {
+	return fmt.Sprintf("smb://%s/%s", NAS_HOST, path.Join(NAS_SHARE, destinationFolder(filename), filename))
+}
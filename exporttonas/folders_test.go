@@ -0,0 +1,109 @@
+package exporttonas
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseExtensionFolders(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{`{}`, map[string]string{}, false},
+		{`{".csv": "csv", ".txt": "/text/daily/"}`, map[string]string{".csv": "csv", ".txt": "text/daily"}, false},
+		{`{".csv": "/"}`, map[string]string{".csv": ""}, false},
+		{`{"csv": "csv"}`, nil, true},
+		{`{".csv": "../csv"}`, nil, true},
+		{`[".csv"]`, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseExtensionFolders(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseExtensionFolders(%s) error = %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseExtensionFolders(%s) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDestinationFolder(t *testing.T) {
+	tests := []struct {
+		name     string
+		folder   string
+		filename string
+		want     string
+	}{
+		{"mapped extension", "exports", "report.csv", "csv"},
+		{"mapped to root", "exports", "notes.txt", ""},
+		{"unmapped extension", "exports", "report.xml", "exports"},
+		{"unmapped to root", "", "report.xml", ""},
+		{"no extension", "exports", "README", "exports"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(folder string, folders map[string]string) {
+				NAS_FOLDER, NAS_EXTENSION_FOLDERS = folder, folders
+			}(NAS_FOLDER, NAS_EXTENSION_FOLDERS)
+			NAS_FOLDER = tt.folder
+			NAS_EXTENSION_FOLDERS = map[string]string{".csv": "csv", ".txt": ""}
+
+			if got := destinationFolder(tt.filename); got != tt.want {
+				t.Errorf("destinationFolder(%q) = %q, want %q", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDestinationFolderCaseInsensitive(t *testing.T) {
+	defer func(folder string, folders map[string]string, insensitive bool) {
+		NAS_FOLDER, NAS_EXTENSION_FOLDERS, CASE_INSENSITIVE_MATCH = folder, folders, insensitive
+	}(NAS_FOLDER, NAS_EXTENSION_FOLDERS, CASE_INSENSITIVE_MATCH)
+	NAS_FOLDER = "exports"
+	NAS_EXTENSION_FOLDERS = map[string]string{".csv": "csv"}
+
+	tests := []struct {
+		insensitive bool
+		filename    string
+		want        string
+	}{
+		{false, "report.csv", "csv"},
+		{false, "report.CSV", "exports"},
+		{true, "report.CSV", "csv"},
+		{true, "report.Csv", "csv"},
+		{true, "report.xml", "exports"},
+	}
+
+	for _, tt := range tests {
+		CASE_INSENSITIVE_MATCH = tt.insensitive
+		if got := destinationFolder(tt.filename); got != tt.want {
+			t.Errorf("destinationFolder(%q) with CASE_INSENSITIVE_MATCH %t = %q, want %q", tt.filename, tt.insensitive, got, tt.want)
+		}
+	}
+}
+
+func TestUploadToShareExtensionFolders(t *testing.T) {
+	defer func(folder string, folders map[string]string) {
+		NAS_FOLDER, NAS_EXTENSION_FOLDERS = folder, folders
+	}(NAS_FOLDER, NAS_EXTENSION_FOLDERS)
+	NAS_FOLDER = "exports"
+	NAS_EXTENSION_FOLDERS = map[string]string{".csv": "csv/daily"}
+	share := newMemShare()
+
+	for _, filename := range []string{"report.csv", "2024/report.csv", "report.xml"} {
+		if err := uploadToShare(share, filename, strings.NewReader("id,name\n")); err != nil {
+			t.Fatalf("uploadToShare(%q) error = %v", filename, err)
+		}
+	}
+
+	want := []string{"csv/daily/2024/report.csv", "csv/daily/report.csv", "exports/report.xml"}
+	if got := share.names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("share holds %q, want %q", got, want)
+	}
+}
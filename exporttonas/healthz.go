@@ -0,0 +1,25 @@
+package exporttonas
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// checkSecretManager verifies the NAS password secret is still accessible.
+func checkSecretManager(ctx context.Context) error {
+	_, err := exporter.AccessSecretVersion(ctx, NAS_PASS_SECRET)
+	return err
+}
+
+// checkNAS verifies the NAS accepts SMB connections.
+func checkNAS(ctx context.Context) error {
+	conn, err := exporter.DialAllowed(ctx, &net.Dialer{Timeout: NAS_DIAL_TIMEOUT}, "tcp", net.JoinHostPort(NAS_HOST, "445"))
+	if err != nil {
+		return fmt.Errorf("unable to reach NAS: %w", err)
+	}
+
+	return conn.Close()
+}
@@ -0,0 +1,109 @@
+package exporttonas
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Keep temporary files of interrupted uploads, so a retry of the export
+// continues at the size already written instead of starting from zero.
+var NAS_RESUME_UPLOADS = false
+
+// Suffix of files recording which source content a temporary file holds.
+const resumeStateSuffix = ".resume"
+
+// resumableSource is content of a source object which can be resumed.
+// The id identifies the source content, so a temporary file is only
+// continued with the same content.
+type resumableSource struct {
+	io.Reader
+	id string
+}
+
+// newResumableSource marks content of the object with the given size and
+// etag as resumable, or returns it as is when resuming is disabled.
+func newResumableSource(r io.Reader, size int64, etag string) io.Reader {
+	if !NAS_RESUME_UPLOADS {
+		return r
+	}
+
+	return &resumableSource{Reader: r, id: fmt.Sprintf("size=%d etag=%s", size, etag)}
+}
+
+// resumeOffset returns size of the temporary file when it was written from
+// the same source content, or 0 when the upload has to start from zero.
+func resumeOffset(share shareFS, partFile, id string) int64 {
+	state, err := share.ReadFile(partFile + resumeStateSuffix)
+	if err != nil {
+		return 0
+	}
+	if strings.TrimSpace(string(state)) != id {
+		log.Printf("Not resuming %s, source changed since the interrupted upload", partFile)
+		return 0
+	}
+
+	info, err := share.Stat(partFile)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// openPartFile opens the temporary file of an upload positioned at the
+// offset, creating it from zero when the offset is 0. Resumable uploads
+// record their source, so a later retry can continue them.
+func openPartFile(share shareFS, partFile string, offset int64, source *resumableSource) (shareFile, error) {
+	if offset == 0 {
+		if source != nil {
+			if err := share.WriteFile(partFile+resumeStateSuffix, []byte(source.id), 0644); err != nil {
+				return nil, fmt.Errorf("unable to record upload source: %w", err)
+			}
+		}
+		return share.Create(partFile)
+	}
+
+	f, err := share.OpenFile(partFile, os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// skipSource advances the source past content already written, seeking
+// when possible and reading it otherwise, so streamed checksums still cover
+// the whole content.
+func skipSource(r io.Reader, offset int64) error {
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(offset, io.SeekStart)
+		return err
+	}
+
+	n, err := io.CopyN(io.Discard, r, offset)
+	if err != nil {
+		return fmt.Errorf("source ended at %d bytes before resume offset %d: %w", n, offset, err)
+	}
+
+	return nil
+}
+
+// resumableUploader uploads content through the SMB client as resumable
+// source, identified by size and etag of the source object.
+type resumableUploader struct {
+	*SMBClient
+	size int64
+	etag string
+}
+
+func (u resumableUploader) Upload(ctx context.Context, filename string, r io.Reader) error {
+	return u.SMBClient.Upload(ctx, filename, newResumableSource(r, u.size, u.etag))
+}
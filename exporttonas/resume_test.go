@@ -0,0 +1,94 @@
+package exporttonas
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// seekRecorder records the offset the source was advanced to by seeking.
+type seekRecorder struct {
+	*strings.Reader
+	offset int64
+}
+
+func (s *seekRecorder) Seek(offset int64, whence int) (int64, error) {
+	s.offset = offset
+	return s.Reader.Seek(offset, whence)
+}
+
+func TestUploadToShareResume(t *testing.T) {
+	defer func(resume bool) { NAS_RESUME_UPLOADS = resume }(NAS_RESUME_UPLOADS)
+
+	content := strings.Repeat("1,alice\n", 10000)
+	tests := []struct {
+		name       string
+		resume     bool
+		retryEtag  string
+		wantPart   bool
+		wantOffset int64
+	}{
+		{"resumed", true, "etag-1", true, 30000},
+		{"source changed", true, "etag-2", true, 0},
+		{"resuming disabled", false, "etag-1", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			NAS_RESUME_UPLOADS = tt.resume
+			share := newMemShare()
+
+			// The first attempt fails after writing part of the content
+			interrupted := failingReader{strings.NewReader(content[:30000])}
+			if err := uploadToShare(share, "report.csv", newResumableSource(interrupted, int64(len(content)), "etag-1")); err == nil {
+				t.Fatal("interrupted uploadToShare() error = nil, want error")
+			}
+			if _, ok := share.content("report.csv.part"); ok != tt.wantPart {
+				t.Fatalf("temporary file kept %t after the interrupted upload, want %t", ok, tt.wantPart)
+			}
+
+			source := &seekRecorder{Reader: strings.NewReader(content)}
+			if err := uploadToShare(share, "report.csv", newResumableSource(source, int64(len(content)), tt.retryEtag)); err != nil {
+				t.Fatalf("retried uploadToShare() error = %v", err)
+			}
+			if source.offset != tt.wantOffset {
+				t.Errorf("retry resumed at offset %d, want %d", source.offset, tt.wantOffset)
+			}
+			if got, _ := share.content("report.csv"); got != content {
+				t.Errorf("report.csv holds %d bytes, want %d", len(got), len(content))
+			}
+			if got := share.names(); strings.Join(got, ",") != "report.csv" {
+				t.Errorf("share holds %q, want only report.csv", got)
+			}
+		})
+	}
+}
+
+func TestSkipSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  io.Reader
+		offset  int64
+		want    string
+		wantErr bool
+	}{
+		{"seekable", strings.NewReader("id,name\n1,alice\n"), 8, "1,alice\n", false},
+		{"not seekable", io.MultiReader(strings.NewReader("id,name\n1,alice\n")), 8, "1,alice\n", false},
+		{"source too short", io.MultiReader(strings.NewReader("id,name\n")), 16, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := skipSource(tt.source, tt.offset)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("skipSource() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if rest, _ := io.ReadAll(tt.source); string(rest) != tt.want {
+				t.Errorf("source continues with %q, want %q", rest, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package exporttonas
+
+import (
+	"io"
+	"os"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// shareFS is the subset of smb2.Share operations used by uploads, so they
+// can be tested without a NAS.
+type shareFS interface {
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Create(name string) (shareFile, error)
+	OpenFile(name string, flag int, perm os.FileMode) (shareFile, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	ReadFile(filename string) ([]byte, error)
+	WriteFile(filename string, data []byte, perm os.FileMode) error
+}
+
+// shareFile is a file opened for writing within the share.
+type shareFile interface {
+	io.WriteSeeker
+	io.Closer
+}
+
+// smbShare implements shareFS with a mounted SMB share.
+type smbShare struct {
+	*smb2.Share
+}
+
+func (s smbShare) Create(name string) (shareFile, error) {
+	f, err := s.Share.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (s smbShare) OpenFile(name string, flag int, perm os.FileMode) (shareFile, error) {
+	f, err := s.Share.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,203 @@
+package exporttonas
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memShare is an in-memory shareFS. Like on SMB, written content is
+// visible to readers of the share right away and renames don't replace
+// existing files.
+type memShare struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+func newMemShare() *memShare {
+	return &memShare{files: map[string][]byte{}, dirs: map[string]bool{".": true}}
+}
+
+// names returns names of the files in the share in lexical order.
+func (s *memShare) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// content returns content of the file and whether it exists.
+func (s *memShare) content(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.files[name]
+	return string(data), ok
+}
+
+func (s *memShare) Stat(name string) (os.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dirs[name] {
+		return memFileInfo{name: path.Base(name), dir: true}, nil
+	}
+	data, ok := s.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return memFileInfo{name: path.Base(name), size: int64(len(data))}, nil
+}
+
+func (s *memShare) MkdirAll(dir string, perm os.FileMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		s.dirs[dir] = true
+	}
+
+	return nil
+}
+
+func (s *memShare) Create(name string) (shareFile, error) {
+	return s.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (s *memShare) OpenFile(name string, flag int, perm os.FileMode) (shareFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirs[path.Dir(name)] {
+		return nil, os.ErrNotExist
+	}
+	if _, ok := s.files[name]; !ok && flag&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+	if flag&os.O_TRUNC != 0 || s.files[name] == nil {
+		s.files[name] = []byte{}
+	}
+
+	return &memFile{share: s, name: name}, nil
+}
+
+func (s *memShare) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[name]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.files, name)
+
+	return nil
+}
+
+func (s *memShare) Rename(oldpath, newpath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.files[oldpath]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if _, ok := s.files[newpath]; ok {
+		return os.ErrExist
+	}
+	s.files[newpath] = data
+	delete(s.files, oldpath)
+
+	return nil
+}
+
+func (s *memShare) ReadFile(filename string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.files[filename]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return append([]byte(nil), data...), nil
+}
+
+func (s *memShare) WriteFile(filename string, data []byte, perm os.FileMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirs[path.Dir(filename)] {
+		return os.ErrNotExist
+	}
+	s.files[filename] = append([]byte(nil), data...)
+
+	return nil
+}
+
+// memFile writes into a file of memShare at its offset.
+type memFile struct {
+	share  *memShare
+	name   string
+	offset int64
+	closed bool
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.share.mu.Lock()
+	defer f.share.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	data, ok := f.share.files[f.name]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	if end := f.offset + int64(len(p)); end > int64(len(data)) {
+		data = append(data, make([]byte, end-int64(len(data)))...)
+	}
+	copy(data[f.offset:], p)
+	f.share.files[f.name] = data
+	f.offset += int64(len(p))
+
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart || offset < 0 {
+		return 0, errors.New("unsupported seek")
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return 0644 }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,25 @@
+package exporttonas
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// handleShutdown stops the shared clients when the instance is stopped,
+// so export events which are still pending are sent before exiting.
+func handleShutdown() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %v, shutting down", sig)
+
+		exporter.Shutdown()
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,32 @@
+package exporttonas
+
+import (
+	"net"
+	"time"
+)
+
+// deadlineConn sets a deadline before each write to the connection, so a
+// NAS which stops reading fails the write instead of blocking it forever.
+// Reads are left without deadline, as the SMB client keeps reading replies
+// in background, also while the connection is idle.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// newDeadlineConn wraps the connection when NAS_WRITE_TIMEOUT is set.
+func newDeadlineConn(conn net.Conn) net.Conn {
+	if NAS_WRITE_TIMEOUT <= 0 {
+		return conn
+	}
+
+	return &deadlineConn{Conn: conn, timeout: NAS_WRITE_TIMEOUT}
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,97 @@
+package exporttonas
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeadlineConn(t *testing.T) {
+	defer func(timeout time.Duration) { NAS_WRITE_TIMEOUT = timeout }(NAS_WRITE_TIMEOUT)
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		wrapped bool
+	}{
+		{"write timeout", 50 * time.Millisecond, true},
+		{"disabled", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			NAS_WRITE_TIMEOUT = tt.timeout
+			conn, nas := net.Pipe()
+			defer conn.Close()
+			defer nas.Close()
+
+			got := newDeadlineConn(conn)
+			if _, wrapped := got.(*deadlineConn); wrapped != tt.wrapped {
+				t.Fatalf("newDeadlineConn() wrapped the connection %t, want %t", wrapped, tt.wrapped)
+			}
+			if !tt.wrapped {
+				return
+			}
+
+			// The NAS never reads, so the write must fail on the deadline.
+			start := time.Now()
+			_, err := got.Write([]byte("write request"))
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("Write() error = %v, want %v", err, os.ErrDeadlineExceeded)
+			}
+			if elapsed := time.Since(start); elapsed > tt.timeout+time.Second {
+				t.Errorf("Write() failed after %s, want about %s", elapsed, tt.timeout)
+			}
+		})
+	}
+}
+
+func TestNewSMBClientDialTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { NAS_DIAL_TIMEOUT = timeout }(NAS_DIAL_TIMEOUT)
+	NAS_DIAL_TIMEOUT = 200 * time.Millisecond
+
+	// Addresses of TEST-NET-1 are never routed, packets to them are dropped.
+	start := time.Now()
+	if _, err := newSMBClient(context.Background(), "192.0.2.1", "user", "pass", "share"); err == nil {
+		t.Fatal("newSMBClient() error = nil, want the dial failed")
+	}
+	if elapsed := time.Since(start); elapsed > NAS_DIAL_TIMEOUT+time.Second {
+		t.Errorf("dial failed after %s, want within %s", elapsed, NAS_DIAL_TIMEOUT)
+	}
+}
+
+func TestNewSMBClientSetupTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { NAS_OPERATION_TIMEOUT = timeout }(NAS_OPERATION_TIMEOUT)
+	NAS_OPERATION_TIMEOUT = 200 * time.Millisecond
+
+	// The NAS accepts connections, but never answers the negotiation.
+	ln, err := net.Listen("tcp", "127.0.0.1:445")
+	if err != nil {
+		t.Skipf("unable to listen on the SMB port: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	start := time.Now()
+	if _, err := newSMBClient(context.Background(), "127.0.0.1", "user", "pass", "share"); err == nil {
+		t.Fatal("newSMBClient() error = nil, want the session setup failed")
+	}
+	if elapsed := time.Since(start); elapsed > NAS_OPERATION_TIMEOUT+time.Second {
+		t.Errorf("session setup failed after %s, want within %s", elapsed, NAS_OPERATION_TIMEOUT)
+	}
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	default:
+		t.Error("newSMBClient() never connected to the NAS")
+	}
+}
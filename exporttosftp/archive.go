@@ -0,0 +1,168 @@
+package exporttosftp
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+var (
+	// Suffix of trigger objects exporting their group as a single tar
+	// archive. The group is the folder named by the trigger without the
+	// suffix, e.g. "in/batch-42.done" bundles all objects under "in/batch-42/".
+	// Objects in folders are exported only within archives of their group,
+	// objects at the bucket root belong to no group and are exported on their
+	// own. Archive mode is disabled when empty
+	ARCHIVE_TRIGGER_SUFFIX = ""
+	// Template of the archive name, supports {group} (base name of the group)
+	// and {date} placeholders
+	ARCHIVE_NAME_TEMPLATE = "{group}.tar"
+	// Compress the archive with gzip, adding ".gz" to its name
+	ARCHIVE_GZIP = false
+)
+
+// isArchiveTrigger reports whether the object triggers export of its group
+func isArchiveTrigger(object string) bool {
+	return ARCHIVE_TRIGGER_SUFFIX != "" && strings.HasSuffix(object, ARCHIVE_TRIGGER_SUFFIX)
+}
+
+// archiveGroup returns the folder bundled by the trigger
+func archiveGroup(trigger string) string {
+	return strings.TrimSuffix(trigger, ARCHIVE_TRIGGER_SUFFIX) + "/"
+}
+
+// isArchiveMember reports whether the object is exported only within the
+// archive of its group, which holds for objects in folders. Triggers arrive
+// after their members, so membership can't depend on the trigger existence
+func isArchiveMember(object string) bool {
+	return ARCHIVE_TRIGGER_SUFFIX != "" && !isArchiveTrigger(object) && strings.Contains(object, "/")
+}
+
+// archiveName returns name of the archive of the group built from
+// ARCHIVE_NAME_TEMPLATE
+func archiveName(group string, t time.Time) string {
+	name := strings.NewReplacer(
+		"{group}", path.Base(group),
+		"{date}", t.Format("20060102"),
+	).Replace(ARCHIVE_NAME_TEMPLATE)
+	if ARCHIVE_GZIP {
+		name += ".gz"
+	}
+
+	return name
+}
+
+// archiveMembers lists objects of the group which would be exported on their own
+func archiveMembers(ctx context.Context, bucket, trigger string) ([]*storage.ObjectAttrs, error) {
+	attrs, err := exporter.Objects.List(ctx, bucket, archiveGroup(trigger))
+	if err != nil {
+		return nil, fmt.Errorf("Bucket(%q).Objects: %w", bucket, err)
+	}
+
+	var members []*storage.ObjectAttrs
+	for _, a := range attrs {
+		if a.Name == trigger || !hasExportExtension(a.Name) || leftForRename(a.Name) || isInlineRenamed(a.Name) || exporter.IsIgnored(a.Name) || exporter.IsHidden(a.Name) {
+			continue
+		}
+		members = append(members, a)
+	}
+
+	return members, nil
+}
+
+// exportArchive streams objects of the trigger's group into a tar archive
+// uploaded to the destination, returning the archive name, size and checksum
+func exportArchive(ctx context.Context, bucket, trigger, folder, tenant string) (string, int64, string, error) {
+	members, err := archiveMembers(ctx, bucket, trigger)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if len(members) == 0 {
+		return "", 0, "", fmt.Errorf("no objects to archive for trigger %s", trigger)
+	}
+
+	remoteName := sanitizeFileName(archiveName(archiveGroup(trigger), time.Now()))
+	log.Printf("Archiving %d objects of %s into %s", len(members), trigger, remoteName)
+
+	up, err := newUploader(ctx, folder, tenant)
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer up.Close()
+
+	// Write the archive while it is uploaded, without buffering it
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeArchive(ctx, pw, bucket, members))
+	}()
+
+	digest := newUploadDigest([]string{exporter.CHECKSUM_ALGORITHM})
+	if err := up.Upload(ctx, remoteName, io.TeeReader(pr, digest)); err != nil {
+		pr.CloseWithError(err)
+		return "", 0, "", err
+	}
+	sum := fmt.Sprintf("%x", digest.hashes[exporter.CHECKSUM_ALGORITHM].Sum(nil))
+
+	return remoteName, digest.size, sum, nil
+}
+
+// writeArchive writes the objects as entries of a tar archive, gzipped
+// when ARCHIVE_GZIP is set. Entries keep the object names
+func writeArchive(ctx context.Context, w io.Writer, bucket string, members []*storage.ObjectAttrs) error {
+	var gz *gzip.Writer
+	if ARCHIVE_GZIP {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+
+	for _, a := range members {
+		if err := writeArchiveEntry(ctx, tw, bucket, a); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("tar.Close: %w", err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("gzip.Close: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// writeArchiveEntry copies the given generation of an object into the archive
+func writeArchiveEntry(ctx context.Context, tw *tar.Writer, bucket string, a *storage.ObjectAttrs) error {
+	rc, err := exporter.NewRetryReader(ctx, bucket, a.Name, a.Generation)
+	if err != nil {
+		return fmt.Errorf("Object(%q).NewRangeReader: %w", a.Name, err)
+	}
+	defer rc.Close()
+
+	hdr := &tar.Header{
+		Name:    a.Name,
+		Mode:    0644,
+		Size:    a.Size,
+		ModTime: a.Updated,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("tar.WriteHeader: %w", err)
+	}
+	if _, err := io.Copy(tw, exporter.NewVerifiedReader(rc, a.Name, exporter.StoredChecksum(a.Name, a.Metadata))); err != nil {
+		return fmt.Errorf("unable to archive object %s: %w", a.Name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package exporttosftp
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+)
+
+func TestArchiveName(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		template string
+		gzip     bool
+		want     string
+	}{
+		{"{group}.tar", false, "batch-42.tar"},
+		{"{group}.tar", true, "batch-42.tar.gz"},
+		{"partner-{group}-{date}.tar", false, "partner-batch-42-20240601.tar"},
+		{"bundle.tar", false, "bundle.tar"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			defer func(template string, gzip bool) { ARCHIVE_NAME_TEMPLATE, ARCHIVE_GZIP = template, gzip }(ARCHIVE_NAME_TEMPLATE, ARCHIVE_GZIP)
+			ARCHIVE_NAME_TEMPLATE, ARCHIVE_GZIP = tt.template, tt.gzip
+
+			if got := archiveName("in/batch-42/", now); got != tt.want {
+				t.Errorf("archiveName(%q) = %q, want %q", "in/batch-42/", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchiveGroups(t *testing.T) {
+	defer func(suffix string) { ARCHIVE_TRIGGER_SUFFIX = suffix }(ARCHIVE_TRIGGER_SUFFIX)
+
+	tests := []struct {
+		suffix      string
+		object      string
+		wantTrigger bool
+		wantMember  bool
+	}{
+		{".done", "in/batch-42.done", true, false},
+		{".done", "in/batch-42/report.csv", false, true},
+		{".done", "report.csv", false, false},
+		{"", "in/batch-42.done", false, false},
+		{"", "in/batch-42/report.csv", false, false},
+	}
+
+	for _, tt := range tests {
+		ARCHIVE_TRIGGER_SUFFIX = tt.suffix
+		if got := isArchiveTrigger(tt.object); got != tt.wantTrigger {
+			t.Errorf("isArchiveTrigger(%q) with suffix %q = %t, want %t", tt.object, tt.suffix, got, tt.wantTrigger)
+		}
+		if got := isArchiveMember(tt.object); got != tt.wantMember {
+			t.Errorf("isArchiveMember(%q) with suffix %q = %t, want %t", tt.object, tt.suffix, got, tt.wantMember)
+		}
+	}
+
+	ARCHIVE_TRIGGER_SUFFIX = ".done"
+	if got := archiveGroup("in/batch-42.done"); got != "in/batch-42/" {
+		t.Errorf("archiveGroup(%q) = %q, want %q", "in/batch-42.done", got, "in/batch-42/")
+	}
+}
+
+// readArchive returns content of the tar archive entries by name
+func readArchive(t *testing.T, data []byte, gzipped bool) map[string]string {
+	t.Helper()
+
+	var r io.Reader = bytes.NewReader(data)
+	if gzipped {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatalf("gzip.NewReader: %v", err)
+		}
+		r = gz
+	}
+
+	entries := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("unable to read archive: %v", err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unable to read archive entry %s: %v", hdr.Name, err)
+		}
+		entries[hdr.Name] = string(content)
+	}
+}
+
+func TestExportArchive(t *testing.T) {
+	defer func(suffix, template string, gzip bool) {
+		ARCHIVE_TRIGGER_SUFFIX, ARCHIVE_NAME_TEMPLATE, ARCHIVE_GZIP = suffix, template, gzip
+	}(ARCHIVE_TRIGGER_SUFFIX, ARCHIVE_NAME_TEMPLATE, ARCHIVE_GZIP)
+	ARCHIVE_TRIGGER_SUFFIX, ARCHIVE_NAME_TEMPLATE = ".done", "{group}.tar"
+
+	want := map[string]string{
+		"in/batch-42/orders.csv":       "id,amount\n1,10\n",
+		"in/batch-42/daily/report.csv": "id,name\n1,alice\n",
+	}
+
+	for _, gzipped := range []bool{false, true} {
+		t.Run("gzip "+strconv.FormatBool(gzipped), func(t *testing.T) {
+			ARCHIVE_GZIP = gzipped
+			srv := useSFTPServer(t)
+			store := exportertest.NewStore().Use(t)
+			for name, content := range want {
+				store.Put("bucket", name, []byte(content), nil)
+			}
+			store.Put("bucket", "in/batch-42/report.csv~", []byte("id,name\n"), nil)
+			store.Put("bucket", "in/batch-42/notes.xml", []byte("<notes/>"), nil)
+			store.Put("bucket", "in/batch-43/other.csv", []byte("id,name\n"), nil)
+
+			// Members arriving on their own wait for the trigger of their group
+			if err := exportStored(t, store, "in/batch-42/orders.csv", []byte(want["in/batch-42/orders.csv"]), nil); err != nil {
+				t.Fatalf("export of a member error = %v", err)
+			}
+			if _, err := srv.ReadFile("in/batch-42/orders.csv"); err == nil {
+				t.Error("member exported on its own")
+			}
+
+			if err := exportStored(t, store, "in/batch-42.done", nil, nil); err != nil {
+				t.Fatalf("export of the trigger error = %v", err)
+			}
+			name := archiveName("in/batch-42/", time.Now())
+			data, err := srv.ReadFile(name)
+			if err != nil {
+				t.Fatalf("archive %s not exported: %v", name, err)
+			}
+			if got := readArchive(t, data, gzipped); !reflect.DeepEqual(got, want) {
+				t.Errorf("archive %s holds %v, want %v", name, got, want)
+			}
+		})
+	}
+}
+
+func TestExportArchiveRootObject(t *testing.T) {
+	defer func(suffix string) { ARCHIVE_TRIGGER_SUFFIX = suffix }(ARCHIVE_TRIGGER_SUFFIX)
+	ARCHIVE_TRIGGER_SUFFIX = ".done"
+	srv := useSFTPServer(t)
+	store := exportertest.NewStore().Use(t)
+
+	// Objects outside of folders belong to no group and are exported alone
+	if err := exportStored(t, store, "report.csv", []byte("id,name\n"), nil); err != nil {
+		t.Fatalf("export error = %v", err)
+	}
+	if err := srv.AssertFile("report.csv", []byte("id,name\n")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,61 @@
+package exporttosftp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/ealebed/gcp-cf/exporttosftp/internal/sftptest"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+)
+
+// useSFTPServer starts an in-process SFTP server and configures it as the
+// default destination until the test ends
+func useSFTPServer(t *testing.T) *sftptest.Server {
+	t.Helper()
+
+	srv, err := sftptest.NewServer("user", "pass")
+	if err != nil {
+		t.Fatalf("unable to start SFTP server: %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	protocol, host, port, user, pass, hostKey := PROTOCOL, SFTP_HOST, SFTP_PORT, SFTP_USER, SFTP_PASS, sftpHostKey
+	t.Cleanup(func() {
+		PROTOCOL, SFTP_HOST, SFTP_PORT, SFTP_USER, SFTP_PASS, sftpHostKey = protocol, host, port, user, pass, hostKey
+
+		// Drop the connection pooled by the test
+		sftpPoolMu.Lock()
+		defer sftpPoolMu.Unlock()
+		if c := sftpPool[""]; c != nil {
+			delete(sftpPool, "")
+			c.close()
+		}
+	})
+	PROTOCOL, SFTP_HOST, SFTP_PORT, SFTP_USER, SFTP_PASS, sftpHostKey = "sftp", srv.Host, srv.Port, srv.User, srv.Password, srv.HostKey
+
+	return srv
+}
+
+// exportStored stores the object and runs its export by the SFTP backend,
+// like the event of its creation does
+func exportStored(t *testing.T, store *exportertest.Store, objectName string, content []byte, metadata map[string]string) error {
+	t.Helper()
+
+	generation := store.Put("bucket", objectName, content, metadata)
+	x := exporter.NewExport(&storagedata.StorageObjectData{
+		Bucket:     "bucket",
+		Name:       objectName,
+		Generation: generation,
+		Size:       int64(len(content)),
+		Metadata:   metadata,
+	})
+
+	deliver, err := sftpBackend{}.Accept(context.Background(), x)
+	if err != nil || deliver == nil {
+		return err
+	}
+
+	return deliver(context.Background())
+}
@@ -0,0 +1,208 @@
+package exporttosftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// SFTP packet types used by the check-file extension
+const (
+	sshFxpInit          = 1
+	sshFxpVersion       = 2
+	sshFxpStatus        = 101
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+)
+
+// Maximal size of SFTP packets accepted from the server while verifying uploads
+const maxCheckFilePacket = 256 << 10
+
+// Verify uploaded files using the server reported hash or size. Hashes
+// are requested over an additional SSH session after every upload
+var SFTP_VERIFY_UPLOAD = false
+
+// verifyRemoteFile compares the uploaded remote file with the digest of
+// uploaded content. When the digest has hashes, as the server advertises
+// check-file extension, the remote hash is compared with the local one,
+// otherwise only file sizes are compared
+func verifyRemoteFile(c *sftpConn, remotePath string, digest *uploadDigest) error {
+	if len(digest.hashes) > 0 {
+		algorithm, remoteSum, err := remoteFileHash(c, remotePath, checkFileAlgorithms())
+		if err == nil {
+			if localSum := digest.hashes[algorithm].Sum(nil); !bytes.Equal(localSum, remoteSum) {
+				return fmt.Errorf("remote file [%s] %s=%x doesn't match local %s=%x", remotePath, algorithm, remoteSum, algorithm, localSum)
+			}
+			log.Printf("Verified remote file [%s] %s=%x", remotePath, algorithm, remoteSum)
+			return nil
+		}
+		log.Printf("unable to get hash of remote file [%s], comparing sizes: %v", remotePath, err)
+	}
+
+	info, err := c.client.Stat(remotePath)
+	if err != nil {
+		return fmt.Errorf("unable to stat remote file: %v", err)
+	}
+	if info.Size() != digest.size {
+		return fmt.Errorf("remote file [%s] has %d bytes, expected %d", remotePath, info.Size(), digest.size)
+	}
+
+	return nil
+}
+
+// checkFileAlgorithms returns hash algorithms requested from the server in
+// order of preference, starting with CHECKSUM_ALGORITHM
+func checkFileAlgorithms() []string {
+	algorithms := []string{exporter.CHECKSUM_ALGORITHM}
+	for _, name := range []string{"sha512", "sha256", "sha1", "md5"} {
+		if name != exporter.CHECKSUM_ALGORITHM {
+			algorithms = append(algorithms, name)
+		}
+	}
+
+	return algorithms
+}
+
+// remoteFileHash requests hash of the whole remote file with check-file-name
+// extended request. The sftp package has no API for custom extended
+// requests, so they are sent over a separate SFTP session on the pooled
+// SSH connection
+func remoteFileHash(c *sftpConn, remotePath string, algorithms []string) (string, []byte, error) {
+	session, err := c.ssh.NewSession()
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to open SSH session: %w", err)
+	}
+	defer session.Close()
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		return "", nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return "", nil, fmt.Errorf("unable to start SFTP subsystem: %w", err)
+	}
+
+	// Negotiate SFTP protocol version 3, as the sftp package does
+	if err := writePacket(w, sshFxpInit, marshalUint32(nil, 3)); err != nil {
+		return "", nil, err
+	}
+	if typ, _, err := readPacket(r); err != nil {
+		return "", nil, err
+	} else if typ != sshFxpVersion {
+		return "", nil, fmt.Errorf("unexpected SFTP packet type %d, expected version", typ)
+	}
+
+	// Hash whole file (offset and length 0) as a single block (block size 0)
+	payload := marshalUint32(nil, 1)
+	payload = marshalString(payload, "check-file-name")
+	payload = marshalString(payload, remotePath)
+	payload = marshalString(payload, strings.Join(algorithms, ","))
+	payload = binary.BigEndian.AppendUint64(payload, 0)
+	payload = binary.BigEndian.AppendUint64(payload, 0)
+	payload = marshalUint32(payload, 0)
+	if err := writePacket(w, sshFxpExtended, payload); err != nil {
+		return "", nil, err
+	}
+
+	typ, reply, err := readPacket(r)
+	if err != nil {
+		return "", nil, err
+	}
+	// Both replies start with the request id
+	if len(reply) < 4 {
+		return "", nil, fmt.Errorf("short SFTP packet")
+	}
+	reply = reply[4:]
+
+	switch typ {
+	case sshFxpExtendedReply:
+		// Reply: string "check-file", string hash algorithm used and the
+		// raw hash of the single block filling the rest of the packet
+		name, rest, err := unmarshalString(reply)
+		if err != nil {
+			return "", nil, err
+		}
+		if name != "check-file" {
+			return "", nil, fmt.Errorf("unexpected extended reply %q, expected check-file", name)
+		}
+		algorithm, sum, err := unmarshalString(rest)
+		if err != nil {
+			return "", nil, err
+		}
+		newHash, ok := exporter.ChecksumAlgorithms[algorithm]
+		if !ok {
+			return "", nil, fmt.Errorf("unsupported hash algorithm %q", algorithm)
+		}
+		if size := newHash().Size(); len(sum) != size {
+			return "", nil, fmt.Errorf("%s hash has %d bytes, expected %d", algorithm, len(sum), size)
+		}
+		return algorithm, sum, nil
+	case sshFxpStatus:
+		if len(reply) < 4 {
+			return "", nil, fmt.Errorf("short SFTP status packet")
+		}
+		msg, _, _ := unmarshalString(reply[4:])
+		return "", nil, fmt.Errorf("check-file failed with status %d: %s", binary.BigEndian.Uint32(reply), msg)
+	default:
+		return "", nil, fmt.Errorf("unexpected SFTP packet type %d", typ)
+	}
+}
+
+// writePacket writes SFTP packet of the type with the payload
+func writePacket(w io.Writer, typ byte, payload []byte) error {
+	packet := marshalUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	packet = append(packet, payload...)
+	_, err := w.Write(packet)
+
+	return err
+}
+
+// readPacket reads SFTP packet, returning its type and payload
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, nil, fmt.Errorf("unable to read SFTP packet: %w", err)
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size == 0 || size > maxCheckFilePacket {
+		return 0, nil, fmt.Errorf("invalid SFTP packet length %d", size)
+	}
+
+	packet := make([]byte, size)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, nil, fmt.Errorf("unable to read SFTP packet: %w", err)
+	}
+
+	return packet[0], packet[1:], nil
+}
+
+func marshalUint32(b []byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32(b, v)
+}
+
+func marshalString(b []byte, s string) []byte {
+	return append(marshalUint32(b, uint32(len(s))), s...)
+}
+
+// unmarshalString returns SSH string from the beginning of b and the rest of b
+func unmarshalString(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, fmt.Errorf("short SFTP string")
+	}
+	size := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < size {
+		return "", nil, fmt.Errorf("short SFTP string")
+	}
+
+	return string(b[4 : 4+size]), b[4+size:], nil
+}
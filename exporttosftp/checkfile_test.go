@@ -0,0 +1,176 @@
+package exporttosftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/exporttosftp/internal/sftptest"
+)
+
+func TestUploadToSFTPVerify(t *testing.T) {
+	content := strings.Repeat("1,alice\n", 10000)
+
+	tests := []struct {
+		name         string
+		verify       bool
+		checkFile    string
+		corrupt      bool
+		wantErr      bool
+		wantRequests int
+	}{
+		{"verification disabled", false, "sha256", true, false, 0},
+		{"check-file hash", true, "sha256", false, false, 1},
+		{"other check-file algorithm", true, "md5", false, false, 1},
+		{"corrupted check-file hash", true, "sha256", true, true, 1},
+		{"unsupported check-file algorithm", true, "crc32", false, false, 1},
+		{"size without check-file", true, "", false, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(verify bool) { SFTP_VERIFY_UPLOAD = verify }(SFTP_VERIFY_UPLOAD)
+			SFTP_VERIFY_UPLOAD = tt.verify
+
+			srv, err := sftptest.NewServer("user", "pass")
+			if err != nil {
+				t.Fatalf("unable to start SFTP server: %v", err)
+			}
+			defer srv.Close()
+			srv.CheckFile(tt.checkFile, tt.corrupt)
+
+			c, err := newSFTPClient(srv.Host, srv.Port, srv.User, srv.Password, srv.HostKey)
+			if err != nil {
+				t.Fatalf("newSFTPClient() error = %v", err)
+			}
+			defer c.ssh.Close()
+			defer c.client.Close()
+
+			err = uploadToSFTP(context.Background(), c, "report.csv", "/", strings.NewReader(content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("uploadToSFTP() error = %v, want error %t", err, tt.wantErr)
+			}
+			if got := srv.CheckFileRequests(); got != tt.wantRequests {
+				t.Errorf("%d check-file requests, want %d", got, tt.wantRequests)
+			}
+
+			if tt.wantErr {
+				for _, name := range []string{"/report.csv", "/report.csv" + SFTP_PART_SUFFIX} {
+					if _, err := srv.ReadFile(name); !errors.Is(err, os.ErrNotExist) {
+						t.Errorf("%s exists after the failed verification: %v", name, err)
+					}
+				}
+				return
+			}
+			if err := srv.AssertFile("/report.csv", []byte(content)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestVerifyRemoteFileSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int64
+		wantErr bool
+	}{
+		{"same size", 11, false},
+		{"truncated remote file", 12, true},
+		{"longer remote file", 10, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, c := startSFTPServer(t)
+			if err := srv.WriteFile("/report.csv", []byte("old content")); err != nil {
+				t.Fatalf("unable to write remote file: %v", err)
+			}
+
+			digest := newUploadDigest(nil)
+			digest.size = tt.size
+			if err := verifyRemoteFile(c, "/report.csv", digest); (err != nil) != tt.wantErr {
+				t.Errorf("verifyRemoteFile() with %d bytes error = %v, want error %t", tt.size, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckFileAlgorithms(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		want      string
+	}{
+		{"sha256", "sha256,sha512,sha1,md5"},
+		{"sha512", "sha512,sha256,sha1,md5"},
+		{"md5", "md5,sha512,sha256,sha1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			defer func(algorithm string) { exporter.CHECKSUM_ALGORITHM = algorithm }(exporter.CHECKSUM_ALGORITHM)
+			exporter.CHECKSUM_ALGORITHM = tt.algorithm
+
+			if got := strings.Join(checkFileAlgorithms(), ","); got != tt.want {
+				t.Errorf("checkFileAlgorithms() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	tests := []struct {
+		name        string
+		packet      []byte
+		wantType    byte
+		wantPayload string
+		wantErr     bool
+	}{
+		{"version packet", []byte("\x00\x00\x00\x05\x02\x00\x00\x00\x03"), sshFxpVersion, "\x00\x00\x00\x03", false},
+		{"empty packet", []byte("\x00\x00\x00\x00"), 0, "", true},
+		{"oversized packet", []byte("\x00\x10\x00\x00\x02"), 0, "", true},
+		{"truncated packet", []byte("\x00\x00\x00\x05\x02\x00"), 0, "", true},
+		{"truncated length", []byte("\x00\x00"), 0, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, payload, err := readPacket(bytes.NewReader(tt.packet))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readPacket() error = %v, want error %t", err, tt.wantErr)
+			}
+			if typ != tt.wantType || string(payload) != tt.wantPayload {
+				t.Errorf("readPacket() = %d, %q, want %d, %q", typ, payload, tt.wantType, tt.wantPayload)
+			}
+		})
+	}
+}
+
+func TestUnmarshalString(t *testing.T) {
+	tests := []struct {
+		data     string
+		want     string
+		wantRest string
+		wantErr  bool
+	}{
+		{"\x00\x00\x00\x06sha256rest", "sha256", "rest", false},
+		{"\x00\x00\x00\x00", "", "", false},
+		{"\x00\x00\x00\x06sha", "", "", true},
+		{"\x00\x00", "", "", true},
+	}
+
+	for _, tt := range tests {
+		got, rest, err := unmarshalString([]byte(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("unmarshalString(%q) error = %v, want error %t", tt.data, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want || string(rest) != tt.wantRest {
+			t.Errorf("unmarshalString(%q) = %q, %q, want %q, %q", tt.data, got, rest, tt.want, tt.wantRest)
+		}
+	}
+}
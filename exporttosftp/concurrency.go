@@ -0,0 +1,118 @@
+package exporttosftp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+var (
+	// Maximum number of concurrent uploads to a destination within an
+	// instance, 0 means unlimited. Uploads beyond the limit are queued
+	MAX_CONCURRENT_UPLOADS = 0
+	// Per-destination limits overriding MAX_CONCURRENT_UPLOADS, keyed by
+	// SFTP host, S3 bucket or webhook host
+	DESTINATION_CONCURRENCY = map[string]int{}
+	// Guards uploadSlots
+	uploadSlotsMu sync.Mutex
+	// Semaphores limiting concurrent uploads of each destination
+	uploadSlots = map[string]chan struct{}{}
+)
+
+// parseDestinationConcurrency parses comma separated "destination=limit" pairs
+func parseDestinationConcurrency(value string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		destination, limit, ok := strings.Cut(pair, "=")
+		if !ok || destination == "" {
+			return nil, fmt.Errorf("invalid pair %q, expected destination=limit", pair)
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid limit of destination %q: %q", destination, limit)
+		}
+		limits[destination] = n
+	}
+
+	return limits, nil
+}
+
+// uploadDestination returns name of the destination uploads of the tenant
+// go to, as used in DESTINATION_CONCURRENCY
+func uploadDestination(ctx context.Context, tenant string) (string, error) {
+	switch PROTOCOL {
+	case "s3":
+		return S3_BUCKET, nil
+	case "webhook":
+		u, err := url.Parse(WEBHOOK_URL)
+		if err != nil {
+			return "", fmt.Errorf("invalid WEBHOOK_URL: %w", err)
+		}
+		return u.Host, nil
+	default:
+		// Host of a tenant is known once its credentials are loaded
+		if tenant != "" {
+			if _, err := tenantCredentials(ctx, tenant); err != nil {
+				return "", err
+			}
+		}
+		return tenantHost(tenant), nil
+	}
+}
+
+// acquireUploadSlot waits until an upload to the destination is allowed by
+// its concurrency limit, returning function which releases the slot
+func acquireUploadSlot(ctx context.Context, destination string) (func(), error) {
+	limit, ok := DESTINATION_CONCURRENCY[destination]
+	if !ok {
+		limit = MAX_CONCURRENT_UPLOADS
+	}
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	uploadSlotsMu.Lock()
+	slots, ok := uploadSlots[destination]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		uploadSlots[destination] = slots
+	}
+	uploadSlotsMu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		log.Printf("Upload to %s queued, %d uploads are in progress", destination, limit)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for upload slot of %s: %w", destination, ctx.Err())
+		}
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }, nil
+}
+
+// limitedUploader holds an upload slot of its destination until closed
+type limitedUploader struct {
+	exporter.Uploader
+	release func()
+}
+
+func (u limitedUploader) Close() error {
+	defer u.release()
+
+	return u.Uploader.Close()
+}
@@ -0,0 +1,158 @@
+package exporttosftp
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseDestinationConcurrency(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]int
+		wantErr bool
+	}{
+		{"sftp.example.com=1", map[string]int{"sftp.example.com": 1}, false},
+		{"sftp.example.com=1, partner-bucket=4,", map[string]int{"sftp.example.com": 1, "partner-bucket": 4}, false},
+		{"sftp.example.com=0", map[string]int{"sftp.example.com": 0}, false},
+		{"", map[string]int{}, false},
+		{"sftp.example.com", nil, true},
+		{"=1", nil, true},
+		{"sftp.example.com=-1", nil, true},
+		{"sftp.example.com=many", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseDestinationConcurrency(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDestinationConcurrency(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDestinationConcurrency(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+// useUploadLimits limits concurrent uploads with fresh semaphores until the
+// test ends
+func useUploadLimits(t *testing.T, max int, limits map[string]int) {
+	prevMax, prevLimits, prevSlots := MAX_CONCURRENT_UPLOADS, DESTINATION_CONCURRENCY, uploadSlots
+	t.Cleanup(func() { MAX_CONCURRENT_UPLOADS, DESTINATION_CONCURRENCY, uploadSlots = prevMax, prevLimits, prevSlots })
+	MAX_CONCURRENT_UPLOADS, DESTINATION_CONCURRENCY, uploadSlots = max, limits, map[string]chan struct{}{}
+}
+
+func TestAcquireUploadSlot(t *testing.T) {
+	tests := []struct {
+		name        string
+		max         int
+		destination string
+		want        int
+	}{
+		{"destination limit", 4, "slow.example.com", 1},
+		{"default limit", 2, "other.example.com", 2},
+		{"unlimited destination", 2, "fast.example.com", 8},
+		{"unlimited", 0, "other.example.com", 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useUploadLimits(t, tt.max, map[string]int{"slow.example.com": 1, "fast.example.com": 0})
+
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+			active, maxActive := 0, 0
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					release, err := acquireUploadSlot(context.Background(), tt.destination)
+					if err != nil {
+						t.Errorf("acquireUploadSlot() error = %v", err)
+						return
+					}
+					defer release()
+
+					mu.Lock()
+					active++
+					if active > maxActive {
+						maxActive = active
+					}
+					mu.Unlock()
+					time.Sleep(50 * time.Millisecond)
+					mu.Lock()
+					active--
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+
+			if maxActive != tt.want {
+				t.Errorf("%d uploads to %s ran concurrently, want %d", maxActive, tt.destination, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcquireUploadSlotCanceled(t *testing.T) {
+	useUploadLimits(t, 0, map[string]int{"slow.example.com": 1})
+
+	release, err := acquireUploadSlot(context.Background(), "slow.example.com")
+	if err != nil {
+		t.Fatalf("acquireUploadSlot() error = %v", err)
+	}
+	// Releasing twice frees the slot once
+	release()
+	release()
+
+	if release, err = acquireUploadSlot(context.Background(), "slow.example.com"); err != nil {
+		t.Fatalf("acquireUploadSlot() after release error = %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := acquireUploadSlot(ctx, "slow.example.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquireUploadSlot() of a busy destination error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestNewUploaderSerializesDestination(t *testing.T) {
+	defer func(protocol, webhookURL string) { PROTOCOL, WEBHOOK_URL = protocol, webhookURL }(PROTOCOL, WEBHOOK_URL)
+	PROTOCOL, WEBHOOK_URL = "webhook", "https://partner.example.com/upload"
+	useUploadLimits(t, 0, map[string]int{"partner.example.com": 1})
+
+	first, err := newUploader(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("newUploader() error = %v", err)
+	}
+
+	opened := make(chan error, 1)
+	go func() {
+		second, err := newUploader(context.Background(), "", "")
+		if err == nil {
+			second.Close()
+		}
+		opened <- err
+	}()
+
+	select {
+	case <-opened:
+		t.Fatal("second uploader opened while the first one holds the only slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Errorf("newUploader() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("second uploader still waiting after the first one was closed")
+	}
+}
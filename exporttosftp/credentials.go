@@ -0,0 +1,97 @@
+package exporttosftp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+var (
+	// Guards SFTP_PASS and sftpPassRefreshedAt during refreshes
+	sftpPassMu sync.Mutex
+	// Time of the last SFTP password refresh from Secret Manager
+	sftpPassRefreshedAt time.Time
+)
+
+// connectSFTP connects SFTP client of the tenant using the cached
+// credentials. When the server rejects them, the password is re-fetched
+// from Secret Manager once and the connection is retried, so rotated
+// passwords are picked up without a redeploy
+func connectSFTP(ctx context.Context, tenant string) (*sftpConn, error) {
+	var c *sftpConn
+	var err error
+	if tenant != "" {
+		c, err = connectTenantSFTP(ctx, tenant)
+	} else {
+		c, err = connectDefaultSFTP(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.tenant = tenant
+
+	return c, nil
+}
+
+// connectDefaultSFTP connects to SFTP server using the default credentials
+func connectDefaultSFTP(ctx context.Context) (*sftpConn, error) {
+	c, err := newSFTPClient(SFTP_HOST, SFTP_PORT, SFTP_USER, currentSFTPPassword(), sftpHostKey)
+	if err == nil || !isAuthError(err) {
+		return c, err
+	}
+
+	refreshed, rerr := refreshSFTPPassword(ctx)
+	if rerr != nil {
+		return nil, fmt.Errorf("%v (password refresh failed: %w)", err, rerr)
+	}
+	if !refreshed {
+		return nil, err
+	}
+
+	log.Printf("SFTP password refreshed, retrying connection")
+	return newSFTPClient(SFTP_HOST, SFTP_PORT, SFTP_USER, currentSFTPPassword(), sftpHostKey)
+}
+
+// currentSFTPPassword returns the cached SFTP password
+func currentSFTPPassword() string {
+	sftpPassMu.Lock()
+	defer sftpPassMu.Unlock()
+
+	return SFTP_PASS
+}
+
+// refreshSFTPPassword re-fetches SFTP password from Secret Manager unless
+// it was refreshed within SFTP_PASS_REFRESH_COOLDOWN. It reports whether
+// a different password is now cached
+func refreshSFTPPassword(ctx context.Context) (bool, error) {
+	sftpPassMu.Lock()
+	defer sftpPassMu.Unlock()
+
+	if time.Since(sftpPassRefreshedAt) < SFTP_PASS_REFRESH_COOLDOWN {
+		log.Printf("SFTP password was refreshed at %s, skipping refresh", sftpPassRefreshedAt.Format(time.RFC3339))
+		return false, nil
+	}
+	sftpPassRefreshedAt = time.Now()
+
+	pass, err := exporter.AccessSecretVersion(ctx, exporter.SecretVersionName("sftp-pass"))
+	if err != nil {
+		return false, err
+	}
+	if pass == SFTP_PASS {
+		return false, nil
+	}
+	SFTP_PASS = pass
+
+	return true, nil
+}
+
+// isAuthError reports whether err is caused by the SSH server rejecting
+// the provided credentials
+func isAuthError(err error) bool {
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
@@ -0,0 +1,118 @@
+package exporttosftp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// stubSecrets serves secrets from the map instead of Secret Manager,
+// counting the accesses
+func stubSecrets(t *testing.T, secrets map[string]string) *int {
+	t.Helper()
+
+	accesses := 0
+	fetch := exporter.FetchSecretVersion
+	t.Cleanup(func() { exporter.FetchSecretVersion = fetch })
+	exporter.FetchSecretVersion = func(ctx context.Context, name string) (string, error) {
+		accesses++
+		secret, ok := secrets[name]
+		if !ok {
+			return "", errors.New("secret not found")
+		}
+		return secret, nil
+	}
+
+	return &accesses
+}
+
+func TestRefreshSFTPPassword(t *testing.T) {
+	tests := []struct {
+		name          string
+		cached        string
+		secrets       map[string]string
+		refreshedAgo  time.Duration
+		wantRefreshed bool
+		wantErr       bool
+		wantPass      string
+		wantAccesses  int
+	}{
+		{
+			name:          "rotated password",
+			cached:        "old",
+			secrets:       map[string]string{exporter.SecretVersionName("sftp-pass"): "new"},
+			refreshedAgo:  time.Hour,
+			wantRefreshed: true,
+			wantPass:      "new",
+			wantAccesses:  1,
+		},
+		{
+			name:         "unchanged password",
+			cached:       "same",
+			secrets:      map[string]string{exporter.SecretVersionName("sftp-pass"): "same"},
+			refreshedAgo: time.Hour,
+			wantPass:     "same",
+			wantAccesses: 1,
+		},
+		{
+			name:         "within cooldown",
+			cached:       "old",
+			secrets:      map[string]string{exporter.SecretVersionName("sftp-pass"): "new"},
+			refreshedAgo: time.Second,
+			wantPass:     "old",
+			wantAccesses: 0,
+		},
+		{
+			name:         "secret access fails",
+			cached:       "old",
+			secrets:      map[string]string{},
+			refreshedAgo: time.Hour,
+			wantErr:      true,
+			wantPass:     "old",
+			wantAccesses: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accesses := stubSecrets(t, tt.secrets)
+			defer func(pass string, at time.Time) { SFTP_PASS, sftpPassRefreshedAt = pass, at }(SFTP_PASS, sftpPassRefreshedAt)
+			SFTP_PASS = tt.cached
+			sftpPassRefreshedAt = time.Now().Add(-tt.refreshedAgo)
+
+			refreshed, err := refreshSFTPPassword(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("refreshSFTPPassword() error = %v, want error %t", err, tt.wantErr)
+			}
+			if refreshed != tt.wantRefreshed {
+				t.Errorf("refreshSFTPPassword() = %t, want %t", refreshed, tt.wantRefreshed)
+			}
+			if got := currentSFTPPassword(); got != tt.wantPass {
+				t.Errorf("cached password = %q, want %q", got, tt.wantPass)
+			}
+			if *accesses != tt.wantAccesses {
+				t.Errorf("secret accessed %d times, want %d", *accesses, tt.wantAccesses)
+			}
+		})
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password], no supported methods remain"), true},
+		{errors.New("dial tcp 10.0.0.1:22: connect: connection refused"), false},
+		{errors.New("ssh: handshake failed: EOF"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isAuthError(tt.err); got != tt.want {
+			t.Errorf("isAuthError(%q) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
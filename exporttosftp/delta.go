@@ -0,0 +1,165 @@
+package exporttosftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/storage"
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+var (
+	// Bucket storing a snapshot of the last exported content of each object,
+	// so only lines changed since then are uploaded. Delta mode is disabled
+	// when empty
+	DELTA_SNAPSHOT_BUCKET = ""
+	// Format of uploaded deltas: "prefix" writes added lines prefixed with
+	// "+" and removed lines prefixed with "-", "added" writes added lines only.
+	// Lines are compared regardless of their position, so lines which only
+	// moved within the content are not reported
+	DELTA_FORMAT = "prefix"
+)
+
+// validDeltaFormat reports whether the value is a supported DELTA_FORMAT
+func validDeltaFormat(value string) bool {
+	return value == "prefix" || value == "added"
+}
+
+// snapshotName returns name of the snapshot object of an object
+func snapshotName(bucket, object string) string {
+	return bucket + "/" + object
+}
+
+// deltaContent returns the lines of content changed since the snapshot of
+// the object, preceded by the unchanged first line when the content has a
+// header, and whether any line changed. Without a snapshot, e.g. on the
+// first export, and for explicit exports like reprocessing the whole content
+// is returned, as the partner may miss the previous version
+func deltaContent(ctx context.Context, bucket, object string, data []byte, header bool) ([]byte, bool, error) {
+	if DELTA_SNAPSHOT_BUCKET == "" {
+		return data, true, nil
+	}
+	if exporter.IsForcedExport(ctx) {
+		log.Printf("Exporting full content of %s, delta mode is skipped for explicit exports", object)
+		return data, true, nil
+	}
+
+	name := snapshotName(bucket, object)
+	previous, err := exporter.DownloadFileIntoMemory(ctx, DELTA_SNAPSHOT_BUCKET, name, 0, "")
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		log.Printf("No snapshot gs://%s/%s of %s, exporting full content", DELTA_SNAPSHOT_BUCKET, name, object)
+		return data, true, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to read snapshot of %s: %w", object, err)
+	}
+
+	// Keep the header in front of the delta, leaving it out of the comparison.
+	// Changed headers alter meaning of all lines, so the whole content is sent
+	var delta bytes.Buffer
+	if header {
+		first, rest := cutFirstLine(data)
+		previousFirst, previousRest := cutFirstLine(previous)
+		if !bytes.Equal(bytes.TrimRight(first, "\r\n"), bytes.TrimRight(previousFirst, "\r\n")) {
+			log.Printf("Header of %s changed since the snapshot, exporting full content", object)
+			return data, true, nil
+		}
+		delta.Write(first)
+		if !bytes.HasSuffix(first, []byte("\n")) {
+			delta.WriteByte('\n')
+		}
+		data, previous = rest, previousRest
+	}
+
+	added, removed := diffLines(previous, data)
+	log.Printf("Delta of %s against snapshot gs://%s/%s: %d lines added, %d lines removed", object, DELTA_SNAPSHOT_BUCKET, name, len(added), len(removed))
+	if len(added) == 0 && (len(removed) == 0 || DELTA_FORMAT == "added") {
+		return nil, false, nil
+	}
+
+	for _, line := range added {
+		if DELTA_FORMAT == "prefix" {
+			delta.WriteByte('+')
+		}
+		delta.Write(line)
+		delta.WriteByte('\n')
+	}
+	if DELTA_FORMAT == "prefix" {
+		for _, line := range removed {
+			delta.WriteByte('-')
+			delta.Write(line)
+			delta.WriteByte('\n')
+		}
+	}
+
+	return delta.Bytes(), true, nil
+}
+
+// cutFirstLine splits content after its first line, keeping the terminator
+// with the line
+func cutFirstLine(data []byte) ([]byte, []byte) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return data[:i+1], data[i+1:]
+	}
+
+	return data, nil
+}
+
+// diffLines compares lines of the contents regardless of their order,
+// returning lines of current missing in previous and lines of previous
+// missing in current, each in their original order. Repeated lines are
+// matched by their number of occurrences
+func diffLines(previous, current []byte) ([][]byte, [][]byte) {
+	remaining := map[string]int{}
+	for _, line := range splitLines(previous) {
+		remaining[string(line)]++
+	}
+
+	var added [][]byte
+	for _, line := range splitLines(current) {
+		if remaining[string(line)] > 0 {
+			remaining[string(line)]--
+			continue
+		}
+		added = append(added, line)
+	}
+
+	var removed [][]byte
+	for _, line := range splitLines(previous) {
+		if remaining[string(line)] > 0 {
+			remaining[string(line)]--
+			removed = append(removed, line)
+		}
+	}
+
+	return added, removed
+}
+
+// splitLines splits content into lines without their "\n" terminators
+func splitLines(data []byte) [][]byte {
+	if len(data) == 0 {
+		return nil
+	}
+
+	return bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+}
+
+// writeSnapshot stores the exported content as the snapshot of the object.
+// Failures are logged but never fail the function, as the file was already
+// delivered, the next delta then also repeats changes of this export
+func writeSnapshot(ctx context.Context, bucket, object string, data []byte) {
+	if DELTA_SNAPSHOT_BUCKET == "" {
+		return
+	}
+
+	name := snapshotName(bucket, object)
+	if err := exporter.WriteContent(ctx, DELTA_SNAPSHOT_BUCKET, name, "application/octet-stream", data); err != nil {
+		log.Printf("unable to write snapshot %s for %s: %v", name, object, err)
+		return
+	}
+
+	log.Printf("Snapshot of %s written to gs://%s/%s", object, DELTA_SNAPSHOT_BUCKET, name)
+}
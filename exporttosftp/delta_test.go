@@ -0,0 +1,149 @@
+package exporttosftp
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+)
+
+func TestValidDeltaFormat(t *testing.T) {
+	for value, want := range map[string]bool{"prefix": true, "added": true, "": false, "unified": false, "Prefix": false} {
+		if got := validDeltaFormat(value); got != want {
+			t.Errorf("validDeltaFormat(%q) = %t, want %t", value, got, want)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name        string
+		previous    string
+		current     string
+		wantAdded   []string
+		wantRemoved []string
+	}{
+		{"unchanged", "1,alice\n2,bob\n", "1,alice\n2,bob\n", nil, nil},
+		{"added line", "1,alice\n", "1,alice\n2,bob\n", []string{"2,bob"}, nil},
+		{"removed line", "1,alice\n2,bob\n", "2,bob\n", nil, []string{"1,alice"}},
+		{"modified line", "1,alice\n2,bob\n", "1,alice\n2,robert\n", []string{"2,robert"}, []string{"2,bob"}},
+		{"moved line", "1,alice\n2,bob\n", "2,bob\n1,alice\n", nil, nil},
+		{"repeated line", "1,alice\n", "1,alice\n1,alice\n", []string{"1,alice"}, nil},
+		{"empty previous", "", "1,alice\n2,bob", []string{"1,alice", "2,bob"}, nil},
+		{"empty current", "1,alice\n", "", nil, []string{"1,alice"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed := diffLines([]byte(tt.previous), []byte(tt.current))
+			if got := lineStrings(added); !reflect.DeepEqual(got, tt.wantAdded) {
+				t.Errorf("diffLines(%q, %q) added %q, want %q", tt.previous, tt.current, got, tt.wantAdded)
+			}
+			if got := lineStrings(removed); !reflect.DeepEqual(got, tt.wantRemoved) {
+				t.Errorf("diffLines(%q, %q) removed %q, want %q", tt.previous, tt.current, got, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+// lineStrings returns the lines as strings, nil for no lines
+func lineStrings(lines [][]byte) []string {
+	var s []string
+	for _, line := range lines {
+		s = append(s, string(line))
+	}
+
+	return s
+}
+
+func TestDeltaContent(t *testing.T) {
+	defer func(bucket, format string) { DELTA_SNAPSHOT_BUCKET, DELTA_FORMAT = bucket, format }(DELTA_SNAPSHOT_BUCKET, DELTA_FORMAT)
+	DELTA_SNAPSHOT_BUCKET = "snapshots"
+
+	snapshot := "id,name\n1,alice\n2,bob\n"
+	tests := []struct {
+		name        string
+		format      string
+		snapshot    string
+		content     string
+		header      bool
+		want        string
+		wantChanged bool
+	}{
+		{"modified content", "prefix", snapshot, "id,name\n1,alice\n2,robert\n3,carol\n", true, "id,name\n+2,robert\n+3,carol\n-2,bob\n", true},
+		{"added lines only", "added", snapshot, "id,name\n1,alice\n2,robert\n3,carol\n", true, "id,name\n2,robert\n3,carol\n", true},
+		{"removed lines only", "prefix", snapshot, "id,name\n1,alice\n", true, "id,name\n-2,bob\n", true},
+		{"removed lines in added format", "added", snapshot, "id,name\n1,alice\n", true, "", false},
+		{"unchanged content", "prefix", snapshot, "id,name\n2,bob\n1,alice\n", true, "", false},
+		{"changed header", "prefix", snapshot, "id,full_name\n1,alice\n2,bob\n", true, "id,full_name\n1,alice\n2,bob\n", true},
+		{"without header", "prefix", "1,alice\n", "1,alice\n2,bob\n", false, "+2,bob\n", true},
+		{"no snapshot", "prefix", "", "id,name\n1,alice\n", true, "id,name\n1,alice\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			DELTA_FORMAT = tt.format
+			store := exportertest.NewStore().Use(t)
+			if tt.snapshot != "" {
+				store.Put("snapshots", snapshotName("bucket", "report.csv"), []byte(tt.snapshot), nil)
+			}
+
+			got, changed, err := deltaContent(context.Background(), "bucket", "report.csv", []byte(tt.content), tt.header)
+			if err != nil {
+				t.Fatalf("deltaContent() error = %v", err)
+			}
+			if string(got) != tt.want || changed != tt.wantChanged {
+				t.Errorf("deltaContent(%q) = %q, %t, want %q, %t", tt.content, got, changed, tt.want, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestDeltaContentSnapshotUnavailable(t *testing.T) {
+	defer func(bucket string) { DELTA_SNAPSHOT_BUCKET = bucket }(DELTA_SNAPSHOT_BUCKET)
+	DELTA_SNAPSHOT_BUCKET = "snapshots"
+	store := exportertest.NewStore().Use(t)
+	store.Put("snapshots", snapshotName("bucket", "report.csv"), []byte("id,name\n"), nil)
+	store.Fail = func(op, bucket, name string) error {
+		if op == "NewReader" && bucket == "snapshots" {
+			return errors.New("permission denied")
+		}
+		return nil
+	}
+
+	if _, _, err := deltaContent(context.Background(), "bucket", "report.csv", []byte("id,name\n1,alice\n"), true); err == nil {
+		t.Error("deltaContent() with unreadable snapshot succeeded, want error")
+	}
+}
+
+func TestExportDelta(t *testing.T) {
+	defer func(bucket, format string) { DELTA_SNAPSHOT_BUCKET, DELTA_FORMAT = bucket, format }(DELTA_SNAPSHOT_BUCKET, DELTA_FORMAT)
+	DELTA_SNAPSHOT_BUCKET, DELTA_FORMAT = "snapshots", "prefix"
+	srv := useSFTPServer(t)
+	store := exportertest.NewStore().Use(t)
+
+	// The first export sends the whole content and stores its snapshot, the
+	// next one only the changed lines, snapshotting the whole content again
+	exports := []struct {
+		content string
+		want    string
+	}{
+		{"id,name\n1,alice\n2,bob\n", "id,name\n1,alice\n2,bob\n"},
+		{"id,name\n1,alice\n2,robert\n", "id,name\n+2,robert\n-2,bob\n"},
+		{"id,name\n1,alice\n2,robert\n3,carol\n", "id,name\n+3,carol\n"},
+	}
+	for _, export := range exports {
+		if err := exportStored(t, store, "report.csv", []byte(export.content), nil); err != nil {
+			t.Fatalf("export error = %v", err)
+		}
+		if err := srv.AssertFile("report.csv", []byte(export.want)); err != nil {
+			t.Error(err)
+		}
+		snapshot, _ := store.Content("snapshots", snapshotName("bucket", "report.csv"))
+		if string(snapshot) != export.content {
+			t.Errorf("snapshot holds %q, want %q", snapshot, export.content)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package exporttosftp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// SFTP status codes reporting exhausted space (draft-ietf-secsh-filexfer)
+const (
+	sshFxNoSpaceOnFilesystem = 14
+	sshFxQuotaExceeded       = 15
+)
+
+// destinationFullError reports an upload which failed because the partner
+// server ran out of disk space or quota, so alerting can tell it apart
+// from other failures
+type destinationFullError struct {
+	path string
+	err  error
+}
+
+func (e *destinationFullError) Error() string {
+	return fmt.Sprintf("destination disk full while writing [%s]: %v", e.path, e.err)
+}
+
+func (e *destinationFullError) Unwrap() error {
+	return e.err
+}
+
+// isDiskFullError reports whether a remote write failed for lack of space.
+// Servers speaking SFTP v3 lack the dedicated status codes and report
+// a generic failure, so their messages are matched as well
+func isDiskFullError(err error) bool {
+	var status *sftp.StatusError
+	if errors.As(err, &status) && (status.Code == sshFxNoSpaceOnFilesystem || status.Code == sshFxQuotaExceeded) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, hint := range []string{"no space left", "disk full", "quota exceeded", "disk quota"} {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ErrorClass returns class of the error reported in export summaries
+func (e *destinationFullError) ErrorClass() string {
+	return "destination_full"
+}
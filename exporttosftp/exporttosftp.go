@@ -1,68 +1,194 @@
 // Package exporttosftp provides a Cloud Function for exporting files
-// from Google Storage Bucket to SFTP server.
+// from Google Storage Bucket to SFTP server (or S3 bucket).
 package exporttosftp
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"log"
+	"net"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
-	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
-	"cloud.google.com/go/storage"
-	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
-	"github.com/cloudevents/sdk-go/v2/event"
-	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/rename"
 	"golang.org/x/crypto/ssh"
-	"google.golang.org/protobuf/encoding/protojson"
 
 	"github.com/pkg/sftp"
 )
 
 var (
-	// Define which file extensions should be processed
-	extensions = [2]string{".csv", ".txt"}
-	// Global API clients used across function invocations
-	storageClient *storage.Client
-	sftpClient    *sftp.Client
-	bgctx         = context.Background()
+	// Define which file extensions should be processed, ".json" is added
+	// when a JSON schema is configured
+	extensions = []string{".csv", ".txt"}
+	bgctx      = context.Background()
+	// Destination protocol: sftp or s3
+	PROTOCOL = "sftp"
 	// SFTP server related variables
 	SFTP_HOST   = ""
 	SFTP_PORT   = "22"
 	SFTP_USER   = ""
 	SFTP_PASS   = ""
 	SFTP_FOLDER = ""
+	// Object metadata key overriding SFTP_FOLDER for a single object
+	SFTP_FOLDER_METADATA_KEY = "x-sftp-folder"
+	// Upload objects by base name into a single flat folder
+	FLATTEN = false
+	// Behavior when a flattened name already exists: overwrite, error or suffix,
+	// which adds the first free counter to the name, e.g. "report-1.csv"
+	FLATTEN_COLLISION_POLICY = "overwrite"
+	// Behavior when the destination file exists: overwrite, skip or version
+	SFTP_EXISTING_POLICY = "overwrite"
+	// Permissions of directories created on the SFTP server, 0 keeps server defaults
+	SFTP_DIR_MODE os.FileMode = 0
+	// Umask (octal) applied to uploaded files and created directories, overriding
+	// server defaults. SFTP_DIR_MODE takes precedence for directories
+	SFTP_UMASK   = ""
+	sftpFileMode os.FileMode
+	// Create missing remote directories, disable for accounts without the permission
+	SFTP_CREATE_DIRS = true
+	// Suffix of temporary files used while uploading
+	SFTP_PART_SUFFIX = ".part"
+	// Send write requests of an upload concurrently. It speeds up transfers over
+	// high-latency links, but some servers corrupt files receiving out-of-order
+	// writes, so writes are sequential by default, waiting for each to complete
+	SFTP_CONCURRENT_WRITES = false
+	// Time given to in-flight uploads to complete on shutdown
+	SHUTDOWN_GRACE_PERIOD = 10 * time.Second
+	// Go time layout of the upload timestamp added to remote filenames
+	SFTP_TIMESTAMP_SUFFIX = ""
+	// Case of remote filenames: preserve, lower, upper or upper-ext
+	FILENAME_CASE = "preserve"
+	// CSV validation related variables
+	VALIDATE_CSV  = false
+	CSV_DELIMITER = ','
+	// Action applied to the CSV header row: keep, strip or rename
+	HEADER_ACTION = "keep"
+	// Mapping of header column names used by the rename header action
+	HEADER_RENAME = map[string]string{}
+	// Prefix in the source bucket where invalid files are copied to
+	QUARANTINE_PREFIX = ""
+	// SSH algorithms offered to the server, empty lists keep library defaults
+	SFTP_CIPHERS []string
+	SFTP_MACS    []string
+	SFTP_KEX     []string
+	// Local IP address outbound SFTP connections are bound to
+	SFTP_SOURCE_ADDR = ""
+	sftpLocalAddr    net.Addr
+	// Time allowed to establish the TCP connection to the SFTP server
+	SFTP_DIAL_TIMEOUT = 10 * time.Second
+	// Time allowed for the SSH handshake and authentication once connected, as
+	// servers may accept connections but never complete the handshake
+	SFTP_HANDSHAKE_TIMEOUT = 15 * time.Second
+	// Interval of SSH keepalive requests on the pooled connection
+	SFTP_KEEPALIVE_INTERVAL time.Duration = 0
+	// Time the server has to answer a keepalive request, connections which
+	// don't answer in time are dropped from the pool
+	SFTP_KEEPALIVE_TIMEOUT = 10 * time.Second
+	// Minimal interval between SFTP password refreshes from Secret Manager,
+	// applied to the default password and to credentials of each tenant
+	SFTP_PASS_REFRESH_COOLDOWN = 5 * time.Minute
+	// Handling of objects without recognized extension: ignore, log or export
+	NO_EXTENSION_POLICY = "ignore"
+	// Export objects with RENAME_SEPARATORS in the name instead of leaving
+	// them for the rename function, for deployments without it
+	PROCESS_PIPE_FILES = false
+	// Remote names or glob patterns which uploads must never overwrite
+	PROTECTED_REMOTE_NAMES []string
 )
 
 func init() {
+	// Tests configure the package themselves, without GCP access
+	if exporter.InTest() {
+		return
+	}
+
 	// Declare a separate err variable to avoid shadowing the client variables
 	var err error
 
-	projectID := os.Getenv("_PROJECT_ID")
-
-	// Get SFTP host from GCP Secret Manager
-	SFTP_HOST, err = accessSecretVersion("projects/" + projectID + "/secrets/sftp-host/versions/latest")
-	if err != nil {
-		log.Fatalf("failed to get secret: %v", err)
+	// Get destination protocol from environment variable
+	if os.Getenv("PROTOCOL") != "" {
+		PROTOCOL = os.Getenv("PROTOCOL")
 	}
 
-	// Get SFTP username from GCP Secret Manager
-	SFTP_USER, err = accessSecretVersion("projects/" + projectID + "/secrets/sftp-user/versions/latest")
-	if err != nil {
-		log.Fatalf("failed to get secret: %v", err)
+	// Read configuration shared with other exporters
+	exporter.HEALTHZ_CHECKS = []string{"secretmanager", "storage", PROTOCOL}
+	exporter.Init()
+	exporter.HealthChecks["secretmanager"] = checkSecretManager
+	exporter.HealthChecks["sftp"] = checkSFTP
+	exporter.HealthChecks["s3"] = checkS3
+	exporter.HealthChecks["webhook"] = checkWebhook
+
+	// Get client certificate presented to HTTPS destinations requiring mutual TLS
+	if os.Getenv("TLS_CLIENT_CERT") != "" {
+		TLS_CLIENT_CERT, err = strconv.ParseBool(os.Getenv("TLS_CLIENT_CERT"))
+		if err != nil {
+			log.Fatalf("invalid TLS_CLIENT_CERT: %v", err)
+		}
+	}
+	if os.Getenv("TLS_CLIENT_CERT_SECRET") != "" {
+		TLS_CLIENT_CERT_SECRET = os.Getenv("TLS_CLIENT_CERT_SECRET")
+	}
+	if os.Getenv("TLS_CLIENT_KEY_SECRET") != "" {
+		TLS_CLIENT_KEY_SECRET = os.Getenv("TLS_CLIENT_KEY_SECRET")
+	}
+	if TLS_CLIENT_CERT {
+		clientTLSConfig, err = loadClientTLSConfig(bgctx)
+		if err != nil {
+			log.Fatalf("failed to load client certificate: %v", err)
+		}
 	}
 
-	// Get SFTP password from GCP Secret Manager
-	SFTP_PASS, err = accessSecretVersion("projects/" + projectID + "/secrets/sftp-pass/versions/latest")
-	if err != nil {
-		log.Fatalf("failed to get secret: %v", err)
+	switch PROTOCOL {
+	case "sftp":
+		// Get SFTP host from GCP Secret Manager
+		SFTP_HOST, err = exporter.AccessSecretVersion(bgctx, exporter.SecretVersionName("sftp-host"))
+		if err != nil {
+			log.Fatalf("failed to get secret: %v", err)
+		}
+
+		// Get SFTP username from GCP Secret Manager
+		SFTP_USER, err = exporter.AccessSecretVersion(bgctx, exporter.SecretVersionName("sftp-user"))
+		if err != nil {
+			log.Fatalf("failed to get secret: %v", err)
+		}
+
+		// Get SFTP password from GCP Secret Manager
+		SFTP_PASS, err = exporter.AccessSecretVersion(bgctx, exporter.SecretVersionName("sftp-pass"))
+		if err != nil {
+			log.Fatalf("failed to get secret: %v", err)
+		}
+
+		// Get pinned SFTP host key from GCP Secret Manager
+		if os.Getenv("SFTP_PIN_HOST_KEY") != "" {
+			SFTP_PIN_HOST_KEY, err = strconv.ParseBool(os.Getenv("SFTP_PIN_HOST_KEY"))
+			if err != nil {
+				log.Fatalf("invalid SFTP_PIN_HOST_KEY: %v", err)
+			}
+		}
+		if SFTP_PIN_HOST_KEY {
+			if err := loadPinnedHostKey(bgctx); err != nil {
+				log.Fatalf("failed to load pinned host key: %v", err)
+			}
+		}
+	case "s3":
+		// Get S3 destination and credentials
+		if err := initS3(bgctx); err != nil {
+			log.Fatalf("failed to initialize S3 client: %v", err)
+		}
+	case "webhook":
+		// Get webhook destination and auth token
+		if err := initWebhook(bgctx); err != nil {
+			log.Fatalf("failed to initialize webhook: %v", err)
+		}
+	default:
+		log.Fatalf("unsupported PROTOCOL: %q", PROTOCOL)
 	}
 
 	// Get SFTP port from environment variable
@@ -70,174 +196,1065 @@ func init() {
 		SFTP_PORT = os.Getenv("SFTP_PORT")
 	}
 
-	// Get SFTP folder from environment variable
+	// Get SFTP folder from environment variable. Empty folder refers to the
+	// login (home) directory of the user, use "/" to upload to the server root
 	if os.Getenv("SFTP_FOLDER") != "" {
 		SFTP_FOLDER = os.Getenv("SFTP_FOLDER")
 	}
 
-	// Initialize Storage client
-	storageClient, err = storage.NewClient(bgctx)
+	// Get SSH ciphers, MACs and key exchange algorithms from environment variables
+	if os.Getenv("SFTP_CIPHERS") != "" {
+		SFTP_CIPHERS, err = parseAlgorithms(os.Getenv("SFTP_CIPHERS"), supportedCiphers)
+		if err != nil {
+			log.Fatalf("invalid SFTP_CIPHERS: %v", err)
+		}
+	}
+	if os.Getenv("SFTP_MACS") != "" {
+		SFTP_MACS, err = parseAlgorithms(os.Getenv("SFTP_MACS"), supportedMACs)
+		if err != nil {
+			log.Fatalf("invalid SFTP_MACS: %v", err)
+		}
+	}
+	if os.Getenv("SFTP_KEX") != "" {
+		SFTP_KEX, err = parseAlgorithms(os.Getenv("SFTP_KEX"), supportedKeyExchanges)
+		if err != nil {
+			log.Fatalf("invalid SFTP_KEX: %v", err)
+		}
+	}
+
+	// Get SFTP source address from environment variable
+	if os.Getenv("SFTP_SOURCE_ADDR") != "" {
+		SFTP_SOURCE_ADDR = os.Getenv("SFTP_SOURCE_ADDR")
+		ip := net.ParseIP(SFTP_SOURCE_ADDR)
+		if ip == nil {
+			log.Fatalf("invalid SFTP_SOURCE_ADDR: %q is not an IP address", SFTP_SOURCE_ADDR)
+		}
+		sftpLocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	// Get SFTP connection and handshake timeouts from environment variables
+	if os.Getenv("SFTP_DIAL_TIMEOUT") != "" {
+		SFTP_DIAL_TIMEOUT, err = time.ParseDuration(os.Getenv("SFTP_DIAL_TIMEOUT"))
+		if err != nil {
+			log.Fatalf("invalid SFTP_DIAL_TIMEOUT: %v", err)
+		}
+	}
+	if os.Getenv("SFTP_HANDSHAKE_TIMEOUT") != "" {
+		SFTP_HANDSHAKE_TIMEOUT, err = time.ParseDuration(os.Getenv("SFTP_HANDSHAKE_TIMEOUT"))
+		if err != nil {
+			log.Fatalf("invalid SFTP_HANDSHAKE_TIMEOUT: %v", err)
+		}
+	}
+
+	// Get tenant metadata key from environment variable
+	if os.Getenv("TENANT_METADATA_KEY") != "" {
+		TENANT_METADATA_KEY = os.Getenv("TENANT_METADATA_KEY")
+	}
+
+	// Get folder override metadata key from environment variable
+	if os.Getenv("SFTP_FOLDER_METADATA_KEY") != "" {
+		SFTP_FOLDER_METADATA_KEY = os.Getenv("SFTP_FOLDER_METADATA_KEY")
+	}
+
+	// Enable flattening of directory structure from environment variable
+	if os.Getenv("FLATTEN") != "" {
+		FLATTEN, err = strconv.ParseBool(os.Getenv("FLATTEN"))
+		if err != nil {
+			log.Fatalf("invalid FLATTEN: %v", err)
+		}
+	}
+
+	// Get flattened name collision policy from environment variable
+	if os.Getenv("FLATTEN_COLLISION_POLICY") != "" {
+		FLATTEN_COLLISION_POLICY = os.Getenv("FLATTEN_COLLISION_POLICY")
+		if FLATTEN_COLLISION_POLICY != "overwrite" && FLATTEN_COLLISION_POLICY != "error" && FLATTEN_COLLISION_POLICY != "suffix" {
+			log.Fatalf("invalid FLATTEN_COLLISION_POLICY: %q", FLATTEN_COLLISION_POLICY)
+		}
+	}
+
+	// Get policy for existing destination files from environment variable
+	if os.Getenv("SFTP_EXISTING_POLICY") != "" {
+		SFTP_EXISTING_POLICY = os.Getenv("SFTP_EXISTING_POLICY")
+		if SFTP_EXISTING_POLICY != "overwrite" && SFTP_EXISTING_POLICY != "skip" && SFTP_EXISTING_POLICY != "version" {
+			log.Fatalf("invalid SFTP_EXISTING_POLICY: %q", SFTP_EXISTING_POLICY)
+		}
+	}
+
+	// Get permissions of created directories (octal) from environment variable
+	if os.Getenv("SFTP_DIR_MODE") != "" {
+		SFTP_DIR_MODE, err = parseFileMode(os.Getenv("SFTP_DIR_MODE"))
+		if err != nil {
+			log.Fatalf("invalid SFTP_DIR_MODE: %v", err)
+		}
+	}
+
+	// Get umask of uploaded files and created directories from environment variable
+	if os.Getenv("SFTP_UMASK") != "" {
+		SFTP_UMASK = os.Getenv("SFTP_UMASK")
+		umask, err := parseFileMode(SFTP_UMASK)
+		if err != nil {
+			log.Fatalf("invalid SFTP_UMASK: %v", err)
+		}
+		applyUmask(umask)
+		log.Printf("Remote file mode: %o, directory mode: %o", sftpFileMode, SFTP_DIR_MODE)
+	}
+
+	// Get temporary upload file suffix from environment variable
+	if os.Getenv("SFTP_PART_SUFFIX") != "" {
+		SFTP_PART_SUFFIX = os.Getenv("SFTP_PART_SUFFIX")
+	}
+
+	// Get concurrent writes of SFTP uploads from environment variable
+	if os.Getenv("SFTP_CONCURRENT_WRITES") != "" {
+		SFTP_CONCURRENT_WRITES, err = strconv.ParseBool(os.Getenv("SFTP_CONCURRENT_WRITES"))
+		if err != nil {
+			log.Fatalf("invalid SFTP_CONCURRENT_WRITES: %v", err)
+		}
+	}
+
+	// Get concurrency limits of upload destinations from environment variables
+	if os.Getenv("MAX_CONCURRENT_UPLOADS") != "" {
+		MAX_CONCURRENT_UPLOADS, err = strconv.Atoi(os.Getenv("MAX_CONCURRENT_UPLOADS"))
+		if err != nil || MAX_CONCURRENT_UPLOADS < 0 {
+			log.Fatalf("invalid MAX_CONCURRENT_UPLOADS: %q", os.Getenv("MAX_CONCURRENT_UPLOADS"))
+		}
+	}
+	if os.Getenv("DESTINATION_CONCURRENCY") != "" {
+		DESTINATION_CONCURRENCY, err = parseDestinationConcurrency(os.Getenv("DESTINATION_CONCURRENCY"))
+		if err != nil {
+			log.Fatalf("invalid DESTINATION_CONCURRENCY: %v", err)
+		}
+	}
+
+	// Get age of stale temporary upload files from environment variable
+	if os.Getenv("SFTP_PART_CLEANUP_AGE") != "" {
+		SFTP_PART_CLEANUP_AGE, err = time.ParseDuration(os.Getenv("SFTP_PART_CLEANUP_AGE"))
+		if err != nil {
+			log.Fatalf("invalid SFTP_PART_CLEANUP_AGE: %v", err)
+		}
+	}
+
+	// Get shutdown grace period from environment variable
+	if os.Getenv("SHUTDOWN_GRACE_PERIOD") != "" {
+		SHUTDOWN_GRACE_PERIOD, err = time.ParseDuration(os.Getenv("SHUTDOWN_GRACE_PERIOD"))
+		if err != nil {
+			log.Fatalf("invalid SHUTDOWN_GRACE_PERIOD: %v", err)
+		}
+	}
+
+	// Get remote filename timestamp layout from environment variable
+	if os.Getenv("SFTP_TIMESTAMP_SUFFIX") != "" {
+		SFTP_TIMESTAMP_SUFFIX = os.Getenv("SFTP_TIMESTAMP_SUFFIX")
+	}
+
+	// Get upload verification mode from environment variable
+	if os.Getenv("SFTP_VERIFY_UPLOAD") != "" {
+		SFTP_VERIFY_UPLOAD, err = strconv.ParseBool(os.Getenv("SFTP_VERIFY_UPLOAD"))
+		if err != nil {
+			log.Fatalf("invalid SFTP_VERIFY_UPLOAD: %v", err)
+		}
+	}
+
+	// Get remote directories creation mode from environment variable
+	if os.Getenv("SFTP_CREATE_DIRS") != "" {
+		SFTP_CREATE_DIRS, err = strconv.ParseBool(os.Getenv("SFTP_CREATE_DIRS"))
+		if err != nil {
+			log.Fatalf("invalid SFTP_CREATE_DIRS: %v", err)
+		}
+	}
+
+	// Get remote filename case from environment variable
+	if os.Getenv("FILENAME_CASE") != "" {
+		FILENAME_CASE = os.Getenv("FILENAME_CASE")
+		if !validFilenameCase(FILENAME_CASE) {
+			log.Fatalf("invalid FILENAME_CASE: %q", FILENAME_CASE)
+		}
+	}
+
+	// Get remote filename unicode handling and sanitizing modes from environment variables
+	if os.Getenv("FILENAME_UNICODE") != "" {
+		FILENAME_UNICODE = os.Getenv("FILENAME_UNICODE")
+		if !validFilenameUnicode(FILENAME_UNICODE) {
+			log.Fatalf("invalid FILENAME_UNICODE: %q", FILENAME_UNICODE)
+		}
+	}
+	if os.Getenv("FILENAME_SANITIZE") != "" {
+		FILENAME_SANITIZE = os.Getenv("FILENAME_SANITIZE")
+		if !validFilenameSanitize(FILENAME_SANITIZE) {
+			log.Fatalf("invalid FILENAME_SANITIZE: %q", FILENAME_SANITIZE)
+		}
+	}
+
+	// Enable CSV structure validation from environment variable
+	if os.Getenv("VALIDATE_CSV") != "" {
+		VALIDATE_CSV, err = strconv.ParseBool(os.Getenv("VALIDATE_CSV"))
+		if err != nil {
+			log.Fatalf("invalid VALIDATE_CSV: %v", err)
+		}
+	}
+
+	// Get JSON schema validating ".json" objects from environment variables
+	JSON_SCHEMA_SECRET = os.Getenv("JSON_SCHEMA_SECRET")
+	JSON_SCHEMA_PATH = os.Getenv("JSON_SCHEMA_PATH")
+	if err := loadJSONSchema(bgctx); err != nil {
+		log.Fatalf("failed to load JSON schema: %v", err)
+	}
+	if jsonSchema != nil {
+		extensions = append(extensions, ".json")
+	}
+
+	// Get CSV delimiter from environment variable
+	if os.Getenv("CSV_DELIMITER") != "" {
+		CSV_DELIMITER, err = parseDelimiter(os.Getenv("CSV_DELIMITER"))
+		if err != nil {
+			log.Fatalf("invalid CSV_DELIMITER: %v", err)
+		}
+	}
+
+	// Get CSV header action from environment variable
+	if os.Getenv("HEADER_ACTION") != "" {
+		HEADER_ACTION = os.Getenv("HEADER_ACTION")
+		if !validHeaderAction(HEADER_ACTION) {
+			log.Fatalf("invalid HEADER_ACTION: %q", HEADER_ACTION)
+		}
+	}
+
+	// Get CSV header rename mapping (JSON object) from environment variable
+	if os.Getenv("HEADER_RENAME") != "" {
+		if err := json.Unmarshal([]byte(os.Getenv("HEADER_RENAME")), &HEADER_RENAME); err != nil {
+			log.Fatalf("invalid HEADER_RENAME: %v", err)
+		}
+	}
+
+	// Get per-bucket routing rules from GCP Secret Manager
+	if os.Getenv("ROUTES_SECRET") != "" {
+		if err := loadRoutes(bgctx, os.Getenv("ROUTES_SECRET")); err != nil {
+			log.Fatalf("failed to load routes: %v", err)
+		}
+	}
+
+	// Get quarantine prefix from environment variable
+	if os.Getenv("QUARANTINE_PREFIX") != "" {
+		QUARANTINE_PREFIX = os.Getenv("QUARANTINE_PREFIX")
+	}
+
+	// Get SSH keepalive interval from environment variable
+	if os.Getenv("SFTP_KEEPALIVE_INTERVAL") != "" {
+		SFTP_KEEPALIVE_INTERVAL, err = time.ParseDuration(os.Getenv("SFTP_KEEPALIVE_INTERVAL"))
+		if err != nil {
+			log.Fatalf("invalid SFTP_KEEPALIVE_INTERVAL: %v", err)
+		}
+	}
+	if os.Getenv("SFTP_KEEPALIVE_TIMEOUT") != "" {
+		SFTP_KEEPALIVE_TIMEOUT, err = time.ParseDuration(os.Getenv("SFTP_KEEPALIVE_TIMEOUT"))
+		if err != nil || SFTP_KEEPALIVE_TIMEOUT <= 0 {
+			log.Fatalf("invalid SFTP_KEEPALIVE_TIMEOUT: %q", os.Getenv("SFTP_KEEPALIVE_TIMEOUT"))
+		}
+	}
+
+	// Get SFTP password refresh cooldown from environment variable
+	if os.Getenv("SFTP_PASS_REFRESH_COOLDOWN") != "" {
+		SFTP_PASS_REFRESH_COOLDOWN, err = time.ParseDuration(os.Getenv("SFTP_PASS_REFRESH_COOLDOWN"))
+		if err != nil {
+			log.Fatalf("invalid SFTP_PASS_REFRESH_COOLDOWN: %v", err)
+		}
+	}
+
+	// Get bucket of delta mode snapshots from environment variable
+	if os.Getenv("DELTA_SNAPSHOT_BUCKET") != "" {
+		DELTA_SNAPSHOT_BUCKET = os.Getenv("DELTA_SNAPSHOT_BUCKET")
+	}
+
+	// Get format of uploaded deltas from environment variable
+	if os.Getenv("DELTA_FORMAT") != "" {
+		DELTA_FORMAT = os.Getenv("DELTA_FORMAT")
+		if !validDeltaFormat(DELTA_FORMAT) {
+			log.Fatalf("invalid DELTA_FORMAT: %q", DELTA_FORMAT)
+		}
+	}
+
+	// Get handling of objects without recognized extension from environment variable
+	if os.Getenv("NO_EXTENSION_POLICY") != "" {
+		NO_EXTENSION_POLICY = os.Getenv("NO_EXTENSION_POLICY")
+		if NO_EXTENSION_POLICY != "ignore" && NO_EXTENSION_POLICY != "log" && NO_EXTENSION_POLICY != "export" {
+			log.Fatalf("invalid NO_EXTENSION_POLICY: %q", NO_EXTENSION_POLICY)
+		}
+	}
+
+	// Get handling of objects with RENAME_SEPARATORS in the name from environment variable
+	if os.Getenv("PROCESS_PIPE_FILES") != "" {
+		PROCESS_PIPE_FILES, err = strconv.ParseBool(os.Getenv("PROCESS_PIPE_FILES"))
+		if err != nil {
+			log.Fatalf("invalid PROCESS_PIPE_FILES: %v", err)
+		}
+	}
+
+	// Get SSH connection debug logging from environment variable
+	if os.Getenv("DEBUG_SSH") != "" {
+		DEBUG_SSH, err = strconv.ParseBool(os.Getenv("DEBUG_SSH"))
+		if err != nil {
+			log.Fatalf("invalid DEBUG_SSH: %v", err)
+		}
+	}
+
+	// Get inline renaming of objects with RENAME_SEPARATORS in the name from environment variable
+	if os.Getenv("INLINE_RENAME") != "" {
+		INLINE_RENAME, err = strconv.ParseBool(os.Getenv("INLINE_RENAME"))
+		if err != nil {
+			log.Fatalf("invalid INLINE_RENAME: %v", err)
+		}
+	}
+
+	// Get remote names which must never be overwritten from environment variable
+	if os.Getenv("PROTECTED_REMOTE_NAMES") != "" {
+		for _, pattern := range strings.Split(os.Getenv("PROTECTED_REMOTE_NAMES"), ",") {
+			pattern = strings.TrimSpace(pattern)
+			if _, err := path.Match(pattern, ""); err != nil {
+				log.Fatalf("invalid PROTECTED_REMOTE_NAMES pattern %q: %v", pattern, err)
+			}
+			PROTECTED_REMOTE_NAMES = append(PROTECTED_REMOTE_NAMES, pattern)
+		}
+	}
+
+	// Get renaming, transforms and case-insensitive extension matching shared
+	// with the rename function from environment variables
+	rename.Init()
+
+	// Get archive mode settings from environment variables
+	if os.Getenv("ARCHIVE_TRIGGER_SUFFIX") != "" {
+		ARCHIVE_TRIGGER_SUFFIX = os.Getenv("ARCHIVE_TRIGGER_SUFFIX")
+	}
+	if os.Getenv("ARCHIVE_NAME_TEMPLATE") != "" {
+		ARCHIVE_NAME_TEMPLATE = os.Getenv("ARCHIVE_NAME_TEMPLATE")
+	}
+	if os.Getenv("ARCHIVE_GZIP") != "" {
+		ARCHIVE_GZIP, err = strconv.ParseBool(os.Getenv("ARCHIVE_GZIP"))
+		if err != nil {
+			log.Fatalf("invalid ARCHIVE_GZIP: %v", err)
+		}
+	}
+
+	// Get control record template from environment variable
+	if os.Getenv("TRAILER_TEMPLATE") != "" {
+		TRAILER_TEMPLATE = os.Getenv("TRAILER_TEMPLATE")
+	}
+
+	// Get exporting of only the latest object per folder from environment variable
+	if os.Getenv("LATEST_PER_PREFIX") != "" {
+		LATEST_PER_PREFIX, err = strconv.ParseBool(os.Getenv("LATEST_PER_PREFIX"))
+		if err != nil {
+			log.Fatalf("invalid LATEST_PER_PREFIX: %v", err)
+		}
+	}
+
+	// Let in-flight uploads complete when the instance is stopped
+	handleShutdown()
+
+	exporter.Register(bgctx, sftpBackend{})
+}
+
+// sftpBackend delivers exported objects to the destination of PROTOCOL
+type sftpBackend struct{}
+
+// Accept selects route, folder and tenant of the object and applies archive,
+// content type, quarantine and extension rules, returning delivery of the
+// object into its folder
+func (sftpBackend) Accept(ctx context.Context, x *exporter.Export) (exporter.Delivery, error) {
+	objectName := x.Object
+	bucketName := x.Bucket
+	metadata := x.Metadata
+
+	// Select export settings configured for the bucket and prefix
+	rt := selectRoute(bucketName, objectName)
+
+	// Allow the object to override destination folder via custom metadata
+	folder := rt.Folder
+	if override, ok := metadata.GetMetadata()[SFTP_FOLDER_METADATA_KEY]; ok {
+		sanitized, err := sanitizeFolder(override)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s metadata on object %s: %w", SFTP_FOLDER_METADATA_KEY, objectName, err)
+		}
+		log.Printf("Using folder %s from object metadata", sanitized)
+		folder = sanitized
+	}
+
+	// Deliver objects of a tenant to the tenant's own SFTP server
+	tenant, err := resolveTenant(metadata.GetMetadata())
 	if err != nil {
-		log.Fatalf("storage.NewClient: %v", err)
+		return nil, fmt.Errorf("invalid %s metadata on object %s: %w", TENANT_METADATA_KEY, objectName, err)
+	}
+	if tenant != "" {
+		log.Printf("Using SFTP credentials of tenant %s", tenant)
 	}
 
-	functions.CloudEvent("ExportFiles", exportFiles)
+	// In archive mode objects of groups are only exported bundled by the
+	// trigger object of their group
+	archive := isArchiveTrigger(objectName)
+	if isArchiveMember(objectName) {
+		log.Printf("Skipping object %s, exported within archive of its group", objectName)
+		x.Skip("archive member")
+		return nil, nil
+	}
+
+	// Skip objects whose content type is not allowed, e.g. binary junk,
+	// quarantining them when QUARANTINE_PREFIX is set
+	if err := exporter.CheckContentType(metadata.GetContentType()); err != nil && !archive {
+		if QUARANTINE_PREFIX != "" {
+			x.Reject(err)
+			return nil, rejectObject(ctx, bucketName, objectName, err)
+		}
+		log.Printf("Skipping object %s: %v", objectName, err)
+		x.Skip("content type")
+		return nil, nil
+	}
+
+	// Never export files which were already quarantined
+	if isQuarantined(objectName) {
+		log.Printf("Skipping quarantined object %s", objectName)
+		x.Skip("quarantined")
+		return nil, nil
+	}
+
+	// Objects without recognized extension are handled by NO_EXTENSION_POLICY,
+	// exporting them as is uses an empty extension matching any name
+	exportExtensions := extensions
+	if !archive && !hasExportExtension(objectName) && !leftForRename(objectName) {
+		switch NO_EXTENSION_POLICY {
+		case "log":
+			log.Printf("Skipping object %s without recognized extension", objectName)
+			x.Skip("extension")
+			return nil, nil
+		case "export":
+			log.Printf("Exporting object %s without recognized extension as is", objectName)
+			exportExtensions = []string{""}
+		}
+	}
+
+	return func(ctx context.Context) error {
+		return exportObject(ctx, x, rt, folder, tenant, archive, exportExtensions)
+	}, nil
 }
 
-// exportFiles consumes a CloudEvent message with changed object
-func exportFiles(ctx context.Context, e event.Event) error {
-	var metadata storagedata.StorageObjectData
-	if err := protojson.Unmarshal(e.Data(), &metadata); err != nil {
-		return fmt.Errorf("protojson.Unmarshal: %w", err)
+// exportObject delivers the object into the folder, bundling its group when
+// it is an archive trigger and uploading it once for each matching extension
+// otherwise. Rejected content is quarantined when QUARANTINE_PREFIX is set
+func exportObject(ctx context.Context, x *exporter.Export, rt route, folder, tenant string, archive bool, exportExtensions []string) error {
+	objectName := x.Object
+	bucketName := x.Bucket
+
+	// Skip versions superseded by a newer object of the same folder
+	if LATEST_PER_PREFIX && !archive {
+		newer, err := supersededBy(ctx, bucketName, objectName, x.Metadata.GetUpdated().AsTime())
+		if err != nil {
+			return err
+		}
+		if newer != "" {
+			log.Printf("Skipping object %s, superseded by newer object %s", objectName, newer)
+			x.Skip("superseded")
+			return nil
+		}
+	}
+
+	// Bundle objects of the group once its trigger object arrives
+	if archive {
+		x.Match()
+		remoteName, size, sum, err := exportArchive(ctx, bucketName, objectName, folder, tenant)
+		if err != nil {
+			return fmt.Errorf("unable to export archive of %s: %w", objectName, err)
+		}
+		x.Delivered(ctx, exportDestination(tenant, folder, remoteName), size, sum)
+		return nil
+	}
+
+	for _, ext := range exportExtensions {
+		// Process file only if object name NOT contains RENAME_SEPARATORS, unless
+		// PROCESS_PIPE_FILES or INLINE_RENAME is set, and file extension is one of extensions
+		if rename.HasSuffixFold(objectName, ext) && !leftForRename(objectName) {
+			x.Match()
+			t, err := extensionTransfer(ctx, x, rt, folder, tenant, ext)
+			if err == nil {
+				err = x.Transfer(ctx, t)
+			}
+			var rejected *exporter.RejectError
+			if errors.As(err, &rejected) {
+				x.Reject(rejected.Cause)
+				return rejectObject(ctx, bucketName, objectName, rejected.Cause)
+			}
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	// Just for debug
-	log.Printf("Bucket: %s", metadata.GetBucket())
-	log.Printf("File: %s", metadata.GetName())
+	// Objects with separators in the name are left for the rename function
+	if !x.Matched() {
+		if leftForRename(objectName) {
+			x.Skip("pipe")
+		} else {
+			x.Skip("extension")
+		}
+	}
 
-	objectName := metadata.GetName()
-	bucketName := metadata.GetBucket()
+	return nil
+}
 
-	for _, ext := range extensions {
-		// Process file only if object name NOT contains '|' and file extension are '.csv' or '.txt'
-		if strings.HasSuffix(objectName, ext) && !strings.Contains(objectName, "|") {
-			// download an object from GCS buket into memory
-			data, err := downloadFileIntoMemory(bgctx, bucketName, objectName)
+// extensionTransfer returns transfer of the object matching the extension
+// into the folder. Buffered content is renamed inline, sampled, its CSV
+// header transformed, validated, reduced to the delta and completed with
+// the trailer, streamed content is only renamed, sampled and its header
+// transformed. Names which can't be renamed inline are rejected
+func extensionTransfer(ctx context.Context, x *exporter.Export, rt route, folder, tenant, ext string) (exporter.Transfer, error) {
+	objectName := x.Object
+	renamed, err := inlineRenamedName(objectName, ext)
+	if err != nil {
+		return exporter.Transfer{}, err
+	}
+	remoteName := remoteFileName(renamed, rt.Extension)
+	headerAction := "keep"
+	if ext == ".csv" {
+		headerAction = rt.HeaderAction
+	}
+
+	// Whole content of the last buffered export, the snapshot of the next delta
+	var snapshot []byte
+
+	return exporter.Transfer{
+		Name:        remoteName,
+		Destination: exportDestination(tenant, folder, remoteName),
+		Open: func(ctx context.Context) (exporter.Uploader, error) {
+			return newUploader(ctx, folder, tenant)
+		},
+		Transform: func(ctx context.Context, data []byte) ([]byte, error) {
+			data, err := inlineRenameContent(objectName, data)
+			if err != nil {
+				return nil, exporter.RejectContent(err)
+			}
+			data = exporter.SampleContent(data)
+
+			// Apply header action to CSV files
+			data, err = transformHeader(data, headerAction)
 			if err != nil {
-				return fmt.Errorf("unable download object %s from bucket %s: %v", objectName, bucketName, err)
+				return nil, exporter.RejectContent(err)
 			}
 
-			// Initialize SMB client
-			if err := newSFTPClient(SFTP_HOST, SFTP_PORT, SFTP_USER, SFTP_PASS); err != nil {
-				return fmt.Errorf("io.Copy: %w", err)
+			// Validate CSV structure before sending it to the partner
+			if *rt.ValidateCSV && ext == ".csv" {
+				if err := validateCSV(data); err != nil {
+					return nil, exporter.RejectContent(err)
+				}
+			}
+
+			// Validate JSON documents before sending them to the partner
+			if isJSONObject(objectName) {
+				if err := validateJSON(data); err != nil {
+					return nil, exporter.RejectContent(err)
+				}
+			}
+
+			// Send only lines changed since the previous export, keeping the
+			// whole content as the snapshot of the next one
+			snapshot = data
+			data, changed, err := deltaContent(ctx, x.Bucket, objectName, data, ext == ".csv" && rt.HeaderAction != "strip")
+			if err != nil {
+				return nil, err
+			}
+			if !changed {
+				log.Printf("Skipping object %s, no lines changed since the snapshot", objectName)
+				return nil, exporter.SkipContent("unchanged")
 			}
 
-			uploadToSFTP(objectName, SFTP_FOLDER, data)
+			// Append partner control record as the last step of content changes
+			return appendTrailer(exporter.NormalizeTrailingNewline(data)), nil
+		},
+		TransformStream: func(ctx context.Context, r io.Reader) (io.Reader, error) {
+			return streamContent(objectName, headerAction, r)
+		},
+		Unstreamable: unstreamedSteps(ctx, objectName, ext, rt),
+		Delivered: func(ctx context.Context) {
+			if snapshot != nil {
+				writeSnapshot(ctx, x.Bucket, objectName, snapshot)
+			}
+		},
+	}, nil
+}
+
+// hasExportExtension reports whether the object name ends with any of
+// the processed extensions
+func hasExportExtension(object string) bool {
+	for _, ext := range extensions {
+		if rename.HasSuffixFold(object, ext) {
+			return true
 		}
 	}
 
-	return nil
+	return false
 }
 
-// downloadFileIntoMemory downloads an object in streaming fashion
-func downloadFileIntoMemory(bgctx context.Context, bucket, object string) ([]byte, error) {
-	bgctx, cancel := context.WithTimeout(bgctx, time.Second*50)
-	defer cancel()
+// leftForRename reports whether the object is left for the rename function,
+// which cleans names with RENAME_SEPARATORS, unless PROCESS_PIPE_FILES is set
+// or the object is renamed inline
+func leftForRename(object string) bool {
+	return !PROCESS_PIPE_FILES && rename.ContainsSeparator(object) && !isInlineRenamed(object)
+}
 
-	rc, err := storageClient.Bucket(bucket).Object(object).NewReader(bgctx)
-	if err != nil {
-		return nil, fmt.Errorf("Object(%q).NewReader: %w", object, err)
+// sanitizeFolder cleans a remote folder path, rejecting values which
+// contain ".." elements and could escape the intended directory
+func sanitizeFolder(folder string) (string, error) {
+	for _, elem := range strings.Split(folder, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("folder %q must not contain parent directory references", folder)
+		}
 	}
-	defer rc.Close()
 
-	data, err := io.ReadAll(rc)
-	if err != nil {
-		return nil, fmt.Errorf("ioutil.ReadAll: %w", err)
+	return path.Clean(folder), nil
+}
+
+// remoteFileName computes the remote file name of an object, relative to
+// the destination folder. A non-empty extension replaces the object's one
+func remoteFileName(objectName, extension string) string {
+	name := objectName
+	if FLATTEN {
+		name = path.Base(objectName)
+	}
+	if extension != "" {
+		name = replaceExtension(name, extension)
+	}
+
+	return sanitizeFileName(applyFilenameCase(addTimestampSuffix(name, time.Now())))
+}
+
+// remotePath returns path of the file in the remote folder. Files in an
+// empty folder are relative to the default directory, without leading slash
+func remotePath(folder, name string) string {
+	return path.Join(folder, name)
+}
+
+// checkFlattenCollision applies FLATTEN_COLLISION_POLICY when a flattened
+// file with the same name already exists in the remote folder, returning
+// the name to upload to
+func checkFlattenCollision(c *sftpConn, folder, name string) (string, error) {
+	if FLATTEN_COLLISION_POLICY == "overwrite" {
+		return name, nil
+	}
+
+	dstFile := remotePath(folder, name)
+	if _, err := c.client.Stat(dstFile); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return name, nil
+		}
+		return "", fmt.Errorf("unable to stat remote file [%s]: %w", dstFile, err)
+	}
+	if FLATTEN_COLLISION_POLICY == "error" {
+		return "", fmt.Errorf("flattened file [%s] already exists", dstFile)
 	}
-	log.Printf("Blob %v downloaded.\n", object)
 
-	return data, nil
+	for counter := 1; ; counter++ {
+		suffixed := addCounterSuffix(name, counter)
+		if _, err := c.client.Stat(remotePath(folder, suffixed)); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				log.Printf("Flattened file [%s] already exists, uploading as [%s]", dstFile, suffixed)
+				return suffixed, nil
+			}
+			return "", fmt.Errorf("unable to stat remote file [%s]: %w", remotePath(folder, suffixed), err)
+		}
+	}
+}
+
+// addCounterSuffix inserts the counter before the file extension, e.g.
+// "report.csv" becomes "report-1.csv"
+func addCounterSuffix(filename string, counter int) string {
+	dir, base := path.Split(filename)
+	ext := path.Ext(base)
+	name := strings.TrimSuffix(base, ext)
+	// Treat dot files like ".env" as names without extension
+	if name == "" {
+		name, ext = base, ""
+	}
+
+	return fmt.Sprintf("%s%s-%d%s", dir, name, counter, ext)
+}
+
+// replaceExtension replaces extension of the file name, or appends the
+// extension when the name has none
+func replaceExtension(filename, extension string) string {
+	dir, base := path.Split(filename)
+	name := strings.TrimSuffix(base, path.Ext(base))
+	// Treat dot files like ".env" as names without extension
+	if name == "" {
+		name = base
+	}
+
+	return dir + name + extension
+}
+
+// addTimestampSuffix inserts the given time formatted with SFTP_TIMESTAMP_SUFFIX
+// layout before the file extension, e.g. "report.csv" becomes
+// "report-20240601T1200.csv". Names without extension get the suffix appended
+func addTimestampSuffix(filename string, t time.Time) string {
+	if SFTP_TIMESTAMP_SUFFIX == "" {
+		return filename
+	}
+
+	dir, base := path.Split(filename)
+	ext := path.Ext(base)
+	name := strings.TrimSuffix(base, ext)
+	// Treat dot files like ".env" as names without extension
+	if name == "" {
+		name, ext = base, ""
+	}
+
+	return fmt.Sprintf("%s%s-%s%s", dir, name, t.Format(SFTP_TIMESTAMP_SUFFIX), ext)
+}
+
+// validFilenameCase reports whether the value is a supported FILENAME_CASE
+func validFilenameCase(value string) bool {
+	switch value {
+	case "preserve", "lower", "upper", "upper-ext":
+		return true
+	}
+	return false
+}
+
+// applyFilenameCase changes case of the base filename according to
+// FILENAME_CASE, leaving the folder part untouched. With "upper-ext" only
+// the extension is uppercased, e.g. "report.csv" becomes "report.CSV"
+func applyFilenameCase(filename string) string {
+	dir, base := path.Split(filename)
+	switch FILENAME_CASE {
+	case "lower":
+		base = strings.ToLower(base)
+	case "upper":
+		base = strings.ToUpper(base)
+	case "upper-ext":
+		ext := path.Ext(base)
+		// Dot files like ".env" have no extension to uppercase
+		if ext != base {
+			base = strings.TrimSuffix(base, ext) + strings.ToUpper(ext)
+		}
+	}
+
+	return dir + base
+}
+
+// newSFTPDialer returns dialer for outbound SFTP connections, bound to
+// SFTP_SOURCE_ADDR when configured and giving up after SFTP_DIAL_TIMEOUT
+func newSFTPDialer() *net.Dialer {
+	return &net.Dialer{LocalAddr: sftpLocalAddr, Timeout: SFTP_DIAL_TIMEOUT}
 }
 
-// newSFTPClient returns pointer to the configured SFTP Client
-func newSFTPClient(server, port, username, password string) error {
+// sshHandshake runs the SSH handshake on the connection, closing it when
+// the handshake doesn't complete within SFTP_HANDSHAKE_TIMEOUT, which also
+// unblocks the pending handshake
+func sshHandshake(conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SFTP_HANDSHAKE_TIMEOUT)
+	defer cancel()
+
+	type result struct {
+		client *ssh.Client
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		done <- result{client: ssh.NewClient(c, chans, reqs)}
+	}()
+
+	select {
+	case r := <-done:
+		return r.client, r.err
+	case <-ctx.Done():
+		conn.Close()
+		return nil, fmt.Errorf("SSH handshake did not complete within %s", SFTP_HANDSHAKE_TIMEOUT)
+	}
+}
+
+// newSFTPClient returns a new connection of the configured SFTP Client
+func newSFTPClient(server, port, username, password string, hostKey ssh.PublicKey) (*sftpConn, error) {
 	// Initialize SFTP client configuration
 	sftpConfig := ssh.ClientConfig{
 		User: username,
-		// Ignore host key check
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		// Verify pinned host key, host key check is ignored otherwise
+		HostKeyCallback:   hostKeyCallback(hostKey),
+		HostKeyAlgorithms: hostKeyAlgorithms(hostKey),
 		Auth: []ssh.AuthMethod{
 			ssh.Password(password),
 		},
+		Config: ssh.Config{
+			Ciphers:      SFTP_CIPHERS,
+			MACs:         SFTP_MACS,
+			KeyExchanges: SFTP_KEX,
+		},
 	}
 
-	addr := fmt.Sprintf("%s:%s", server, port)
+	addr := net.JoinHostPort(server, port)
 
-	// Connect to server
-	sshConn, err := ssh.Dial("tcp", addr, &sftpConfig)
+	// Connect to server, refusing hosts outside of the allowlist
+	conn, err := exporter.DialAllowed(bgctx, newSFTPDialer(), "tcp", addr)
 	if err != nil {
-		log.Fatalf("failed to connect to [%s]: %v", addr, err)
-		return err
+		return nil, fmt.Errorf("failed to connect to [%s]: %w", addr, err)
+	}
+
+	// Record the handshake to log the negotiated algorithms
+	var tap *kexInitTap
+	if DEBUG_SSH {
+		tap = newKexInitTap(conn)
+		conn = tap
 	}
 
-	// Initialize SFTP client
-	sftpClient, err = sftp.NewClient(sshConn)
+	sshConn, err := sshHandshake(conn, addr, &sftpConfig)
 	if err != nil {
-		log.Fatalf("unable to start SFTP subsystem: %v", err)
-		return err
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to [%s]: %w", addr, err)
+	}
+	if tap != nil {
+		logSSHConnection(sshConn, tap)
 	}
 
-	return nil
+	// Initialize SFTP client, setting write concurrency explicitly instead of
+	// relying on the library default
+	client, err := sftp.NewClient(sshConn, sftp.UseConcurrentWrites(SFTP_CONCURRENT_WRITES))
+	if err != nil {
+		sshConn.Close()
+		return nil, fmt.Errorf("unable to start SFTP subsystem: %w", err)
+	}
+
+	return &sftpConn{client: client, ssh: sshConn}, nil
 }
 
-// uploadToSFTP uploads an object to remote SFTP server
-func uploadToSFTP(filename, folder string, data []byte) error {
+// uploadToSFTP uploads an object to remote SFTP server. The content is
+// written to a temporary ".part" file first and renamed into place once
+// fully transferred, so the partner never sees partial files
+func uploadToSFTP(ctx context.Context, c *sftpConn, filename, folder string, r io.Reader) error {
+	// Track the upload so shutdown can wait for it to complete
+	done, err := beginUpload()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// Make sure the destination stays within the configured folder
+	name, err := exporter.CleanRelativePath(filename)
+	if err != nil {
+		log.Printf("Rejected upload of [%s]: %v", filename, err)
+		return err
+	}
+
 	// Set the destination for the object
-	dstFile := fmt.Sprintf("%s/%s", folder, filename)
+	dstFile := remotePath(folder, name)
+
+	// Decide what to do when the destination already exists
+	dstFile, err = applyExistingPolicy(c, dstFile)
+	if err != nil {
+		return err
+	}
+
+	// Never clobber critical files on the partner server
+	if dstFile != "" && isProtected(dstFile) {
+		log.Printf("Rejected upload of [%s]: destination [%s] is protected", filename, dstFile)
+		return fmt.Errorf("destination [%s] is protected", dstFile)
+	}
+	if dstFile == "" {
+		log.Printf("Skipping upload of [%s], destination already exists\n", filename)
+		return nil
+	}
 	log.Printf("Uploading [%s] to [%s] ...\n", filename, dstFile)
 
 	// check path on the remote server and create directories if needed
 	dir := path.Dir(dstFile)
-	if dir != "" {
-		in, err := sftpClient.Stat(dir)
+	if dir != "" && SFTP_CREATE_DIRS {
+		in, err := c.client.Stat(dir)
 		if err != nil || !in.IsDir() {
-			err := sftpClient.MkdirAll(dir)
-			if err != nil {
+			if err := mkdirAll(c, dir); err != nil {
 				return err
 			}
 		}
 	}
 
 	// Note: SFTP To Go doesn't support O_RDWR mode
-	destFile, err := sftpClient.OpenFile(dstFile, (os.O_WRONLY | os.O_CREATE | os.O_TRUNC))
+	partFile := dstFile + SFTP_PART_SUFFIX
+	destFile, err := c.client.OpenFile(partFile, (os.O_WRONLY | os.O_CREATE | os.O_TRUNC))
 	if err != nil {
 		return fmt.Errorf("unable to open remote file: %v", err)
 	}
-	defer destFile.Close()
 
-	bytes, err := io.Copy(destFile, bytes.NewReader(data))
+	// Compute what's needed to verify the remote file while streaming
+	var algorithms []string
+	if _, ok := c.client.HasExtension("check-file"); ok && SFTP_VERIFY_UPLOAD {
+		algorithms = checkFileAlgorithms()
+	}
+	digest := newUploadDigest(algorithms)
+
+	bytes, err := io.Copy(destFile, exporter.NewProgressReader(newAbortableReader(ctx, io.TeeReader(r, digest)), dstFile, exporter.ReaderSize(r)))
 	if err != nil {
+		destFile.Close()
+		removePartFile(c, partFile)
+		if isDiskFullError(err) {
+			log.Printf("Partner disk full, upload of [%s] aborted after %d bytes: %v", dstFile, bytes, err)
+			return &destinationFullError{path: dstFile, err: err}
+		}
 		return fmt.Errorf("unable to upload local file: %v", err)
 	}
+	// Buffered writes may only fail once the file is closed
+	if err := destFile.Close(); err != nil {
+		removePartFile(c, partFile)
+		if isDiskFullError(err) {
+			log.Printf("Partner disk full, upload of [%s] aborted on close: %v", dstFile, err)
+			return &destinationFullError{path: dstFile, err: err}
+		}
+		return fmt.Errorf("unable to close remote file: %v", err)
+	}
 	log.Printf("%d bytes copied\n", bytes)
 
+	// Apply permissions derived from SFTP_UMASK before the file is published
+	if sftpFileMode != 0 {
+		if err := c.client.Chmod(partFile, sftpFileMode); err != nil {
+			removePartFile(c, partFile)
+			return fmt.Errorf("unable to chmod remote file: %v", err)
+		}
+	}
+
+	// Make sure the server received the same content before publishing it
+	if SFTP_VERIFY_UPLOAD {
+		if err := verifyRemoteFile(c, partFile, digest); err != nil {
+			removePartFile(c, partFile)
+			return fmt.Errorf("unable to verify remote file: %v", err)
+		}
+	}
+
+	// Move fully uploaded file into place
+	if err := renameRemoteFile(c, partFile, dstFile); err != nil {
+		removePartFile(c, partFile)
+		return fmt.Errorf("unable to rename remote file: %v", err)
+	}
+
 	return nil
 }
 
-// accessSecretVersion accesses the payload for the given secret version if one
-// exists. The version can be a version number as a string (e.g. "5") or an
-// alias (e.g. "latest")
-func accessSecretVersion(name string) (string, error) {
-	// name := "projects/my-project/secrets/my-secret/versions/5"
-	// name := "projects/my-project/secrets/my-secret/versions/latest"
+// isProtected reports whether the destination path or its base name matches
+// any of PROTECTED_REMOTE_NAMES glob patterns
+func isProtected(dstFile string) bool {
+	for _, pattern := range PROTECTED_REMOTE_NAMES {
+		for _, name := range []string{dstFile, strings.TrimPrefix(dstFile, "/"), path.Base(dstFile)} {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
 
-	// Create the client
-	ctx := context.Background()
-	client, err := secretmanager.NewClient(ctx)
-	if err != nil {
-		return "", fmt.Errorf("failed to create secretmanager client: %w", err)
+	return false
+}
+
+// applyExistingPolicy returns the path to upload to according to
+// SFTP_EXISTING_POLICY when dstFile already exists on the server: the same
+// path for "overwrite", an empty path for "skip" and the first free
+// versioned path (dstFile.1, dstFile.2, ...) for "version"
+func applyExistingPolicy(c *sftpConn, dstFile string) (string, error) {
+	if SFTP_EXISTING_POLICY == "overwrite" {
+		return dstFile, nil
+	}
+
+	if _, err := c.client.Stat(dstFile); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return dstFile, nil
+		}
+		return "", fmt.Errorf("unable to stat remote file [%s]: %w", dstFile, err)
+	}
+
+	if SFTP_EXISTING_POLICY == "skip" {
+		return "", nil
+	}
+
+	for version := 1; ; version++ {
+		versioned := fmt.Sprintf("%s.%d", dstFile, version)
+		if _, err := c.client.Stat(versioned); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return versioned, nil
+			}
+			return "", fmt.Errorf("unable to stat remote file [%s]: %w", versioned, err)
+		}
+	}
+}
+
+// mkdirAll creates a remote directory along with any missing parents.
+// When SFTP_DIR_MODE is set, only directories created here get chmod'ed.
+// Parents which can't be inspected, e.g. outside of a chrooted account,
+// are assumed to exist, and directories created concurrently by other
+// uploads are not treated as errors
+func mkdirAll(c *sftpConn, dir string) error {
+	// Collect directories which don't exist yet, deepest first
+	var missing []string
+	for d := dir; d != "." && d != "/" && d != ""; d = path.Dir(d) {
+		if _, err := c.client.Stat(d); err == nil || !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		missing = append(missing, d)
 	}
-	defer client.Close()
 
-	// Build the request
-	req := &secretmanagerpb.AccessSecretVersionRequest{
-		Name: name,
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := c.client.Mkdir(missing[i]); err != nil {
+			if info, serr := c.client.Stat(missing[i]); serr == nil && info.IsDir() {
+				continue
+			}
+			return fmt.Errorf("unable to create remote directory [%s]: %w", missing[i], err)
+		}
+
+		if SFTP_DIR_MODE == 0 {
+			continue
+		}
+		if err := c.client.Chmod(missing[i], SFTP_DIR_MODE); err != nil {
+			return fmt.Errorf("unable to chmod remote directory [%s]: %w", missing[i], err)
+		}
 	}
 
-	// Call the API
-	result, err := client.AccessSecretVersion(ctx, req)
+	return nil
+}
+
+// parseFileMode parses octal permission bits like "0770"
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
 	if err != nil {
-		return "", fmt.Errorf("failed to access secret version: %w", err)
+		return 0, err
+	}
+	if mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("mode %q has bits beyond permissions", s)
 	}
 
-	// Verify the data checksum
-	crc32c := crc32.MakeTable(crc32.Castagnoli)
-	checksum := int64(crc32.Checksum(result.Payload.Data, crc32c))
-	if checksum != *result.Payload.DataCrc32C {
-		return "", fmt.Errorf("data corruption detected")
+	return os.FileMode(mode), nil
+}
+
+// applyUmask derives permissions of uploaded files from the umask, and of
+// created directories unless SFTP_DIR_MODE is set
+func applyUmask(umask os.FileMode) {
+	sftpFileMode = 0666 &^ umask
+	if SFTP_DIR_MODE == 0 {
+		SFTP_DIR_MODE = 0777 &^ umask
+	}
+}
+
+// renameRemoteFile atomically replaces newname with oldname when the server
+// supports posix-rename extension, and falls back to remove and rename
+func renameRemoteFile(c *sftpConn, oldname, newname string) error {
+	if _, ok := c.client.HasExtension("posix-rename@openssh.com"); ok {
+		return c.client.PosixRename(oldname, newname)
 	}
 
-	secret := string(result.Payload.Data)
+	// Plain SFTP rename fails when the target exists
+	if _, err := c.client.Stat(newname); err == nil {
+		if err := c.client.Remove(newname); err != nil {
+			return err
+		}
+	}
 
-	return secret, nil
+	return c.client.Rename(oldname, newname)
+}
+
+// removePartFile deletes a temporary upload file left after a failure
+func removePartFile(c *sftpConn, partFile string) {
+	if err := c.client.Remove(partFile); err != nil {
+		log.Printf("unable to remove temporary file [%s]: %v", partFile, err)
+	}
 }
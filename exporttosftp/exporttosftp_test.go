@@ -0,0 +1,558 @@
+package exporttosftp
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/ealebed/gcp-cf/common/rename"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+)
+
+func TestAddTimestampSuffix(t *testing.T) {
+	at := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		layout   string
+		filename string
+		want     string
+	}{
+		{"disabled", "", "report.csv", "report.csv"},
+		{"before extension", "20060102T1504", "report.csv", "report-20240601T1200.csv"},
+		{"keeps folder", "20060102", "out/daily/report.csv", "out/daily/report-20240601.csv"},
+		{"only last extension", "20060102", "report.csv.gz", "report.csv-20240601.gz"},
+		{"without extension", "20060102", "README", "README-20240601"},
+		{"dot file", "20060102", "config/.env", "config/.env-20240601"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(layout string) { SFTP_TIMESTAMP_SUFFIX = layout }(SFTP_TIMESTAMP_SUFFIX)
+			SFTP_TIMESTAMP_SUFFIX = tt.layout
+
+			if got := addTimestampSuffix(tt.filename, at); got != tt.want {
+				t.Errorf("addTimestampSuffix(%q) = %q, want %q", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFolder(t *testing.T) {
+	tests := []struct {
+		folder  string
+		want    string
+		wantErr bool
+	}{
+		{"partner/in", "partner/in", false},
+		{"/partner/in/", "/partner/in", false},
+		{"partner//in/./daily", "partner/in/daily", false},
+		{"", ".", false},
+		{"../etc", "", true},
+		{"partner/../../etc", "", true},
+		{"partner/..", "", true},
+		{"partner/..data", "partner/..data", false},
+	}
+
+	for _, tt := range tests {
+		got, err := sanitizeFolder(tt.folder)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("sanitizeFolder(%q) error = %v, want error %t", tt.folder, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("sanitizeFolder(%q) = %q, want %q", tt.folder, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptFolderOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		wantErr  bool
+	}{
+		{"without override", nil, false},
+		{"valid override", map[string]string{"x-sftp-folder": "partner/in"}, false},
+		{"escaping override", map[string]string{"x-sftp-folder": "../../etc"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := &exporter.Export{
+				Bucket:   "bucket",
+				Object:   "out/report.csv",
+				Metadata: &storagedata.StorageObjectData{Bucket: "bucket", Name: "out/report.csv", Metadata: tt.metadata},
+			}
+
+			delivery, err := sftpBackend{}.Accept(context.Background(), x)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Accept() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && delivery == nil {
+				t.Error("Accept() returned no delivery")
+			}
+		})
+	}
+}
+
+func TestNewSFTPDialerSourceAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn.RemoteAddr()
+			conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name   string
+		source net.Addr
+		want   string
+	}{
+		{"default source", nil, "127.0.0.1"},
+		{"bound source", &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}, "127.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(addr net.Addr) { sftpLocalAddr = addr }(sftpLocalAddr)
+			sftpLocalAddr = tt.source
+
+			conn, err := newSFTPDialer().Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			conn.Close()
+
+			if got := (<-accepted).(*net.TCPAddr).IP.String(); got != tt.want {
+				t.Errorf("connection from %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteFileNameFlatten(t *testing.T) {
+	tests := []struct {
+		name    string
+		flatten bool
+		object  string
+		want    string
+	}{
+		{"nested", false, "2024/06/report.csv", "2024/06/report.csv"},
+		{"flattened", true, "2024/06/report.csv", "report.csv"},
+		{"flattened top level", true, "report.csv", "report.csv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(flatten bool) { FLATTEN = flatten }(FLATTEN)
+			FLATTEN = tt.flatten
+
+			if got := remoteFileName(tt.object, ""); got != tt.want {
+				t.Errorf("remoteFileName(%q) = %q, want %q", tt.object, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddCounterSuffix(t *testing.T) {
+	tests := []struct {
+		filename string
+		counter  int
+		want     string
+	}{
+		{"report.csv", 1, "report-1.csv"},
+		{"report.csv", 12, "report-12.csv"},
+		{"report.tar.gz", 1, "report.tar-1.gz"},
+		{"report", 1, "report-1"},
+		{".env", 1, ".env-1"},
+		{"out/report.csv", 2, "out/report-2.csv"},
+	}
+
+	for _, tt := range tests {
+		if got := addCounterSuffix(tt.filename, tt.counter); got != tt.want {
+			t.Errorf("addCounterSuffix(%q, %d) = %q, want %q", tt.filename, tt.counter, got, tt.want)
+		}
+	}
+}
+
+func TestExportFlattenCollision(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"overwrite", map[string]string{"report.csv": "2,bob\n"}, false},
+		{"error", map[string]string{"report.csv": "1,alice\n"}, true},
+		{"suffix", map[string]string{"report.csv": "1,alice\n", "report-1.csv": "2,bob\n"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			defer func(flatten bool, policy string) {
+				FLATTEN, FLATTEN_COLLISION_POLICY = flatten, policy
+			}(FLATTEN, FLATTEN_COLLISION_POLICY)
+			FLATTEN, FLATTEN_COLLISION_POLICY = true, tt.policy
+			srv := useSFTPServer(t)
+			store := exportertest.NewStore().Use(t)
+
+			if err := exportStored(t, store, "a/report.csv", []byte("1,alice\n"), nil); err != nil {
+				t.Fatalf("export of a/report.csv error = %v", err)
+			}
+			err := exportStored(t, store, "b/report.csv", []byte("2,bob\n"), nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("export of b/report.csv error = %v, want error %t", err, tt.wantErr)
+			}
+			for name, want := range tt.want {
+				if err := srv.AssertFile(name, []byte(want)); err != nil {
+					t.Error(err)
+				}
+			}
+			if _, err := srv.ReadFile("report-2.csv"); err == nil {
+				t.Errorf("report-2.csv exported, want a single suffixed file at most")
+			}
+		})
+	}
+}
+
+func TestExportFlattenCollisionCounter(t *testing.T) {
+	defer func(flatten bool, policy string) {
+		FLATTEN, FLATTEN_COLLISION_POLICY = flatten, policy
+	}(FLATTEN, FLATTEN_COLLISION_POLICY)
+	FLATTEN, FLATTEN_COLLISION_POLICY = true, "suffix"
+	srv := useSFTPServer(t)
+	store := exportertest.NewStore().Use(t)
+
+	// Counters continue after the names already taken
+	for _, folder := range []string{"a", "b", "c"} {
+		if err := exportStored(t, store, folder+"/report.csv", []byte(folder+"\n"), nil); err != nil {
+			t.Fatalf("export of %s/report.csv error = %v", folder, err)
+		}
+	}
+	for name, want := range map[string]string{"report.csv": "a\n", "report-1.csv": "b\n", "report-2.csv": "c\n"} {
+		if err := srv.AssertFile(name, []byte(want)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestApplyFilenameCase(t *testing.T) {
+	tests := []struct {
+		filenameCase string
+		filename     string
+		want         string
+	}{
+		{"preserve", "Daily/Report.Csv", "Daily/Report.Csv"},
+		{"lower", "Daily/Report.CSV", "Daily/report.csv"},
+		{"upper", "Daily/Report.csv", "Daily/REPORT.CSV"},
+		{"upper-ext", "Daily/report.csv", "Daily/report.CSV"},
+		{"upper-ext", "report.tar.gz", "report.tar.GZ"},
+		{"upper-ext", "README", "README"},
+		{"upper-ext", ".env", ".env"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filenameCase, func(t *testing.T) {
+			defer func(filenameCase string) { FILENAME_CASE = filenameCase }(FILENAME_CASE)
+			FILENAME_CASE = tt.filenameCase
+
+			if got := applyFilenameCase(tt.filename); got != tt.want {
+				t.Errorf("applyFilenameCase(%q) = %q, want %q", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteFileNameCase(t *testing.T) {
+	tests := []struct {
+		filenameCase string
+		extension    string
+		want         string
+	}{
+		{"lower", "", "daily/report.csv"},
+		{"lower", ".DAT", "daily/report.dat"},
+		{"upper", ".dat", "daily/REPORT.DAT"},
+		{"upper-ext", ".dat", "daily/Report.DAT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filenameCase, func(t *testing.T) {
+			defer func(filenameCase string) { FILENAME_CASE = filenameCase }(FILENAME_CASE)
+			FILENAME_CASE = tt.filenameCase
+
+			if got := remoteFileName("daily/Report.CSV", tt.extension); got != tt.want {
+				t.Errorf("remoteFileName(%q, %q) = %q, want %q", "daily/Report.CSV", tt.extension, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplaceExtension(t *testing.T) {
+	tests := []struct {
+		filename  string
+		extension string
+		want      string
+	}{
+		{"report.csv", ".dat", "report.dat"},
+		{"daily/report.csv", ".dat", "daily/report.dat"},
+		{"report.tar.gz", ".dat", "report.tar.dat"},
+		{"README", ".txt", "README.txt"},
+		{".env", ".dat", ".env.dat"},
+		{"daily.v2/README", ".txt", "daily.v2/README.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename+tt.extension, func(t *testing.T) {
+			if got := replaceExtension(tt.filename, tt.extension); got != tt.want {
+				t.Errorf("replaceExtension(%q, %q) = %q, want %q", tt.filename, tt.extension, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoExtensionPolicy(t *testing.T) {
+	tests := []struct {
+		policy     string
+		object     string
+		wantExport bool
+	}{
+		{"ignore", "README", false},
+		{"log", "README", false},
+		{"export", "README", true},
+		{"export", "in/report.xml", true},
+		{"ignore", "report.csv", true},
+		{"log", "report.csv", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy+" "+tt.object, func(t *testing.T) {
+			defer func(policy string) { NO_EXTENSION_POLICY = policy }(NO_EXTENSION_POLICY)
+			NO_EXTENSION_POLICY = tt.policy
+			srv := useSFTPServer(t)
+			store := exportertest.NewStore().Use(t)
+
+			if err := exportStored(t, store, tt.object, []byte("id,name\n"), nil); err != nil {
+				t.Fatalf("export error = %v", err)
+			}
+			_, err := srv.ReadFile(tt.object)
+			if exported := err == nil; exported != tt.wantExport {
+				t.Errorf("%s exported = %t, want %t", tt.object, exported, tt.wantExport)
+			}
+		})
+	}
+}
+
+func TestHasExportExtension(t *testing.T) {
+	tests := []struct {
+		insensitive bool
+		object      string
+		want        bool
+	}{
+		{false, "in/report.csv", true},
+		{false, "in/report.CSV", false},
+		{true, "in/report.CSV", true},
+		{true, "in/notes.Txt", true},
+		{true, "in/report.xml", false},
+	}
+
+	defer func(insensitive bool) { rename.CASE_INSENSITIVE_MATCH = insensitive }(rename.CASE_INSENSITIVE_MATCH)
+	for _, tt := range tests {
+		rename.CASE_INSENSITIVE_MATCH = tt.insensitive
+		if got := hasExportExtension(tt.object); got != tt.want {
+			t.Errorf("hasExportExtension(%q) with CASE_INSENSITIVE_MATCH %t = %t, want %t", tt.object, tt.insensitive, got, tt.want)
+		}
+	}
+}
+
+func TestLeftForRename(t *testing.T) {
+	tests := []struct {
+		process bool
+		object  string
+		want    bool
+	}{
+		{false, "in/report|20230801.csv", true},
+		{false, "in/report.csv", false},
+		{true, "in/report|20230801.csv", false},
+		{true, "in/report.csv", false},
+	}
+
+	defer func(process bool) { PROCESS_PIPE_FILES = process }(PROCESS_PIPE_FILES)
+	for _, tt := range tests {
+		PROCESS_PIPE_FILES = tt.process
+		if got := leftForRename(tt.object); got != tt.want {
+			t.Errorf("leftForRename(%q) with PROCESS_PIPE_FILES %t = %t, want %t", tt.object, tt.process, got, tt.want)
+		}
+	}
+}
+
+func TestExportPipeFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		process  bool
+		wantFile bool
+	}{
+		{"left for rename", false, false},
+		{"exported as is", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(process bool) { PROCESS_PIPE_FILES = process }(PROCESS_PIPE_FILES)
+			PROCESS_PIPE_FILES = tt.process
+			srv := useSFTPServer(t)
+			store := exportertest.NewStore().Use(t)
+
+			if err := exportStored(t, store, "report|20230801.csv", []byte("id,name\n"), nil); err != nil {
+				t.Fatalf("export error = %v", err)
+			}
+			if _, err := srv.ReadFile("report|20230801.csv"); (err == nil) != tt.wantFile {
+				t.Errorf("report|20230801.csv exported %t, want %t", err == nil, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestExportContentType(t *testing.T) {
+	defer func(allowed []string) { exporter.ALLOWED_CONTENT_TYPES = allowed }(exporter.ALLOWED_CONTENT_TYPES)
+	exporter.ALLOWED_CONTENT_TYPES = []string{"text/csv", "text/plain"}
+
+	tests := []struct {
+		name            string
+		contentType     string
+		quarantine      string
+		wantFile        bool
+		wantQuarantined bool
+	}{
+		{"allowed", "text/csv", "", true, false},
+		{"allowed with charset", "text/plain; charset=utf-8", "", true, false},
+		{"disallowed skipped", "application/octet-stream", "", false, false},
+		{"disallowed quarantined", "application/octet-stream", "quarantine", false, true},
+		{"missing content type", "", "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(prefix string) { QUARANTINE_PREFIX = prefix }(QUARANTINE_PREFIX)
+			QUARANTINE_PREFIX = tt.quarantine
+			srv := useSFTPServer(t)
+			store := exportertest.NewStore().Use(t)
+
+			content := []byte("id,name\n")
+			x := exporter.NewExport(&storagedata.StorageObjectData{
+				Bucket:      "bucket",
+				Name:        "report.csv",
+				Generation:  store.Put("bucket", "report.csv", content, nil),
+				Size:        int64(len(content)),
+				ContentType: tt.contentType,
+			})
+			deliver, err := sftpBackend{}.Accept(context.Background(), x)
+			if err == nil && deliver != nil {
+				err = deliver(context.Background())
+			}
+			if err != nil {
+				t.Fatalf("export error = %v", err)
+			}
+
+			if _, err := srv.ReadFile("report.csv"); (err == nil) != tt.wantFile {
+				t.Errorf("report.csv exported %t, want %t", err == nil, tt.wantFile)
+			}
+			if _, ok := store.Content("bucket", "quarantine/report.csv"); ok != tt.wantQuarantined {
+				t.Errorf("report.csv quarantined %t, want %t", ok, tt.wantQuarantined)
+			}
+		})
+	}
+}
+
+func TestExportTrailingNewline(t *testing.T) {
+	tests := []struct {
+		name      string
+		normalize bool
+		content   string
+		want      string
+	}{
+		{"no trailing newline", true, "id,name\n1,alice", "id,name\n1,alice\n"},
+		{"one trailing newline", true, "id,name\n1,alice\n", "id,name\n1,alice\n"},
+		{"multiple trailing newlines", true, "id,name\n1,alice\n\n\n", "id,name\n1,alice\n"},
+		{"disabled", false, "id,name\n1,alice\n\n\n", "id,name\n1,alice\n\n\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(normalize bool) { exporter.NORMALIZE_TRAILING_NEWLINE = normalize }(exporter.NORMALIZE_TRAILING_NEWLINE)
+			exporter.NORMALIZE_TRAILING_NEWLINE = tt.normalize
+			srv := useSFTPServer(t)
+			store := exportertest.NewStore().Use(t)
+
+			if err := exportStored(t, store, "report.csv", []byte(tt.content), nil); err != nil {
+				t.Fatalf("export error = %v", err)
+			}
+			got, err := srv.ReadFile("report.csv")
+			if err != nil {
+				t.Fatalf("unable to read report.csv: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("report.csv holds %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportReceipt(t *testing.T) {
+	defer func(prefix string) { exporter.RECEIPTS_PREFIX = prefix }(exporter.RECEIPTS_PREFIX)
+	exporter.RECEIPTS_PREFIX = "receipts/"
+
+	tests := []struct {
+		name        string
+		diskSpace   int64
+		wantReceipt bool
+		wantErr     bool
+	}{
+		{"delivered", -1, true, false},
+		{"upload failure", 0, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := useSFTPServer(t)
+			srv.SetDiskSpace(tt.diskSpace)
+			store := exportertest.NewStore().Use(t)
+
+			err := exportStored(t, store, "in/report.csv", []byte("id,name\n"), nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("export error = %v, want error %t", err, tt.wantErr)
+			}
+			data, ok := store.Content("bucket", "receipts/in/report.csv.json")
+			if ok != tt.wantReceipt {
+				t.Fatalf("bucket holds %q, want receipt written %t", store.Names("bucket"), tt.wantReceipt)
+			}
+			if !ok {
+				return
+			}
+			var got struct {
+				Destination string `json:"destination"`
+				Bytes       int64  `json:"bytes"`
+			}
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("unable to decode receipt %q: %v", data, err)
+			}
+			if want := "sftp://" + srv.Host + "/in/report.csv"; got.Destination != want || got.Bytes != 8 {
+				t.Errorf("receipt = %+v, want destination %q of 8 bytes", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package exporttosftp
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// checkSecretManager verifies the destination secret is still accessible
+func checkSecretManager(ctx context.Context) error {
+	secret := "sftp-host"
+	if PROTOCOL == "s3" {
+		secret = "s3-access-key-id"
+	}
+	if PROTOCOL == "webhook" {
+		// Webhooks without auth don't use any secret
+		if WEBHOOK_TOKEN_SECRET == "" {
+			return nil
+		}
+		secret = WEBHOOK_TOKEN_SECRET
+	}
+
+	_, err := exporter.AccessSecretVersion(ctx, exporter.SecretVersionName(secret))
+	return err
+}
+
+// checkSFTP verifies the SFTP server accepts TCP connections
+func checkSFTP(ctx context.Context) error {
+	conn, err := exporter.DialAllowed(ctx, newSFTPDialer(), "tcp", net.JoinHostPort(SFTP_HOST, SFTP_PORT))
+	if err != nil {
+		return fmt.Errorf("unable to reach SFTP server: %w", err)
+	}
+
+	return conn.Close()
+}
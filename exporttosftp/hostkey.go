@@ -0,0 +1,82 @@
+package exporttosftp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// Verify the SFTP server presents the host key stored in sftp-host-key secret
+	SFTP_PIN_HOST_KEY = false
+	sftpHostKey       ssh.PublicKey
+)
+
+// loadPinnedHostKey reads the pinned SFTP server public key, in
+// authorized_keys format, from GCP Secret Manager
+func loadPinnedHostKey(ctx context.Context) error {
+	key, err := readHostKey(ctx, "sftp-host-key")
+	if err != nil {
+		return err
+	}
+	sftpHostKey = key
+
+	return nil
+}
+
+// readHostKey reads SFTP server public key, in authorized_keys format,
+// from the given secret
+func readHostKey(ctx context.Context, secret string) (ssh.PublicKey, error) {
+	value, err := exporter.AccessSecretVersion(ctx, exporter.SecretVersionName(secret))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse pinned host key: %w", err)
+	}
+	log.Printf("Pinned SFTP host key %s %s", key.Type(), ssh.FingerprintSHA256(key))
+
+	return key, nil
+}
+
+// hostKeyCallback returns callback verifying the pinned host key, or
+// ignoring host keys when pinning is disabled
+func hostKeyCallback(pinned ssh.PublicKey) ssh.HostKeyCallback {
+	if pinned == nil {
+		return ssh.InsecureIgnoreHostKey()
+	}
+
+	return pinnedHostKey(pinned)
+}
+
+// pinnedHostKey returns callback accepting only the given host key, like
+// ssh.FixedHostKey, reporting fingerprints of both keys on mismatch
+func pinnedHostKey(pinned ssh.PublicKey) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if bytes.Equal(key.Marshal(), pinned.Marshal()) {
+			return nil
+		}
+
+		return fmt.Errorf("host key mismatch for %s: server presented %s %s, pinned %s %s", hostname, key.Type(), ssh.FingerprintSHA256(key), pinned.Type(), ssh.FingerprintSHA256(pinned))
+	}
+}
+
+// hostKeyAlgorithms returns host key algorithms matching the pinned key,
+// so the server presents it instead of a key of another type
+func hostKeyAlgorithms(pinned ssh.PublicKey) []string {
+	if pinned == nil {
+		return nil
+	}
+	if pinned.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+
+	return []string{pinned.Type()}
+}
@@ -0,0 +1,153 @@
+package exporttosftp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/exporttosftp/internal/sftptest"
+	"golang.org/x/crypto/ssh"
+)
+
+// newHostKey generates an ed25519 public key
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("unable to create public key: %v", err)
+	}
+
+	return key
+}
+
+func TestReadHostKey(t *testing.T) {
+	key := newHostKey(t)
+	authorizedKey := string(ssh.MarshalAuthorizedKey(key))
+
+	tests := []struct {
+		name    string
+		secrets map[string]string
+		wantErr bool
+	}{
+		{"authorized key", map[string]string{exporter.SecretVersionName("sftp-host-key"): authorizedKey}, false},
+		{"authorized key with comment", map[string]string{exporter.SecretVersionName("sftp-host-key"): strings.TrimSpace(authorizedKey) + " sftp.partner.com\n"}, false},
+		{"invalid key", map[string]string{exporter.SecretVersionName("sftp-host-key"): "ssh-ed25519 AAAA"}, true},
+		{"missing secret", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubSecrets(t, tt.secrets)
+
+			got, err := readHostKey(context.Background(), "sftp-host-key")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readHostKey() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && ssh.FingerprintSHA256(got) != ssh.FingerprintSHA256(key) {
+				t.Errorf("readHostKey() = %s, want %s", ssh.FingerprintSHA256(got), ssh.FingerprintSHA256(key))
+			}
+		})
+	}
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	pinned, other := newHostKey(t), newHostKey(t)
+
+	tests := []struct {
+		name    string
+		pinned  ssh.PublicKey
+		key     ssh.PublicKey
+		wantErr bool
+	}{
+		{"pinned key", pinned, pinned, false},
+		{"other key", pinned, other, true},
+		{"pinning disabled", nil, other, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := hostKeyCallback(tt.pinned)("sftp.partner.com:22", nil, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("hostKeyCallback() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), ssh.FingerprintSHA256(tt.key)) {
+				t.Errorf("hostKeyCallback() error = %v, want fingerprint of the presented key", err)
+			}
+		})
+	}
+}
+
+func TestLoadPinnedHostKey(t *testing.T) {
+	srv, err := sftptest.NewServer("user", "pass")
+	if err != nil {
+		t.Fatalf("unable to start SFTP server: %v", err)
+	}
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		key     ssh.PublicKey
+		wantErr bool
+	}{
+		{"server key", srv.HostKey, false},
+		{"other key", newHostKey(t), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(key ssh.PublicKey) { sftpHostKey = key }(sftpHostKey)
+			stubSecrets(t, map[string]string{exporter.SecretVersionName("sftp-host-key"): string(ssh.MarshalAuthorizedKey(tt.key))})
+
+			if err := loadPinnedHostKey(context.Background()); err != nil {
+				t.Fatalf("loadPinnedHostKey() error = %v", err)
+			}
+			c, err := newSFTPClient(srv.Host, srv.Port, srv.User, srv.Password, sftpHostKey)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newSFTPClient() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil {
+				c.client.Close()
+				c.ssh.Close()
+			}
+		})
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	rsaPub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("unable to create public key: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		pinned ssh.PublicKey
+		want   []string
+	}{
+		{"no pinned key", nil, nil},
+		{"ed25519", newHostKey(t), []string{ssh.KeyAlgoED25519}},
+		{"rsa", rsaPub, []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hostKeyAlgorithms(tt.pinned); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hostKeyAlgorithms() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package sftptest
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP packet types, status codes and open flags used by check-file
+const (
+	fxpVersion       = 2
+	fxpStatus        = 101
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+
+	fxNoSuchFile    = 2
+	fxBadMessage    = 5
+	fxOpUnsupported = 8
+
+	fxfRead = 1
+)
+
+// Maximal size of SFTP packets accepted from clients
+const maxCheckFilePacket = 256 << 10
+
+// Supported check-file hash algorithms
+var checkFileHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// checkFileChannel sits between an SFTP session and the request server,
+// which knows nothing of check-file. It adds the extension to the version
+// packet and answers check-file-name requests itself
+type checkFileChannel struct {
+	s       *Server
+	channel ssh.Channel
+	in      *io.PipeReader
+
+	// Serializes packets written into the channel
+	mu      sync.Mutex
+	out     []byte
+	version bool
+}
+
+func newCheckFileChannel(s *Server, channel ssh.Channel) *checkFileChannel {
+	pr, pw := io.Pipe()
+	c := &checkFileChannel{s: s, channel: channel, in: pr}
+	go c.readPackets(pw)
+
+	return c
+}
+
+// readPackets passes packets of the client to the request server, except
+// for check-file-name requests
+func (c *checkFileChannel) readPackets(pw *io.PipeWriter) {
+	for {
+		packet, err := readPacket(c.channel)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			pw.CloseWithError(err)
+			return
+		}
+
+		if reply, ok := c.s.checkFileReply(packet[4:]); ok {
+			if err := c.writeChannel(reply); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			continue
+		}
+		if _, err := pw.Write(packet); err != nil {
+			return
+		}
+	}
+}
+
+func (c *checkFileChannel) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+// Write collects packets of the request server, which writes them in
+// parts, so the first one, the version packet, can be extended
+func (c *checkFileChannel) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.out = append(c.out, p...)
+	for len(c.out) >= 4 {
+		size := int(binary.BigEndian.Uint32(c.out)) + 4
+		if len(c.out) < size {
+			break
+		}
+		packet := c.out[:size]
+		if !c.version && packet[4] == fxpVersion {
+			c.version = true
+			packet = appendString(appendString(append([]byte(nil), packet...), "check-file"), "1")
+			binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+		}
+		if _, err := c.channel.Write(packet); err != nil {
+			return 0, err
+		}
+		c.out = c.out[size:]
+	}
+
+	return len(p), nil
+}
+
+func (c *checkFileChannel) writeChannel(packet []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.channel.Write(packet)
+	return err
+}
+
+func (c *checkFileChannel) Close() error {
+	return c.channel.Close()
+}
+
+// checkFileReply answers check-file-name request with hash of the whole
+// file, ignoring offset, length and block size. It returns false for other
+// packets
+func (s *Server) checkFileReply(packet []byte) ([]byte, bool) {
+	if len(packet) < 5 || packet[0] != fxpExtended {
+		return nil, false
+	}
+	id := binary.BigEndian.Uint32(packet[1:])
+	name, rest, ok := parseString(packet[5:])
+	if !ok || name != "check-file-name" {
+		return nil, false
+	}
+	path, rest, ok := parseString(rest)
+	if !ok {
+		return statusPacket(id, fxBadMessage, "malformed check-file-name request"), true
+	}
+	algorithms, _, ok := parseString(rest)
+	if !ok {
+		return statusPacket(id, fxBadMessage, "malformed check-file-name request"), true
+	}
+
+	s.mu.Lock()
+	algorithm, corrupt := s.checkFile, s.corruptCheckFile
+	s.checkFileRequests++
+	s.mu.Unlock()
+
+	newHash, ok := checkFileHashes[algorithm]
+	if !ok || !contains(strings.Split(algorithms, ","), algorithm) {
+		return statusPacket(id, fxOpUnsupported, fmt.Sprintf("no supported algorithm in %q", algorithms)), true
+	}
+	sum, err := s.fileHash(path, newHash())
+	if err != nil {
+		return statusPacket(id, fxNoSuchFile, err.Error()), true
+	}
+	if corrupt {
+		sum[0] ^= 0xff
+	}
+
+	reply := binary.BigEndian.AppendUint32(nil, id)
+	reply = appendString(reply, "check-file")
+	reply = appendString(reply, algorithm)
+	reply = append(reply, sum...)
+
+	return packetOf(fxpExtendedReply, reply), true
+}
+
+// fileHash hashes content of the file in the in-memory file system
+func (s *Server) fileHash(path string, h hash.Hash) ([]byte, error) {
+	r := sftp.NewRequest("Get", path)
+	r.Flags = fxfRead
+	f, err := s.handlers.FileGet.Fileread(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, 1<<62)); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// readPacket reads SFTP packet including its length
+func readPacket(r io.Reader) ([]byte, error) {
+	packet := make([]byte, 4)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(packet)
+	if size == 0 || size > maxCheckFilePacket {
+		return nil, fmt.Errorf("invalid SFTP packet length %d", size)
+	}
+	packet = append(packet, make([]byte, size)...)
+	if _, err := io.ReadFull(r, packet[4:]); err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+func packetOf(typ byte, payload []byte) []byte {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+
+	return append(packet, payload...)
+}
+
+func statusPacket(id, code uint32, msg string) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, id)
+	payload = binary.BigEndian.AppendUint32(payload, code)
+	payload = appendString(payload, msg)
+	payload = appendString(payload, "")
+
+	return packetOf(fxpStatus, payload)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint32(b, uint32(len(s))), s...)
+}
+
+func parseString(b []byte) (string, []byte, bool) {
+	if len(b) < 4 {
+		return "", nil, false
+	}
+	size := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < size {
+		return "", nil, false
+	}
+
+	return string(b[4 : 4+size]), b[4+size:], true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,70 @@
+package sftptest
+
+import (
+	"errors"
+	"io"
+
+	"github.com/pkg/sftp"
+)
+
+// Error of writes beyond the disk space, reported to clients as a generic
+// failure with this message like SFTP v3 servers do
+var errDiskFull = errors.New("no space left on device")
+
+// SetDiskSpace makes writes past the given number of bytes of a file fail
+// like on a full disk, after writing the part which fits. Negative space
+// disables the limit
+func (s *Server) SetDiskSpace(space int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.diskSpace = space
+}
+
+// diskSpaceLeft returns the space set by SetDiskSpace
+func (s *Server) diskSpaceLeft() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.diskSpace
+}
+
+// diskFullWriter limits files opened for writing by the in-memory handlers
+// to the disk space. Files opened for reading as well are not limited
+type diskFullWriter struct {
+	s *Server
+	sftp.FileWriter
+}
+
+func (w diskFullWriter) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	wa, err := w.FileWriter.Filewrite(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return diskFullWriterAt{w.s, wa}, nil
+}
+
+// OpenFile keeps the read-write support of the in-memory handlers
+func (w diskFullWriter) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return w.FileWriter.(sftp.OpenFileWriter).OpenFile(r)
+}
+
+// diskFullWriterAt fails writes past the disk space
+type diskFullWriterAt struct {
+	s *Server
+	io.WriterAt
+}
+
+func (w diskFullWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	space := w.s.diskSpaceLeft()
+	if space < 0 || off+int64(len(p)) <= space {
+		return w.WriterAt.WriteAt(p, off)
+	}
+
+	n := 0
+	if off < space {
+		n, _ = w.WriterAt.WriteAt(p[:space-off], off)
+	}
+	return n, errDiskFull
+}
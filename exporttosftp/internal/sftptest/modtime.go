@@ -0,0 +1,85 @@
+package sftptest
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// SetModTime makes the server report the modification time of the file,
+// as the in-memory handlers keep the time of its creation
+func (s *Server) SetModTime(name string, mtime time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.modTimes[path.Join("/", name)] = mtime
+}
+
+// modTime returns the modification time set for the file, if any
+func (s *Server) modTime(name string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mtime, ok := s.modTimes[name]
+	return mtime, ok
+}
+
+// modTimeLister reports modification times set by SetModTime in listings
+// and stats of the in-memory handlers
+type modTimeLister struct {
+	s *Server
+	sftp.FileLister
+}
+
+func (l modTimeLister) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	lister, err := l.FileLister.Filelist(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := r.Filepath
+	if r.Method != "List" {
+		dir = path.Dir(r.Filepath)
+	}
+	return modTimeListerAt{l.s, dir, lister}, nil
+}
+
+// Lstat keeps the lstat support of the in-memory handlers
+func (l modTimeLister) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	lister, err := l.FileLister.(sftp.LstatFileLister).Lstat(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return modTimeListerAt{l.s, path.Dir(r.Filepath), lister}, nil
+}
+
+// modTimeListerAt replaces modification times of listed files in dir
+type modTimeListerAt struct {
+	s   *Server
+	dir string
+	sftp.ListerAt
+}
+
+func (l modTimeListerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	n, err := l.ListerAt.ListAt(ls, offset)
+	for i := 0; i < n; i++ {
+		if mtime, ok := l.s.modTime(path.Join(l.dir, ls[i].Name())); ok {
+			ls[i] = modTimeInfo{ls[i], mtime}
+		}
+	}
+
+	return n, err
+}
+
+// modTimeInfo is file info with the modification time replaced
+type modTimeInfo struct {
+	os.FileInfo
+	mtime time.Time
+}
+
+func (fi modTimeInfo) ModTime() time.Time {
+	return fi.mtime
+}
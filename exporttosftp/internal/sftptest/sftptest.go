@@ -0,0 +1,388 @@
+// Package sftptest provides an in-process SFTP server for exercising the
+// exporter SFTP logic without external infrastructure.
+package sftptest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Server is an SFTP server listening on a loopback address and storing
+// uploaded files in memory
+type Server struct {
+	// Host and Port the server listens on
+	Host string
+	Port string
+	// Credentials accepted by the server
+	User     string
+	Password string
+	// Public part of the server host key
+	HostKey ssh.PublicKey
+
+	listener net.Listener
+	config   *ssh.ServerConfig
+	handlers sftp.Handlers
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[*ssh.ServerConn]bool
+	// Keepalive requests received and whether they are left unanswered
+	keepalives       int
+	ignoreKeepalives bool
+	// Permissions set by clients, as the in-memory handlers ignore them
+	modes map[string]os.FileMode
+	// Modification times set by tests, reported in listings and stats
+	modTimes map[string]time.Time
+	// Bytes a file may hold before writes fail like on a full disk,
+	// negative when unlimited
+	diskSpace int64
+	// Delay of each write request, and the number of writes in progress
+	// and their maximum
+	writeDelay time.Duration
+	writes     int
+	maxWrites  int
+	// Hash algorithm of the check-file extension, whether its hashes are
+	// corrupted and the number of check-file requests answered
+	checkFile         string
+	corruptCheckFile  bool
+	checkFileRequests int
+}
+
+// NewServer starts an SFTP server accepting the given credentials
+func NewServer(user, password string) (*Server, error) {
+	return NewServerAt("127.0.0.1:0", user, password)
+}
+
+// NewServerAt starts an SFTP server listening on the address, e.g. to run
+// servers on distinct loopback hosts sharing a port
+func NewServerAt(addr, user, password string) (*Server, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate host key: %w", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create host key signer: %w", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == user && string(pass) == password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %q", c.User())
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen: %w", err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	handlers := sftp.InMemHandler()
+	s := &Server{
+		Host:     host,
+		Port:     port,
+		User:     user,
+		Password: password,
+		HostKey:  signer.PublicKey(),
+		listener: listener,
+		config:   config,
+		conns:    map[*ssh.ServerConn]bool{},
+		modes:    map[string]os.FileMode{},
+		modTimes: map[string]time.Time{},
+	}
+	s.SetDiskSpace(-1)
+	// Handlers share a single in-memory file system across connections
+	handlers.FileCmd = modeRecorder{s, handlers.FileCmd}
+	handlers.FileList = modTimeLister{s, handlers.FileList}
+	handlers.FilePut = writeRecorder{s, diskFullWriter{s, handlers.FilePut}}
+	s.handlers = handlers
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Close stops accepting connections and waits for the accept loop to exit
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+
+	return err
+}
+
+// Keepalives returns the number of keepalive requests received so far
+func (s *Server) Keepalives() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.keepalives
+}
+
+// IgnoreKeepalives makes the server leave keepalive requests unanswered,
+// like a peer behind a half-open TCP connection
+func (s *Server) IgnoreKeepalives(ignore bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ignoreKeepalives = ignore
+}
+
+// DropConnections closes all established client connections, e.g. like
+// a server dropping idle sessions
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Mode returns permissions a client set on the file or directory and
+// whether any were set
+func (s *Server) Mode(name string) (os.FileMode, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mode, ok := s.modes[name]
+	return mode, ok
+}
+
+// CheckFile makes the server advertise the check-file extension to new
+// sessions and answer check-file-name requests with hashes of the given
+// algorithm. With corrupt set the hashes don't match the stored files,
+// like of content damaged in transit
+func (s *Server) CheckFile(algorithm string, corrupt bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkFile, s.corruptCheckFile = algorithm, corrupt
+}
+
+// CheckFileRequests returns the number of check-file requests answered so far
+func (s *Server) CheckFileRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.checkFileRequests
+}
+
+// ReadFile returns content of a file stored on the server
+func (s *Server) ReadFile(name string) ([]byte, error) {
+	client, closeClient, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer closeClient()
+
+	f, err := client.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// WriteFile stores a file on the server, e.g. to prepare existing
+// destination files
+func (s *Server) WriteFile(name string, data []byte) error {
+	client, closeClient, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+
+	f, err := client.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// AssertFile verifies that the file stored on the server has the expected content
+func (s *Server) AssertFile(name string, want []byte) error {
+	got, err := s.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("unable to read [%s]: %w", name, err)
+	}
+	if string(got) != string(want) {
+		return fmt.Errorf("unexpected content of [%s]: got %q, want %q", name, got, want)
+	}
+
+	return nil
+}
+
+// dial opens a client connection to the server
+func (s *Server) dial() (*sftp.Client, func(), error) {
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(s.Host, s.Port), &ssh.ClientConfig{
+		User:            s.User,
+		Auth:            []ssh.AuthMethod{ssh.Password(s.Password)},
+		HostKeyCallback: ssh.FixedHostKey(s.HostKey),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return client, func() {
+		client.Close()
+		conn.Close()
+	}, nil
+}
+
+// modeRecorder records permissions of Setstat requests, which the in-memory
+// handlers fail for directories
+type modeRecorder struct {
+	s *Server
+	sftp.FileCmder
+}
+
+func (m modeRecorder) Filecmd(r *sftp.Request) error {
+	if r.Method != "Setstat" || !r.AttrFlags().Permissions {
+		if err := m.FileCmder.Filecmd(r); err != nil {
+			return err
+		}
+		if r.Method == "Rename" {
+			m.moveMode(r.Filepath, r.Target)
+		}
+		return nil
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	m.s.modes[r.Filepath] = os.FileMode(r.Attributes().Mode).Perm()
+	return nil
+}
+
+// PosixRename keeps the posix-rename extension of the in-memory handlers
+func (m modeRecorder) PosixRename(r *sftp.Request) error {
+	if err := m.FileCmder.(sftp.PosixRenameFileCmder).PosixRename(r); err != nil {
+		return err
+	}
+	m.moveMode(r.Filepath, r.Target)
+
+	return nil
+}
+
+// moveMode keeps permissions recorded for a renamed file with its new name
+func (m modeRecorder) moveMode(oldpath, newpath string) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	delete(m.s.modes, newpath)
+	if mode, ok := m.s.modes[oldpath]; ok {
+		m.s.modes[newpath] = mode
+		delete(m.s.modes, oldpath)
+	}
+}
+
+// handleRequests answers global requests such as keepalives
+func (s *Server) handleRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.Type == "keepalive@openssh.com" {
+			s.mu.Lock()
+			s.keepalives++
+			ignore := s.ignoreKeepalives
+			s.mu.Unlock()
+			if ignore {
+				continue
+			}
+		}
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// serve accepts incoming connections until the listener is closed
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn performs SSH handshake and serves SFTP subsystem requests
+func (s *Server) handleConn(conn net.Conn) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns[sconn] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, sconn)
+		s.mu.Unlock()
+	}()
+	go s.handleRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}(requests)
+
+		go func() {
+			var rwc io.ReadWriteCloser = channel
+			s.mu.Lock()
+			checkFile := s.checkFile != ""
+			s.mu.Unlock()
+			if checkFile {
+				rwc = newCheckFileChannel(s, channel)
+			}
+
+			server := sftp.NewRequestServer(rwc, s.handlers)
+			if err := server.Serve(); err != nil && err != io.EOF {
+				log.Printf("sftptest: serve: %v", err)
+			}
+			server.Close()
+		}()
+	}
+}
@@ -0,0 +1,93 @@
+package sftptest
+
+import (
+	"io"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// SetWriteDelay makes the server take the given time for each write
+// request, so concurrent write requests of clients overlap
+func (s *Server) SetWriteDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writeDelay = delay
+}
+
+// MaxConcurrentWrites returns the maximum number of write requests the
+// server handled at once
+func (s *Server) MaxConcurrentWrites() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.maxWrites
+}
+
+// recordWrite runs the write, recording it while in progress
+func (s *Server) recordWrite(write func() (int, error)) (int, error) {
+	s.mu.Lock()
+	s.writes++
+	if s.writes > s.maxWrites {
+		s.maxWrites = s.writes
+	}
+	delay := s.writeDelay
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.writes--
+	}()
+	time.Sleep(delay)
+
+	return write()
+}
+
+// writeRecorder records concurrency of writes into files opened by the
+// wrapped handlers
+type writeRecorder struct {
+	s *Server
+	sftp.FileWriter
+}
+
+func (w writeRecorder) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	wa, err := w.FileWriter.Filewrite(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return recordedWriterAt{w.s, wa}, nil
+}
+
+// OpenFile records writes into files opened for reading as well
+func (w writeRecorder) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	f, err := w.FileWriter.(sftp.OpenFileWriter).OpenFile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return recordedFile{w.s, f}, nil
+}
+
+// recordedWriterAt records writes while they are in progress
+type recordedWriterAt struct {
+	s *Server
+	io.WriterAt
+}
+
+func (w recordedWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return w.s.recordWrite(func() (int, error) { return w.WriterAt.WriteAt(p, off) })
+}
+
+// recordedFile records writes into a file opened for reading as well
+type recordedFile struct {
+	s *Server
+	sftp.WriterAtReaderAt
+}
+
+func (f recordedFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.s.recordWrite(func() (int, error) { return f.WriterAtReaderAt.WriteAt(p, off) })
+}
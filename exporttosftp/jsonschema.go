@@ -0,0 +1,81 @@
+package exporttosftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/rename"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+var (
+	// Secret holding JSON schema which ".json" objects are validated against
+	JSON_SCHEMA_SECRET = ""
+	// Path of JSON schema file, used when JSON_SCHEMA_SECRET is not set
+	JSON_SCHEMA_PATH = ""
+	jsonSchema       *jsonschema.Schema
+)
+
+// loadJSONSchema reads and compiles the JSON schema from JSON_SCHEMA_SECRET
+// or JSON_SCHEMA_PATH, leaving validation disabled when neither is set
+func loadJSONSchema(ctx context.Context) error {
+	var schema string
+	switch {
+	case JSON_SCHEMA_SECRET != "":
+		value, err := exporter.AccessSecretVersion(ctx, exporter.SecretVersionName(JSON_SCHEMA_SECRET))
+		if err != nil {
+			return fmt.Errorf("failed to get secret: %w", err)
+		}
+		schema = value
+	case JSON_SCHEMA_PATH != "":
+		value, err := os.ReadFile(JSON_SCHEMA_PATH)
+		if err != nil {
+			return fmt.Errorf("unable to read JSON schema: %w", err)
+		}
+		schema = string(value)
+	default:
+		return nil
+	}
+
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("schema.json", strings.NewReader(schema)); err != nil {
+		return fmt.Errorf("invalid JSON schema: %w", err)
+	}
+	compiled, err := compiler.Compile("schema.json")
+	if err != nil {
+		return fmt.Errorf("invalid JSON schema: %w", err)
+	}
+	jsonSchema = compiled
+
+	return nil
+}
+
+// isJSONObject reports whether the object is validated against the JSON schema
+func isJSONObject(object string) bool {
+	return jsonSchema != nil && rename.HasSuffixFold(object, ".json")
+}
+
+// validateJSON verifies that data is a JSON document conforming to the schema
+func validateJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("malformed JSON: %w", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("malformed JSON: unexpected data after document")
+	}
+
+	if err := jsonSchema.Validate(doc); err != nil {
+		return fmt.Errorf("JSON schema validation failed: %w", err)
+	}
+
+	return nil
+}
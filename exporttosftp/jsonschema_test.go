@@ -0,0 +1,136 @@
+package exporttosftp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Schema of test documents, requiring an integer id
+const testJSONSchema = `{"type": "object", "required": ["id"], "properties": {"id": {"type": "integer"}}}`
+
+// useJSONSchema compiles the schema and validates ".json" exports against
+// it until the test ends
+func useJSONSchema(t *testing.T, schema string) {
+	t.Helper()
+
+	prevSchema, prevExtensions := jsonSchema, extensions
+	t.Cleanup(func() { jsonSchema, extensions = prevSchema, prevExtensions })
+
+	compiled, err := jsonschema.CompileString("schema.json", schema)
+	if err != nil {
+		t.Fatalf("unable to compile JSON schema: %v", err)
+	}
+	jsonSchema, extensions = compiled, append(extensions[:len(extensions):len(extensions)], ".json")
+}
+
+func TestLoadJSONSchema(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "schema.json"), []byte(testJSONSchema), 0o600); err != nil {
+		t.Fatalf("unable to write schema: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "invalid.json"), []byte(`{"type": 42}`), 0o600); err != nil {
+		t.Fatalf("unable to write schema: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		secret     string
+		path       string
+		wantSchema bool
+		wantErr    bool
+	}{
+		{"disabled", "", "", false, false},
+		{"from secret", "json-schema", "", true, false},
+		{"from path", "", filepath.Join(dir, "schema.json"), true, false},
+		{"secret preferred", "json-schema", filepath.Join(dir, "missing.json"), true, false},
+		{"missing secret", "other-schema", "", false, true},
+		{"missing file", "", filepath.Join(dir, "missing.json"), false, true},
+		{"invalid schema", "", filepath.Join(dir, "invalid.json"), false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(secret, path string, schema *jsonschema.Schema) {
+				JSON_SCHEMA_SECRET, JSON_SCHEMA_PATH, jsonSchema = secret, path, schema
+			}(JSON_SCHEMA_SECRET, JSON_SCHEMA_PATH, jsonSchema)
+			JSON_SCHEMA_SECRET, JSON_SCHEMA_PATH, jsonSchema = tt.secret, tt.path, nil
+			stubSecrets(t, map[string]string{exporter.SecretVersionName("json-schema"): testJSONSchema})
+
+			err := loadJSONSchema(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadJSONSchema() error = %v, want error %t", err, tt.wantErr)
+			}
+			if (jsonSchema != nil) != tt.wantSchema {
+				t.Errorf("JSON schema loaded %t, want %t", jsonSchema != nil, tt.wantSchema)
+			}
+		})
+	}
+}
+
+func TestValidateJSON(t *testing.T) {
+	useJSONSchema(t, testJSONSchema)
+
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"valid", `{"id": 1, "name": "alice"}`, false},
+		{"valid with trailing newline", "{\"id\": 1}\n", false},
+		{"large integer", `{"id": 12345678901234567890}`, false},
+		{"missing property", `{"name": "alice"}`, true},
+		{"wrong type", `{"id": "1"}`, true},
+		{"not an object", `[{"id": 1}]`, true},
+		{"malformed", `{"id": 1`, true},
+		{"trailing data", `{"id": 1} {"id": 2}`, true},
+		{"empty", ``, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateJSON([]byte(tt.data)); (err != nil) != tt.wantErr {
+				t.Errorf("validateJSON(%q) error = %v, want error %t", tt.data, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		schema   bool
+		object   string
+		content  string
+		wantFile bool
+		wantErr  bool
+	}{
+		{"valid document", true, "report.json", `{"id": 1}`, true, false},
+		{"invalid document", true, "report.json", `{"id": "1"}`, false, true},
+		{"without schema", false, "report.json", `{"id": "1"}`, false, false},
+		{"other extensions", true, "report.csv", "id,name\n", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.schema {
+				useJSONSchema(t, testJSONSchema)
+			}
+			srv := useSFTPServer(t)
+			store := exportertest.NewStore().Use(t)
+
+			err := exportStored(t, store, tt.object, []byte(tt.content), nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("export error = %v, want error %t", err, tt.wantErr)
+			}
+			if _, err := srv.ReadFile(tt.object); (err == nil) != tt.wantFile {
+				t.Errorf("%s exported %t, want %t", tt.object, err == nil, tt.wantFile)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package exporttosftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// errKeepaliveTimeout reports a keepalive request the server didn't answer
+// within SFTP_KEEPALIVE_TIMEOUT, e.g. on a half-open TCP connection
+var errKeepaliveTimeout = errors.New("keepalive request timed out")
+
+// startKeepalive periodically sends SSH keepalive requests on the pooled
+// connection every SFTP_KEEPALIVE_INTERVAL, so the server doesn't drop it
+// as idle between invocations. Requests stop once the connection is closed,
+// connections which don't answer are dropped from the pool
+func (c *sftpConn) startKeepalive() {
+	if SFTP_KEEPALIVE_INTERVAL <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	c.stop = stop
+
+	go func() {
+		ticker := time.NewTicker(SFTP_KEEPALIVE_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := c.keepalive(bgctx); err != nil {
+					log.Printf("SSH keepalive failed, connection dropped: %v", err)
+					c.retire()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// alive reports whether the pooled connection can be reused
+func (c *sftpConn) alive(ctx context.Context) bool {
+	return c.keepalive(ctx) == nil
+}
+
+// keepalive sends a keepalive request and waits for the reply at most
+// SFTP_KEEPALIVE_TIMEOUT or until the context is done. A request left
+// unanswered is only unblocked once the connection is closed
+func (c *sftpConn) keepalive(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, SFTP_KEEPALIVE_TIMEOUT)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := c.ssh.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w after %s", errKeepaliveTimeout, SFTP_KEEPALIVE_TIMEOUT)
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,121 @@
+package exporttosftp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitFor polls the condition until it holds or a second passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStartKeepalive(t *testing.T) {
+	defer func(interval time.Duration) { SFTP_KEEPALIVE_INTERVAL = interval }(SFTP_KEEPALIVE_INTERVAL)
+	SFTP_KEEPALIVE_INTERVAL = 20 * time.Millisecond
+	srv, c := startSFTPServer(t)
+
+	start := time.Now()
+	c.startKeepalive()
+	waitFor(t, "3 keepalives", func() bool { return srv.Keepalives() >= 3 })
+	if elapsed := time.Since(start); elapsed < 3*SFTP_KEEPALIVE_INTERVAL {
+		t.Errorf("3 keepalives sent within %s, want one every %s", elapsed, SFTP_KEEPALIVE_INTERVAL)
+	}
+
+	sftpPoolMu.Lock()
+	c.close()
+	sftpPoolMu.Unlock()
+	sent := srv.Keepalives()
+	time.Sleep(5 * SFTP_KEEPALIVE_INTERVAL)
+	if got := srv.Keepalives(); got != sent {
+		t.Errorf("%d keepalives sent after the connection was closed, want none", got-sent)
+	}
+}
+
+func TestStartKeepaliveDisabled(t *testing.T) {
+	defer func(interval time.Duration) { SFTP_KEEPALIVE_INTERVAL = interval }(SFTP_KEEPALIVE_INTERVAL)
+	SFTP_KEEPALIVE_INTERVAL = 0
+	srv, c := startSFTPServer(t)
+
+	c.startKeepalive()
+	if c.stop != nil {
+		t.Error("keepalive started with SFTP_KEEPALIVE_INTERVAL = 0")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := srv.Keepalives(); got != 0 {
+		t.Errorf("%d keepalives sent, want none", got)
+	}
+}
+
+func TestStartKeepaliveRetires(t *testing.T) {
+	defer func(interval, timeout time.Duration) {
+		SFTP_KEEPALIVE_INTERVAL, SFTP_KEEPALIVE_TIMEOUT = interval, timeout
+	}(SFTP_KEEPALIVE_INTERVAL, SFTP_KEEPALIVE_TIMEOUT)
+	SFTP_KEEPALIVE_INTERVAL, SFTP_KEEPALIVE_TIMEOUT = 20*time.Millisecond, 20*time.Millisecond
+	srv, c := startSFTPServer(t)
+	srv.IgnoreKeepalives(true)
+
+	c.tenant = "partner"
+	sftpPoolMu.Lock()
+	sftpPool[c.tenant] = c
+	sftpPoolMu.Unlock()
+	defer func() {
+		sftpPoolMu.Lock()
+		delete(sftpPool, c.tenant)
+		sftpPoolMu.Unlock()
+	}()
+
+	c.startKeepalive()
+	waitFor(t, "the connection to be retired", func() bool {
+		sftpPoolMu.Lock()
+		defer sftpPoolMu.Unlock()
+		return sftpPool[c.tenant] == nil && c.retired
+	})
+}
+
+func TestAlive(t *testing.T) {
+	defer func(timeout time.Duration) { SFTP_KEEPALIVE_TIMEOUT = timeout }(SFTP_KEEPALIVE_TIMEOUT)
+	SFTP_KEEPALIVE_TIMEOUT = 50 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		ignore  bool
+		drop    bool
+		want    bool
+		wantErr error
+	}{
+		{"answered keepalive", false, false, true, nil},
+		{"unanswered keepalive", true, false, false, errKeepaliveTimeout},
+		{"dropped connection", false, true, false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, c := startSFTPServer(t)
+			srv.IgnoreKeepalives(tt.ignore)
+			if tt.drop {
+				srv.DropConnections()
+				waitFor(t, "the connection to be dropped", func() bool { return c.keepalive(context.Background()) != nil })
+			}
+
+			if got := c.alive(context.Background()); got != tt.want {
+				t.Errorf("alive() = %t, want %t", got, tt.want)
+			}
+			if tt.wantErr != nil {
+				if err := c.keepalive(context.Background()); !errors.Is(err, tt.wantErr) {
+					t.Errorf("keepalive() error = %v, want %v", err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
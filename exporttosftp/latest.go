@@ -0,0 +1,52 @@
+package exporttosftp
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// Export only the most recently updated object of each folder, skipping
+// older versions of e.g. daily files which are still waiting in the bucket
+var LATEST_PER_PREFIX = false
+
+// latestGroup returns the prefix grouping versions of the object, which is
+// its folder
+func latestGroup(object string) string {
+	dir := path.Dir(object)
+	if dir == "." {
+		return ""
+	}
+
+	return dir + "/"
+}
+
+// supersededBy returns name of a newer exportable object in the group of
+// the object, or an empty string when the object is the latest one. Objects
+// updated at the same time are ordered by name
+func supersededBy(ctx context.Context, bucket, object string, updated time.Time) (string, error) {
+	group := latestGroup(object)
+	attrs, err := exporter.Objects.List(ctx, bucket, group)
+	if err != nil {
+		return "", fmt.Errorf("Bucket(%q).Objects: %w", bucket, err)
+	}
+
+	for _, a := range attrs {
+		// Objects of nested folders belong to their own groups
+		if a.Name == object || strings.Contains(strings.TrimPrefix(a.Name, group), "/") {
+			continue
+		}
+		if !hasExportExtension(a.Name) || leftForRename(a.Name) || exporter.IsIgnored(a.Name) || exporter.IsBlocked(a.Name) || exporter.IsHidden(a.Name) || isQuarantined(a.Name) {
+			continue
+		}
+		if a.Updated.After(updated) || (a.Updated.Equal(updated) && a.Name > object) {
+			return a.Name, nil
+		}
+	}
+
+	return "", nil
+}
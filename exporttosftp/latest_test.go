@@ -0,0 +1,98 @@
+package exporttosftp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestLatestGroup(t *testing.T) {
+	tests := []struct {
+		object string
+		want   string
+	}{
+		{"daily/report-20240601.csv", "daily/"},
+		{"in/daily/report-20240601.csv", "in/daily/"},
+		{"report-20240601.csv", ""},
+	}
+
+	for _, tt := range tests {
+		if got := latestGroup(tt.object); got != tt.want {
+			t.Errorf("latestGroup(%q) = %q, want %q", tt.object, got, tt.want)
+		}
+	}
+}
+
+func TestExportLatestPerPrefix(t *testing.T) {
+	// Objects in the order they are stored, each one updated after the
+	// previous ones
+	objects := []string{
+		"daily/report-20240601.csv",
+		"daily/report-20240602.csv",
+		"other/report-20240601.csv",
+		"daily/report-20240603.csv",
+		"daily/archive/report-20240604.csv",
+		"daily/report-20240605.xml",
+		"daily/report-20240606.csv~",
+	}
+
+	tests := []struct {
+		name   string
+		latest bool
+		want   map[string]bool
+	}{
+		{"disabled", false, map[string]bool{
+			"daily/report-20240601.csv":         true,
+			"daily/report-20240602.csv":         true,
+			"other/report-20240601.csv":         true,
+			"daily/report-20240603.csv":         true,
+			"daily/archive/report-20240604.csv": true,
+		}},
+		{"latest per prefix", true, map[string]bool{
+			"other/report-20240601.csv":         true,
+			"daily/report-20240603.csv":         true,
+			"daily/archive/report-20240604.csv": true,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(latest bool) { LATEST_PER_PREFIX = latest }(LATEST_PER_PREFIX)
+			LATEST_PER_PREFIX = tt.latest
+			srv := useSFTPServer(t)
+			store := exportertest.NewStore().Use(t)
+			for _, object := range objects {
+				store.Put("bucket", object, []byte("id,name\n"), nil)
+			}
+
+			for _, object := range objects {
+				attrs, err := store.Attrs(context.Background(), "bucket", object, 0)
+				if err != nil {
+					t.Fatalf("Attrs(%q) error = %v", object, err)
+				}
+				x := exporter.NewExport(&storagedata.StorageObjectData{
+					Bucket:     "bucket",
+					Name:       object,
+					Generation: attrs.Generation,
+					Size:       attrs.Size,
+					Updated:    timestamppb.New(attrs.Updated),
+				})
+				deliver, err := sftpBackend{}.Accept(context.Background(), x)
+				if err == nil && deliver != nil {
+					err = deliver(context.Background())
+				}
+				if err != nil {
+					t.Fatalf("export of %s error = %v", object, err)
+				}
+
+				if _, err := srv.ReadFile(object); (err == nil) != tt.want[object] {
+					t.Errorf("%s exported %t, want %t", object, err == nil, tt.want[object])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package exporttosftp
+
+import (
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Temporary upload files older than this are removed from the folder
+	// before uploading, 0 disables the cleanup
+	SFTP_PART_CLEANUP_AGE time.Duration = 0
+	// Guards partCleanups
+	partCleanupMu sync.Mutex
+	// Time of the last cleanup of each folder
+	partCleanups = map[string]time.Time{}
+)
+
+// cleanStalePartFiles removes temporary upload files left in the folder by
+// crashed runs. Each folder is cleaned at most once per SFTP_PART_CLEANUP_AGE,
+// failures are logged but never fail the export
+func cleanStalePartFiles(c *sftpConn, folder string) {
+	if SFTP_PART_CLEANUP_AGE <= 0 {
+		return
+	}
+
+	partCleanupMu.Lock()
+	defer partCleanupMu.Unlock()
+
+	now := time.Now()
+	key := c.tenant + ":" + folder
+	if last, ok := partCleanups[key]; ok && now.Sub(last) < SFTP_PART_CLEANUP_AGE {
+		return
+	}
+	partCleanups[key] = now
+
+	dir := folder
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := c.client.ReadDir(dir)
+	if err != nil {
+		log.Printf("unable to list [%s] for stale temporary files: %v", dir, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), SFTP_PART_SUFFIX) {
+			continue
+		}
+		if now.Sub(entry.ModTime()) < SFTP_PART_CLEANUP_AGE {
+			continue
+		}
+
+		partFile := path.Join(dir, entry.Name())
+		if err := c.client.Remove(partFile); err != nil {
+			log.Printf("unable to remove stale temporary file [%s]: %v", partFile, err)
+			continue
+		}
+		log.Printf("Removed stale temporary file [%s] modified at %s", partFile, entry.ModTime().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,99 @@
+package exporttosftp
+
+import (
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCleanStalePartFiles(t *testing.T) {
+	defer func(age time.Duration, cleanups map[string]time.Time) {
+		SFTP_PART_CLEANUP_AGE, partCleanups = age, cleanups
+	}(SFTP_PART_CLEANUP_AGE, partCleanups)
+
+	tests := []struct {
+		name   string
+		age    time.Duration
+		folder string
+		want   []string
+	}{
+		{"disabled", 0, "out", []string{"fresh.csv.part", "report.csv", "stale.csv.part"}},
+		{"stale temporary files removed", time.Hour, "out", []string{"fresh.csv.part", "report.csv"}},
+		{"home directory", time.Hour, "", []string{"fresh.csv.part", "report.csv"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SFTP_PART_CLEANUP_AGE, partCleanups = tt.age, map[string]time.Time{}
+			srv, c := startSFTPServer(t)
+			if tt.folder != "" {
+				if err := mkdirAll(c, tt.folder); err != nil {
+					t.Fatalf("mkdirAll() error = %v", err)
+				}
+			}
+			for name, age := range map[string]time.Duration{"fresh.csv.part": time.Minute, "stale.csv.part": 2 * time.Hour, "report.csv": 2 * time.Hour} {
+				if err := srv.WriteFile(path.Join(tt.folder, name), []byte("id,name\n")); err != nil {
+					t.Fatalf("unable to write %s: %v", name, err)
+				}
+				srv.SetModTime(path.Join(tt.folder, name), time.Now().Add(-age))
+			}
+
+			cleanStalePartFiles(c, tt.folder)
+
+			if got := listNames(t, c, tt.folder); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("folder holds %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanStalePartFilesOncePerAge(t *testing.T) {
+	defer func(age time.Duration, cleanups map[string]time.Time) {
+		SFTP_PART_CLEANUP_AGE, partCleanups = age, cleanups
+	}(SFTP_PART_CLEANUP_AGE, partCleanups)
+	SFTP_PART_CLEANUP_AGE, partCleanups = time.Hour, map[string]time.Time{}
+	srv, c := startSFTPServer(t)
+
+	cleanStalePartFiles(c, "")
+
+	// Files left by crashes after the cleanup wait for the next one
+	if err := srv.WriteFile("stale.csv.part", []byte("id,name\n")); err != nil {
+		t.Fatalf("unable to write stale.csv.part: %v", err)
+	}
+	srv.SetModTime("stale.csv.part", time.Now().Add(-2*time.Hour))
+	cleanStalePartFiles(c, "")
+	if got := listNames(t, c, ""); !reflect.DeepEqual(got, []string{"stale.csv.part"}) {
+		t.Errorf("folder holds %q after repeated cleanup, want the stale file kept", got)
+	}
+
+	// The folder is cleaned again once SFTP_PART_CLEANUP_AGE passed
+	partCleanups[":"] = time.Now().Add(-2 * time.Hour)
+	cleanStalePartFiles(c, "")
+	if got := listNames(t, c, ""); len(got) != 0 {
+		t.Errorf("folder holds %q after the next cleanup, want none", got)
+	}
+}
+
+// listNames returns sorted names of files in the folder
+func listNames(t *testing.T, c *sftpConn, folder string) []string {
+	t.Helper()
+
+	if folder == "" {
+		folder = "."
+	}
+	entries, err := c.client.ReadDir(folder)
+	if err != nil {
+		t.Fatalf("unable to list %s: %v", folder, err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
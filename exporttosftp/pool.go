@@ -0,0 +1,139 @@
+package exporttosftp
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// Guards sftpPool, sftpConnecting and reference counts of connections
+	sftpPoolMu sync.Mutex
+	// SFTP connections kept alive across invocations, keyed by tenant
+	sftpPool = map[string]*sftpConn{}
+	// Serializes connecting of each tenant, so concurrent invocations share
+	// a single new connection
+	sftpConnecting = map[string]*sync.Mutex{}
+)
+
+// sftpConn is an SFTP connection shared by concurrent uploads of an
+// instance. Each upload holds a reference, so a connection replaced in the
+// pool is only closed once no upload uses it anymore
+type sftpConn struct {
+	client *sftp.Client
+	ssh    *ssh.Client
+	// Tenant whose credentials the connection uses, empty for the default ones
+	tenant string
+	// Number of uploaders using the connection
+	refs int
+	// Set once the connection left the pool, it is closed when unused
+	retired bool
+	// Stops keepalive requests of the connection
+	stop chan struct{}
+}
+
+// acquireSFTPConn returns pooled connection of the tenant, connecting when
+// there is none or it was dropped. The connection must be released after use
+func acquireSFTPConn(ctx context.Context, tenant string) (*sftpConn, error) {
+	if c := pooledSFTPConn(ctx, tenant); c != nil {
+		return c, nil
+	}
+
+	mu := connectingMutex(tenant)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Another invocation may have connected while waiting
+	if c := pooledSFTPConn(ctx, tenant); c != nil {
+		return c, nil
+	}
+
+	c, err := connectSFTP(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	c.startKeepalive()
+
+	sftpPoolMu.Lock()
+	defer sftpPoolMu.Unlock()
+	c.refs = 1
+	sftpPool[tenant] = c
+
+	return c, nil
+}
+
+// connectingMutex returns mutex serializing connecting of the tenant
+func connectingMutex(tenant string) *sync.Mutex {
+	sftpPoolMu.Lock()
+	defer sftpPoolMu.Unlock()
+
+	mu, ok := sftpConnecting[tenant]
+	if !ok {
+		mu = &sync.Mutex{}
+		sftpConnecting[tenant] = mu
+	}
+
+	return mu
+}
+
+// pooledSFTPConn returns a reference to the pooled connection of the tenant
+// when it is still alive, retiring it otherwise
+func pooledSFTPConn(ctx context.Context, tenant string) *sftpConn {
+	sftpPoolMu.Lock()
+	c := sftpPool[tenant]
+	if c != nil {
+		c.refs++
+	}
+	sftpPoolMu.Unlock()
+
+	if c == nil {
+		return nil
+	}
+	if c.alive(ctx) {
+		return c
+	}
+
+	log.Printf("Pooled SFTP connection is dropped, reconnecting")
+	c.retire()
+	c.release()
+	return nil
+}
+
+// release drops a reference to the connection, closing it when it is
+// retired and no longer used
+func (c *sftpConn) release() {
+	sftpPoolMu.Lock()
+	defer sftpPoolMu.Unlock()
+
+	c.refs--
+	if c.refs == 0 && c.retired {
+		c.close()
+	}
+}
+
+// retire removes the connection from the pool, closing it when unused
+func (c *sftpConn) retire() {
+	sftpPoolMu.Lock()
+	defer sftpPoolMu.Unlock()
+
+	if sftpPool[c.tenant] == c {
+		delete(sftpPool, c.tenant)
+	}
+	c.retired = true
+	if c.refs == 0 {
+		c.close()
+	}
+}
+
+// close closes the connection and stops its keepalive, callers hold sftpPoolMu
+func (c *sftpConn) close() {
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.client.Close()
+	c.ssh.Close()
+}
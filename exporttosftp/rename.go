@@ -0,0 +1,67 @@
+package exporttosftp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/rename"
+)
+
+// Apply the renamefile rename and transforms to objects with separated
+// metadata in the name before upload, so they are exported without the
+// rename function
+var INLINE_RENAME = false
+
+// isInlineRenamed reports whether the object is renamed before upload.
+// Gzipped objects are left for the rename function, which decompresses them
+func isInlineRenamed(object string) bool {
+	return INLINE_RENAME && rename.ContainsSeparator(object) && !rename.IsGzipped(object)
+}
+
+// inlineRenamedName returns the object name renamefile would store the
+// object under, e.g. "in/report|20230801.csv" becomes "in/report.csv" with
+// the default RENAME_SEPARATORS. Other names are returned unchanged. Names
+// which can't be renamed are reported as *exporter.RejectError
+func inlineRenamedName(object, extension string) (string, error) {
+	if !isInlineRenamed(object) {
+		return object, nil
+	}
+
+	name, err := rename.SetDestFileName(object, extension)
+	if err != nil {
+		return "", exporter.RejectContent(err)
+	}
+
+	return name, nil
+}
+
+// inlineRenameContent applies the renamefile transforms of the object to
+// its buffered content
+func inlineRenameContent(object string, data []byte) ([]byte, error) {
+	if !isInlineRenamed(object) {
+		return data, nil
+	}
+
+	r := inlineRenameReader(object, bytes.NewReader(data))
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to transform object %s: %w", object, err)
+	}
+
+	return data, nil
+}
+
+// inlineRenameReader applies the renamefile transforms of the object to
+// its streamed content. Closing the returned reader stops the transforms
+// and leaves r open
+func inlineRenameReader(object string, r io.Reader) io.ReadCloser {
+	if !isInlineRenamed(object) {
+		return io.NopCloser(r)
+	}
+
+	return rename.ApplyTransforms(r, rename.TransformsFor(object))
+}
@@ -0,0 +1,103 @@
+package exporttosftp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/ealebed/gcp-cf/common/rename"
+)
+
+func TestInlineRenamedName(t *testing.T) {
+	tests := []struct {
+		name       string
+		inline     bool
+		template   string
+		object     string
+		want       string
+		wantReject bool
+	}{
+		{"renamed", true, "", "in/report|20230801.csv", "in/report.csv", false},
+		{"without separator", true, "", "in/report.csv", "in/report.csv", false},
+		{"gzipped left for rename", true, "", "in/report|20230801.csv.gz", "in/report|20230801.csv.gz", false},
+		{"disabled", false, "", "in/report|20230801.csv", "in/report|20230801.csv", false},
+		{"missing template field", true, "{3}", "in/report|20230801.csv", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(inline bool, template string) {
+				INLINE_RENAME, rename.RENAME_TEMPLATE = inline, template
+			}(INLINE_RENAME, rename.RENAME_TEMPLATE)
+			INLINE_RENAME, rename.RENAME_TEMPLATE = tt.inline, tt.template
+
+			got, err := inlineRenamedName(tt.object, ".csv")
+			var rejected *exporter.RejectError
+			if errors.As(err, &rejected) != tt.wantReject {
+				t.Fatalf("inlineRenamedName(%q) error = %v, want rejection %t", tt.object, err, tt.wantReject)
+			}
+			if got != tt.want {
+				t.Errorf("inlineRenamedName(%q) = %q, want %q", tt.object, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInlineRenameContent(t *testing.T) {
+	defer func(inline bool) { INLINE_RENAME = inline }(INLINE_RENAME)
+	INLINE_RENAME = true
+
+	for object, want := range map[string]string{
+		"in/report|20230801.csv": "id,name\n1,alice\n",
+		"in/report.csv":          "id~~name\n1~~alice\n",
+	} {
+		got, err := inlineRenameContent(object, []byte("id~~name\n1~~alice\n"))
+		if err != nil {
+			t.Fatalf("inlineRenameContent(%q) error = %v", object, err)
+		}
+		if string(got) != want {
+			t.Errorf("inlineRenameContent(%q) = %q, want %q", object, got, want)
+		}
+	}
+}
+
+func TestExportInlineRename(t *testing.T) {
+	defer func(threshold int64) { exporter.STREAM_THRESHOLD_BYTES = threshold }(exporter.STREAM_THRESHOLD_BYTES)
+
+	tests := []struct {
+		name      string
+		inline    bool
+		threshold int64
+		want      map[string]string
+	}{
+		{"buffered", true, 0, map[string]string{"in/report.csv": "id,name\n1,alice\n"}},
+		{"streamed", true, 1, map[string]string{"in/report.csv": "id,name\n1,alice\n"}},
+		{"left for rename", false, 0, map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(inline bool) { INLINE_RENAME = inline }(INLINE_RENAME)
+			INLINE_RENAME, exporter.STREAM_THRESHOLD_BYTES = tt.inline, tt.threshold
+			srv := useSFTPServer(t)
+			store := exportertest.NewStore().Use(t)
+
+			if err := exportStored(t, store, "in/report|20230801.csv", []byte("id~~name\n1~~alice\n"), nil); err != nil {
+				t.Fatalf("export error = %v", err)
+			}
+			for name, want := range tt.want {
+				if err := srv.AssertFile(name, []byte(want)); err != nil {
+					t.Error(err)
+				}
+			}
+			for _, name := range []string{"in/report|20230801.csv", "in/report.csv"} {
+				if _, ok := tt.want[name]; !ok {
+					if _, err := srv.ReadFile(name); err == nil {
+						t.Errorf("%s exported, want %q only", name, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package exporttosftp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// route holds export settings applied to objects of a bucket, optionally
+// limited to a prefix. Empty fields fall back to the global settings
+type route struct {
+	// Bucket name, optionally followed by an object prefix ("bucket/prefix/")
+	Match        string `json:"match"`
+	Folder       string `json:"folder,omitempty"`
+	HeaderAction string `json:"header_action,omitempty"`
+	ValidateCSV  *bool  `json:"validate_csv,omitempty"`
+	// Extension replacing the object's one on uploaded files, e.g. ".dat"
+	Extension string `json:"extension,omitempty"`
+}
+
+// routingConfig is the JSON document stored in ROUTES_SECRET
+type routingConfig struct {
+	Routes  []route `json:"routes"`
+	Default *route  `json:"default,omitempty"`
+}
+
+// Routing rules consulted for every incoming event
+var routes routingConfig
+
+// loadRoutes reads and validates routing rules from the given secret
+func loadRoutes(ctx context.Context, secret string) error {
+	payload, err := exporter.AccessSecretVersion(ctx, exporter.SecretVersionName(secret))
+	if err != nil {
+		return err
+	}
+
+	var cfg routingConfig
+	if err := json.Unmarshal([]byte(payload), &cfg); err != nil {
+		return fmt.Errorf("invalid routing config: %w", err)
+	}
+
+	for _, rt := range cfg.Routes {
+		if rt.Match == "" {
+			return fmt.Errorf("invalid routing config: route without match")
+		}
+		if rt.HeaderAction != "" && !validHeaderAction(rt.HeaderAction) {
+			return fmt.Errorf("invalid routing config: route %q: unknown header action %q", rt.Match, rt.HeaderAction)
+		}
+		if !validExtension(rt.Extension) {
+			return fmt.Errorf("invalid routing config: route %q: extension %q must start with a dot", rt.Match, rt.Extension)
+		}
+	}
+	if cfg.Default != nil && cfg.Default.HeaderAction != "" && !validHeaderAction(cfg.Default.HeaderAction) {
+		return fmt.Errorf("invalid routing config: default route: unknown header action %q", cfg.Default.HeaderAction)
+	}
+	if cfg.Default != nil && !validExtension(cfg.Default.Extension) {
+		return fmt.Errorf("invalid routing config: default route: extension %q must start with a dot", cfg.Default.Extension)
+	}
+
+	routes = cfg
+
+	return nil
+}
+
+// validExtension reports whether a route extension is empty or a
+// single extension like ".dat"
+func validExtension(ext string) bool {
+	return ext == "" || (strings.HasPrefix(ext, ".") && !strings.ContainsAny(ext, "/"))
+}
+
+// selectRoute returns settings for an object. The route with the longest
+// matching bucket/prefix wins, then the default route, then global settings
+func selectRoute(bucket, object string) route {
+	var selected *route
+	for i, rt := range routes.Routes {
+		if matchesRoute(rt.Match, bucket, object) && (selected == nil || len(rt.Match) > len(selected.Match)) {
+			selected = &routes.Routes[i]
+		}
+	}
+	if selected == nil {
+		selected = routes.Default
+	}
+
+	rt := route{}
+	if selected != nil {
+		rt = *selected
+	}
+
+	return rt.withDefaults()
+}
+
+// matchesRoute reports whether "bucket[/prefix]" pattern matches an object
+func matchesRoute(match, bucket, object string) bool {
+	routeBucket, prefix, _ := strings.Cut(match, "/")
+
+	return routeBucket == bucket && strings.HasPrefix(object, prefix)
+}
+
+// withDefaults fills empty route settings from the global configuration
+func (rt route) withDefaults() route {
+	if rt.Folder == "" {
+		rt.Folder = SFTP_FOLDER
+	}
+	if rt.HeaderAction == "" {
+		rt.HeaderAction = HEADER_ACTION
+	}
+	if rt.ValidateCSV == nil {
+		validate := VALIDATE_CSV
+		rt.ValidateCSV = &validate
+	}
+
+	return rt
+}
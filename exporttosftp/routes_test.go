@@ -0,0 +1,135 @@
+package exporttosftp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+)
+
+func TestSelectRoute(t *testing.T) {
+	defer func(rs routingConfig) { routes = rs }(routes)
+	defer func(folder, action string, validate bool) {
+		SFTP_FOLDER, HEADER_ACTION, VALIDATE_CSV = folder, action, validate
+	}(SFTP_FOLDER, HEADER_ACTION, VALIDATE_CSV)
+	SFTP_FOLDER, HEADER_ACTION, VALIDATE_CSV = "/global", "keep", false
+
+	strict := true
+	configured := routingConfig{
+		Routes: []route{
+			{Match: "sales", Folder: "/sales"},
+			{Match: "sales/eu/", Folder: "/sales-eu", HeaderAction: "strip"},
+			{Match: "billing", Folder: "/billing", ValidateCSV: &strict},
+		},
+		Default: &route{Folder: "/default"},
+	}
+
+	tests := []struct {
+		name         string
+		routes       routingConfig
+		bucket       string
+		object       string
+		wantFolder   string
+		wantAction   string
+		wantValidate bool
+	}{
+		{"bucket route", configured, "sales", "us/report.csv", "/sales", "keep", false},
+		{"longest prefix wins", configured, "sales", "eu/report.csv", "/sales-eu", "strip", false},
+		{"other bucket", configured, "billing", "eu/report.csv", "/billing", "keep", true},
+		{"default route", configured, "hr", "report.csv", "/default", "keep", false},
+		{"bucket is matched exactly", configured, "sales-archive", "report.csv", "/default", "keep", false},
+		{"global settings", routingConfig{Routes: configured.Routes}, "hr", "report.csv", "/global", "keep", false},
+		{"no routes", routingConfig{}, "sales", "report.csv", "/global", "keep", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes = tt.routes
+
+			got := selectRoute(tt.bucket, tt.object)
+			if got.Folder != tt.wantFolder || got.HeaderAction != tt.wantAction || *got.ValidateCSV != tt.wantValidate {
+				t.Errorf("selectRoute(%q, %q) = folder %q, header action %q, validate %t, want %q, %q, %t",
+					tt.bucket, tt.object, got.Folder, got.HeaderAction, *got.ValidateCSV, tt.wantFolder, tt.wantAction, tt.wantValidate)
+			}
+		})
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		wantRoutes int
+		wantErr    bool
+	}{
+		{"routes and default", `{"routes":[{"match":"sales","folder":"/sales"},{"match":"sales/eu/","header_action":"strip"}],"default":{"folder":"/default"}}`, 2, false},
+		{"routes only", `{"routes":[{"match":"sales","validate_csv":true}]}`, 1, false},
+		{"invalid JSON", `{"routes":[`, 0, true},
+		{"route without match", `{"routes":[{"folder":"/sales"}]}`, 0, true},
+		{"unknown header action", `{"routes":[{"match":"sales","header_action":"drop"}]}`, 0, true},
+		{"unknown default header action", `{"default":{"header_action":"drop"}}`, 0, true},
+		{"extensions", `{"routes":[{"match":"sales","extension":".dat"}],"default":{"extension":".txt"}}`, 1, false},
+		{"extension without dot", `{"routes":[{"match":"sales","extension":"dat"}]}`, 0, true},
+		{"extension with slash", `{"routes":[{"match":"sales","extension":".d/at"}]}`, 0, true},
+		{"default extension without dot", `{"default":{"extension":"dat"}}`, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(rs routingConfig) { routes = rs }(routes)
+			routes = routingConfig{}
+			stubSecrets(t, map[string]string{exporter.SecretVersionName("sftp-routes"): tt.config})
+
+			err := loadRoutes(context.Background(), "sftp-routes")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadRoutes() error = %v, want error %t", err, tt.wantErr)
+			}
+			if len(routes.Routes) != tt.wantRoutes {
+				t.Errorf("loadRoutes() loaded %d routes, want %d", len(routes.Routes), tt.wantRoutes)
+			}
+		})
+	}
+
+	t.Run("missing secret", func(t *testing.T) {
+		stubSecrets(t, nil)
+		if err := loadRoutes(context.Background(), "sftp-routes"); err == nil {
+			t.Error("loadRoutes() error = nil, want error")
+		}
+	})
+}
+
+func TestExportRouteExtension(t *testing.T) {
+	defer func(rs routingConfig) { routes = rs }(routes)
+	routes = routingConfig{
+		Routes: []route{
+			{Match: "bucket/a/", Extension: ".csv"},
+			{Match: "bucket/b/", Extension: ".dat"},
+		},
+	}
+	defer func(suffix string) { SFTP_TIMESTAMP_SUFFIX = suffix }(SFTP_TIMESTAMP_SUFFIX)
+	SFTP_TIMESTAMP_SUFFIX = ""
+
+	tests := []struct {
+		object string
+		want   string
+	}{
+		{"a/report.txt", "a/report.csv"},
+		{"b/report.txt", "b/report.dat"},
+		{"c/report.txt", "c/report.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.object, func(t *testing.T) {
+			srv := useSFTPServer(t)
+			store := exportertest.NewStore().Use(t)
+
+			if err := exportStored(t, store, tt.object, []byte("id,name\n"), nil); err != nil {
+				t.Fatalf("export error = %v", err)
+			}
+			if _, err := srv.ReadFile(tt.want); err != nil {
+				t.Errorf("%s not exported as %s: %v", tt.object, tt.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package exporttosftp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// s3API is the subset of the S3 client used by the exporter
+type s3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+var (
+	// Global S3 client used across function invocations
+	s3Client s3API
+	// S3 destination related variables
+	S3_BUCKET   = ""
+	S3_REGION   = "us-east-1"
+	S3_PREFIX   = ""
+	S3_ENDPOINT = ""
+	// Size of parts of streamed content uploaded as S3 multipart upload,
+	// each part is held in memory while it is uploaded. S3 requires at least 5 MiB
+	S3_PART_SIZE int64 = 8 << 20
+)
+
+// s3MinPartSize is the smallest part size accepted by S3 multipart uploads
+const s3MinPartSize = 5 << 20
+
+// initS3 reads S3 destination settings from environment variables and
+// credentials from GCP Secret Manager, and initializes the S3 client
+func initS3(ctx context.Context) error {
+	S3_BUCKET = os.Getenv("S3_BUCKET")
+	if S3_BUCKET == "" {
+		return fmt.Errorf("S3_BUCKET must be set")
+	}
+
+	// Get S3 region, key prefix and custom endpoint from environment variables
+	if os.Getenv("S3_REGION") != "" {
+		S3_REGION = os.Getenv("S3_REGION")
+	}
+	if os.Getenv("S3_PREFIX") != "" {
+		S3_PREFIX = os.Getenv("S3_PREFIX")
+	}
+	if os.Getenv("S3_ENDPOINT") != "" {
+		S3_ENDPOINT = os.Getenv("S3_ENDPOINT")
+	}
+	if os.Getenv("S3_PART_SIZE") != "" {
+		size, err := strconv.ParseInt(os.Getenv("S3_PART_SIZE"), 10, 64)
+		if err != nil || size < s3MinPartSize {
+			return fmt.Errorf("invalid S3_PART_SIZE: %q must be at least %d bytes", os.Getenv("S3_PART_SIZE"), s3MinPartSize)
+		}
+		S3_PART_SIZE = size
+	}
+
+	// Get S3 credentials from GCP Secret Manager
+	keyID, err := exporter.AccessSecretVersion(ctx, exporter.SecretVersionName("s3-access-key-id"))
+	if err != nil {
+		return fmt.Errorf("failed to get secret: %w", err)
+	}
+	secretKey, err := exporter.AccessSecretVersion(ctx, exporter.SecretVersionName("s3-secret-access-key"))
+	if err != nil {
+		return fmt.Errorf("failed to get secret: %w", err)
+	}
+
+	opts := s3.Options{
+		Region:      S3_REGION,
+		Credentials: credentials.NewStaticCredentialsProvider(keyID, secretKey, ""),
+	}
+	if S3_ENDPOINT != "" {
+		opts.EndpointResolver = s3.EndpointResolverFromURL(S3_ENDPOINT)
+		opts.UsePathStyle = true
+	}
+
+	// Refuse to connect to hosts outside of the allowlist and present client
+	// certificate to endpoints requiring mutual TLS
+	opts.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.DialContext = allowedDialContext(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+		if clientTLSConfig != nil {
+			tr.TLSClientConfig = clientTLSConfig
+		}
+	})
+	s3Client = s3.New(opts)
+
+	return nil
+}
+
+// uploadToS3 uploads an object to the partner S3 bucket under the given prefix
+func uploadToS3(ctx context.Context, filename, prefix string, r io.Reader) error {
+	name, err := exporter.CleanRelativePath(filename)
+	if err != nil {
+		log.Printf("Rejected upload of [%s]: %v", filename, err)
+		return err
+	}
+
+	key := path.Join(prefix, name)
+	log.Printf("Uploading [%s] to [s3://%s/%s] ...\n", filename, S3_BUCKET, key)
+
+	// The SDK needs to seek in the body for signing, so streamed content of
+	// unknown size is uploaded in parts of S3_PART_SIZE instead of buffering
+	// all of it
+	size := exporter.ReaderSize(r)
+	if size < 0 {
+		size, err = uploadS3Parts(ctx, key, r)
+		if err != nil {
+			return err
+		}
+		log.Printf("%d bytes copied\n", size)
+		return nil
+	}
+
+	if err := putS3Object(ctx, key, r, size); err != nil {
+		return err
+	}
+	log.Printf("%d bytes copied\n", size)
+
+	return nil
+}
+
+// putS3Object uploads content of known size with a single request
+func putS3Object(ctx context.Context, key string, r io.Reader, size int64) error {
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(S3_BUCKET),
+		Key:           aws.String(key),
+		Body:          r,
+		ContentLength: size,
+	}
+	if _, err := s3Client.PutObject(ctx, input); err != nil {
+		return fmt.Errorf("s3.PutObject: %w", err)
+	}
+
+	return nil
+}
+
+// uploadS3Parts uploads streamed content as multipart upload, holding only
+// the current part in memory. Content smaller than a single part is put
+// with a single request. Failed uploads are aborted, so S3 doesn't keep
+// their parts
+func uploadS3Parts(ctx context.Context, key string, r io.Reader) (int64, error) {
+	buf := make([]byte, S3_PART_SIZE)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return int64(n), putS3Object(ctx, key, bytes.NewReader(buf[:n]), int64(n))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to read content: %w", err)
+	}
+
+	created, err := s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(S3_BUCKET),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("s3.CreateMultipartUpload: %w", err)
+	}
+
+	size, err := uploadS3PartsOf(ctx, key, created.UploadId, r, buf, n)
+	if err != nil {
+		_, abortErr := s3Client.AbortMultipartUpload(bgctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(S3_BUCKET),
+			Key:      aws.String(key),
+			UploadId: created.UploadId,
+		})
+		if abortErr != nil {
+			log.Printf("unable to abort multipart upload of [%s]: %v", key, abortErr)
+		}
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// uploadS3PartsOf uploads the first part read into buf and the remaining
+// content of r as parts of the multipart upload, completing it afterwards
+func uploadS3PartsOf(ctx context.Context, key string, uploadID *string, r io.Reader, buf []byte, n int) (int64, error) {
+	var parts []types.CompletedPart
+	var size int64
+	for number := int32(1); n > 0; number++ {
+		out, err := s3Client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(S3_BUCKET),
+			Key:           aws.String(key),
+			UploadId:      uploadID,
+			PartNumber:    number,
+			Body:          bytes.NewReader(buf[:n]),
+			ContentLength: int64(n),
+		})
+		if err != nil {
+			return 0, fmt.Errorf("s3.UploadPart %d: %w", number, err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: out.ETag, PartNumber: number})
+		size += int64(n)
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("unable to read content: %w", err)
+		}
+	}
+
+	_, err := s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(S3_BUCKET),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("s3.CompleteMultipartUpload: %w", err)
+	}
+
+	return size, nil
+}
+
+// checkS3 verifies the destination S3 bucket is reachable
+func checkS3(ctx context.Context) error {
+	if _, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(S3_BUCKET)}); err != nil {
+		return fmt.Errorf("s3.HeadBucket: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package exporttosftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeS3 records requests made to S3, keeping uploaded objects and parts
+type fakeS3 struct {
+	objects   map[string]string
+	puts      []*s3.PutObjectInput
+	parts     map[string][]string
+	completed []string
+	aborted   []string
+	uploads   int
+	// Error returned by UploadPart, when set
+	partErr error
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+
+	f := &fakeS3{objects: map[string]string{}, parts: map[string][]string{}}
+	client := s3Client
+	t.Cleanup(func() { s3Client = client })
+	s3Client = f
+
+	return f
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.puts = append(f.puts, params)
+	f.objects[aws.ToString(params.Key)] = string(body)
+
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.uploads++
+
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(aws.ToString(params.Key))}, nil
+}
+
+func (f *fakeS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if f.partErr != nil {
+		return nil, f.partErr
+	}
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	id := aws.ToString(params.UploadId)
+	f.parts[id] = append(f.parts[id], string(body))
+
+	return &s3.UploadPartOutput{ETag: aws.String("etag")}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	id := aws.ToString(params.UploadId)
+	if len(params.MultipartUpload.Parts) != len(f.parts[id]) {
+		return nil, errors.New("parts don't match the uploaded ones")
+	}
+	f.completed = append(f.completed, id)
+	f.objects[aws.ToString(params.Key)] = strings.Join(f.parts[id], "")
+
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.aborted = append(f.aborted, aws.ToString(params.UploadId))
+
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestUploadToS3(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		prefix   string
+		wantKey  string
+		wantErr  bool
+	}{
+		{"without prefix", "report.csv", "", "report.csv", false},
+		{"with prefix", "daily/report.csv", "partner/in", "partner/in/daily/report.csv", false},
+		{"escaping name", "../report.csv", "partner/in", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(bucket string) { S3_BUCKET = bucket }(S3_BUCKET)
+			S3_BUCKET = "partner-bucket"
+			f := newFakeS3(t)
+
+			err := uploadToS3(context.Background(), tt.filename, tt.prefix, bytes.NewReader([]byte("id,name\n")))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("uploadToS3() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(f.puts) != 0 {
+					t.Errorf("PutObject called %d times, want none", len(f.puts))
+				}
+				return
+			}
+
+			if len(f.puts) != 1 {
+				t.Fatalf("PutObject called %d times, want once", len(f.puts))
+			}
+			put := f.puts[0]
+			if got := aws.ToString(put.Bucket); got != "partner-bucket" {
+				t.Errorf("PutObject bucket = %q, want %q", got, "partner-bucket")
+			}
+			if got := aws.ToString(put.Key); got != tt.wantKey {
+				t.Errorf("PutObject key = %q, want %q", got, tt.wantKey)
+			}
+			if put.ContentLength != 8 {
+				t.Errorf("PutObject content length = %d, want 8", put.ContentLength)
+			}
+			if got := f.objects[tt.wantKey]; got != "id,name\n" {
+				t.Errorf("uploaded content = %q, want %q", got, "id,name\n")
+			}
+		})
+	}
+}
+
+func TestUploadToS3Streamed(t *testing.T) {
+	defer func(bucket string, partSize int64) { S3_BUCKET, S3_PART_SIZE = bucket, partSize }(S3_BUCKET, S3_PART_SIZE)
+	S3_BUCKET, S3_PART_SIZE = "partner-bucket", 4
+
+	tests := []struct {
+		name        string
+		content     string
+		partErr     error
+		wantPuts    int
+		wantParts   []string
+		wantAborted bool
+		wantErr     bool
+	}{
+		{"smaller than a part", "id,", nil, 1, nil, false, false},
+		{"single part", "id,n", nil, 0, []string{"id,n"}, false, false},
+		{"multiple parts", "id,name\n1", nil, 0, []string{"id,n", "ame\n", "1"}, false, false},
+		{"failed part", "id,name\n1", errors.New("connection reset"), 0, nil, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeS3(t)
+			f.partErr = tt.partErr
+
+			// Readers of unknown size are streamed
+			r := io.MultiReader(strings.NewReader(tt.content))
+			err := uploadToS3(context.Background(), "report.csv", "", r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("uploadToS3() error = %v, want error %t", err, tt.wantErr)
+			}
+			if len(f.puts) != tt.wantPuts {
+				t.Errorf("PutObject called %d times, want %d", len(f.puts), tt.wantPuts)
+			}
+			if got := f.parts["report.csv"]; !reflect.DeepEqual(got, tt.wantParts) {
+				t.Errorf("uploaded parts %q, want %q", got, tt.wantParts)
+			}
+			if aborted := len(f.aborted) > 0; aborted != tt.wantAborted {
+				t.Errorf("multipart upload aborted %t, want %t", aborted, tt.wantAborted)
+			}
+			if err != nil {
+				return
+			}
+			if got := f.objects["report.csv"]; got != tt.content {
+				t.Errorf("uploaded content = %q, want %q", got, tt.content)
+			}
+		})
+	}
+}
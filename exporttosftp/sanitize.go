@@ -0,0 +1,106 @@
+package exporttosftp
+
+import (
+	"log"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Handling of remote filename characters which some SFTP servers mishandle:
+// "none" keeps names as is, "underscore" replaces spaces and characters
+// other than ASCII letters, digits, ".", "-" and "_" with underscores and
+// "percent" percent-encodes them
+var FILENAME_SANITIZE = "none"
+
+// Unicode handling of remote filenames, applied before FILENAME_SANITIZE:
+// "none" keeps names as stored in GCS, "nfc" and "nfd" normalize them to the
+// composed or decomposed form and "ascii" strips accents, e.g. "é" becomes
+// "e", replacing other non-ASCII characters with underscores
+var FILENAME_UNICODE = "none"
+
+// validFilenameUnicode reports whether the value is a supported FILENAME_UNICODE
+func validFilenameUnicode(value string) bool {
+	switch value {
+	case "none", "nfc", "nfd", "ascii":
+		return true
+	}
+
+	return false
+}
+
+// normalizeFileName applies FILENAME_UNICODE to the remote file name
+func normalizeFileName(name string) string {
+	switch FILENAME_UNICODE {
+	case "nfc":
+		return norm.NFC.String(name)
+	case "nfd":
+		return norm.NFD.String(name)
+	case "ascii":
+		// Decompose characters, so accents can be removed as separate marks
+		stripped, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), name)
+		if err != nil {
+			stripped = name
+		}
+		return strings.Map(func(r rune) rune {
+			if r > unicode.MaxASCII {
+				return '_'
+			}
+			return r
+		}, stripped)
+	}
+
+	return name
+}
+
+// validFilenameSanitize reports whether the value is a supported FILENAME_SANITIZE
+func validFilenameSanitize(value string) bool {
+	switch value {
+	case "none", "underscore", "percent":
+		return true
+	}
+
+	return false
+}
+
+// sanitizeFileName applies FILENAME_SANITIZE to every segment of the remote
+// file name, keeping folder separators, and logs the mapping when changed
+func sanitizeFileName(name string) string {
+	if normalized := normalizeFileName(name); normalized != name {
+		log.Printf("Normalized remote filename. original=%q normalized=%q\n", name, normalized)
+		name = normalized
+	}
+	if FILENAME_SANITIZE == "none" {
+		return name
+	}
+
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		if FILENAME_SANITIZE == "percent" {
+			segments[i] = url.PathEscape(segment)
+			continue
+		}
+		segments[i] = strings.Map(func(r rune) rune {
+			if isSafeFileNameRune(r) {
+				return r
+			}
+			return '_'
+		}, segment)
+	}
+
+	sanitized := strings.Join(segments, "/")
+	if sanitized != name {
+		log.Printf("Sanitized remote filename. original=%q sanitized=%q\n", name, sanitized)
+	}
+
+	return sanitized
+}
+
+// isSafeFileNameRune reports whether the rune is kept by "underscore" sanitizing
+func isSafeFileNameRune(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_'
+}
@@ -0,0 +1,193 @@
+package exporttosftp
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		mode string
+		name string
+		want string
+	}{
+		{"none", "daily/sales report.csv", "daily/sales report.csv"},
+		{"none", "daily/café query.csv", "daily/café query.csv"},
+		{"underscore", "daily/sales report.csv", "daily/sales_report.csv"},
+		{"underscore", "daily reports/report.csv", "daily_reports/report.csv"},
+		{"underscore", "daily/café.csv", "daily/caf_.csv"},
+		{"underscore", "daily/отчёт (1).csv", "daily/_______1_.csv"},
+		{"underscore", "daily/report-2024_06.v1.csv", "daily/report-2024_06.v1.csv"},
+		{"percent", "daily/sales report.csv", "daily/sales%20report.csv"},
+		{"percent", "daily reports/café.csv", "daily%20reports/caf%C3%A9.csv"},
+		{"percent", "daily/report-2024_06.v1.csv", "daily/report-2024_06.v1.csv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.name, func(t *testing.T) {
+			defer func(mode string) { FILENAME_SANITIZE = mode }(FILENAME_SANITIZE)
+			FILENAME_SANITIZE = tt.mode
+
+			if got := sanitizeFileName(tt.name); got != tt.want {
+				t.Errorf("sanitizeFileName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFileNameLogsMapping(t *testing.T) {
+	defer func(mode string) { FILENAME_SANITIZE = mode }(FILENAME_SANITIZE)
+	FILENAME_SANITIZE = "underscore"
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	sanitizeFileName("sales report.csv")
+	if want := `original="sales report.csv" sanitized="sales_report.csv"`; !strings.Contains(logged.String(), want) {
+		t.Errorf("log %q doesn't contain %q", logged.String(), want)
+	}
+
+	logged.Reset()
+	sanitizeFileName("report.csv")
+	if logged.Len() != 0 {
+		t.Errorf("unchanged name logged %q, want nothing", logged.String())
+	}
+}
+
+func TestValidFilenameSanitize(t *testing.T) {
+	for value, want := range map[string]bool{"none": true, "underscore": true, "percent": true, "": false, "Percent": false, "escape": false} {
+		if got := validFilenameSanitize(value); got != want {
+			t.Errorf("validFilenameSanitize(%q) = %t, want %t", value, got, want)
+		}
+	}
+}
+
+func TestExportSanitizedFileName(t *testing.T) {
+	tests := []struct {
+		mode   string
+		object string
+		want   string
+	}{
+		{"underscore", "sales report.csv", "sales_report.csv"},
+		{"underscore", "Übersicht März.csv", "_bersicht_M_rz.csv"},
+		{"percent", "sales report.csv", "sales%20report.csv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.object, func(t *testing.T) {
+			defer func(mode string) { FILENAME_SANITIZE = mode }(FILENAME_SANITIZE)
+			FILENAME_SANITIZE = tt.mode
+			srv := useSFTPServer(t)
+			store := exportertest.NewStore().Use(t)
+
+			if err := exportStored(t, store, tt.object, []byte("id,name\n"), nil); err != nil {
+				t.Fatalf("export error = %v", err)
+			}
+			if _, err := srv.ReadFile(tt.want); err != nil {
+				t.Errorf("%s not exported as %s: %v", tt.object, tt.want, err)
+			}
+		})
+	}
+}
+
+// Names of the same file in composed and decomposed Unicode forms
+const (
+	composedName   = "caf\u00e9 r\u00e9sum\u00e9.csv"
+	decomposedName = "cafe\u0301 re\u0301sume\u0301.csv"
+)
+
+func TestNormalizeFileName(t *testing.T) {
+	tests := []struct {
+		mode string
+		name string
+		want string
+	}{
+		{"none", composedName, composedName},
+		{"none", decomposedName, decomposedName},
+		{"nfc", composedName, composedName},
+		{"nfc", decomposedName, composedName},
+		{"nfd", composedName, decomposedName},
+		{"nfd", decomposedName, decomposedName},
+		{"ascii", composedName, "cafe resume.csv"},
+		{"ascii", decomposedName, "cafe resume.csv"},
+		{"ascii", "daily/Übersicht März.csv", "daily/Ubersicht Marz.csv"},
+		{"ascii", "отчёт.csv", "_____.csv"},
+		{"ascii", "report.csv", "report.csv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.name, func(t *testing.T) {
+			defer func(mode string) { FILENAME_UNICODE = mode }(FILENAME_UNICODE)
+			FILENAME_UNICODE = tt.mode
+
+			if got := normalizeFileName(tt.name); got != tt.want {
+				t.Errorf("normalizeFileName(%+q) = %+q, want %+q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFileNameUnicode(t *testing.T) {
+	defer func(unicode, mode string) {
+		FILENAME_UNICODE, FILENAME_SANITIZE = unicode, mode
+	}(FILENAME_UNICODE, FILENAME_SANITIZE)
+	FILENAME_UNICODE, FILENAME_SANITIZE = "nfc", "percent"
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// Both forms are normalized before sanitizing, so they encode alike
+	want := "caf%C3%A9%20r%C3%A9sum%C3%A9.csv"
+	for _, name := range []string{composedName, decomposedName} {
+		if got := sanitizeFileName(name); got != want {
+			t.Errorf("sanitizeFileName(%+q) = %q, want %q", name, got, want)
+		}
+	}
+	if !strings.Contains(logged.String(), "Normalized remote filename") {
+		t.Errorf("log %q doesn't report the normalized decomposed name", logged.String())
+	}
+}
+
+func TestValidFilenameUnicode(t *testing.T) {
+	for value, want := range map[string]bool{"none": true, "nfc": true, "nfd": true, "ascii": true, "": false, "NFC": false, "nfkc": false} {
+		if got := validFilenameUnicode(value); got != want {
+			t.Errorf("validFilenameUnicode(%q) = %t, want %t", value, got, want)
+		}
+	}
+}
+
+func TestExportNormalizedFileName(t *testing.T) {
+	tests := []struct {
+		mode   string
+		object string
+		want   string
+	}{
+		{"none", decomposedName, decomposedName},
+		{"nfc", decomposedName, composedName},
+		{"nfd", composedName, decomposedName},
+		{"ascii", decomposedName, "cafe resume.csv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			defer func(mode string) { FILENAME_UNICODE = mode }(FILENAME_UNICODE)
+			FILENAME_UNICODE = tt.mode
+			srv := useSFTPServer(t)
+			store := exportertest.NewStore().Use(t)
+
+			if err := exportStored(t, store, tt.object, []byte("id,name\n"), nil); err != nil {
+				t.Fatalf("export error = %v", err)
+			}
+			if _, err := srv.ReadFile(tt.want); err != nil {
+				t.Errorf("%+q not exported as %+q: %v", tt.object, tt.want, err)
+			}
+		})
+	}
+}
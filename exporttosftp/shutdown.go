@@ -0,0 +1,104 @@
+package exporttosftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+var (
+	// Tracks uploads which are currently in progress
+	inflightUploads sync.WaitGroup
+	// Guards shuttingDown flag and registration of new uploads
+	shutdownMu   sync.Mutex
+	shuttingDown bool
+	// Canceled when grace period expires to abort remaining uploads
+	uploadsCtx, abortUploads = context.WithCancel(context.Background())
+)
+
+// beginUpload registers a new in-flight upload and returns a function
+// which must be called once the upload is finished. New uploads are
+// refused once the shutdown has started
+func beginUpload() (func(), error) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+
+	if shuttingDown {
+		return nil, fmt.Errorf("instance is shutting down")
+	}
+	inflightUploads.Add(1)
+
+	return inflightUploads.Done, nil
+}
+
+// handleShutdown waits for SIGTERM, then gives in-flight uploads up to
+// SHUTDOWN_GRACE_PERIOD to complete. Uploads still running afterwards are
+// aborted, which makes them remove their temporary ".part" files. Shared
+// clients are stopped before exiting
+func handleShutdown() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %v, waiting up to %s for in-flight uploads", sig, SHUTDOWN_GRACE_PERIOD)
+
+		shutdownMu.Lock()
+		shuttingDown = true
+		shutdownMu.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			inflightUploads.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			log.Printf("All uploads completed, shutting down")
+		case <-time.After(SHUTDOWN_GRACE_PERIOD):
+			log.Printf("Grace period expired, aborting in-flight uploads")
+			abortUploads()
+			// Give aborted uploads a chance to clean up temporary files
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+			}
+		}
+
+		// Send export events which are still pending
+		exporter.Shutdown()
+		os.Exit(0)
+	}()
+}
+
+// abortableReader stops reading once either the request context or the
+// shutdown abort context is canceled
+type abortableReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// newAbortableReader wraps r so the copy aborts on cancellation
+func newAbortableReader(ctx context.Context, r io.Reader) io.Reader {
+	return &abortableReader{ctx: ctx, r: r}
+}
+
+func (a *abortableReader) Read(p []byte) (int, error) {
+	if err := a.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := uploadsCtx.Err(); err != nil {
+		return 0, fmt.Errorf("upload aborted on shutdown: %w", err)
+	}
+
+	return a.r.Read(p)
+}
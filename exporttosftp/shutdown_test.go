@@ -0,0 +1,71 @@
+package exporttosftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBeginUpload(t *testing.T) {
+	defer func(stopping bool) { shuttingDown = stopping }(shuttingDown)
+
+	shuttingDown = false
+	done, err := beginUpload()
+	if err != nil {
+		t.Fatalf("beginUpload() error = %v, want nil", err)
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		inflightUploads.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("in-flight uploads completed before the upload finished")
+	default:
+	}
+	done()
+	<-waited
+
+	shuttingDown = true
+	if _, err := beginUpload(); err == nil {
+		t.Error("beginUpload() during shutdown error = nil, want error")
+	}
+}
+
+func TestAbortableReader(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		abort   bool
+		wantErr error
+	}{
+		{"running", context.Background(), false, nil},
+		{"request canceled", canceled, false, context.Canceled},
+		{"aborted on shutdown", context.Background(), true, context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(ctx context.Context, abort context.CancelFunc) { uploadsCtx, abortUploads = ctx, abort }(uploadsCtx, abortUploads)
+			uploadsCtx, abortUploads = context.WithCancel(context.Background())
+			if tt.abort {
+				abortUploads()
+			}
+
+			got, err := io.ReadAll(newAbortableReader(tt.ctx, strings.NewReader("content")))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadAll() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && string(got) != "content" {
+				t.Errorf("ReadAll() = %q, want %q", got, "content")
+			}
+		})
+	}
+}
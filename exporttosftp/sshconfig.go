@@ -0,0 +1,59 @@
+package exporttosftp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Algorithms implemented by golang.org/x/crypto/ssh, used to validate
+// SFTP_CIPHERS, SFTP_MACS and SFTP_KEX settings at startup
+var (
+	supportedCiphers = []string{
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"arcfour256", "arcfour128", "arcfour",
+		"aes128-cbc", "3des-cbc",
+	}
+	supportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512",
+		"hmac-sha1", "hmac-sha1-96",
+	}
+	supportedKeyExchanges = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+		"diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1",
+	}
+)
+
+// parseAlgorithms splits comma-separated list of algorithm names and
+// verifies each of them is supported
+func parseAlgorithms(value string, supported []string) ([]string, error) {
+	var algorithms []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !containsString(supported, name) {
+			return nil, fmt.Errorf("unsupported algorithm %q, supported are: %s", name, strings.Join(supported, ", "))
+		}
+		algorithms = append(algorithms, name)
+	}
+
+	return algorithms, nil
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
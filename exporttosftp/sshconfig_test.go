@@ -0,0 +1,72 @@
+package exporttosftp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/exporttosftp/internal/sftptest"
+)
+
+func TestParseAlgorithms(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"aes256-ctr", []string{"aes256-ctr"}, false},
+		{" aes128-cbc , 3des-cbc,", []string{"aes128-cbc", "3des-cbc"}, false},
+		{"aes256-ctr,blowfish-cbc", nil, true},
+		{"AES256-CTR", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseAlgorithms(tt.value, supportedCiphers)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAlgorithms(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAlgorithms(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestNewSFTPClientAlgorithms(t *testing.T) {
+	// The test server offers the library defaults, which exclude legacy
+	// algorithms like 3des-cbc, so connecting fails when those are the
+	// only configured ones
+	tests := []struct {
+		name    string
+		ciphers []string
+		macs    []string
+		kex     []string
+		wantErr bool
+	}{
+		{"library defaults", nil, nil, nil, false},
+		{"supported algorithms", []string{"aes256-ctr"}, []string{"hmac-sha2-512"}, []string{"diffie-hellman-group14-sha256"}, false},
+		{"legacy cipher", []string{"3des-cbc"}, nil, nil, true},
+		{"legacy key exchange", nil, nil, []string{"diffie-hellman-group1-sha1"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(ciphers, macs, kex []string) { SFTP_CIPHERS, SFTP_MACS, SFTP_KEX = ciphers, macs, kex }(SFTP_CIPHERS, SFTP_MACS, SFTP_KEX)
+			SFTP_CIPHERS, SFTP_MACS, SFTP_KEX = tt.ciphers, tt.macs, tt.kex
+			srv, err := sftptest.NewServer("user", "pass")
+			if err != nil {
+				t.Fatalf("unable to start SFTP server: %v", err)
+			}
+			defer srv.Close()
+
+			c, err := newSFTPClient(srv.Host, srv.Port, srv.User, srv.Password, srv.HostKey)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newSFTPClient() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil {
+				c.client.Close()
+				c.ssh.Close()
+			}
+		})
+	}
+}
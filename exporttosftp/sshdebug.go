@@ -0,0 +1,192 @@
+package exporttosftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Log the SSH server version and the negotiated algorithms after connecting,
+// for debugging compatibility issues with partner servers
+var DEBUG_SSH = false
+
+// kexInitTapLimit bounds the handshake bytes recorded in each direction
+const kexInitTapLimit = 64 << 10
+
+// aeadCiphers are ciphers which authenticate packets themselves, so the
+// negotiated MAC is not used
+var aeadCiphers = map[string]bool{
+	"aes128-gcm@openssh.com":        true,
+	"aes256-gcm@openssh.com":        true,
+	"chacha20-poly1305@openssh.com": true,
+}
+
+// kexInitTap records the start of the SSH handshake in both directions.
+// The ssh package keeps the negotiated algorithms private, so they are
+// determined from the KEXINIT messages, which are sent unencrypted
+type kexInitTap struct {
+	net.Conn
+	mu      sync.Mutex
+	stopped bool
+	read    bytes.Buffer
+	written bytes.Buffer
+}
+
+// newKexInitTap returns the connection recording its handshake
+func newKexInitTap(conn net.Conn) *kexInitTap {
+	return &kexInitTap{Conn: conn}
+}
+
+func (t *kexInitTap) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	t.record(&t.read, p[:n])
+	return n, err
+}
+
+func (t *kexInitTap) Write(p []byte) (int, error) {
+	t.record(&t.written, p)
+	return t.Conn.Write(p)
+}
+
+// record appends the bytes to the buffer until the tap is stopped
+func (t *kexInitTap) record(buf *bytes.Buffer, p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped || buf.Len() >= kexInitTapLimit {
+		return
+	}
+	buf.Write(p)
+}
+
+// stop ends recording, returning the bytes sent and received so far
+func (t *kexInitTap) stop() ([]byte, []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+
+	return t.written.Bytes(), t.read.Bytes()
+}
+
+// kexInit holds the algorithm name-lists of a KEXINIT message
+type kexInit struct {
+	kex, hostKey            []string
+	cipherOut, cipherIn     []string
+	macOut, macIn           []string
+	compressOut, compressIn []string
+}
+
+// parseKexInit parses the first KEXINIT message of one side of the
+// handshake, which follows the version line and optional banner lines
+func parseKexInit(stream []byte) (*kexInit, error) {
+	for {
+		i := bytes.IndexByte(stream, '\n')
+		if i < 0 {
+			return nil, errors.New("version line not found")
+		}
+		line := stream[:i]
+		stream = stream[i+1:]
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			break
+		}
+	}
+
+	// Binary packet: uint32 length, byte padding length, payload, padding
+	if len(stream) < 5 {
+		return nil, errors.New("KEXINIT packet truncated")
+	}
+	length := binary.BigEndian.Uint32(stream)
+	padding := uint32(stream[4])
+	if length < padding+1 || uint64(len(stream)) < 4+uint64(length) {
+		return nil, errors.New("KEXINIT packet truncated")
+	}
+	payload := stream[5 : 4+length-padding]
+
+	// Payload: message number 20, 16 byte cookie and the name-lists
+	if len(payload) < 17 || payload[0] != 20 {
+		return nil, errors.New("first packet is not KEXINIT")
+	}
+	payload = payload[17:]
+
+	var lists [8][]string
+	for i := range lists {
+		if len(payload) < 4 {
+			return nil, errors.New("KEXINIT name-list truncated")
+		}
+		n := binary.BigEndian.Uint32(payload)
+		if uint64(len(payload)) < 4+uint64(n) {
+			return nil, errors.New("KEXINIT name-list truncated")
+		}
+		if n > 0 {
+			lists[i] = strings.Split(string(payload[4:4+n]), ",")
+		}
+		payload = payload[4+n:]
+	}
+
+	return &kexInit{
+		kex: lists[0], hostKey: lists[1],
+		cipherOut: lists[2], cipherIn: lists[3],
+		macOut: lists[4], macIn: lists[5],
+		compressOut: lists[6], compressIn: lists[7],
+	}, nil
+}
+
+// negotiate returns the first client algorithm supported by the server,
+// as chosen by the SSH algorithm negotiation
+func negotiate(client, server []string) string {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c
+			}
+		}
+	}
+
+	return "none"
+}
+
+// negotiatedMAC returns the MAC used with the cipher
+func negotiatedMAC(cipher string, client, server []string) string {
+	if aeadCiphers[cipher] {
+		return "implicit"
+	}
+
+	return negotiate(client, server)
+}
+
+// logSSHConnection logs versions and negotiated algorithms of the connection
+// recorded by the tap, ciphers, MACs and compression as client-to-server and
+// server-to-client pairs
+func logSSHConnection(client *ssh.Client, tap *kexInitTap) {
+	written, read := tap.stop()
+	log.Printf("SSH connected to %s: server version %q, client version %q", client.RemoteAddr(), client.ServerVersion(), client.ClientVersion())
+
+	local, err := parseKexInit(written)
+	if err != nil {
+		log.Printf("unable to determine negotiated SSH algorithms: client %v", err)
+		return
+	}
+	remote, err := parseKexInit(read)
+	if err != nil {
+		log.Printf("unable to determine negotiated SSH algorithms: server %v", err)
+		return
+	}
+
+	cipherOut := negotiate(local.cipherOut, remote.cipherOut)
+	cipherIn := negotiate(local.cipherIn, remote.cipherIn)
+	log.Printf("SSH negotiated algorithms with %s: kex=%s hostkey=%s cipher=%s/%s mac=%s/%s compression=%s/%s",
+		client.RemoteAddr(),
+		negotiate(local.kex, remote.kex),
+		negotiate(local.hostKey, remote.hostKey),
+		cipherOut, cipherIn,
+		negotiatedMAC(cipherOut, local.macOut, remote.macOut),
+		negotiatedMAC(cipherIn, local.macIn, remote.macIn),
+		negotiate(local.compressOut, remote.compressOut),
+		negotiate(local.compressIn, remote.compressIn),
+	)
+}
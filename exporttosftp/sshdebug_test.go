@@ -0,0 +1,154 @@
+package exporttosftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/exporttosftp/internal/sftptest"
+)
+
+// kexInitStream returns the start of one side of an SSH handshake, the
+// version line followed by a KEXINIT packet with the name-lists
+func kexInitStream(lists [8]string) []byte {
+	payload := append([]byte{20}, make([]byte, 16)...)
+	for _, list := range lists {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(list)))
+		payload = append(payload, list...)
+	}
+	payload = append(payload, 0, 0, 0, 0, 0)
+
+	padding := 4
+	packet := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)+padding))
+	packet = append(packet, byte(padding))
+	packet = append(packet, payload...)
+	packet = append(packet, make([]byte, padding)...)
+
+	return append([]byte("SSH-2.0-OpenSSH_9.6\r\n"), packet...)
+}
+
+func TestParseKexInit(t *testing.T) {
+	lists := [8]string{
+		"curve25519-sha256,diffie-hellman-group14-sha256", "ssh-ed25519",
+		"aes128-ctr", "aes256-ctr", "hmac-sha2-256", "hmac-sha2-512",
+		"none", "",
+	}
+	stream := kexInitStream(lists)
+	notKexInit := kexInitStream(lists)
+	notKexInit[len("SSH-2.0-OpenSSH_9.6\r\n")+5] = 21
+	want := &kexInit{
+		kex:         []string{"curve25519-sha256", "diffie-hellman-group14-sha256"},
+		hostKey:     []string{"ssh-ed25519"},
+		cipherOut:   []string{"aes128-ctr"},
+		cipherIn:    []string{"aes256-ctr"},
+		macOut:      []string{"hmac-sha2-256"},
+		macIn:       []string{"hmac-sha2-512"},
+		compressOut: []string{"none"},
+	}
+
+	tests := []struct {
+		name    string
+		stream  []byte
+		want    *kexInit
+		wantErr string
+	}{
+		{"kexinit", stream, want, ""},
+		{"banner lines", append([]byte("Authorized use only\r\n"), stream...), want, ""},
+		{"missing version line", []byte("Authorized use only\r\n"), nil, "version line not found"},
+		{"truncated packet", stream[:len(stream)-8], nil, "KEXINIT packet truncated"},
+		{"missing packet", []byte("SSH-2.0-OpenSSH_9.6\r\n"), nil, "KEXINIT packet truncated"},
+		{"other message", notKexInit, nil, "first packet is not KEXINIT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKexInit(tt.stream)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("parseKexInit() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseKexInit() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseKexInit() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name   string
+		client []string
+		server []string
+		want   string
+	}{
+		{"client preference", []string{"aes256-ctr", "aes128-ctr"}, []string{"aes128-ctr", "aes256-ctr"}, "aes256-ctr"},
+		{"single match", []string{"aes256-ctr", "aes128-ctr"}, []string{"aes128-ctr"}, "aes128-ctr"},
+		{"no match", []string{"aes256-ctr"}, []string{"3des-cbc"}, "none"},
+		{"empty server list", []string{"aes256-ctr"}, nil, "none"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiate(tt.client, tt.server); got != tt.want {
+				t.Errorf("negotiate(%q, %q) = %q, want %q", tt.client, tt.server, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiatedMAC(t *testing.T) {
+	macs := []string{"hmac-sha2-256"}
+
+	for cipher, want := range map[string]string{
+		"aes128-ctr":                    "hmac-sha2-256",
+		"aes128-gcm@openssh.com":        "implicit",
+		"aes256-gcm@openssh.com":        "implicit",
+		"chacha20-poly1305@openssh.com": "implicit",
+	} {
+		if got := negotiatedMAC(cipher, macs, macs); got != want {
+			t.Errorf("negotiatedMAC(%q) = %q, want %q", cipher, got, want)
+		}
+	}
+}
+
+func TestNewSFTPClientDebugSSH(t *testing.T) {
+	defer func(debug bool, ciphers []string) { DEBUG_SSH, SFTP_CIPHERS = debug, ciphers }(DEBUG_SSH, SFTP_CIPHERS)
+	SFTP_CIPHERS = []string{"aes128-ctr"}
+
+	for _, debug := range []bool{true, false} {
+		DEBUG_SSH = debug
+		srv, err := sftptest.NewServer("user", "pass")
+		if err != nil {
+			t.Fatalf("unable to start SFTP server: %v", err)
+		}
+		defer srv.Close()
+
+		var logged bytes.Buffer
+		log.SetOutput(&logged)
+		c, err := newSFTPClient(srv.Host, srv.Port, srv.User, srv.Password, srv.HostKey)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Fatalf("newSFTPClient() error = %v", err)
+		}
+		c.client.Close()
+		c.ssh.Close()
+
+		for _, want := range []string{"server version", "SSH negotiated algorithms", "cipher=aes128-ctr/aes128-ctr", "compression=none/none"} {
+			if strings.Contains(logged.String(), want) != debug {
+				t.Errorf("log %q contains %q = %t with DEBUG_SSH=%t", logged.String(), want, !debug, debug)
+			}
+		}
+		if strings.Contains(logged.String(), "unable to determine") {
+			t.Errorf("log %q reports undetermined algorithms", logged.String())
+		}
+	}
+}
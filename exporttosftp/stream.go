@@ -0,0 +1,50 @@
+package exporttosftp
+
+import (
+	"context"
+	"io"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// unstreamedSteps returns enabled content steps of the object which need the
+// whole content, so they can't be applied when it is streamed: CSV and JSON
+// validation, deltas, trailers and trailing newline normalization
+func unstreamedSteps(ctx context.Context, object, ext string, rt route) []string {
+	var steps []string
+	if *rt.ValidateCSV && ext == ".csv" {
+		steps = append(steps, "CSV validation")
+	}
+	if isJSONObject(object) {
+		steps = append(steps, "JSON schema validation")
+	}
+	if DELTA_SNAPSHOT_BUCKET != "" && !exporter.IsForcedExport(ctx) {
+		steps = append(steps, "delta")
+	}
+	if TRAILER_TEMPLATE != "" {
+		steps = append(steps, "trailer")
+	}
+	if exporter.NORMALIZE_TRAILING_NEWLINE {
+		steps = append(steps, "trailing newline normalization")
+	}
+
+	return steps
+}
+
+// streamContent applies inline renaming, sampling and the header action to
+// streamed content of the object. Rejected headers are reported as
+// *exporter.RejectError. Closing the returned reader stops the inline
+// rename transforms
+func streamContent(object, headerAction string, r io.Reader) (io.ReadCloser, error) {
+	renamed := inlineRenameReader(object, r)
+	content, err := transformHeaderReader(exporter.SampleReader(renamed), headerAction)
+	if err != nil {
+		renamed.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{content, renamed}, nil
+}
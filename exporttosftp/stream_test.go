@@ -0,0 +1,54 @@
+package exporttosftp
+
+import (
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+)
+
+func TestExportStreamThreshold(t *testing.T) {
+	defer func(threshold int64, action, template string, validate bool) {
+		exporter.STREAM_THRESHOLD_BYTES, HEADER_ACTION, TRAILER_TEMPLATE, VALIDATE_CSV = threshold, action, template, validate
+	}(exporter.STREAM_THRESHOLD_BYTES, HEADER_ACTION, TRAILER_TEMPLATE, VALIDATE_CSV)
+	exporter.STREAM_THRESHOLD_BYTES = 16
+
+	tests := []struct {
+		name       string
+		content    string
+		action     string
+		template   string
+		validate   bool
+		want       string
+		wantReject bool
+	}{
+		{"buffered at threshold", "id,name\n1,alice\n", "keep", "TRL|{rows}", false, "id,name\n1,alice\nTRL|2\n", false},
+		{"buffered header action", "id,name\n1,alice\n", "strip", "", false, "1,alice\n", false},
+		{"streamed above threshold", "id,name\n1,alice\n2,bob\n", "keep", "", false, "id,name\n1,alice\n2,bob\n", false},
+		{"streamed header action", "id,name\n1,alice\n2,bob\n", "strip", "", false, "1,alice\n2,bob\n", false},
+		{"streamed trailer rejected", "id,name\n1,alice\n2,bob\n", "keep", "TRL|{rows}", false, "", true},
+		{"streamed validation rejected", "id,name\n1,alice\n2,bob\n", "keep", "", true, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			HEADER_ACTION, TRAILER_TEMPLATE, VALIDATE_CSV = tt.action, tt.template, tt.validate
+			srv := useSFTPServer(t)
+			store := exportertest.NewStore().Use(t)
+
+			err := exportStored(t, store, "report.csv", []byte(tt.content), nil)
+			if (err != nil) != tt.wantReject {
+				t.Fatalf("export error = %v, want rejection %t", err, tt.wantReject)
+			}
+			if tt.wantReject {
+				if _, err := srv.ReadFile("report.csv"); err == nil {
+					t.Error("rejected object was uploaded")
+				}
+				return
+			}
+			if err := srv.AssertFile("report.csv", []byte(tt.want)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package exporttosftp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// Object metadata key naming the tenant, whose SFTP destination is read
+	// from "<tenant>-sftp-host", "<tenant>-sftp-user" and "<tenant>-sftp-pass"
+	// secrets. Objects without it use the default credentials
+	TENANT_METADATA_KEY = ""
+	// Guards tenantCredentialsCache and tenantRefreshedAt
+	tenantsMu sync.Mutex
+	// SFTP credentials of tenants, cached across invocations
+	tenantCredentialsCache = map[string]*sftpCredentials{}
+	// Time of the last credentials refresh of each tenant, refreshes are
+	// limited by SFTP_PASS_REFRESH_COOLDOWN like the default password
+	tenantRefreshedAt = map[string]time.Time{}
+)
+
+// Tenant names must be usable within secret names
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// sftpCredentials holds SFTP destination of a tenant
+type sftpCredentials struct {
+	host    string
+	user    string
+	pass    string
+	hostKey ssh.PublicKey
+}
+
+// resolveTenant returns tenant named in object metadata, or empty string
+// when tenants are disabled or the object doesn't name one
+func resolveTenant(metadata map[string]string) (string, error) {
+	if TENANT_METADATA_KEY == "" {
+		return "", nil
+	}
+
+	tenant := metadata[TENANT_METADATA_KEY]
+	if tenant != "" && !validTenant.MatchString(tenant) {
+		return "", fmt.Errorf("invalid tenant %q", tenant)
+	}
+
+	return tenant, nil
+}
+
+// tenantCredentials returns SFTP credentials of the tenant, loading them
+// from GCP Secret Manager on first use
+func tenantCredentials(ctx context.Context, tenant string) (*sftpCredentials, error) {
+	tenantsMu.Lock()
+	defer tenantsMu.Unlock()
+
+	if creds, ok := tenantCredentialsCache[tenant]; ok {
+		return creds, nil
+	}
+
+	return loadTenantCredentials(ctx, tenant)
+}
+
+// loadTenantCredentials reads SFTP credentials of the tenant from GCP Secret
+// Manager into the cache, callers hold tenantsMu
+func loadTenantCredentials(ctx context.Context, tenant string) (*sftpCredentials, error) {
+	creds := &sftpCredentials{}
+	var err error
+	if creds.host, err = exporter.AccessSecretVersion(ctx, exporter.SecretVersionName(tenant+"-sftp-host")); err != nil {
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+	if creds.user, err = exporter.AccessSecretVersion(ctx, exporter.SecretVersionName(tenant+"-sftp-user")); err != nil {
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+	if creds.pass, err = exporter.AccessSecretVersion(ctx, exporter.SecretVersionName(tenant+"-sftp-pass")); err != nil {
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+	if SFTP_PIN_HOST_KEY {
+		if creds.hostKey, err = readHostKey(ctx, tenant+"-sftp-host-key"); err != nil {
+			return nil, err
+		}
+	}
+	tenantCredentialsCache[tenant] = creds
+	log.Printf("Loaded SFTP credentials of tenant %s", tenant)
+
+	return creds, nil
+}
+
+// refreshTenantCredentials re-reads SFTP credentials of the tenant from GCP
+// Secret Manager unless they were refreshed within SFTP_PASS_REFRESH_COOLDOWN.
+// It returns the credentials and whether they differ from the cached ones
+func refreshTenantCredentials(ctx context.Context, tenant string) (*sftpCredentials, bool, error) {
+	tenantsMu.Lock()
+	defer tenantsMu.Unlock()
+
+	if at, ok := tenantRefreshedAt[tenant]; ok && time.Since(at) < SFTP_PASS_REFRESH_COOLDOWN {
+		log.Printf("SFTP credentials of tenant %s were refreshed at %s, skipping refresh", tenant, at.Format(time.RFC3339))
+		return nil, false, nil
+	}
+	tenantRefreshedAt[tenant] = time.Now()
+
+	previous := tenantCredentialsCache[tenant]
+	creds, err := loadTenantCredentials(ctx, tenant)
+	if err != nil {
+		return nil, false, err
+	}
+	changed := previous == nil || creds.host != previous.host || creds.user != previous.user || creds.pass != previous.pass
+
+	return creds, changed, nil
+}
+
+// connectTenantSFTP connects to SFTP server of the tenant. When the server
+// rejects cached credentials, they are re-read once and the connection is
+// retried, so rotated passwords are picked up without a redeploy
+func connectTenantSFTP(ctx context.Context, tenant string) (*sftpConn, error) {
+	creds, err := tenantCredentials(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newSFTPClient(creds.host, SFTP_PORT, creds.user, creds.pass, creds.hostKey)
+	if err == nil || !isAuthError(err) {
+		return c, err
+	}
+
+	creds, refreshed, rerr := refreshTenantCredentials(ctx, tenant)
+	if rerr != nil {
+		return nil, fmt.Errorf("%v (credentials refresh failed: %w)", err, rerr)
+	}
+	if !refreshed {
+		return nil, err
+	}
+
+	log.Printf("SFTP credentials of tenant %s refreshed, retrying connection", tenant)
+	return newSFTPClient(creds.host, SFTP_PORT, creds.user, creds.pass, creds.hostKey)
+}
+
+// tenantHost returns SFTP host of the tenant reported in export events
+func tenantHost(tenant string) string {
+	tenantsMu.Lock()
+	defer tenantsMu.Unlock()
+
+	if creds, ok := tenantCredentialsCache[tenant]; ok {
+		return creds.host
+	}
+
+	return SFTP_HOST
+}
@@ -0,0 +1,174 @@
+package exporttosftp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/ealebed/gcp-cf/exporttosftp/internal/sftptest"
+)
+
+// useTenantServer starts an SFTP server of the tenant on the loopback host,
+// sharing SFTP_PORT with the default server, and returns secrets naming it
+func useTenantServer(t *testing.T, tenant, host string) (*sftptest.Server, map[string]string) {
+	t.Helper()
+
+	srv, err := sftptest.NewServerAt(host+":"+SFTP_PORT, tenant+"-user", tenant+"-pass")
+	if err != nil {
+		t.Skipf("unable to start SFTP server on %s: %v", host, err)
+	}
+	t.Cleanup(func() {
+		srv.Close()
+
+		// Drop the connection pooled by the test
+		sftpPoolMu.Lock()
+		defer sftpPoolMu.Unlock()
+		if c := sftpPool[tenant]; c != nil {
+			delete(sftpPool, tenant)
+			c.close()
+		}
+	})
+
+	return srv, map[string]string{
+		exporter.SecretVersionName(tenant + "-sftp-host"): host,
+		exporter.SecretVersionName(tenant + "-sftp-user"): srv.User,
+		exporter.SecretVersionName(tenant + "-sftp-pass"): srv.Password,
+	}
+}
+
+func TestResolveTenant(t *testing.T) {
+	defer func(key string) { TENANT_METADATA_KEY = key }(TENANT_METADATA_KEY)
+
+	tests := []struct {
+		key      string
+		metadata map[string]string
+		want     string
+		wantErr  bool
+	}{
+		{"", map[string]string{"x-tenant": "acme"}, "", false},
+		{"x-tenant", map[string]string{"x-tenant": "acme"}, "acme", false},
+		{"x-tenant", map[string]string{"x-tenant": "acme_eu-2"}, "acme_eu-2", false},
+		{"x-tenant", map[string]string{"x-partner": "acme"}, "", false},
+		{"x-tenant", nil, "", false},
+		{"x-tenant", map[string]string{"x-tenant": "../acme"}, "", true},
+		{"x-tenant", map[string]string{"x-tenant": "acme/sftp"}, "", true},
+	}
+
+	for _, tt := range tests {
+		TENANT_METADATA_KEY = tt.key
+		got, err := resolveTenant(tt.metadata)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveTenant(%q) with key %q error = %v, want error %t", tt.metadata, tt.key, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("resolveTenant(%q) with key %q = %q, want %q", tt.metadata, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestExportTenants(t *testing.T) {
+	defer func(key string, cache map[string]*sftpCredentials) {
+		TENANT_METADATA_KEY, tenantCredentialsCache = key, cache
+	}(TENANT_METADATA_KEY, tenantCredentialsCache)
+	TENANT_METADATA_KEY, tenantCredentialsCache = "x-tenant", map[string]*sftpCredentials{}
+
+	defaultSrv := useSFTPServer(t)
+	acmeSrv, acmeSecrets := useTenantServer(t, "acme", "127.0.0.2")
+	globexSrv, globexSecrets := useTenantServer(t, "globex", "127.0.0.3")
+	secrets := map[string]string{}
+	for _, s := range []map[string]string{acmeSecrets, globexSecrets} {
+		for name, value := range s {
+			secrets[name] = value
+		}
+	}
+	accesses := stubSecrets(t, secrets)
+	store := exportertest.NewStore().Use(t)
+
+	tests := []struct {
+		object   string
+		metadata map[string]string
+		srv      *sftptest.Server
+	}{
+		{"acme.csv", map[string]string{"x-tenant": "acme"}, acmeSrv},
+		{"globex.csv", map[string]string{"x-tenant": "globex"}, globexSrv},
+		{"default.csv", nil, defaultSrv},
+		{"acme2.csv", map[string]string{"x-tenant": "acme"}, acmeSrv},
+		{"globex2.csv", map[string]string{"x-tenant": "globex"}, globexSrv},
+	}
+
+	for _, tt := range tests {
+		if err := exportStored(t, store, tt.object, []byte("id,name\n"), tt.metadata); err != nil {
+			t.Fatalf("export of %s error = %v", tt.object, err)
+		}
+	}
+	for _, tt := range tests {
+		for _, srv := range []*sftptest.Server{defaultSrv, acmeSrv, globexSrv} {
+			_, err := srv.ReadFile(tt.object)
+			if exported := err == nil; exported != (srv == tt.srv) {
+				t.Errorf("%s exported to %s = %t, want %t", tt.object, srv.Host, exported, srv == tt.srv)
+			}
+		}
+	}
+
+	// Credentials of each tenant are read once and cached
+	if *accesses != len(secrets) {
+		t.Errorf("secrets accessed %d times, want %d", *accesses, len(secrets))
+	}
+	if got := tenantHost("globex"); got != "127.0.0.3" {
+		t.Errorf("tenantHost(%q) = %q, want %q", "globex", got, "127.0.0.3")
+	}
+
+	// Objects naming a tenant without credentials aren't sent to the default server
+	if err := exportStored(t, store, "initech.csv", []byte("id,name\n"), map[string]string{"x-tenant": "initech"}); err == nil {
+		t.Error("export of initech.csv error = nil, want error")
+	}
+	if _, err := defaultSrv.ReadFile("initech.csv"); err == nil {
+		t.Error("initech.csv exported to the default server")
+	}
+}
+
+func TestRefreshTenantCredentials(t *testing.T) {
+	defer func(cache map[string]*sftpCredentials, refreshed map[string]time.Time, cooldown time.Duration) {
+		tenantCredentialsCache, tenantRefreshedAt, SFTP_PASS_REFRESH_COOLDOWN = cache, refreshed, cooldown
+	}(tenantCredentialsCache, tenantRefreshedAt, SFTP_PASS_REFRESH_COOLDOWN)
+	tenantCredentialsCache, tenantRefreshedAt, SFTP_PASS_REFRESH_COOLDOWN = map[string]*sftpCredentials{}, map[string]time.Time{}, time.Minute
+
+	secrets := map[string]string{
+		exporter.SecretVersionName("acme-sftp-host"):   "127.0.0.2",
+		exporter.SecretVersionName("acme-sftp-user"):   "acme-user",
+		exporter.SecretVersionName("acme-sftp-pass"):   "rotated",
+		exporter.SecretVersionName("globex-sftp-host"): "127.0.0.3",
+		exporter.SecretVersionName("globex-sftp-user"): "globex-user",
+		exporter.SecretVersionName("globex-sftp-pass"): "globex-pass",
+	}
+	stubSecrets(t, secrets)
+	tenantCredentialsCache["acme"] = &sftpCredentials{host: "127.0.0.2", user: "acme-user", pass: "expired"}
+	tenantCredentialsCache["globex"] = &sftpCredentials{host: "127.0.0.3", user: "globex-user", pass: "globex-pass"}
+
+	tests := []struct {
+		name        string
+		tenant      string
+		wantCreds   bool
+		wantChanged bool
+	}{
+		{"rotated password", "acme", true, true},
+		{"within cooldown", "acme", false, false},
+		{"other tenant unchanged", "globex", true, false},
+	}
+
+	for _, tt := range tests {
+		creds, changed, err := refreshTenantCredentials(context.Background(), tt.tenant)
+		if err != nil {
+			t.Fatalf("%s: refreshTenantCredentials(%q) error = %v", tt.name, tt.tenant, err)
+		}
+		if (creds != nil) != tt.wantCreds || changed != tt.wantChanged {
+			t.Errorf("%s: refreshTenantCredentials(%q) returned credentials %t, changed %t, want %t, %t", tt.name, tt.tenant, creds != nil, changed, tt.wantCreds, tt.wantChanged)
+		}
+	}
+	if got := tenantCredentialsCache["acme"].pass; got != "rotated" {
+		t.Errorf("cached password of acme = %q, want %q", got, "rotated")
+	}
+}
@@ -0,0 +1,57 @@
+package exporttosftp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+var (
+	// Present client certificate from Secret Manager to partners requiring mutual TLS
+	TLS_CLIENT_CERT = false
+	// Secrets holding PEM encoded client certificate chain and private key
+	TLS_CLIENT_CERT_SECRET = "tls-client-cert"
+	TLS_CLIENT_KEY_SECRET  = "tls-client-key"
+	// TLS configuration shared by HTTPS destinations, nil without client certificate
+	clientTLSConfig *tls.Config
+)
+
+// loadClientTLSConfig returns TLS configuration presenting the client
+// certificate stored in Secret Manager. The pair is validated here, so
+// invalid or expired certificates fail the function at startup instead of
+// during the first handshake
+func loadClientTLSConfig(ctx context.Context) (*tls.Config, error) {
+	certPEM, err := exporter.AccessSecretVersion(ctx, exporter.SecretVersionName(TLS_CLIENT_CERT_SECRET))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+	keyPEM, err := exporter.AccessSecretVersion(ctx, exporter.SecretVersionName(TLS_CLIENT_KEY_SECRET))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("x509.ParseCertificate: %w", err)
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("client certificate %q is valid from %s to %s", leaf.Subject, leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+	log.Printf("Loaded client certificate %q valid until %s", leaf.Subject, leaf.NotAfter.Format(time.RFC3339))
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,132 @@
+package exporttosftp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// newClientCert returns PEM encoded self-signed certificate and its key,
+// valid within the given period
+func newClientCert(t *testing.T, name string, notBefore, notAfter time.Time) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal key: %v", err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestLoadClientTLSConfig(t *testing.T) {
+	now := time.Now()
+	cert, key := newClientCert(t, "exporter", now.Add(-time.Hour), now.Add(time.Hour))
+	expiredCert, expiredKey := newClientCert(t, "exporter", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	_, otherKey := newClientCert(t, "other", now.Add(-time.Hour), now.Add(time.Hour))
+
+	tests := []struct {
+		name    string
+		cert    string
+		key     string
+		wantErr bool
+	}{
+		{"valid pair", cert, key, false},
+		{"expired certificate", expiredCert, expiredKey, true},
+		{"mismatched key", cert, otherKey, true},
+		{"not PEM", "certificate", "key", true},
+		{"missing secrets", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secrets := map[string]string{}
+			if tt.cert != "" {
+				secrets[exporter.SecretVersionName(TLS_CLIENT_CERT_SECRET)] = tt.cert
+				secrets[exporter.SecretVersionName(TLS_CLIENT_KEY_SECRET)] = tt.key
+			}
+			stubSecrets(t, secrets)
+
+			cfg, err := loadClientTLSConfig(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadClientTLSConfig() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && len(cfg.Certificates) != 1 {
+				t.Errorf("loadClientTLSConfig() has %d certificates, want 1", len(cfg.Certificates))
+			}
+		})
+	}
+}
+
+func TestClientTLSConfigHandshake(t *testing.T) {
+	now := time.Now()
+	cert, key := newClientCert(t, "exporter", now.Add(-time.Hour), now.Add(time.Hour))
+	stubSecrets(t, map[string]string{
+		exporter.SecretVersionName(TLS_CLIENT_CERT_SECRET): cert,
+		exporter.SecretVersionName(TLS_CLIENT_KEY_SECRET):  key,
+	})
+	cfg, err := loadClientTLSConfig(context.Background())
+	if err != nil {
+		t.Fatalf("loadClientTLSConfig() error = %v", err)
+	}
+
+	var presented []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, c := range r.TLS.PeerCertificates {
+			presented = append(presented, c.Subject.CommonName)
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	cfg = cfg.Clone()
+	cfg.RootCAs = x509.NewCertPool()
+	cfg.RootCAs.AddCert(srv.Certificate())
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request with client certificate failed: %v", err)
+	}
+	resp.Body.Close()
+	if len(presented) != 1 || presented[0] != "exporter" {
+		t.Errorf("server received client certificates %q, want %q", presented, "exporter")
+	}
+
+	// Without the certificate the server refuses the handshake
+	cfg.Certificates = nil
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	if resp, err := client.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Error("request without client certificate succeeded, want handshake failure")
+	}
+}
@@ -0,0 +1,51 @@
+package exporttosftp
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// Control record appended to exported files, disabled when empty. Supports
+// {rows} (number of lines), {bytes} (content size), {checksum} and
+// {algorithm} placeholders computed over the content before the trailer,
+// e.g. "TRL|{rows}|{checksum}"
+var TRAILER_TEMPLATE = ""
+
+// appendTrailer appends control record built from TRAILER_TEMPLATE to data.
+// The trailer uses the same line ending as the content, and a missing final
+// line ending is added first, so the trailer is always on its own line
+func appendTrailer(data []byte) []byte {
+	if TRAILER_TEMPLATE == "" {
+		return data
+	}
+
+	eol := []byte("\n")
+	if bytes.Contains(data, []byte("\r\n")) {
+		eol = []byte("\r\n")
+	}
+
+	rows := bytes.Count(data, []byte("\n"))
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		// The last line isn't terminated, but it's still a row
+		rows++
+	}
+
+	trailer := strings.NewReplacer(
+		"{rows}", strconv.Itoa(rows),
+		"{bytes}", strconv.Itoa(len(data)),
+		"{checksum}", exporter.DataChecksum(data),
+		"{algorithm}", exporter.CHECKSUM_ALGORITHM,
+	).Replace(TRAILER_TEMPLATE)
+
+	out := make([]byte, 0, len(data)+len(eol)*2+len(trailer))
+	out = append(out, data...)
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		out = append(out, eol...)
+	}
+	out = append(out, trailer...)
+
+	return append(out, eol...)
+}
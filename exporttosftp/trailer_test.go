@@ -0,0 +1,61 @@
+package exporttosftp
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+)
+
+func TestAppendTrailer(t *testing.T) {
+	defer func(template, algorithm string) {
+		TRAILER_TEMPLATE, exporter.CHECKSUM_ALGORITHM = template, algorithm
+	}(TRAILER_TEMPLATE, exporter.CHECKSUM_ALGORITHM)
+
+	sha256Sum := func(s string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(s))) }
+
+	tests := []struct {
+		name      string
+		template  string
+		algorithm string
+		data      string
+		want      string
+	}{
+		{"disabled", "", "sha256", "id,name\n1,alice\n", "id,name\n1,alice\n"},
+		{"rows and checksum", "TRL|{rows}|{checksum}", "sha256", "id,name\n1,alice\n", "id,name\n1,alice\nTRL|2|" + sha256Sum("id,name\n1,alice\n") + "\n"},
+		{"bytes and algorithm", "TRL|{bytes}|{algorithm}", "sha256", "id,name\n1,alice\n", "id,name\n1,alice\nTRL|16|sha256\n"},
+		{"md5 checksum", "TRL|{checksum}|{algorithm}", "md5", "id,name\n", fmt.Sprintf("id,name\nTRL|%x|md5\n", md5.Sum([]byte("id,name\n")))},
+		{"unterminated last line", "TRL|{rows}|{bytes}", "sha256", "id,name\n1,alice", "id,name\n1,alice\nTRL|2|15\n"},
+		{"crlf line endings", "TRL|{rows}", "sha256", "id,name\r\n1,alice\r\n", "id,name\r\n1,alice\r\nTRL|2\r\n"},
+		{"unterminated crlf line", "TRL|{rows}", "sha256", "id,name\r\n1,alice", "id,name\r\n1,alice\r\nTRL|2\r\n"},
+		{"empty content", "TRL|{rows}|{bytes}", "sha256", "", "TRL|0|0\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			TRAILER_TEMPLATE, exporter.CHECKSUM_ALGORITHM = tt.template, tt.algorithm
+
+			if got := string(appendTrailer([]byte(tt.data))); got != tt.want {
+				t.Errorf("appendTrailer(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportTrailer(t *testing.T) {
+	defer func(template string) { TRAILER_TEMPLATE = template }(TRAILER_TEMPLATE)
+	TRAILER_TEMPLATE = "TRL|{rows}|{bytes}"
+	srv := useSFTPServer(t)
+	store := exportertest.NewStore().Use(t)
+
+	// The trailer goes on its own line using the line ending of the content
+	if err := exportStored(t, store, "report.csv", []byte("id,name\r\n1,alice"), nil); err != nil {
+		t.Fatalf("export error = %v", err)
+	}
+	if err := srv.AssertFile("report.csv", []byte("id,name\r\n1,alice\r\nTRL|2|16\r\n")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,102 @@
+package exporttosftp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// validHeaderAction reports whether action is a supported header action
+func validHeaderAction(action string) bool {
+	return action == "keep" || action == "strip" || action == "rename"
+}
+
+// transformHeader applies header action to the first line of CSV content.
+// The rest of the content is left untouched
+func transformHeader(data []byte, action string) ([]byte, error) {
+	if action == "keep" || len(data) == 0 {
+		return data, nil
+	}
+
+	header, body := data, []byte{}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		header, body = data[:i+1], data[i+1:]
+	}
+
+	switch action {
+	case "strip":
+		return body, nil
+	case "rename":
+		renamed, err := renameHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		return append(renamed, body...), nil
+	}
+
+	return nil, fmt.Errorf("unknown header action %q", action)
+}
+
+// transformHeaderReader applies header action to the first line of streamed
+// CSV content. Only the first line is read before returning
+func transformHeaderReader(r io.Reader, action string) (io.Reader, error) {
+	if action == "keep" {
+		return r, nil
+	}
+
+	br := bufio.NewReader(r)
+	header, err := br.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	header, err = transformHeader(header, action)
+	if err != nil {
+		return nil, exporter.RejectContent(err)
+	}
+
+	return io.MultiReader(bytes.NewReader(header), br), nil
+}
+
+// renameHeader replaces column names of a single CSV header line according
+// to HEADER_RENAME, preserving the delimiter and the original line ending
+func renameHeader(header []byte) ([]byte, error) {
+	eol := ""
+	line := string(header)
+	for _, suffix := range []string{"\r\n", "\n"} {
+		if strings.HasSuffix(line, suffix) {
+			line, eol = strings.TrimSuffix(line, suffix), suffix
+			break
+		}
+	}
+
+	r := csv.NewReader(strings.NewReader(line))
+	r.Comma = CSV_DELIMITER
+	columns, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse CSV header: %w", err)
+	}
+
+	for i, column := range columns {
+		if name, ok := HEADER_RENAME[column]; ok {
+			columns[i] = name
+		}
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = CSV_DELIMITER
+	if err := w.Write(columns); err != nil {
+		return nil, fmt.Errorf("unable to write CSV header: %w", err)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, fmt.Errorf("unable to write CSV header: %w", err)
+	}
+
+	return append(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), eol...), nil
+}
@@ -0,0 +1,84 @@
+package exporttosftp
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+func TestTransformHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		action  string
+		rename  map[string]string
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{"keep", "keep", nil, "id,name\n1,alice\n", "id,name\n1,alice\n", false},
+		{"strip", "strip", nil, "id,name\n1,alice\n", "1,alice\n", false},
+		{"strip header only", "strip", nil, "id,name", "", false},
+		{"strip empty", "strip", nil, "", "", false},
+		{"rename columns", "rename", map[string]string{"id": "customer_id"}, "id,name\n1,alice\n", "customer_id,name\n1,alice\n", false},
+		{"rename keeps CRLF", "rename", map[string]string{"name": "full name"}, "id,name\r\n1,alice\r\n", "id,full name\r\n1,alice\r\n", false},
+		{"rename quotes new delimiter", "rename", map[string]string{"name": "last, first"}, "id,name\n", "id,\"last, first\"\n", false},
+		{"rename malformed header", "rename", nil, "id,\"name\n1,alice\n", "", true},
+		{"unknown action", "drop", nil, "id,name\n", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(rename map[string]string) { HEADER_RENAME = rename }(HEADER_RENAME)
+			HEADER_RENAME = tt.rename
+
+			got, err := transformHeader([]byte(tt.data), tt.action)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("transformHeader() error = %v, want error %t", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("transformHeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformHeaderReader(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     string
+		data       string
+		want       string
+		wantReject bool
+	}{
+		{"keep", "keep", "id,name\n1,alice\n", "id,name\n1,alice\n", false},
+		{"strip", "strip", "id,name\n1,alice\n2,bob\n", "1,alice\n2,bob\n", false},
+		{"rename", "rename", "id,name\n1,alice\n", "customer_id,name\n1,alice\n", false},
+		{"malformed header", "rename", "id,\"name\n", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(rename map[string]string) { HEADER_RENAME = rename }(HEADER_RENAME)
+			HEADER_RENAME = map[string]string{"id": "customer_id"}
+
+			r, err := transformHeaderReader(strings.NewReader(tt.data), tt.action)
+			var rejected *exporter.RejectError
+			if got := errors.As(err, &rejected); got != tt.wantReject {
+				t.Fatalf("transformHeaderReader() error = %v, want rejection %t", err, tt.wantReject)
+			}
+			if tt.wantReject {
+				return
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unable to read content: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("transformHeaderReader() content = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
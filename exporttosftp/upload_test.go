@@ -0,0 +1,791 @@
+package exporttosftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/exporttosftp/internal/sftptest"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startSFTPServer starts an in-process SFTP server and connects to it
+func startSFTPServer(t *testing.T) (*sftptest.Server, *sftpConn) {
+	t.Helper()
+
+	srv, err := sftptest.NewServer("user", "pass")
+	if err != nil {
+		t.Fatalf("unable to start SFTP server: %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	c, err := newSFTPClient(srv.Host, srv.Port, srv.User, srv.Password, srv.HostKey)
+	if err != nil {
+		t.Fatalf("newSFTPClient() error = %v", err)
+	}
+	t.Cleanup(func() {
+		c.client.Close()
+		c.ssh.Close()
+	})
+
+	return srv, c
+}
+
+func TestNewSFTPClient(t *testing.T) {
+	srv, err := sftptest.NewServer("user", "pass")
+	if err != nil {
+		t.Fatalf("unable to start SFTP server: %v", err)
+	}
+	defer srv.Close()
+
+	other, err := sftptest.NewServer("user", "pass")
+	if err != nil {
+		t.Fatalf("unable to start SFTP server: %v", err)
+	}
+	defer other.Close()
+
+	tests := []struct {
+		name     string
+		password string
+		hostKey  ssh.PublicKey
+		wantErr  bool
+		wantAuth bool
+	}{
+		{"pinned host key", "pass", srv.HostKey, false, false},
+		{"host key not pinned", "pass", nil, false, false},
+		{"wrong password", "wrong", srv.HostKey, true, true},
+		{"wrong host key", "pass", other.HostKey, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newSFTPClient(srv.Host, srv.Port, "user", tt.password, tt.hostKey)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newSFTPClient() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				if isAuthError(err) != tt.wantAuth {
+					t.Errorf("isAuthError(%v) = %t, want %t", err, !tt.wantAuth, tt.wantAuth)
+				}
+				return
+			}
+			defer c.ssh.Close()
+			defer c.client.Close()
+
+			if _, err := c.client.Getwd(); err != nil {
+				t.Errorf("SFTP session unusable: %v", err)
+			}
+		})
+	}
+}
+
+// startStalledServer accepts TCP connections, sends the banner and never
+// completes the SSH handshake, returning host and port it listens on
+func startStalledServer(t *testing.T, banner string) (string, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			if banner != "" {
+				conn.Write([]byte(banner))
+			}
+		}
+	}()
+
+	host, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to split listener address: %v", err)
+	}
+	return host, port
+}
+
+func TestNewSFTPClientHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { SFTP_HANDSHAKE_TIMEOUT = timeout }(SFTP_HANDSHAKE_TIMEOUT)
+	SFTP_HANDSHAKE_TIMEOUT = 500 * time.Millisecond
+
+	srv, err := sftptest.NewServer("user", "pass")
+	if err != nil {
+		t.Fatalf("unable to start SFTP server: %v", err)
+	}
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		banner  string
+		stalled bool
+	}{
+		{"silent server", "", true},
+		{"stalled after banner", "SSH-2.0-stalled\r\n", true},
+		{"responsive server", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port := srv.Host, srv.Port
+			if tt.stalled {
+				host, port = startStalledServer(t, tt.banner)
+			}
+
+			start := time.Now()
+			c, err := newSFTPClient(host, port, "user", "pass", nil)
+			if (err != nil) != tt.stalled {
+				t.Fatalf("newSFTPClient() error = %v, want error %t", err, tt.stalled)
+			}
+			if err == nil {
+				c.client.Close()
+				c.ssh.Close()
+				return
+			}
+			if elapsed := time.Since(start); elapsed > SFTP_HANDSHAKE_TIMEOUT+2*time.Second {
+				t.Errorf("stalled handshake failed after %s, want about %s", elapsed, SFTP_HANDSHAKE_TIMEOUT)
+			}
+			if !strings.Contains(err.Error(), "did not complete") {
+				t.Errorf("newSFTPClient() error = %v, want the handshake timeout reported", err)
+			}
+		})
+	}
+}
+
+func TestNewSFTPDialerTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { SFTP_DIAL_TIMEOUT = timeout }(SFTP_DIAL_TIMEOUT)
+	SFTP_DIAL_TIMEOUT = 3 * time.Second
+
+	if got := newSFTPDialer().Timeout; got != SFTP_DIAL_TIMEOUT {
+		t.Errorf("dialer timeout = %s, want SFTP_DIAL_TIMEOUT %s", got, SFTP_DIAL_TIMEOUT)
+	}
+}
+
+func TestNewSFTPClientConcurrentWrites(t *testing.T) {
+	defer func(concurrent bool) { SFTP_CONCURRENT_WRITES = concurrent }(SFTP_CONCURRENT_WRITES)
+
+	// Content spans several SFTP packets of at most 32 KiB
+	content := strings.Repeat("1,alice\n", 64*1024)
+
+	tests := []struct {
+		name           string
+		concurrent     bool
+		wantConcurrent bool
+	}{
+		{"sequential writes", false, false},
+		{"concurrent writes", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SFTP_CONCURRENT_WRITES = tt.concurrent
+			srv, c := startSFTPServer(t)
+			srv.SetWriteDelay(5 * time.Millisecond)
+
+			f, err := c.client.Create("report.csv")
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			if _, err := f.ReadFrom(strings.NewReader(content)); err != nil {
+				t.Fatalf("ReadFrom() error = %v", err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			if err := srv.AssertFile("report.csv", []byte(content)); err != nil {
+				t.Error(err)
+			}
+			if got := srv.MaxConcurrentWrites(); got < 1 || (got > 1) != tt.wantConcurrent {
+				t.Errorf("server handled %d writes at once, want concurrent %t", got, tt.wantConcurrent)
+			}
+		})
+	}
+}
+
+// observingReader checks once, when the upload starts reading, which of
+// the destination file and its temporary file exist on the server
+type observingReader struct {
+	r        io.Reader
+	srv      *sftptest.Server
+	dstFile  string
+	observed bool
+	dstSeen  string
+	partSeen bool
+}
+
+func (o *observingReader) Read(p []byte) (int, error) {
+	if !o.observed {
+		o.observed = true
+		if data, err := o.srv.ReadFile(o.dstFile); err == nil {
+			o.dstSeen = string(data)
+		}
+		_, err := o.srv.ReadFile(o.dstFile + SFTP_PART_SUFFIX)
+		o.partSeen = err == nil
+	}
+
+	return o.r.Read(p)
+}
+
+func TestUploadToSFTP(t *testing.T) {
+	content := strings.Repeat("1,alice\n", 10000)
+
+	tests := []struct {
+		name     string
+		folder   string
+		filename string
+		existing string
+		want     string
+		wantErr  bool
+	}{
+		{"new file", "/in", "report.csv", "", "/in/report.csv", false},
+		{"nested file", "/in", "2024/06/report.csv", "", "/in/2024/06/report.csv", false},
+		{"replaced file", "/in", "report.csv", "old content", "/in/report.csv", false},
+		{"escaping name", "/in", "../report.csv", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, c := startSFTPServer(t)
+			if tt.existing != "" {
+				if err := mkdirAll(c, tt.folder); err != nil {
+					t.Fatalf("mkdirAll() error = %v", err)
+				}
+				if err := srv.WriteFile(tt.want, []byte(tt.existing)); err != nil {
+					t.Fatalf("unable to write existing file: %v", err)
+				}
+			}
+
+			r := &observingReader{r: strings.NewReader(content), srv: srv, dstFile: tt.want}
+			err := uploadToSFTP(context.Background(), c, tt.filename, tt.folder, r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("uploadToSFTP() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if !r.partSeen {
+				t.Errorf("content was not written into %s%s", tt.want, SFTP_PART_SUFFIX)
+			}
+			if r.dstSeen != tt.existing {
+				t.Errorf("%s held %d bytes before the upload completed", tt.want, len(r.dstSeen))
+			}
+			if err := srv.AssertFile(tt.want, []byte(content)); err != nil {
+				t.Error(err)
+			}
+			if _, err := srv.ReadFile(tt.want + SFTP_PART_SUFFIX); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("temporary file left behind: %v", err)
+			}
+		})
+	}
+}
+
+// failingReader fails once its content is read
+type failingReader struct {
+	r io.Reader
+}
+
+func (f failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestRemotePath(t *testing.T) {
+	tests := []struct {
+		folder string
+		name   string
+		want   string
+	}{
+		{"", "report.csv", "report.csv"},
+		{"", "2024/report.csv", "2024/report.csv"},
+		{"/", "report.csv", "/report.csv"},
+		{"in", "report.csv", "in/report.csv"},
+		{"in/", "report.csv", "in/report.csv"},
+		{"/in", "report.csv", "/in/report.csv"},
+		{"/in/", "2024/report.csv", "/in/2024/report.csv"},
+	}
+
+	for _, tt := range tests {
+		if got := remotePath(tt.folder, tt.name); got != tt.want {
+			t.Errorf("remotePath(%q, %q) = %q, want %q", tt.folder, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUploadToSFTPFolder(t *testing.T) {
+	tests := []struct {
+		folder string
+		want   string
+	}{
+		// The test server resolves relative paths against the root
+		{"", "/report.csv"},
+		{"/", "/report.csv"},
+		{"in", "/in/report.csv"},
+		{"/in", "/in/report.csv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.folder, func(t *testing.T) {
+			srv, c := startSFTPServer(t)
+
+			if err := uploadToSFTP(context.Background(), c, "report.csv", tt.folder, strings.NewReader("1,alice\n")); err != nil {
+				t.Fatalf("uploadToSFTP() error = %v", err)
+			}
+			if err := srv.AssertFile(tt.want, []byte("1,alice\n")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestUploadToSFTPFailure(t *testing.T) {
+	srv, c := startSFTPServer(t)
+
+	err := uploadToSFTP(context.Background(), c, "report.csv", "/", failingReader{strings.NewReader("1,alice\n")})
+	if err == nil {
+		t.Fatal("uploadToSFTP() error = nil, want error")
+	}
+	for _, name := range []string{"/report.csv", "/report.csv" + SFTP_PART_SUFFIX} {
+		if _, err := srv.ReadFile(name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s exists after the failed upload: %v", name, err)
+		}
+	}
+}
+
+// slowReader returns a line of content every 10ms
+type slowReader struct {
+	lines int
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if s.lines == 0 {
+		return 0, io.EOF
+	}
+	s.lines--
+	time.Sleep(10 * time.Millisecond)
+
+	return copy(p, "1,alice\n"), nil
+}
+
+func TestUploadToSFTPDeadline(t *testing.T) {
+	srv, c := startSFTPServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := uploadToSFTP(ctx, c, "report.csv", "/", &slowReader{lines: 1000})
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("uploadToSFTP() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("upload aborted after %s, want about 50ms", elapsed)
+	}
+	for _, name := range []string{"/report.csv", "/report.csv" + SFTP_PART_SUFFIX} {
+		if _, err := srv.ReadFile(name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s exists after the aborted upload: %v", name, err)
+		}
+	}
+}
+
+func TestIsProtected(t *testing.T) {
+	defer func(names []string) { PROTECTED_REMOTE_NAMES = names }(PROTECTED_REMOTE_NAMES)
+	PROTECTED_REMOTE_NAMES = []string{"control.txt", "in/*.lock", "/etc/*"}
+
+	tests := []struct {
+		dstFile string
+		want    bool
+	}{
+		{"/in/control.txt", true},
+		{"control.txt", true},
+		{"/in/2024/control.txt", true},
+		{"/in/upload.lock", true},
+		{"in/upload.lock", true},
+		{"/etc/passwd", true},
+		{"/in/2024/upload.lock", false},
+		{"/in/control.txt.1", false},
+		{"/in/report.csv", false},
+	}
+
+	for _, tt := range tests {
+		if got := isProtected(tt.dstFile); got != tt.want {
+			t.Errorf("isProtected(%q) = %t, want %t", tt.dstFile, got, tt.want)
+		}
+	}
+}
+
+func TestUploadToSFTPProtected(t *testing.T) {
+	defer func(names []string) { PROTECTED_REMOTE_NAMES = names }(PROTECTED_REMOTE_NAMES)
+	PROTECTED_REMOTE_NAMES = []string{"control.txt"}
+
+	tests := []struct {
+		filename string
+		wantErr  bool
+	}{
+		{"control.txt", true},
+		{"2024/control.txt", true},
+		{"report.csv", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			srv, c := startSFTPServer(t)
+			dstFile := "/in/" + tt.filename
+			if err := mkdirAll(c, path.Dir(dstFile)); err != nil {
+				t.Fatalf("mkdirAll() error = %v", err)
+			}
+			if err := srv.WriteFile(dstFile, []byte("old content")); err != nil {
+				t.Fatalf("unable to write existing file: %v", err)
+			}
+
+			err := uploadToSFTP(context.Background(), c, tt.filename, "/in", strings.NewReader("new content"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("uploadToSFTP() error = %v, want error %t", err, tt.wantErr)
+			}
+			want := "new content"
+			if tt.wantErr {
+				want = "old content"
+			}
+			if err := srv.AssertFile(dstFile, []byte(want)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestApplyExistingPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		existing []string
+		want     string
+	}{
+		{"overwrite", []string{"/report.csv"}, "/report.csv"},
+		{"skip", nil, "/report.csv"},
+		{"skip", []string{"/report.csv"}, ""},
+		{"version", nil, "/report.csv"},
+		{"version", []string{"/report.csv"}, "/report.csv.1"},
+		{"version", []string{"/report.csv", "/report.csv.1", "/report.csv.2"}, "/report.csv.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			defer func(policy string) { SFTP_EXISTING_POLICY = policy }(SFTP_EXISTING_POLICY)
+			SFTP_EXISTING_POLICY = tt.policy
+			srv, c := startSFTPServer(t)
+			for _, name := range tt.existing {
+				if err := srv.WriteFile(name, []byte("old content")); err != nil {
+					t.Fatalf("unable to write existing file: %v", err)
+				}
+			}
+
+			got, err := applyExistingPolicy(c, "/report.csv")
+			if err != nil {
+				t.Fatalf("applyExistingPolicy() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("applyExistingPolicy() with %d existing = %q, want %q", len(tt.existing), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMkdirAll(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		dir      string
+	}{
+		{"single directory", "", "/in"},
+		{"nested directories", "", "/in/2024/06"},
+		{"existing parent", "/in", "/in/2024/06"},
+		{"existing directory", "/in/2024", "/in/2024"},
+		{"relative directory", "", "in/2024"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, c := startSFTPServer(t)
+			if tt.existing != "" {
+				if err := c.client.MkdirAll(tt.existing); err != nil {
+					t.Fatalf("unable to create existing directory: %v", err)
+				}
+			}
+
+			if err := mkdirAll(c, tt.dir); err != nil {
+				t.Fatalf("mkdirAll(%q) error = %v", tt.dir, err)
+			}
+			info, err := c.client.Stat(tt.dir)
+			if err != nil || !info.IsDir() {
+				t.Errorf("%s is not a directory after mkdirAll(): %v", tt.dir, err)
+			}
+		})
+	}
+}
+
+func TestMkdirAllDirMode(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      os.FileMode
+		wantModes map[string]os.FileMode
+	}{
+		{"server default", 0, map[string]os.FileMode{}},
+		{"created directories", 0770, map[string]os.FileMode{"/in/2024": 0770, "/in/2024/06": 0770}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(mode os.FileMode) { SFTP_DIR_MODE = mode }(SFTP_DIR_MODE)
+			SFTP_DIR_MODE = tt.mode
+			srv, c := startSFTPServer(t)
+			if err := c.client.Mkdir("/in"); err != nil {
+				t.Fatalf("unable to create existing directory: %v", err)
+			}
+
+			if err := mkdirAll(c, "/in/2024/06"); err != nil {
+				t.Fatalf("mkdirAll() error = %v", err)
+			}
+			for _, dir := range []string{"/in", "/in/2024", "/in/2024/06"} {
+				got, ok := srv.Mode(dir)
+				want, wantOK := tt.wantModes[dir]
+				if ok != wantOK || got != want {
+					t.Errorf("mode of %s = %o (set %t), want %o (set %t)", dir, got, ok, want, wantOK)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadToSFTPUmask(t *testing.T) {
+	tests := []struct {
+		name      string
+		umask     os.FileMode
+		dirMode   os.FileMode
+		wantModes map[string]os.FileMode
+	}{
+		{"server defaults", 0, 0, map[string]os.FileMode{}},
+		{"umask", 0027, 0, map[string]os.FileMode{"/in/2024": 0750, "/in/2024/report.csv": 0640}},
+		{"umask with directory mode", 0027, 0700, map[string]os.FileMode{"/in/2024": 0700, "/in/2024/report.csv": 0640}},
+		{"restrictive umask", 0077, 0, map[string]os.FileMode{"/in/2024": 0700, "/in/2024/report.csv": 0600}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(fileMode, dirMode os.FileMode) {
+				sftpFileMode, SFTP_DIR_MODE = fileMode, dirMode
+			}(sftpFileMode, SFTP_DIR_MODE)
+			sftpFileMode, SFTP_DIR_MODE = 0, tt.dirMode
+			if tt.umask != 0 {
+				applyUmask(tt.umask)
+			}
+			srv, c := startSFTPServer(t)
+			if err := c.client.Mkdir("/in"); err != nil {
+				t.Fatalf("unable to create existing directory: %v", err)
+			}
+
+			if err := uploadToSFTP(context.Background(), c, "2024/report.csv", "/in", strings.NewReader("1,alice\n")); err != nil {
+				t.Fatalf("uploadToSFTP() error = %v", err)
+			}
+			for _, name := range []string{"/in", "/in/2024", "/in/2024/report.csv", "/in/2024/report.csv" + SFTP_PART_SUFFIX} {
+				got, ok := srv.Mode(name)
+				want, wantOK := tt.wantModes[name]
+				if ok != wantOK || got != want {
+					t.Errorf("mode of %s = %o (set %t), want %o (set %t)", name, got, ok, want, wantOK)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFileMode(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{"0770", 0770, false},
+		{"750", 0750, false},
+		{"0644", 0644, false},
+		{"0789", 0, true},
+		{"01777", 0, true},
+		{"rwx", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseFileMode(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFileMode(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseFileMode(%q) = %o, want %o", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestUploadToSFTPExistingPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   map[string]string
+	}{
+		{"overwrite", map[string]string{"/report.csv": "new content"}},
+		{"skip", map[string]string{"/report.csv": "old content"}},
+		{"version", map[string]string{"/report.csv": "old content", "/report.csv.1": "new content"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			defer func(policy string) { SFTP_EXISTING_POLICY = policy }(SFTP_EXISTING_POLICY)
+			SFTP_EXISTING_POLICY = tt.policy
+			srv, c := startSFTPServer(t)
+			if err := srv.WriteFile("/report.csv", []byte("old content")); err != nil {
+				t.Fatalf("unable to write existing file: %v", err)
+			}
+
+			if err := uploadToSFTP(context.Background(), c, "report.csv", "/", strings.NewReader("new content")); err != nil {
+				t.Fatalf("uploadToSFTP() error = %v", err)
+			}
+			for name, content := range tt.want {
+				if err := srv.AssertFile(name, []byte(content)); err != nil {
+					t.Error(err)
+				}
+			}
+			if _, ok := tt.want["/report.csv.1"]; !ok {
+				if _, err := srv.ReadFile("/report.csv.1"); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("unexpected version created: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadToSFTPCreateDirs(t *testing.T) {
+	tests := []struct {
+		name       string
+		createDirs bool
+		existing   string
+		wantErr    bool
+	}{
+		{"missing directories created", true, "", false},
+		{"existing directories", true, "/in/2024", false},
+		{"creation disabled, existing directories", false, "/in/2024", false},
+		{"creation disabled, missing directories", false, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(createDirs bool) { SFTP_CREATE_DIRS = createDirs }(SFTP_CREATE_DIRS)
+			SFTP_CREATE_DIRS = tt.createDirs
+			srv, c := startSFTPServer(t)
+			if tt.existing != "" {
+				if err := c.client.MkdirAll(tt.existing); err != nil {
+					t.Fatalf("unable to create existing directory: %v", err)
+				}
+			}
+
+			err := uploadToSFTP(context.Background(), c, "2024/report.csv", "/in", strings.NewReader("1,alice\n"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("uploadToSFTP() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, err := c.client.Stat("/in"); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("/in exists with SFTP_CREATE_DIRS disabled: %v", err)
+				}
+				return
+			}
+			if err := srv.AssertFile("/in/2024/report.csv", []byte("1,alice\n")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestIsDiskFullError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no space on filesystem", &sftp.StatusError{Code: sshFxNoSpaceOnFilesystem}, true},
+		{"quota exceeded", fmt.Errorf("write: %w", &sftp.StatusError{Code: sshFxQuotaExceeded}), true},
+		{"permission denied", &sftp.StatusError{Code: 3}, false},
+		{"SFTP v3 message", errors.New("sftp: \"no space left on device\" (SSH_FX_FAILURE)"), true},
+		{"disk quota message", errors.New("Disk quota exceeded"), true},
+		{"other failure", errors.New("connection lost"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDiskFullError(tt.err); got != tt.want {
+				t.Errorf("isDiskFullError(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadToSFTPDiskFull(t *testing.T) {
+	tests := []struct {
+		name     string
+		space    int64
+		wantFull bool
+	}{
+		{"short write", 1000, true},
+		{"no space at all", 0, true},
+		{"enough space", 1 << 20, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, c := startSFTPServer(t)
+			srv.SetDiskSpace(tt.space)
+
+			content := strings.Repeat("1,alice\n", 10000)
+			err := uploadToSFTP(context.Background(), c, "report.csv", "/", strings.NewReader(content))
+			var full *destinationFullError
+			if errors.As(err, &full) != tt.wantFull {
+				t.Fatalf("uploadToSFTP() error = %v, want destination full %t", err, tt.wantFull)
+			}
+			if !tt.wantFull {
+				if err != nil {
+					t.Fatalf("uploadToSFTP() error = %v", err)
+				}
+				if err := srv.AssertFile("/report.csv", []byte(content)); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+
+			for _, name := range []string{"/report.csv", "/report.csv" + SFTP_PART_SUFFIX} {
+				if _, err := srv.ReadFile(name); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("%s exists after the upload to a full disk: %v", name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package exporttosftp
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// newUploader returns uploader of the configured PROTOCOL, once the
+// concurrency limit of its destination allows another upload. It must be
+// closed to release the upload slot
+func newUploader(ctx context.Context, folder, tenant string) (exporter.Uploader, error) {
+	destination, err := uploadDestination(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	release, err := acquireUploadSlot(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	up, err := openUploader(ctx, folder, tenant)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	return limitedUploader{Uploader: up, release: release}, nil
+}
+
+// openUploader returns uploader of the configured PROTOCOL. SFTP uploads go
+// to the folder on server of the tenant and reuse the pooled connection
+func openUploader(ctx context.Context, folder, tenant string) (exporter.Uploader, error) {
+	switch PROTOCOL {
+	case "s3":
+		return s3Uploader{prefix: S3_PREFIX}, nil
+	case "webhook":
+		return webhookUploader{}, nil
+	default:
+		c, err := acquireSFTPConn(ctx, tenant)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to SFTP server: %w", err)
+		}
+		cleanStalePartFiles(c, folder)
+		return sftpUploader{folder: folder, conn: c}, nil
+	}
+}
+
+// sftpUploader uploads files into a folder on the SFTP server through a
+// pooled connection
+type sftpUploader struct {
+	folder string
+	conn   *sftpConn
+}
+
+func (u sftpUploader) Upload(ctx context.Context, name string, r io.Reader) error {
+	if FLATTEN {
+		var err error
+		name, err = checkFlattenCollision(u.conn, u.folder, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return uploadToSFTP(ctx, u.conn, name, u.folder, r)
+}
+
+// Close releases the connection, which stays open in the pool
+func (u sftpUploader) Close() error {
+	u.conn.release()
+
+	return nil
+}
+
+// s3Uploader uploads files under a prefix of the partner S3 bucket
+type s3Uploader struct {
+	prefix string
+}
+
+func (u s3Uploader) Upload(ctx context.Context, name string, r io.Reader) error {
+	return uploadToS3(ctx, name, u.prefix, r)
+}
+
+func (u s3Uploader) Close() error {
+	return nil
+}
+
+// webhookUploader posts files to the partner webhook
+type webhookUploader struct{}
+
+func (u webhookUploader) Upload(ctx context.Context, name string, r io.Reader) error {
+	return uploadToWebhook(ctx, name, r)
+}
+
+func (u webhookUploader) Close() error {
+	return nil
+}
+
+// exportDestination returns URL of the uploaded file reported in export events
+func exportDestination(tenant, folder, filename string) string {
+	if PROTOCOL == "s3" {
+		return fmt.Sprintf("s3://%s/%s", S3_BUCKET, path.Join(S3_PREFIX, filename))
+	}
+	if PROTOCOL == "webhook" {
+		return WEBHOOK_URL + "#" + filename
+	}
+
+	return fmt.Sprintf("sftp://%s%s", tenantHost(tenant), path.Join("/", folder, filename))
+}
+
+// uploadDigest computes size and hashes of the uploaded content while it
+// is streamed, for verifying the remote file afterwards
+type uploadDigest struct {
+	size   int64
+	hashes map[string]hash.Hash
+}
+
+// newUploadDigest returns digest computing the given hash algorithms
+func newUploadDigest(algorithms []string) *uploadDigest {
+	d := &uploadDigest{hashes: map[string]hash.Hash{}}
+	for _, name := range algorithms {
+		d.hashes[name] = exporter.ChecksumAlgorithms[name]()
+	}
+
+	return d
+}
+
+func (d *uploadDigest) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	for _, h := range d.hashes {
+		h.Write(p)
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,98 @@
+package exporttosftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// validateCSV verifies that data is a parsable CSV document with at least
+// one record and the same number of columns in every row
+func validateCSV(data []byte) error {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = CSV_DELIMITER
+	// Zero means every record must have the same field count as the first one
+	r.FieldsPerRecord = 0
+
+	rows := 0
+	for {
+		_, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("malformed CSV: %w", err)
+		}
+		rows++
+	}
+
+	if rows == 0 {
+		return fmt.Errorf("malformed CSV: no records found")
+	}
+
+	return nil
+}
+
+// parseDelimiter converts a delimiter setting into a single rune. The
+// escaped form "\t" is accepted for tab-delimited files
+func parseDelimiter(s string) (rune, error) {
+	if s == `\t` {
+		return '\t', nil
+	}
+
+	r, size := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError || size != len(s) {
+		return 0, fmt.Errorf("delimiter %q must be a single character", s)
+	}
+
+	return r, nil
+}
+
+// isQuarantined reports whether the object is stored under QUARANTINE_PREFIX
+func isQuarantined(object string) bool {
+	if QUARANTINE_PREFIX == "" {
+		return false
+	}
+
+	return strings.HasPrefix(object, strings.TrimSuffix(QUARANTINE_PREFIX, "/")+"/")
+}
+
+// rejectObject aborts the export of an invalid object. When QUARANTINE_PREFIX
+// is set, the object is copied there, annotated with the rejection reason
+func rejectObject(ctx context.Context, bucket, object string, cause error) error {
+	if QUARANTINE_PREFIX == "" {
+		return fmt.Errorf("object %s rejected: %w", object, cause)
+	}
+
+	if err := quarantineObject(ctx, bucket, object, cause); err != nil {
+		return fmt.Errorf("object %s rejected (%v) and not quarantined: %w", object, cause, err)
+	}
+	log.Printf("Object %s rejected and quarantined: %v", object, cause)
+
+	return nil
+}
+
+// quarantineObject copies an object under QUARANTINE_PREFIX within the same
+// bucket, recording the reason in the object metadata
+func quarantineObject(ctx context.Context, bucket, object string, cause error) error {
+	dst := path.Join(QUARANTINE_PREFIX, object)
+	metadata := map[string]string{
+		"quarantine-reason": cause.Error(),
+	}
+	err := exporter.RetryGCS(ctx, "Copy of object "+object, exporter.GCS_WRITE_ATTEMPTS, func() error {
+		return exporter.Objects.Copy(ctx, bucket, dst, object, 0, metadata)
+	})
+	if err != nil {
+		return fmt.Errorf("Object(%q).CopierFrom(%q).Run: %w", dst, object, err)
+	}
+
+	return nil
+}
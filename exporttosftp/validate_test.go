@@ -0,0 +1,85 @@
+package exporttosftp
+
+import "testing"
+
+func TestValidateCSV(t *testing.T) {
+	tests := []struct {
+		name      string
+		delimiter rune
+		data      string
+		wantErr   bool
+	}{
+		{"consistent columns", ',', "id,name\n1,alice\n2,bob\n", false},
+		{"quoted delimiter", ',', "id,name\n1,\"smith, alice\"\n", false},
+		{"missing column", ',', "id,name\n1,alice\n2\n", true},
+		{"extra column", ',', "id,name\n1,alice,admin\n", true},
+		{"unterminated quote", ',', "id,name\n1,\"alice\n", true},
+		{"empty file", ',', "", true},
+		{"tab delimited", '\t', "id\tname\n1\talice\n", false},
+		{"wrong delimiter", ';', "id;name\n1;alice;x\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(delimiter rune) { CSV_DELIMITER = delimiter }(CSV_DELIMITER)
+			CSV_DELIMITER = tt.delimiter
+
+			if err := validateCSV([]byte(tt.data)); (err != nil) != tt.wantErr {
+				t.Errorf("validateCSV() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseDelimiter(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    rune
+		wantErr bool
+	}{
+		{",", ',', false},
+		{";", ';', false},
+		{`\t`, '\t', false},
+		{"\t", '\t', false},
+		{"|", '|', false},
+		{"", 0, true},
+		{",,", 0, true},
+		{"\xff", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseDelimiter(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDelimiter(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseDelimiter(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestIsQuarantined(t *testing.T) {
+	tests := []struct {
+		prefix string
+		object string
+		want   bool
+	}{
+		{"", "quarantine/report.csv", false},
+		{"quarantine", "quarantine/report.csv", true},
+		{"quarantine/", "quarantine/in/report.csv", true},
+		{"quarantine", "quarantined/report.csv", false},
+		{"quarantine", "in/quarantine/report.csv", false},
+	}
+
+	for _, tt := range tests {
+		func() {
+			defer func(prefix string) { QUARANTINE_PREFIX = prefix }(QUARANTINE_PREFIX)
+			QUARANTINE_PREFIX = tt.prefix
+
+			if got := isQuarantined(tt.object); got != tt.want {
+				t.Errorf("isQuarantined(%q) with prefix %q = %t, want %t", tt.object, tt.prefix, got, tt.want)
+			}
+		}()
+	}
+}
@@ -0,0 +1,223 @@
+package exporttosftp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+var (
+	// Webhook destination related variables
+	WEBHOOK_URL = ""
+	// Extra request headers as JSON object, e.g. {"X-Partner-Id": "42"}
+	WEBHOOK_HEADERS = map[string]string{}
+	// Secret holding bearer token sent in Authorization header, no auth when empty
+	WEBHOOK_TOKEN_SECRET = ""
+	// Multipart form field carrying the file
+	WEBHOOK_FIELD = "file"
+	// Number of attempts to POST a file, retried on 5xx responses and network errors
+	WEBHOOK_ATTEMPTS = 3
+	WEBHOOK_TIMEOUT  = 60 * time.Second
+	webhookToken     = ""
+	webhookClient    = &http.Client{}
+)
+
+// initWebhook reads webhook destination settings from environment variables
+// and the auth token from GCP Secret Manager
+func initWebhook(ctx context.Context) error {
+	WEBHOOK_URL = os.Getenv("WEBHOOK_URL")
+	u, err := url.Parse(WEBHOOK_URL)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return fmt.Errorf("WEBHOOK_URL must be a http(s) URL, got %q", WEBHOOK_URL)
+	}
+
+	if os.Getenv("WEBHOOK_HEADERS") != "" {
+		if err := json.Unmarshal([]byte(os.Getenv("WEBHOOK_HEADERS")), &WEBHOOK_HEADERS); err != nil {
+			return fmt.Errorf("invalid WEBHOOK_HEADERS: %w", err)
+		}
+	}
+	if os.Getenv("WEBHOOK_FIELD") != "" {
+		WEBHOOK_FIELD = os.Getenv("WEBHOOK_FIELD")
+	}
+	if os.Getenv("WEBHOOK_ATTEMPTS") != "" {
+		WEBHOOK_ATTEMPTS, err = strconv.Atoi(os.Getenv("WEBHOOK_ATTEMPTS"))
+		if err != nil || WEBHOOK_ATTEMPTS < 1 {
+			return fmt.Errorf("invalid WEBHOOK_ATTEMPTS: %q", os.Getenv("WEBHOOK_ATTEMPTS"))
+		}
+	}
+	if os.Getenv("WEBHOOK_TIMEOUT") != "" {
+		WEBHOOK_TIMEOUT, err = time.ParseDuration(os.Getenv("WEBHOOK_TIMEOUT"))
+		if err != nil {
+			return fmt.Errorf("invalid WEBHOOK_TIMEOUT: %w", err)
+		}
+	}
+	webhookClient.Timeout = WEBHOOK_TIMEOUT
+
+	// Refuse to connect to hosts outside of the allowlist, including
+	// redirect targets, and present client certificate to servers requiring
+	// mutual TLS
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = allowedDialContext(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+	if clientTLSConfig != nil {
+		transport.TLSClientConfig = clientTLSConfig
+	}
+	webhookClient.Transport = transport
+
+	// Get webhook auth token from GCP Secret Manager
+	WEBHOOK_TOKEN_SECRET = os.Getenv("WEBHOOK_TOKEN_SECRET")
+	if WEBHOOK_TOKEN_SECRET != "" {
+		webhookToken, err = exporter.AccessSecretVersion(ctx, exporter.SecretVersionName(WEBHOOK_TOKEN_SECRET))
+		if err != nil {
+			return fmt.Errorf("failed to get secret: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// uploadToWebhook POSTs the file to WEBHOOK_URL as multipart form, which is
+// written while it is sent. Any 2xx response is a success, 5xx responses
+// and network errors are retried when the content can be read again.
+// Streamed content can be read only once, so its failures are retried with
+// the event instead
+func uploadToWebhook(ctx context.Context, filename string, r io.Reader) error {
+	name, err := exporter.CleanRelativePath(filename)
+	if err != nil {
+		log.Printf("Rejected upload of [%s]: %v", filename, err)
+		return err
+	}
+	seeker, replayable := r.(io.Seeker)
+
+	log.Printf("Uploading [%s] to [%s] ...\n", filename, WEBHOOK_URL)
+	var size int64
+	for attempt := 1; ; attempt++ {
+		if replayable {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("unable to rewind content: %w", err)
+			}
+		}
+
+		var retry bool
+		retry, size, err = postWebhook(ctx, name, r)
+		if err == nil {
+			break
+		}
+		if !retry || !replayable || attempt >= WEBHOOK_ATTEMPTS {
+			return err
+		}
+
+		log.Printf("Webhook upload of [%s] failed (attempt %d of %d): %v", filename, attempt, WEBHOOK_ATTEMPTS, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+	log.Printf("%d bytes copied\n", size)
+
+	return nil
+}
+
+// postWebhook sends a single POST request with the file as multipart form,
+// reporting whether a failure may be retried and how many bytes of the file
+// were sent
+func postWebhook(ctx context.Context, name string, r io.Reader) (bool, int64, error) {
+	// Write the form through a pipe, so the file isn't held in memory
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	var size int64
+	written := make(chan error, 1)
+	go func() {
+		part, err := form.CreateFormFile(WEBHOOK_FIELD, name)
+		if err == nil {
+			size, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+		written <- err
+	}()
+	// Stop the writer when the request ends before the whole form was sent
+	stopWriter := func() error {
+		pr.Close()
+		return <-written
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, WEBHOOK_URL, pr)
+	if err != nil {
+		stopWriter()
+		return false, 0, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	for key, value := range WEBHOOK_HEADERS {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if webhookToken != "" {
+		req.Header.Set("Authorization", "Bearer "+webhookToken)
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		stopWriter()
+		return ctx.Err() == nil, 0, fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	// Read a bit of the response for diagnostics and connection reuse
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	// A response before the whole form was sent means the file is incomplete
+	werr := stopWriter()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		if werr != nil {
+			return false, 0, fmt.Errorf("unable to send file: %w", werr)
+		}
+		return false, size, nil
+	case resp.StatusCode >= 500:
+		return true, 0, fmt.Errorf("webhook responded %s: %s", resp.Status, msg)
+	default:
+		return false, 0, fmt.Errorf("webhook responded %s: %s", resp.Status, msg)
+	}
+}
+
+// checkWebhook verifies the webhook server accepts TCP connections
+func checkWebhook(ctx context.Context) error {
+	u, err := url.Parse(WEBHOOK_URL)
+	if err != nil {
+		return err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	conn, err := exporter.DialAllowed(ctx, &net.Dialer{}, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return fmt.Errorf("unable to reach webhook server: %w", err)
+	}
+
+	return conn.Close()
+}
+
+// allowedDialContext returns DialContext of HTTP transports connecting like
+// the dialer, refusing hosts outside of the allowlist
+func allowedDialContext(d *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return exporter.DialAllowed(ctx, d, network, address)
+	}
+}
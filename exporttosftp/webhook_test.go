@@ -0,0 +1,227 @@
+package exporttosftp
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+// webhookRequest is a request received by the test webhook server
+type webhookRequest struct {
+	header   http.Header
+	field    string
+	filename string
+	content  string
+}
+
+// startWebhookServer starts a webhook server answering requests with the
+// given statuses in turn, the last one repeated, and configures it as
+// WEBHOOK_URL until the test ends. It returns the requests received so far
+func startWebhookServer(t *testing.T, statuses ...int) func() []webhookRequest {
+	t.Helper()
+
+	var mu sync.Mutex
+	var requests []webhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := webhookRequest{header: r.Header}
+		if r.Method == http.MethodPost {
+			if f, h, err := r.FormFile(WEBHOOK_FIELD); err == nil {
+				// FileHeader.Filename drops the directories, so read the sent name
+				_, params, _ := mime.ParseMediaType(h.Header.Get("Content-Disposition"))
+				data, _ := io.ReadAll(f)
+				req.field, req.filename, req.content = WEBHOOK_FIELD, params["filename"], string(data)
+			}
+		}
+
+		mu.Lock()
+		requests = append(requests, req)
+		status := statuses[len(statuses)-1]
+		if len(requests) <= len(statuses) {
+			status = statuses[len(requests)-1]
+		}
+		mu.Unlock()
+
+		w.WriteHeader(status)
+		io.WriteString(w, http.StatusText(status))
+	}))
+	t.Cleanup(srv.Close)
+
+	prevURL := WEBHOOK_URL
+	t.Cleanup(func() { WEBHOOK_URL = prevURL })
+	WEBHOOK_URL = srv.URL + "/upload"
+
+	return func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]webhookRequest(nil), requests...)
+	}
+}
+
+func TestUploadToWebhook(t *testing.T) {
+	defer func(headers map[string]string, token string, attempts int) {
+		WEBHOOK_HEADERS, webhookToken, WEBHOOK_ATTEMPTS = headers, token, attempts
+	}(WEBHOOK_HEADERS, webhookToken, WEBHOOK_ATTEMPTS)
+	WEBHOOK_HEADERS, webhookToken, WEBHOOK_ATTEMPTS = map[string]string{"X-Partner-Id": "42"}, "s3cr3t", 2
+
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantRequests int
+		wantErr      bool
+	}{
+		{"accepted", []int{http.StatusOK}, 1, false},
+		{"created", []int{http.StatusCreated}, 1, false},
+		{"retried server error", []int{http.StatusServiceUnavailable, http.StatusOK}, 2, false},
+		{"persistent server error", []int{http.StatusBadGateway}, 2, true},
+		{"client error", []int{http.StatusBadRequest}, 1, true},
+		{"unauthorized", []int{http.StatusUnauthorized}, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := startWebhookServer(t, tt.statuses...)
+
+			err := uploadToWebhook(context.Background(), "in/report.csv", strings.NewReader("id,name\n1,alice\n"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("uploadToWebhook() error = %v, want error %t", err, tt.wantErr)
+			}
+			if len(requests()) != tt.wantRequests {
+				t.Fatalf("webhook received %d requests, want %d", len(requests()), tt.wantRequests)
+			}
+			for _, req := range requests() {
+				if req.filename != "in/report.csv" || req.content != "id,name\n1,alice\n" {
+					t.Errorf("webhook received file %q with %q, want %q with %q", req.filename, req.content, "in/report.csv", "id,name\n1,alice\n")
+				}
+				if got := req.header.Get("Authorization"); got != "Bearer s3cr3t" {
+					t.Errorf("Authorization = %q, want %q", got, "Bearer s3cr3t")
+				}
+				if got := req.header.Get("X-Partner-Id"); got != "42" {
+					t.Errorf("X-Partner-Id = %q, want %q", got, "42")
+				}
+			}
+		})
+	}
+}
+
+func TestUploadToWebhookField(t *testing.T) {
+	defer func(field, token string) { WEBHOOK_FIELD, webhookToken = field, token }(WEBHOOK_FIELD, webhookToken)
+	WEBHOOK_FIELD, webhookToken = "document", ""
+	requests := startWebhookServer(t, http.StatusOK)
+
+	if err := uploadToWebhook(context.Background(), "report.csv", strings.NewReader("id,name\n")); err != nil {
+		t.Fatalf("uploadToWebhook() error = %v", err)
+	}
+	req := requests()[0]
+	if req.field != "document" || req.content != "id,name\n" {
+		t.Errorf("webhook received field %q with %q, want %q with %q", req.field, req.content, "document", "id,name\n")
+	}
+	if got := req.header.Get("Authorization"); got != "" {
+		t.Errorf("Authorization = %q, want none", got)
+	}
+}
+
+func TestUploadToWebhookEscapingName(t *testing.T) {
+	requests := startWebhookServer(t, http.StatusOK)
+
+	if err := uploadToWebhook(context.Background(), "../report.csv", strings.NewReader("id,name\n")); err == nil {
+		t.Error("uploadToWebhook() error = nil, want error")
+	}
+	if len(requests()) != 0 {
+		t.Errorf("webhook received %d requests, want none", len(requests()))
+	}
+}
+
+func TestInitWebhook(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		wantToken string
+		wantErr   bool
+	}{
+		{"url only", map[string]string{}, "", false},
+		{"headers and token", map[string]string{"WEBHOOK_HEADERS": `{"X-Partner-Id":"42"}`, "WEBHOOK_TOKEN_SECRET": "webhook-token"}, "s3cr3t", false},
+		{"invalid URL", map[string]string{"WEBHOOK_URL": "ftp://partner.com/upload"}, "", true},
+		{"invalid headers", map[string]string{"WEBHOOK_HEADERS": `["X-Partner-Id"]`}, "", true},
+		{"invalid attempts", map[string]string{"WEBHOOK_ATTEMPTS": "0"}, "", true},
+		{"invalid timeout", map[string]string{"WEBHOOK_TIMEOUT": "soon"}, "", true},
+		{"missing token", map[string]string{"WEBHOOK_TOKEN_SECRET": "other-token"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(client http.Client, headers map[string]string, secret, token string, attempts int, timeout time.Duration) {
+				*webhookClient, WEBHOOK_HEADERS, WEBHOOK_TOKEN_SECRET, webhookToken = client, headers, secret, token
+				WEBHOOK_ATTEMPTS, WEBHOOK_TIMEOUT = attempts, timeout
+			}(*webhookClient, WEBHOOK_HEADERS, WEBHOOK_TOKEN_SECRET, webhookToken, WEBHOOK_ATTEMPTS, WEBHOOK_TIMEOUT)
+			// initWebhook decodes WEBHOOK_HEADERS into the existing map
+			WEBHOOK_HEADERS = map[string]string{}
+			requests := startWebhookServer(t, http.StatusOK)
+			stubSecrets(t, map[string]string{exporter.SecretVersionName("webhook-token"): "s3cr3t"})
+			t.Setenv("WEBHOOK_URL", WEBHOOK_URL)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			err := initWebhook(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("initWebhook() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if webhookToken != tt.wantToken {
+				t.Errorf("webhook token = %q, want %q", webhookToken, tt.wantToken)
+			}
+
+			// Uploads go through the transport checking ALLOWED_HOSTS
+			if err := uploadToWebhook(context.Background(), "report.csv", strings.NewReader("id,name\n")); err != nil {
+				t.Fatalf("uploadToWebhook() error = %v", err)
+			}
+			if len(requests()) != 1 {
+				t.Errorf("webhook received %d requests, want 1", len(requests()))
+			}
+		})
+	}
+}
+
+func TestUploadToWebhookStreamed(t *testing.T) {
+	defer func(attempts int) { WEBHOOK_ATTEMPTS = attempts }(WEBHOOK_ATTEMPTS)
+	WEBHOOK_ATTEMPTS = 3
+
+	tests := []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+	}{
+		{"accepted", []int{http.StatusOK}, false},
+		// Streamed content can't be read again, the event is retried instead
+		{"server error not retried", []int{http.StatusServiceUnavailable, http.StatusOK}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := startWebhookServer(t, tt.statuses...)
+
+			r := io.MultiReader(strings.NewReader("id,name\n1,alice\n"))
+			err := uploadToWebhook(context.Background(), "report.csv", r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("uploadToWebhook() error = %v, want error %t", err, tt.wantErr)
+			}
+			if len(requests()) != 1 {
+				t.Fatalf("webhook received %d requests, want 1", len(requests()))
+			}
+			if got := requests()[0].content; got != "id,name\n1,alice\n" {
+				t.Errorf("webhook received %q, want %q", got, "id,name\n1,alice\n")
+			}
+		})
+	}
+}
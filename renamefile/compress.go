@@ -0,0 +1,55 @@
+package renamefile
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/ealebed/gcp-cf/common/rename"
+)
+
+// Store destination objects gzip-compressed with Content-Encoding gzip, so
+// Cloud Storage decompresses them for readers which do not accept gzip.
+var COMPRESS_OUTPUT = false
+
+// compressedName returns name of a destination object, with gzip extension
+// appended when the output is compressed.
+func compressedName(objectName string) string {
+	if !COMPRESS_OUTPUT {
+		return objectName
+	}
+
+	return objectName + rename.GzipExtension
+}
+
+// countingWriter counts bytes written into the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// copyContent copies content into the destination writer, compressing it
+// when the output is compressed, and returns the number of bytes stored.
+func copyContent(dst io.Writer, content io.Reader) (int64, error) {
+	if !COMPRESS_OUTPUT {
+		return io.Copy(dst, content)
+	}
+
+	counter := &countingWriter{w: dst}
+	gw := gzip.NewWriter(counter)
+	if _, err := io.Copy(gw, content); err != nil {
+		return 0, err
+	}
+	// Flush the remaining compressed data and the gzip footer
+	if err := gw.Close(); err != nil {
+		return 0, err
+	}
+
+	return counter.n, nil
+}
@@ -0,0 +1,117 @@
+package renamefile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+)
+
+// gunzip returns decompressed content of valid gzip data
+func gunzip(t *testing.T, data []byte) string {
+	t.Helper()
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("invalid gzip data: %v", err)
+	}
+
+	return string(content)
+}
+
+func TestCopyContent(t *testing.T) {
+	content := strings.Repeat("1,alice\n", 1000)
+
+	for _, compress := range []bool{false, true} {
+		func() {
+			defer func(compress bool) { COMPRESS_OUTPUT = compress }(COMPRESS_OUTPUT)
+			COMPRESS_OUTPUT = compress
+
+			var dst bytes.Buffer
+			n, err := copyContent(&dst, strings.NewReader(content))
+			if err != nil {
+				t.Fatalf("copyContent() error = %v", err)
+			}
+			if n != int64(dst.Len()) {
+				t.Errorf("copyContent() with COMPRESS_OUTPUT=%t = %d, want %d bytes stored", compress, n, dst.Len())
+			}
+
+			got := dst.String()
+			if compress {
+				got = gunzip(t, dst.Bytes())
+				if dst.Len() >= len(content) {
+					t.Errorf("compressed content holds %d bytes, want less than %d", dst.Len(), len(content))
+				}
+			}
+			if got != content {
+				t.Errorf("copyContent() with COMPRESS_OUTPUT=%t stored %q, want %q", compress, got, content)
+			}
+		}()
+	}
+}
+
+func TestProcessFileCompressOutput(t *testing.T) {
+	tests := []struct {
+		name         string
+		compress     bool
+		filenameCase string
+		want         string
+	}{
+		{"uncompressed", false, "preserve", "in/report.csv"},
+		{"compressed", true, "preserve", "in/report.csv.gz"},
+		{"compressed upper case", true, "upper", "in/REPORT.CSV.gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(compress bool, filenameCase string) {
+				COMPRESS_OUTPUT, FILENAME_CASE = compress, filenameCase
+			}(COMPRESS_OUTPUT, FILENAME_CASE)
+			COMPRESS_OUTPUT, FILENAME_CASE = tt.compress, tt.filenameCase
+			store := exportertest.NewStore().Use(t)
+
+			if err := processObject(t, store, "in/report|20230801.csv", []byte("id~~name\n1~~alice\n")); err != nil {
+				t.Fatalf("processFile() error = %v", err)
+			}
+			data, ok := store.Content("bucket", tt.want)
+			if !ok {
+				t.Fatalf("bucket holds %q, want %q", store.Names("bucket"), tt.want)
+			}
+			attrs, err := store.Attrs(context.Background(), "bucket", tt.want, 0)
+			if err != nil {
+				t.Fatalf("Attrs(%q) error = %v", tt.want, err)
+			}
+
+			got, wantEncoding := string(data), ""
+			if tt.compress {
+				got, wantEncoding = gunzip(t, data), "gzip"
+			}
+			if got != "id,name\n1,alice\n" {
+				t.Errorf("%s holds %q, want %q", tt.want, got, "id,name\n1,alice\n")
+			}
+			if attrs.ContentEncoding != wantEncoding {
+				t.Errorf("%s stored with content encoding %q, want %q", tt.want, attrs.ContentEncoding, wantEncoding)
+			}
+			if names := store.Names("bucket"); len(names) != 1 {
+				t.Errorf("bucket holds %q, want the source removed", names)
+			}
+
+			// Readers of the function decompress the stored object
+			content, err := transformObject("bucket", tt.want, 0)
+			if err != nil {
+				t.Fatalf("transformObject(%q) error = %v", tt.want, err)
+			}
+			if string(content) != "id,name\n1,alice\n" {
+				t.Errorf("transformObject(%q) = %q, want %q", tt.want, content, "id,name\n1,alice\n")
+			}
+		})
+	}
+}
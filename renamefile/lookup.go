@@ -0,0 +1,142 @@
+package renamefile
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/rename"
+)
+
+var (
+	// Location of the table mapping internal codes to partner filenames,
+	// e.g. "gs://bucket/lookup/partners.csv", disabled when empty. CSV tables
+	// have code and partner name columns, JSON tables are a single object.
+	RENAME_LOOKUP_URI = ""
+	// Time the lookup table is cached before it is loaded again.
+	RENAME_LOOKUP_TTL = 10 * time.Minute
+	// Handling of codes missing in the lookup table: keep the code or reject the object.
+	RENAME_LOOKUP_FALLBACK = "keep"
+	// Bucket and object of RENAME_LOOKUP_URI.
+	lookupBucket, lookupObject string
+	renameLookup               lookupTable
+)
+
+// lookupTable caches the code mapping loaded from RENAME_LOOKUP_URI.
+type lookupTable struct {
+	mu      sync.Mutex
+	entries map[string]string
+	loaded  time.Time
+}
+
+// parseGCSURI splits a "gs://bucket/object" URI into bucket and object names.
+func parseGCSURI(uri string) (string, string, error) {
+	bucket, object, ok := strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+	if !strings.HasPrefix(uri, "gs://") || !ok || bucket == "" || object == "" {
+		return "", "", fmt.Errorf("%q is not a gs://bucket/object URI", uri)
+	}
+
+	return bucket, object, nil
+}
+
+// refresh loads the lookup table when it is older than RENAME_LOOKUP_TTL.
+// A table which fails to load again stays in use, so an error is only
+// returned when no table was loaded yet.
+func (t *lookupTable) refresh(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.entries != nil && time.Since(t.loaded) < RENAME_LOOKUP_TTL {
+		return nil
+	}
+
+	entries, err := loadLookupTable(ctx)
+	if err != nil {
+		if t.entries != nil {
+			log.Printf("unable to reload lookup table %s, using table loaded at %s: %v", RENAME_LOOKUP_URI, t.loaded.Format(time.RFC3339), err)
+			return nil
+		}
+		return fmt.Errorf("unable to load lookup table %s: %w", RENAME_LOOKUP_URI, err)
+	}
+	t.entries, t.loaded = entries, time.Now()
+	log.Printf("Loaded lookup table %s with %d entries", RENAME_LOOKUP_URI, len(entries))
+
+	return nil
+}
+
+// translate returns partner name of the code, handling codes missing in
+// the table according to RENAME_LOOKUP_FALLBACK.
+func (t *lookupTable) translate(code string) (string, error) {
+	t.mu.Lock()
+	name, ok := t.entries[code]
+	t.mu.Unlock()
+
+	if ok {
+		cleaned := path.Clean(name)
+		if name == "" || path.IsAbs(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			return "", fmt.Errorf("partner name %q of code %q escapes source folder", name, code)
+		}
+		log.Printf("Code %s translated to %s", code, cleaned)
+		return cleaned, nil
+	}
+	if RENAME_LOOKUP_FALLBACK == "reject" {
+		return "", fmt.Errorf("code %q is missing in lookup table %s", code, RENAME_LOOKUP_URI)
+	}
+	log.Printf("Code %s is missing in lookup table %s, keeping it", code, RENAME_LOOKUP_URI)
+
+	return code, nil
+}
+
+// loadLookupTable reads and parses the table at RENAME_LOOKUP_URI.
+func loadLookupTable(ctx context.Context) (map[string]string, error) {
+	var data []byte
+	err := exporter.RetryGCS(ctx, "Read of lookup table "+RENAME_LOOKUP_URI, exporter.GCS_READ_ATTEMPTS, func() error {
+		rc, err := exporter.Objects.NewReader(ctx, lookupBucket, lookupObject, 0, false)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		data, err = io.ReadAll(rc)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLookupTable(lookupObject, data)
+}
+
+// parseLookupTable parses a JSON object or, for other file extensions, CSV
+// rows of code and partner name. Rows with other number of fields are rejected.
+func parseLookupTable(name string, data []byte) (map[string]string, error) {
+	entries := map[string]string{}
+	if rename.HasSuffixFold(name, ".json") {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("invalid JSON lookup table: %w", err)
+		}
+		return entries, nil
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV lookup table: %w", err)
+	}
+	for _, record := range records {
+		entries[strings.TrimSpace(record[0])] = strings.TrimSpace(record[1])
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,236 @@
+package renamefile
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/ealebed/gcp-cf/common/rename"
+)
+
+// useLookupTable translates destination names through the table stored at
+// gs://config/<object> until the test ends
+func useLookupTable(t *testing.T, store *exportertest.Store, object, content string) {
+	t.Helper()
+
+	prevURI, prevBucket, prevObject, prevTranslate := RENAME_LOOKUP_URI, lookupBucket, lookupObject, rename.Translate
+	t.Cleanup(func() {
+		RENAME_LOOKUP_URI, lookupBucket, lookupObject, rename.Translate = prevURI, prevBucket, prevObject, prevTranslate
+		renameLookup = lookupTable{}
+	})
+
+	store.Put("config", object, []byte(content), nil)
+	RENAME_LOOKUP_URI, lookupBucket, lookupObject = "gs://config/"+object, "config", object
+	rename.Translate, renameLookup = renameLookup.translate, lookupTable{}
+}
+
+func TestParseGCSURI(t *testing.T) {
+	tests := []struct {
+		uri        string
+		wantBucket string
+		wantObject string
+		wantErr    bool
+	}{
+		{"gs://config/lookup/partners.csv", "config", "lookup/partners.csv", false},
+		{"gs://config/partners.json", "config", "partners.json", false},
+		{"gs://config/", "", "", true},
+		{"gs://config", "", "", true},
+		{"gs:///partners.csv", "", "", true},
+		{"config/partners.csv", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			bucket, object, err := parseGCSURI(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseGCSURI(%q) error = %v, want error %t", tt.uri, err, tt.wantErr)
+			}
+			if bucket != tt.wantBucket || object != tt.wantObject {
+				t.Errorf("parseGCSURI(%q) = %q, %q, want %q, %q", tt.uri, bucket, object, tt.wantBucket, tt.wantObject)
+			}
+		})
+	}
+}
+
+func TestParseLookupTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		object  string
+		data    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"csv", "partners.csv", "R1,acme_daily\nR2, acme_weekly \n", map[string]string{"R1": "acme_daily", "R2": "acme_weekly"}, false},
+		{"quoted csv", "partners.csv", "\"R1\",\"acme, daily\"\n", map[string]string{"R1": "acme, daily"}, false},
+		{"json", "partners.json", `{"R1": "acme_daily", "R2": "acme_weekly"}`, map[string]string{"R1": "acme_daily", "R2": "acme_weekly"}, false},
+		{"empty csv", "partners.csv", "", map[string]string{}, false},
+		{"csv with missing column", "partners.csv", "R1,acme_daily\nR2\n", nil, true},
+		{"csv with extra column", "partners.csv", "R1,acme_daily,daily\n", nil, true},
+		{"malformed json", "partners.json", `{"R1": "acme_daily"`, nil, true},
+		{"json with other values", "partners.json", `{"R1": 1}`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLookupTable(tt.object, []byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLookupTable(%q) error = %v, want error %t", tt.data, err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLookupTable(%q) = %v, want %v", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupTableTranslate(t *testing.T) {
+	defer func(fallback string) { RENAME_LOOKUP_FALLBACK = fallback }(RENAME_LOOKUP_FALLBACK)
+	table := lookupTable{entries: map[string]string{
+		"R1": "acme_daily",
+		"R2": "acme/./weekly",
+		"R3": "../acme_daily",
+		"R4": "/acme_daily",
+		"R5": "",
+	}}
+
+	tests := []struct {
+		name     string
+		code     string
+		fallback string
+		want     string
+		wantErr  bool
+	}{
+		{"hit", "R1", "keep", "acme_daily", false},
+		{"hit in subfolder", "R2", "keep", "acme/weekly", false},
+		{"miss kept", "R9", "keep", "R9", false},
+		{"miss rejected", "R9", "reject", "", true},
+		{"hit rejected fallback", "R1", "reject", "acme_daily", false},
+		{"parent folder", "R3", "keep", "", true},
+		{"absolute name", "R4", "keep", "", true},
+		{"empty name", "R5", "keep", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			RENAME_LOOKUP_FALLBACK = tt.fallback
+
+			got, err := table.translate(tt.code)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("translate(%q) error = %v, want error %t", tt.code, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("translate(%q) = %q, want %q", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupTableRefresh(t *testing.T) {
+	defer func(ttl time.Duration) { RENAME_LOOKUP_TTL = ttl }(RENAME_LOOKUP_TTL)
+	RENAME_LOOKUP_TTL = time.Hour
+	store := exportertest.NewStore().Use(t)
+	useLookupTable(t, store, "partners.csv", "R1,acme_daily\n")
+	ctx := context.Background()
+
+	if err := renameLookup.refresh(ctx); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	// The cached table is used until RENAME_LOOKUP_TTL passes
+	store.Put("config", "partners.csv", []byte("R1,acme_weekly\n"), nil)
+	if err := renameLookup.refresh(ctx); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	if got, _ := renameLookup.translate("R1"); got != "acme_daily" {
+		t.Errorf("translate(%q) within TTL = %q, want %q", "R1", got, "acme_daily")
+	}
+
+	// An expired table is loaded again
+	renameLookup.loaded = time.Now().Add(-2 * time.Hour)
+	if err := renameLookup.refresh(ctx); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	if got, _ := renameLookup.translate("R1"); got != "acme_weekly" {
+		t.Errorf("translate(%q) after TTL = %q, want %q", "R1", got, "acme_weekly")
+	}
+
+	// A table failing to load again keeps the previous one in use
+	store.Put("config", "partners.csv", []byte("R1\n"), nil)
+	renameLookup.loaded = time.Now().Add(-2 * time.Hour)
+	if err := renameLookup.refresh(ctx); err != nil {
+		t.Fatalf("refresh() of invalid table error = %v, want the previous table used", err)
+	}
+	if got, _ := renameLookup.translate("R1"); got != "acme_weekly" {
+		t.Errorf("translate(%q) after failed reload = %q, want %q", "R1", got, "acme_weekly")
+	}
+}
+
+func TestLookupTableRefreshFirstLoad(t *testing.T) {
+	store := exportertest.NewStore().Use(t)
+	useLookupTable(t, store, "partners.csv", "R1,acme_daily\n")
+	store.Fail = func(op, bucket, name string) error {
+		if bucket == "config" {
+			return errors.New("permission denied")
+		}
+		return nil
+	}
+
+	if err := renameLookup.refresh(context.Background()); err == nil {
+		t.Fatal("refresh() error = nil, want the failed load reported")
+	}
+	if renameLookup.entries != nil {
+		t.Errorf("lookup table holds %v after failed load, want none", renameLookup.entries)
+	}
+}
+
+func TestProcessFileLookup(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback string
+		object   string
+		want     string
+	}{
+		{"hit", "keep", "in/R1|20230801.csv", "in/acme_daily.csv"},
+		{"miss kept", "keep", "in/R9|20230801.csv", "in/R9.csv"},
+		{"miss quarantined", "reject", "in/R9|20230801.csv", "quarantine/in/R9|20230801.csv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(fallback, prefix string) {
+				RENAME_LOOKUP_FALLBACK, QUARANTINE_PREFIX = fallback, prefix
+			}(RENAME_LOOKUP_FALLBACK, QUARANTINE_PREFIX)
+			RENAME_LOOKUP_FALLBACK, QUARANTINE_PREFIX = tt.fallback, "quarantine"
+			store := exportertest.NewStore().Use(t)
+			useLookupTable(t, store, "partners.json", `{"R1": "acme_daily"}`)
+
+			if err := processObject(t, store, tt.object, []byte("id~~name\n")); err != nil {
+				t.Fatalf("processFile() error = %v", err)
+			}
+			if _, ok := store.Content("bucket", tt.want); !ok {
+				t.Errorf("bucket holds %q, want %q", store.Names("bucket"), tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessFileLookupUnavailable(t *testing.T) {
+	store := exportertest.NewStore().Use(t)
+	useLookupTable(t, store, "partners.csv", "R1,acme_daily\n")
+	store.Fail = func(op, bucket, name string) error {
+		if bucket == "config" {
+			return errors.New("permission denied")
+		}
+		return nil
+	}
+
+	// The event is retried instead of quarantining the object
+	if err := processObject(t, store, "in/R1|20230801.csv", []byte("id~~name\n")); err == nil {
+		t.Fatal("processFile() error = nil, want the failed load reported")
+	}
+	if got := store.Names("bucket"); !reflect.DeepEqual(got, []string{"in/R1|20230801.csv"}) {
+		t.Errorf("bucket holds %q, want the source kept", got)
+	}
+}
@@ -0,0 +1,95 @@
+package renamefile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ealebed/gcp-cf/common/exporter"
+)
+
+var (
+	// Number of attempts to delete the source after it was saved under the new name.
+	DELETE_ATTEMPTS = 3
+	// Prefix where sources which couldn't be deleted are recorded for reconciliation.
+	RECONCILE_PREFIX = ""
+)
+
+// pendingDeletion is the reconciliation record of a source object which
+// was saved under the new name but couldn't be deleted.
+type pendingDeletion struct {
+	Bucket      string    `json:"bucket"`
+	Source      string    `json:"source"`
+	Generation  int64     `json:"generation"`
+	Destination string    `json:"destination"`
+	Error       string    `json:"error"`
+	Time        time.Time `json:"time"`
+}
+
+// verifyDestination makes sure the destination object exists and has the
+// expected size, before the source is deleted.
+func verifyDestination(ctx context.Context, bucketName, objectName string, size int64) error {
+	attrs, err := exporter.Objects.Attrs(ctx, bucketName, objectName, 0)
+	if err != nil {
+		return fmt.Errorf("Object(%q).Attrs: %w", objectName, err)
+	}
+	if attrs.Size != size {
+		return fmt.Errorf("destination %s has %d bytes, expected %d", objectName, attrs.Size, size)
+	}
+
+	return nil
+}
+
+// deleteSource deletes the given generation of the source object, retrying
+// transient errors. A source which is already gone is not an error, as it
+// was deleted by an earlier attempt.
+func deleteSource(ctx context.Context, bucketName, objectName string, generation int64) error {
+	return exporter.RetryGCS(ctx, "Delete of "+objectName, DELETE_ATTEMPTS, func() error {
+		err := exporter.Objects.Delete(ctx, bucketName, objectName, generation)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil
+		}
+		return err
+	})
+}
+
+// recordPendingDeletion records a source which is left in place while its
+// destination already exists, so it can be reconciled. The record is written
+// under RECONCILE_PREFIX when set, and always logged.
+func recordPendingDeletion(ctx context.Context, bucketName, srcObjectName, dstObjectName string, generation int64, cause error) {
+	record := pendingDeletion{
+		Bucket:      bucketName,
+		Source:      srcObjectName,
+		Generation:  generation,
+		Destination: dstObjectName,
+		Error:       cause.Error(),
+		Time:        time.Now().UTC(),
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("unable to encode reconciliation record for %s: %v", srcObjectName, err)
+		return
+	}
+	log.Printf("Source %s was saved as %s but not deleted, reconciliation record: %s", srcObjectName, dstObjectName, data)
+
+	if RECONCILE_PREFIX == "" {
+		return
+	}
+
+	name := path.Join(RECONCILE_PREFIX, srcObjectName) + "." + strconv.FormatInt(generation, 10) + ".json"
+	wc := exporter.Objects.NewWriter(ctx, bucketName, name, exporter.WriteOptions{ContentType: "application/json", SingleRequest: true})
+	if _, err := wc.Write(data); err != nil {
+		wc.Close()
+		log.Printf("unable to write reconciliation record %s: %v", name, err)
+		return
+	}
+	if err := wc.Close(); err != nil {
+		log.Printf("unable to write reconciliation record %s: %v", name, err)
+	}
+}
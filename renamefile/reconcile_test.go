@@ -0,0 +1,147 @@
+package renamefile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"google.golang.org/api/googleapi"
+)
+
+func TestVerifyDestination(t *testing.T) {
+	tests := []struct {
+		name    string
+		object  string
+		size    int64
+		wantErr bool
+	}{
+		{"matching size", "in/report.csv", 8, false},
+		{"truncated destination", "in/report.csv", 9, true},
+		{"missing destination", "in/other.csv", 8, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := exportertest.NewStore().Use(t)
+			store.Put("bucket", "in/report.csv", []byte("id,name\n"), nil)
+
+			if err := verifyDestination(context.Background(), "bucket", tt.object, tt.size); (err != nil) != tt.wantErr {
+				t.Errorf("verifyDestination(%q, %d) error = %v, want error %t", tt.object, tt.size, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeleteSource(t *testing.T) {
+	defer func(attempts int, delay time.Duration) {
+		DELETE_ATTEMPTS, exporter.GCS_READ_RETRY_DELAY = attempts, delay
+	}(DELETE_ATTEMPTS, exporter.GCS_READ_RETRY_DELAY)
+	DELETE_ATTEMPTS, exporter.GCS_READ_RETRY_DELAY = 3, time.Millisecond
+
+	tests := []struct {
+		name         string
+		failures     int
+		failure      error
+		missing      bool
+		wantAttempts int
+		wantDeleted  bool
+		wantErr      bool
+	}{
+		{"deleted", 0, nil, false, 1, true, false},
+		{"transient errors", 2, &googleapi.Error{Code: 503}, false, 3, true, false},
+		{"persistent transient errors", 3, &googleapi.Error{Code: 503}, false, 3, false, true},
+		{"permanent error", 1, &googleapi.Error{Code: 403}, false, 1, false, true},
+		{"already deleted", 0, nil, true, 1, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := exportertest.NewStore().Use(t)
+			generation := int64(1)
+			if !tt.missing {
+				generation = store.Put("bucket", "in/report|20230801.csv", []byte("id~~name\n"), nil)
+			}
+			attempts := 0
+			store.Fail = func(op, bucket, object string) error {
+				if op != "Delete" {
+					return nil
+				}
+				attempts++
+				if attempts <= tt.failures {
+					return tt.failure
+				}
+				return nil
+			}
+
+			err := deleteSource(context.Background(), "bucket", "in/report|20230801.csv", generation)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("deleteSource() error = %v, want error %t", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("deleteSource() made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			store.Fail = nil
+			if _, ok := store.Content("bucket", "in/report|20230801.csv"); ok == tt.wantDeleted {
+				t.Errorf("source exists %t after deleteSource(), want %t", ok, !tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestSaveObjectRecordsPendingDeletion(t *testing.T) {
+	defer func(deleteSource bool, prefix string) {
+		DELETE_SOURCE, RECONCILE_PREFIX = deleteSource, prefix
+	}(DELETE_SOURCE, RECONCILE_PREFIX)
+	DELETE_SOURCE = true
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"in/report.csv", "in/report|20230801.csv"}},
+		{"reconcile", []string{"in/report.csv", "in/report|20230801.csv", "reconcile/in/report|20230801.csv.1.json"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			RECONCILE_PREFIX = tt.prefix
+			store := exportertest.NewStore().Use(t)
+			generation := store.Put("bucket", "in/report|20230801.csv", []byte("id~~name\n"), nil)
+			store.Fail = func(op, bucket, object string) error {
+				if op == "Delete" {
+					return errors.New("access denied")
+				}
+				return nil
+			}
+
+			err := saveObject(context.Background(), "bucket", "in/report|20230801.csv", "in/report.csv", generation, bytes.NewReader([]byte("id,name\n")))
+			if err == nil {
+				t.Fatal("saveObject() error = nil, want error")
+			}
+			store.Fail = nil
+			if got := store.Names("bucket"); !equalNames(got, tt.want) {
+				t.Fatalf("bucket holds %q, want %q", got, tt.want)
+			}
+			if tt.prefix == "" {
+				return
+			}
+
+			data, _ := store.Content("bucket", "reconcile/in/report|20230801.csv."+strconv.FormatInt(generation, 10)+".json")
+			var record pendingDeletion
+			if err := json.Unmarshal(data, &record); err != nil {
+				t.Fatalf("unable to decode reconciliation record %q: %v", data, err)
+			}
+			want := pendingDeletion{Bucket: "bucket", Source: "in/report|20230801.csv", Generation: generation, Destination: "in/report.csv", Error: "access denied"}
+			record.Time = time.Time{}
+			if record != want {
+				t.Errorf("reconciliation record = %+v, want %+v", record, want)
+			}
+		})
+	}
+}
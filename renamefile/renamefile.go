@@ -5,18 +5,22 @@ package renamefile
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"regexp"
+	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
-	"cloud.google.com/go/storage"
+	"cloud.google.com/go/pubsub"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/rename"
 	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
-	"github.com/jf-tech/go-corelib/ios"
 	"google.golang.org/protobuf/encoding/protojson"
 )
 
@@ -24,25 +28,146 @@ var (
 	// Define which file extensions should be processed
 	extensions = [2]string{".csv", ".txt"}
 	// Global API clients used across function invocations.
-	storageClient *storage.Client
-	bgctx         = context.Background()
+	pubsubClient *pubsub.Client
+	notifyTopic  *pubsub.Topic
+	bgctx        = context.Background()
+	// Processing mode: "move" deletes the source, "copy" keeps it.
+	MODE = "move"
+	// Suffix added to copies so they are distinguishable from sources.
+	COPY_SUFFIX = "_copy"
+	// Delete source object after it was saved under the new name.
+	DELETE_SOURCE = true
+	// Prefix where objects failing transformation are copied to.
+	QUARANTINE_PREFIX = ""
+	// Pub/Sub topic notified after an object is successfully moved.
+	NOTIFY_TOPIC = ""
+	// Case of destination filenames: preserve, lower, upper or upper-ext.
+	FILENAME_CASE = "preserve"
 )
 
+// moveNotification is the payload published to NOTIFY_TOPIC.
+type moveNotification struct {
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
 func init() {
+	// Tests configure the package themselves, without GCP access
+	if exporter.InTest() {
+		return
+	}
+
 	// Declare a separate err variable to avoid shadowing the client variables.
 	var err error
 
-	// Initialize Storage client
-	storageClient, err = storage.NewClient(bgctx)
-	if err != nil {
-		log.Fatalf("storage.NewClient: %v", err)
+	// Initialize Storage client shared with the exporters
+	if err := exporter.InitStorage(bgctx); err != nil {
+		log.Fatal(err)
+	}
+
+	// Get object filters, checksums, GCS retries and streaming shared with the exporters
+	exporter.InitObjects()
+
+	// Get rename and transform configuration shared with exporters renaming inline
+	rename.Init()
+
+	// Get source deletion mode from environment variable
+	if os.Getenv("DELETE_SOURCE") != "" {
+		DELETE_SOURCE, err = strconv.ParseBool(os.Getenv("DELETE_SOURCE"))
+		if err != nil {
+			log.Fatalf("invalid DELETE_SOURCE: %v", err)
+		}
+	}
+
+	// Get processing mode from environment variable
+	if os.Getenv("MODE") != "" {
+		MODE = os.Getenv("MODE")
+		if MODE != "move" && MODE != "copy" {
+			log.Fatalf("invalid MODE: %q", MODE)
+		}
+	}
+	if os.Getenv("COPY_SUFFIX") != "" {
+		COPY_SUFFIX = os.Getenv("COPY_SUFFIX")
+	}
+	// Originals are always kept in copy mode
+	if MODE == "copy" {
+		DELETE_SOURCE = false
+	}
+	log.Printf("Mode: %s, source deletion enabled: %t", MODE, DELETE_SOURCE)
+
+	// Get quarantine prefix from environment variable
+	if os.Getenv("QUARANTINE_PREFIX") != "" {
+		QUARANTINE_PREFIX = os.Getenv("QUARANTINE_PREFIX")
+	}
+
+	// Get source deletion attempts and reconciliation prefix from environment variables
+	if os.Getenv("DELETE_ATTEMPTS") != "" {
+		DELETE_ATTEMPTS, err = strconv.Atoi(os.Getenv("DELETE_ATTEMPTS"))
+		if err != nil || DELETE_ATTEMPTS < 1 {
+			log.Fatalf("invalid DELETE_ATTEMPTS: %q", os.Getenv("DELETE_ATTEMPTS"))
+		}
+	}
+	if os.Getenv("RECONCILE_PREFIX") != "" {
+		RECONCILE_PREFIX = os.Getenv("RECONCILE_PREFIX")
+	}
+
+	// Get destination filename case from environment variable
+	if os.Getenv("FILENAME_CASE") != "" {
+		FILENAME_CASE = os.Getenv("FILENAME_CASE")
+		if !validFilenameCase(FILENAME_CASE) {
+			log.Fatalf("invalid FILENAME_CASE: %q", FILENAME_CASE)
+		}
+	}
+
+	// Get lookup table of partner filenames from environment variables
+	if os.Getenv("RENAME_LOOKUP_URI") != "" {
+		RENAME_LOOKUP_URI = os.Getenv("RENAME_LOOKUP_URI")
+		lookupBucket, lookupObject, err = parseGCSURI(RENAME_LOOKUP_URI)
+		if err != nil {
+			log.Fatalf("invalid RENAME_LOOKUP_URI: %v", err)
+		}
+		rename.Translate = renameLookup.translate
+	}
+	if os.Getenv("RENAME_LOOKUP_TTL") != "" {
+		RENAME_LOOKUP_TTL, err = time.ParseDuration(os.Getenv("RENAME_LOOKUP_TTL"))
+		if err != nil {
+			log.Fatalf("invalid RENAME_LOOKUP_TTL: %v", err)
+		}
+	}
+	if os.Getenv("RENAME_LOOKUP_FALLBACK") != "" {
+		RENAME_LOOKUP_FALLBACK = os.Getenv("RENAME_LOOKUP_FALLBACK")
+		if RENAME_LOOKUP_FALLBACK != "keep" && RENAME_LOOKUP_FALLBACK != "reject" {
+			log.Fatalf("invalid RENAME_LOOKUP_FALLBACK: %q", RENAME_LOOKUP_FALLBACK)
+		}
+	}
+
+	// Get compression of destination objects from environment variable
+	if os.Getenv("COMPRESS_OUTPUT") != "" {
+		COMPRESS_OUTPUT, err = strconv.ParseBool(os.Getenv("COMPRESS_OUTPUT"))
+		if err != nil {
+			log.Fatalf("invalid COMPRESS_OUTPUT: %v", err)
+		}
+	}
+
+	// Get notification topic from environment variable
+	if os.Getenv("NOTIFY_TOPIC") != "" {
+		NOTIFY_TOPIC = os.Getenv("NOTIFY_TOPIC")
+
+		// Initialize Pub/Sub client
+		pubsubClient, err = pubsub.NewClient(bgctx, pubsub.DetectProjectID)
+		if err != nil {
+			log.Fatalf("pubsub.NewClient: %v", err)
+		}
+		// Share one topic handle, each handle runs its own publishing goroutines
+		notifyTopic = pubsubClient.Topic(NOTIFY_TOPIC)
 	}
 
 	functions.CloudEvent("ProcessFile", processFile)
 }
 
 // processFile moves an object into another location.
-func processFile(ctx context.Context, e event.Event) error {
+func processFile(ctx context.Context, e event.Event) (err error) {
 	var metadata storagedata.StorageObjectData
 	if err := protojson.Unmarshal(e.Data(), &metadata); err != nil {
 		return fmt.Errorf("protojson.Unmarshal: %w", err)
@@ -54,73 +179,216 @@ func processFile(ctx context.Context, e event.Event) error {
 	bucketName := metadata.GetBucket()
 	objectName := metadata.GetName()
 
-	for _, ext := range extensions {
-		if strings.HasSuffix(objectName, ext) && strings.Contains(objectName, "|") {
-			dstObjectName := setDestFileName(objectName, ext)
-			saveObject(bucketName, objectName, dstObjectName)
+	// Summarize decisions made for the object once the invocation ends
+	summary := exporter.NewSummary("Process", "processed", bucketName, objectName)
+	defer func() { summary.Log(err) }()
+	reject := func(cause error) error {
+		summary.Reject(cause)
+		return rejectObject(ctx, bucketName, objectName, metadata.GetGeneration(), cause)
+	}
+	// Objects are only rejected for permanent failures, transient GCS
+	// errors fail the invocation so the event is retried
+	rejectUnlessTransient := func(cause error) error {
+		if exporter.IsTransientGCSError(cause) {
+			return cause
 		}
+		return reject(cause)
 	}
 
-	return nil
-}
+	// Ignore events of buckets outside of ALLOWED_BUCKETS, e.g. from a misconfigured trigger
+	if !exporter.IsAllowedBucket(bucketName) {
+		log.Printf("Ignoring object %s of bucket %s, which is not in ALLOWED_BUCKETS", objectName, bucketName)
+		summary.Skip("bucket")
+		return nil
+	}
 
-// setDestFileName performs operations under existing GCS Object name to
-// define new, destination Object name
-func setDestFileName(srcObjectName, extension string) string {
-	fileName := regexp.MustCompile(`.*\/`).ReplaceAllString(srcObjectName, "")
-	log.Printf("Filename without path is %s \n", fileName)
+	// Skip objects under ignored prefixes before any other processing
+	if exporter.IsIgnored(objectName) {
+		log.Printf("Skipping object %s under ignored prefix", objectName)
+		summary.Skip("ignored prefix")
+		return nil
+	}
 
-	// // Define which exactly prefixes should be replaced
-	// var prefixes = [2]string{"66000_", "69000_"}
+	// Skip editor and temporary artifacts, e.g. ".~lock.report.csv#" or "report.csv~"
+	if exporter.SKIP_HIDDEN_OBJECTS && exporter.IsHidden(objectName) {
+		log.Printf("Skipping hidden or temporary object %s", objectName)
+		summary.Skip("hidden")
+		return nil
+	}
 
-	// // Removing leading prefixes from file name
-	// for _, prefix := range prefixes {
-	// 	if strings.HasPrefix(fileName, prefix) {
-	// 		dstName = strings.TrimPrefix(fileName, prefix)
-	// 	} else {
-	// 		dstName = fileName
-	// 	}
-	// }
+	// Never process files which were already quarantined
+	if isQuarantined(objectName) {
+		log.Printf("Skipping quarantined object %s", objectName)
+		summary.Skip("quarantined")
+		return nil
+	}
 
-	// Cut meaningful part of object name (before separator)
-	dstName, _, _ := strings.Cut(fileName, "|")
+	for _, ext := range extensions {
+		if rename.MatchesExtension(objectName, ext) && rename.ContainsSeparator(objectName) {
+			summary.Match()
+			// Load the lookup table first, so its failures are retried instead of rejecting the object
+			if RENAME_LOOKUP_URI != "" {
+				if err := renameLookup.refresh(ctx); err != nil {
+					return err
+				}
+			}
+			dstObjectName, err := rename.SetDestFileName(objectName, ext)
+			if err != nil {
+				return reject(err)
+			}
+			if MODE == "copy" {
+				dstObjectName = addCopySuffix(dstObjectName, rename.OutputExtension(ext))
+			}
+			// Change case last, so the extension and copy suffix are matched as configured,
+			// and keep the appended gzip extension lower case
+			dstObjectName = compressedName(applyFilenameCase(dstObjectName))
+			if MODE == "copy" {
+				// The copy stays in the same bucket, so it must not trigger processing again
+				if wouldTrigger(dstObjectName) {
+					return fmt.Errorf("copy %s of object %s would be processed again", dstObjectName, objectName)
+				}
+			}
+
+			// Stream large objects to limit memory in flight, buffer the others
+			if exporter.ShouldStream(objectName, metadata.GetSize()) {
+				var content *transformedReader
+				err := exporter.RetryGCS(ctx, "Open of object "+objectName, exporter.GCS_READ_ATTEMPTS, func() (err error) {
+					content, err = openTransformed(ctx, bucketName, objectName, metadata.GetGeneration())
+					return err
+				})
+				if err != nil {
+					return rejectUnlessTransient(err)
+				}
+				// Streamed objects take as long as the request allows
+				err = saveObject(ctx, bucketName, objectName, dstObjectName, metadata.GetGeneration(), content)
+				content.Close()
+				if err != nil {
+					// Transformation failures surface while writing the destination
+					if content.err != nil {
+						return reject(content.err)
+					}
+					return err
+				}
+				log.Printf("Blob %v streamed. object=%q %s=%s\n", objectName, objectName, exporter.CHECKSUM_ALGORITHM, content.checksum())
+			} else {
+				content, err := transformObject(bucketName, objectName, metadata.GetGeneration())
+				if err != nil {
+					return rejectUnlessTransient(err)
+				}
+
+				if err := saveObject(bgctx, bucketName, objectName, dstObjectName, metadata.GetGeneration(), bytes.NewReader(content)); err != nil {
+					return err
+				}
+			}
+
+			notifyMoved(ctx, bucketName, objectName, dstObjectName)
+		}
+	}
 
-	// Add extension to new object name if needed
-	if !strings.HasSuffix(dstName, extension) {
-		dstName = fmt.Sprintf("%s%s", dstName, extension)
+	// Objects without separator are already renamed
+	if !summary.Matched() {
+		if rename.ContainsSeparator(objectName) {
+			summary.Skip("extension")
+		} else {
+			summary.Skip("separator")
+		}
 	}
 
-	dstObjectName := strings.Replace(srcObjectName, fileName, dstName, 1)
+	return nil
+}
 
-	return dstObjectName
+// wouldTrigger reports whether an object name is picked for processing.
+func wouldTrigger(objectName string) bool {
+	for _, ext := range extensions {
+		if rename.MatchesExtension(objectName, ext) && rename.ContainsSeparator(objectName) {
+			return true
+		}
+	}
+
+	return false
 }
 
-// saveObject saves processed object with new name into GCS bucket
-// and deletes original object from GCS bucket
-func saveObject(bucketName, srcObjectName, dstObjectName string) error {
-	bgctx, cancel := context.WithTimeout(bgctx, time.Second*50)
-	defer cancel()
+// addCopySuffix inserts COPY_SUFFIX before the extension of a copied
+// object name, e.g. "report.csv" becomes "report_copy.csv".
+func addCopySuffix(objectName, extension string) string {
+	name := rename.TrimSuffixFold(objectName, extension)
+	return name + COPY_SUFFIX + objectName[len(name):]
+}
 
-	content, _ := replaceQuotes(bucketName, srcObjectName)
-	buf := bytes.NewBuffer(content)
+// validFilenameCase reports whether the value is a supported FILENAME_CASE.
+func validFilenameCase(value string) bool {
+	switch value {
+	case "preserve", "lower", "upper", "upper-ext":
+		return true
+	}
+	return false
+}
 
-	src := storageClient.Bucket(bucketName).Object(srcObjectName)
+// applyFilenameCase changes case of the base object name according to
+// FILENAME_CASE, leaving the prefix untouched. With "upper-ext" only
+// the extension is uppercased, e.g. "report.csv" becomes "report.CSV".
+func applyFilenameCase(objectName string) string {
+	dir, base := path.Split(objectName)
+	switch FILENAME_CASE {
+	case "lower":
+		base = strings.ToLower(base)
+	case "upper":
+		base = strings.ToUpper(base)
+	case "upper-ext":
+		ext := path.Ext(base)
+		// Dot files like ".env" have no extension to uppercase.
+		if ext != base {
+			base = strings.TrimSuffix(base, ext) + strings.ToUpper(ext)
+		}
+	}
 
-	// Upload an object with storage.Writer.
-	wc := storageClient.Bucket(bucketName).Object(dstObjectName).NewWriter(bgctx)
-	wc.ContentType = "application/octet-stream"
-	wc.ChunkSize = 0 // note retries are not supported for chunk size 0.
+	return dir + base
+}
 
-	if _, err := io.Copy(wc, buf); err != nil {
-		return fmt.Errorf("io.Copy: %w", err)
+// saveObject saves processed content with new name into GCS bucket
+// and deletes original object (the given generation) from GCS bucket.
+// Buffered content is saved within 50 seconds, while streamed content is
+// bounded by the context only, as its duration grows with the object size.
+func saveObject(ctx context.Context, bucketName, srcObjectName, dstObjectName string, generation int64, content io.Reader) error {
+	// Retry transient write errors when the content can be read again
+	attempts := 1
+	seeker, seekable := content.(io.Seeker)
+	if seekable {
+		attempts = exporter.GCS_WRITE_ATTEMPTS
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Second*50)
+		defer cancel()
 	}
-	// Data can continue to be added to the file until the writer is closed.
-	if err := wc.Close(); err != nil {
-		return fmt.Errorf("Writer.Close: %w", err)
+	var size int64
+	err := exporter.RetryGCS(ctx, "Write of object "+dstObjectName, attempts, func() (err error) {
+		if seekable {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		size, err = writeObject(ctx, bucketName, dstObjectName, content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Make sure the destination is durable before the source goes away
+	if err := verifyDestination(ctx, bucketName, dstObjectName, size); err != nil {
+		return err
 	}
 
-	// Delete original object from bucket
-	if err := src.Delete(bgctx); err != nil {
+	// Keep original object in place when source deletion is disabled
+	if !DELETE_SOURCE {
+		log.Printf("Blob %v copied to %v, source kept.\n", srcObjectName, dstObjectName)
+		return nil
+	}
+
+	// Delete original object from bucket, recording it when that fails
+	if err := deleteSource(ctx, bucketName, srcObjectName, generation); err != nil {
+		// Record it even when the request is over, so the source isn't left behind
+		recordPendingDeletion(bgctx, bucketName, srcObjectName, dstObjectName, generation, err)
 		return fmt.Errorf("Object(%q).Delete: %w", srcObjectName, err)
 	}
 
@@ -129,27 +397,119 @@ func saveObject(bucketName, srcObjectName, dstObjectName string) error {
 	return nil
 }
 
-// replaceQuotes recurcively replaces two double quotes in a row into one double qoute, like:
-// cat _test_file_20230818.csv' | sed "s/~~/,/g" | sed "s/\"\",\"\"/\",\"/g"
-func replaceQuotes(bucketName, objectName string) ([]byte, error) {
-	var r io.Reader
-
-	bgctx, cancel := context.WithTimeout(bgctx, time.Second*50)
+// writeObject uploads content into the object with storage writer,
+// returning the number of bytes stored.
+func writeObject(ctx context.Context, bucketName, objectName string, content io.Reader) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	rc, err := storageClient.Bucket(bucketName).Object(objectName).NewReader(bgctx)
+	opts := exporter.WriteOptions{
+		ContentType:   "application/octet-stream",
+		SingleRequest: true,
+	}
+	if COMPRESS_OUTPUT {
+		opts.ContentEncoding = "gzip"
+	}
+	wc := exporter.Objects.NewWriter(ctx, bucketName, objectName, opts)
+
+	size, err := copyContent(wc, content)
+	if err != nil {
+		// Abort the upload, so no partial object is created
+		cancel()
+		wc.Close()
+		return 0, fmt.Errorf("io.Copy: %w", err)
+	}
+	// Data can continue to be added to the file until the writer is closed.
+	if err := wc.Close(); err != nil {
+		return 0, fmt.Errorf("Writer.Close: %w", err)
+	}
+
+	return size, nil
+}
+
+// transformObject reads the given generation of an object, decompresses
+// gzipped content and passes it through the pipeline of its extension.
+// Reads failing with transient errors are retried from the start.
+func transformObject(bucketName, objectName string, generation int64) ([]byte, error) {
+	var data []byte
+	err := exporter.RetryGCS(bgctx, "Read of object "+objectName, exporter.GCS_READ_ATTEMPTS, func() error {
+		ctx, cancel := context.WithTimeout(bgctx, time.Second*50)
+		defer cancel()
+
+		r, err := openTransformed(ctx, bucketName, objectName, generation)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		data, err = io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("ioutil.ReadAll: %w", err)
+		}
+		log.Printf("Blob %v read. object=%q %s=%s\n", objectName, objectName, exporter.CHECKSUM_ALGORITHM, r.checksum())
+
+		return nil
+	})
+
+	return data, err
+}
+
+// isQuarantined reports whether the object is stored under QUARANTINE_PREFIX.
+func isQuarantined(objectName string) bool {
+	if QUARANTINE_PREFIX == "" {
+		return false
+	}
+
+	return strings.HasPrefix(objectName, strings.TrimSuffix(QUARANTINE_PREFIX, "/")+"/")
+}
+
+// rejectObject handles an object which failed transformation. When
+// QUARANTINE_PREFIX is set the original object is copied there, annotated
+// with the failure reason, and the source is kept in place.
+func rejectObject(ctx context.Context, bucketName, objectName string, generation int64, cause error) error {
+	if QUARANTINE_PREFIX == "" {
+		return fmt.Errorf("unable to transform object %s: %w", objectName, cause)
+	}
+
+	dstObjectName := path.Join(QUARANTINE_PREFIX, objectName)
+	metadata := map[string]string{
+		"quarantine-reason": cause.Error(),
+	}
+	err := exporter.RetryGCS(ctx, "Copy of object "+objectName, exporter.GCS_WRITE_ATTEMPTS, func() error {
+		return exporter.Objects.Copy(ctx, bucketName, dstObjectName, objectName, generation, metadata)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("Object(%q).NewReader: %w", objectName, err)
+		return fmt.Errorf("unable to quarantine object %s (%v): %w", objectName, cause, err)
 	}
-	defer rc.Close()
 
-	r = ios.NewBytesReplacingReader(rc, []byte(`~~`), []byte(`,`))
-	r = ios.NewBytesReplacingReader(r, []byte(`"",""`), []byte(`","`))
+	log.Printf("Blob %v quarantined to %v: %v\n", objectName, dstObjectName, cause)
+
+	return nil
+}
+
+// notifyMoved publishes the new object location to NOTIFY_TOPIC so the
+// pipeline can continue. Failures are logged but never fail the function.
+func notifyMoved(ctx context.Context, bucketName, srcObjectName, dstObjectName string) {
+	if NOTIFY_TOPIC == "" {
+		return
+	}
+
+	data, err := json.Marshal(moveNotification{
+		Bucket: bucketName,
+		Name:   dstObjectName,
+		Source: srcObjectName,
+	})
+	if err != nil {
+		log.Printf("unable to encode notification for %s: %v", dstObjectName, err)
+		return
+	}
 
-	data, err := io.ReadAll(r)
+	result := notifyTopic.Publish(ctx, &pubsub.Message{Data: data})
+	id, err := result.Get(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("ioutil.ReadAll: %w", err)
+		log.Printf("unable to notify topic %s about %s: %v", NOTIFY_TOPIC, dstObjectName, err)
+		return
 	}
 
-	return data, nil
+	log.Printf("Notified topic %s about %v (message %s).\n", NOTIFY_TOPIC, dstObjectName, id)
 }
@@ -0,0 +1,537 @@
+package renamefile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+	"github.com/ealebed/gcp-cf/common/rename"
+	"github.com/googleapis/google-cloudevents-go/cloud/storagedata"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// processObject stores the object and processes the event of its creation
+func processObject(t *testing.T, store *exportertest.Store, objectName string, content []byte) error {
+	t.Helper()
+
+	generation := store.Put("bucket", objectName, content, nil)
+	data, err := protojson.Marshal(&storagedata.StorageObjectData{
+		Bucket:     "bucket",
+		Name:       objectName,
+		Generation: generation,
+		Size:       int64(len(content)),
+	})
+	if err != nil {
+		t.Fatalf("protojson.Marshal: %v", err)
+	}
+	e := event.New()
+	if err := e.SetData(event.ApplicationJSON, data); err != nil {
+		t.Fatalf("unable to set event data: %v", err)
+	}
+
+	return processFile(context.Background(), e)
+}
+
+// startFakePubSub points the Pub/Sub client at an in-process server with
+// the topic created
+func startFakePubSub(t *testing.T, topic string) *pstest.Server {
+	t.Helper()
+	ctx := context.Background()
+
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.Dial: %v", err)
+	}
+	client, err := pubsub.NewClient(ctx, "project", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("pubsub.NewClient: %v", err)
+	}
+	if _, err := client.CreateTopic(ctx, topic); err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+
+	handle := client.Topic(topic)
+	t.Cleanup(func() {
+		handle.Stop()
+		client.Close()
+	})
+
+	prevClient, prevTopic, prevName := pubsubClient, notifyTopic, NOTIFY_TOPIC
+	t.Cleanup(func() { pubsubClient, notifyTopic, NOTIFY_TOPIC = prevClient, prevTopic, prevName })
+	pubsubClient, notifyTopic, NOTIFY_TOPIC = client, handle, topic
+
+	return srv
+}
+
+func TestNotifyMoved(t *testing.T) {
+	tests := []struct {
+		name  string
+		topic string
+		want  []moveNotification
+	}{
+		{
+			name:  "publishes new location",
+			topic: "moved",
+			want:  []moveNotification{{Bucket: "bucket", Name: "in/report.csv", Source: "in/report|20230801.csv"}},
+		},
+		{
+			name:  "disabled",
+			topic: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := startFakePubSub(t, "moved")
+			NOTIFY_TOPIC = tt.topic
+
+			notifyMoved(context.Background(), "bucket", "in/report|20230801.csv", "in/report.csv")
+
+			messages := srv.Messages()
+			if len(messages) != len(tt.want) {
+				t.Fatalf("published %d messages, want %d", len(messages), len(tt.want))
+			}
+			for i, msg := range messages {
+				var got moveNotification
+				if err := json.Unmarshal(msg.Data, &got); err != nil {
+					t.Fatalf("unable to decode message: %v", err)
+				}
+				if got != tt.want[i] {
+					t.Errorf("message %d = %+v, want %+v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProcessFileQuarantine(t *testing.T) {
+	tests := []struct {
+		name       string
+		prefix     string
+		object     string
+		content    []byte
+		wantErr    bool
+		wantObject []string
+	}{
+		{
+			name:       "valid object",
+			prefix:     "quarantine",
+			object:     "report|20230801.csv",
+			content:    []byte("id~~name\n"),
+			wantObject: []string{"report.csv"},
+		},
+		{
+			name:       "quarantined",
+			prefix:     "quarantine",
+			object:     "report.csv.gz|20230801",
+			content:    []byte("not gzipped"),
+			wantObject: []string{"quarantine/report.csv.gz|20230801", "report.csv.gz|20230801"},
+		},
+		{
+			name:       "without quarantine",
+			object:     "report.csv.gz|20230801",
+			content:    []byte("not gzipped"),
+			wantErr:    true,
+			wantObject: []string{"report.csv.gz|20230801"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(prefix string) { QUARANTINE_PREFIX = prefix }(QUARANTINE_PREFIX)
+			QUARANTINE_PREFIX = tt.prefix
+			store := exportertest.NewStore().Use(t)
+
+			err := processObject(t, store, tt.object, tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("processFile() error = %v, want error %t", err, tt.wantErr)
+			}
+			if got := store.Names("bucket"); !equalNames(got, tt.wantObject) {
+				t.Errorf("bucket holds %q, want %q", got, tt.wantObject)
+			}
+
+			if isQuarantined(tt.wantObject[0]) {
+				attrs, err := store.Attrs(context.Background(), "bucket", tt.wantObject[0], 0)
+				if err != nil {
+					t.Fatalf("quarantined object: %v", err)
+				}
+				if attrs.Metadata["quarantine-reason"] == "" {
+					t.Errorf("quarantined object has no quarantine-reason metadata")
+				}
+				if quarantined, _ := store.Content("bucket", tt.wantObject[0]); string(quarantined) != string(tt.content) {
+					t.Errorf("quarantined content = %q, want the original %q", quarantined, tt.content)
+				}
+			}
+		})
+	}
+}
+
+// equalNames reports whether both lists hold the same object names in order
+func equalNames(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestProcessFileDeleteSource(t *testing.T) {
+	tests := []struct {
+		name         string
+		deleteSource bool
+		want         []string
+	}{
+		{"source deleted", true, []string{"in/report.csv"}},
+		{"source kept", false, []string{"in/report.csv", "in/report|20230801.csv"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(deleteSource bool) { DELETE_SOURCE = deleteSource }(DELETE_SOURCE)
+			DELETE_SOURCE = tt.deleteSource
+			store := exportertest.NewStore().Use(t)
+
+			if err := processObject(t, store, "in/report|20230801.csv", []byte("id~~name\n")); err != nil {
+				t.Fatalf("processFile() error = %v", err)
+			}
+			if got := store.Names("bucket"); !equalNames(got, tt.want) {
+				t.Errorf("bucket holds %q, want %q", got, tt.want)
+			}
+			if got, _ := store.Content("bucket", "in/report.csv"); string(got) != "id,name\n" {
+				t.Errorf("renamed content = %q, want %q", got, "id,name\n")
+			}
+		})
+	}
+}
+
+func TestAddCopySuffix(t *testing.T) {
+	tests := []struct {
+		objectName string
+		extension  string
+		want       string
+	}{
+		{"in/report.csv", ".csv", "in/report_copy.csv"},
+		{"in/report.tar.gz", ".tar.gz", "in/report_copy.tar.gz"},
+		{"in/report", ".csv", "in/report_copy"},
+	}
+
+	for _, tt := range tests {
+		if got := addCopySuffix(tt.objectName, tt.extension); got != tt.want {
+			t.Errorf("addCopySuffix(%q, %q) = %q, want %q", tt.objectName, tt.extension, got, tt.want)
+		}
+	}
+}
+
+func TestProcessFileCopyMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		copySuffix string
+		want       []string
+		wantErr    bool
+	}{
+		{"copy next to the source", "_copy", []string{"in/report_copy.csv", "in/report|20230801.csv"}, false},
+		{"copy triggering processing again", "|copy", []string{"in/report|20230801.csv"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(mode, suffix string, deleteSource bool) {
+				MODE, COPY_SUFFIX, DELETE_SOURCE = mode, suffix, deleteSource
+			}(MODE, COPY_SUFFIX, DELETE_SOURCE)
+			// Like init in copy mode
+			MODE, COPY_SUFFIX, DELETE_SOURCE = "copy", tt.copySuffix, false
+			store := exportertest.NewStore().Use(t)
+
+			err := processObject(t, store, "in/report|20230801.csv", []byte("id~~name\n"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("processFile() error = %v, want error %t", err, tt.wantErr)
+			}
+			if got := store.Names("bucket"); !equalNames(got, tt.want) {
+				t.Errorf("bucket holds %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveObject(t *testing.T) {
+	tests := []struct {
+		name      string
+		failOp    string
+		want      []string
+		wantSaved bool
+		wantErr   bool
+	}{
+		{"moved", "", []string{"in/report.csv"}, true, false},
+		{"write failure", "NewWriter", []string{"in/report|20230801.csv"}, false, true},
+		{"verification failure", "Attrs", []string{"in/report.csv", "in/report|20230801.csv"}, true, true},
+		{"delete failure", "Delete", []string{"in/report.csv", "in/report|20230801.csv"}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(deleteSource bool) { DELETE_SOURCE = deleteSource }(DELETE_SOURCE)
+			DELETE_SOURCE = true
+			store := exportertest.NewStore().Use(t)
+			generation := store.Put("bucket", "in/report|20230801.csv", []byte("id~~name\n"), nil)
+			store.Fail = func(op, bucket, object string) error {
+				if op == tt.failOp {
+					return errors.New("access denied")
+				}
+				return nil
+			}
+
+			err := saveObject(context.Background(), "bucket", "in/report|20230801.csv", "in/report.csv", generation, bytes.NewReader([]byte("id,name\n")))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("saveObject() error = %v, want error %t", err, tt.wantErr)
+			}
+			store.Fail = nil
+			if got := store.Names("bucket"); !equalNames(got, tt.want) {
+				t.Errorf("bucket holds %q, want %q", got, tt.want)
+			}
+			if got, ok := store.Content("bucket", "in/report.csv"); ok != tt.wantSaved || (ok && string(got) != "id,name\n") {
+				t.Errorf("saved content = %q (saved %t), want %q (saved %t)", got, ok, "id,name\n", tt.wantSaved)
+			}
+		})
+	}
+}
+
+func TestSaveObjectKeepsNewerSource(t *testing.T) {
+	defer func(deleteSource bool) { DELETE_SOURCE = deleteSource }(DELETE_SOURCE)
+	DELETE_SOURCE = true
+	store := exportertest.NewStore().Use(t)
+	generation := store.Put("bucket", "in/report|20230801.csv", []byte("id~~name\n"), nil)
+	// The source is overwritten while the old generation is processed
+	store.Put("bucket", "in/report|20230801.csv", []byte("id~~name\n1~~alice\n"), nil)
+
+	if err := saveObject(context.Background(), "bucket", "in/report|20230801.csv", "in/report.csv", generation, bytes.NewReader([]byte("id,name\n"))); err != nil {
+		t.Fatalf("saveObject() error = %v", err)
+	}
+	if got, _ := store.Content("bucket", "in/report|20230801.csv"); string(got) != "id~~name\n1~~alice\n" {
+		t.Errorf("source content = %q, want the newer generation kept", got)
+	}
+}
+
+func TestProcessFileFilenameCase(t *testing.T) {
+	tests := []struct {
+		filenameCase string
+		mode         string
+		want         string
+	}{
+		{"preserve", "move", "In/Report.csv"},
+		{"lower", "move", "In/report.csv"},
+		{"upper", "move", "In/REPORT.CSV"},
+		{"upper-ext", "move", "In/Report.CSV"},
+		{"upper", "copy", "In/REPORT_COPY.CSV"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filenameCase+" "+tt.mode, func(t *testing.T) {
+			defer func(filenameCase, mode string, deleteSource bool) {
+				FILENAME_CASE, MODE, DELETE_SOURCE = filenameCase, mode, deleteSource
+			}(FILENAME_CASE, MODE, DELETE_SOURCE)
+			FILENAME_CASE, MODE, DELETE_SOURCE = tt.filenameCase, tt.mode, tt.mode == "move"
+			store := exportertest.NewStore().Use(t)
+
+			if err := processObject(t, store, "In/Report|20230801.csv", []byte("id~~name\n")); err != nil {
+				t.Fatalf("processFile() error = %v", err)
+			}
+			if _, ok := store.Content("bucket", tt.want); !ok {
+				t.Errorf("bucket holds %q, want %q", store.Names("bucket"), tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessFileAllowedBuckets(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		want    []string
+	}{
+		{"all buckets allowed", nil, []string{"in/report.csv"}},
+		{"allowed", []string{"other", "bucket"}, []string{"in/report.csv"}},
+		{"not allowed", []string{"other"}, []string{"in/report|20230801.csv"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(buckets []string) { exporter.ALLOWED_BUCKETS = buckets }(exporter.ALLOWED_BUCKETS)
+			exporter.ALLOWED_BUCKETS = tt.allowed
+			store := exportertest.NewStore().Use(t)
+
+			if err := processObject(t, store, "in/report|20230801.csv", []byte("id~~name\n")); err != nil {
+				t.Fatalf("processFile() error = %v", err)
+			}
+			if got := store.Names("bucket"); !equalNames(got, tt.want) {
+				t.Errorf("bucket holds %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessFileIgnoredPrefix(t *testing.T) {
+	defer func(prefixes []string) { exporter.IGNORE_PREFIXES = prefixes }(exporter.IGNORE_PREFIXES)
+	exporter.IGNORE_PREFIXES = []string{"_incoming/"}
+
+	tests := []struct {
+		object string
+		want   []string
+	}{
+		{"_incoming/report|20230801.csv", []string{"_incoming/report|20230801.csv"}},
+		{"in/report|20230801.csv", []string{"in/report.csv"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.object, func(t *testing.T) {
+			store := exportertest.NewStore().Use(t)
+
+			if err := processObject(t, store, tt.object, []byte("id~~name\n")); err != nil {
+				t.Fatalf("processFile() error = %v", err)
+			}
+			if got := store.Names("bucket"); !equalNames(got, tt.want) {
+				t.Errorf("bucket holds %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessFileHiddenObjects(t *testing.T) {
+	defer func(skip bool) { exporter.SKIP_HIDDEN_OBJECTS = skip }(exporter.SKIP_HIDDEN_OBJECTS)
+
+	tests := []struct {
+		name string
+		skip bool
+		want []string
+	}{
+		{"skipped", true, []string{"in/.report|20230801.csv"}},
+		{"renamed when disabled", false, []string{"in/.report.csv"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter.SKIP_HIDDEN_OBJECTS = tt.skip
+			store := exportertest.NewStore().Use(t)
+
+			if err := processObject(t, store, "in/.report|20230801.csv", []byte("id~~name\n")); err != nil {
+				t.Fatalf("processFile() error = %v", err)
+			}
+			if got := store.Names("bucket"); !equalNames(got, tt.want) {
+				t.Errorf("bucket holds %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessFileCaseInsensitiveMatch(t *testing.T) {
+	tests := []struct {
+		insensitive bool
+		object      string
+		want        string
+	}{
+		{false, "in/report|20230801.CSV", "in/report|20230801.CSV"},
+		{true, "in/report|20230801.CSV", "in/report.csv"},
+		{true, "in/report|20230801.Txt", "in/report.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.object, func(t *testing.T) {
+			defer func(insensitive, deleteSource bool) {
+				rename.CASE_INSENSITIVE_MATCH, DELETE_SOURCE = insensitive, deleteSource
+			}(rename.CASE_INSENSITIVE_MATCH, DELETE_SOURCE)
+			rename.CASE_INSENSITIVE_MATCH, DELETE_SOURCE = tt.insensitive, true
+			store := exportertest.NewStore().Use(t)
+
+			if err := processObject(t, store, tt.object, []byte("id~~name\n")); err != nil {
+				t.Fatalf("processFile() error = %v", err)
+			}
+			if got := store.Names("bucket"); !equalNames(got, []string{tt.want}) {
+				t.Errorf("bucket holds %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessFileSummary(t *testing.T) {
+	tests := []struct {
+		object string
+		want   string
+	}{
+		{"in/report|20230801.csv", `matched=true skip_reason="" outcome=processed`},
+		{"in/report|20230801.xml", `matched=false skip_reason="extension" outcome=skipped`},
+		{"in/report.csv", `matched=false skip_reason="separator" outcome=skipped`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.object, func(t *testing.T) {
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			defer log.SetOutput(os.Stderr)
+			store := exportertest.NewStore().Use(t)
+
+			if err := processObject(t, store, tt.object, []byte("id~~name\n")); err != nil {
+				t.Fatalf("processFile() error = %v", err)
+			}
+			want := fmt.Sprintf("Process summary. bucket=%q object=%q %s", "bucket", tt.object, tt.want)
+			if !strings.Contains(logged.String(), want) {
+				t.Errorf("logged %q, want summary %q", logged.String(), want)
+			}
+		})
+	}
+}
+
+func TestProcessFileTransformProfiles(t *testing.T) {
+	defer func(profiles map[string][]string, threshold int64) {
+		rename.TRANSFORM_PROFILES, exporter.STREAM_THRESHOLD_BYTES = profiles, threshold
+	}(rename.TRANSFORM_PROFILES, exporter.STREAM_THRESHOLD_BYTES)
+	profiles := map[string][]string{".csv": {"tilde-to-comma", "crlf-to-lf"}, ".txt": {}}
+
+	tests := []struct {
+		name      string
+		profiles  map[string][]string
+		threshold int64
+		object    string
+		dst       string
+		want      string
+	}{
+		{"csv profile", profiles, 0, "in/report|20230801.csv", "in/report.csv", "id,name\n1,alice\n"},
+		{"txt passes through", profiles, 0, "in/notes|20230801.txt", "in/notes.txt", "id~~name\r\n1~~alice\r\n"},
+		{"csv profile streamed", profiles, 1, "in/report|20230801.csv", "in/report.csv", "id,name\n1,alice\n"},
+		{"txt streamed", profiles, 1, "in/notes|20230801.txt", "in/notes.txt", "id~~name\r\n1~~alice\r\n"},
+		{"default pipeline", nil, 0, "in/notes|20230801.txt", "in/notes.txt", "id,name\r\n1,alice\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rename.TRANSFORM_PROFILES, exporter.STREAM_THRESHOLD_BYTES = tt.profiles, tt.threshold
+			store := exportertest.NewStore().Use(t)
+
+			if err := processObject(t, store, tt.object, []byte("id~~name\r\n1~~alice\r\n")); err != nil {
+				t.Fatalf("processFile() error = %v", err)
+			}
+			if got, _ := store.Content("bucket", tt.dst); string(got) != tt.want {
+				t.Errorf("%s = %q, want %q", tt.dst, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package renamefile
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/rename"
+)
+
+// transformedReader reads content of an object passed through the
+// pipeline configured for its extension. It records the first read error, so
+// callers can tell transformation failures from destination failures.
+type transformedReader struct {
+	r       io.Reader
+	hash    hash.Hash
+	closers []io.Closer
+	cancel  context.CancelFunc
+	err     error
+}
+
+// openTransformed opens the given generation of an object, decompresses
+// gzipped content and passes it through the pipeline of its extension.
+// The object is read until the reader is closed or the context ends.
+func openTransformed(ctx context.Context, bucketName, objectName string, generation int64) (*transformedReader, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	// Read gzipped objects as stored, decompression is handled below
+	rc, err := exporter.Objects.NewReader(ctx, bucketName, objectName, generation, rename.IsGzipped(objectName))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("Object(%q).NewReader: %w", objectName, err)
+	}
+	t := &transformedReader{hash: exporter.NewChecksumHash(), closers: []io.Closer{rc}, cancel: cancel}
+
+	// Compute checksum of the original content within the same pass
+	var r io.Reader = io.TeeReader(rc, t.hash)
+	if rename.IsGzipped(objectName) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("gzip.NewReader: %w", err)
+		}
+		t.closers = append(t.closers, zr)
+		r = zr
+	}
+	transformed := rename.ApplyTransforms(r, rename.TransformsFor(objectName))
+	t.closers = append(t.closers, transformed)
+	t.r = transformed
+
+	return t, nil
+}
+
+func (t *transformedReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// Close releases the readers of the pipeline in reverse order.
+func (t *transformedReader) Close() error {
+	var err error
+	for i := len(t.closers) - 1; i >= 0; i-- {
+		if cerr := t.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	t.cancel()
+	return err
+}
+
+// checksum returns hex encoded checksum of the original content read so far.
+func (t *transformedReader) checksum() string {
+	return fmt.Sprintf("%x", t.hash.Sum(nil))
+}
@@ -0,0 +1,37 @@
+package renamefile
+
+import (
+	"testing"
+
+	"github.com/ealebed/gcp-cf/common/exporter"
+	"github.com/ealebed/gcp-cf/common/exporter/exportertest"
+)
+
+func TestProcessFileStreamThreshold(t *testing.T) {
+	defer func(threshold int64) { exporter.STREAM_THRESHOLD_BYTES = threshold }(exporter.STREAM_THRESHOLD_BYTES)
+
+	tests := []struct {
+		name      string
+		threshold int64
+		content   string
+		want      string
+	}{
+		{"buffered without threshold", 0, "id~~name\n1~~alice\n", "id,name\n1,alice\n"},
+		{"buffered at threshold", 18, "id~~name\n1~~alice\n", "id,name\n1,alice\n"},
+		{"streamed above threshold", 17, "id~~name\n1~~alice\n", "id,name\n1,alice\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter.STREAM_THRESHOLD_BYTES = tt.threshold
+			store := exportertest.NewStore().Use(t)
+
+			if err := processObject(t, store, "in/report|20230801.csv", []byte(tt.content)); err != nil {
+				t.Fatalf("processFile() error = %v", err)
+			}
+			if got, _ := store.Content("bucket", "in/report.csv"); string(got) != tt.want {
+				t.Errorf("in/report.csv = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}